@@ -3,17 +3,25 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/SoftwareDefinedBuildings/mortar/stages"
 	"github.com/heptiolabs/healthcheck"
 	"github.com/pkg/profile"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	logrus "github.com/sirupsen/logrus"
+	"io"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 var log = logrus.New()
 
+const configFile = "mortarconfig.yml"
+
 func init() {
 	log.SetFormatter(&logrus.TextFormatter{FullTimestamp: true, ForceColors: true})
 	log.SetOutput(os.Stdout)
@@ -32,13 +40,17 @@ func main() {
 
 	maincontext, cancel := context.WithCancel(context.Background())
 
-	cfg, err := stages.ReadConfig("mortarconfig.yml")
+	cfg, err := stages.ReadConfig(configFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 	log.Infof("%+v", cfg)
+	setLogLevel(cfg.LogLevel)
 
 	brickready := false
+	// what the server is doing while shutting down; empty until then
+	var shutdownPhase atomic.Value
+	shutdownPhase.Store("")
 	health := healthcheck.NewHandler()
 	health.AddReadinessCheck("brick", func() error {
 		if !brickready {
@@ -46,7 +58,18 @@ func main() {
 		}
 		return nil
 	})
-	go http.ListenAndServe("0.0.0.0:8086", health)
+	health.AddReadinessCheck("shutdown", func() error {
+		if phase := shutdownPhase.Load().(string); phase != "" {
+			return fmt.Errorf("Shutting down: %s (%d requests in flight)", phase, stages.InFlightRequests())
+		}
+		return nil
+	})
+	// /live and /ready, plus an overview of the stages once they are running
+	status := stages.NewStatusPage()
+	healthMux := http.NewServeMux()
+	healthMux.Handle("/", health)
+	healthMux.Handle("/status", status)
+	go http.ListenAndServe("0.0.0.0:8086", healthMux)
 
 	http.Handle("/metrics", promhttp.Handler())
 	go func() {
@@ -56,12 +79,25 @@ func main() {
 		}
 	}()
 
+	if err := stages.StartTracing(maincontext, cfg.Tracing); err != nil {
+		log.Fatal(err)
+	}
+	if err := stages.StartAuditLog(maincontext, cfg.Audit); err != nil {
+		log.Fatal(err)
+	}
+
+	stages.ConfigureQueues(cfg.Queues)
+
 	frontend_stage_cfg := &stages.ApiFrontendBasicStageConfig{
 		StageContext: maincontext,
 		ListenAddr:   cfg.ListenAddr,
 		AuthConfig:   cfg.Cognito,
 		TLSCrtFile:   cfg.TLSCrtFile,
 		TLSKeyFile:   cfg.TLSKeyFile,
+
+		HTTPListenAddr:     cfg.HTTPListenAddr,
+		CORSAllowedOrigins: cfg.CORSAllowedOrigins,
+		Jobs:               cfg.Jobs,
 	}
 	frontend_stage, err := stages.NewApiFrontendBasicStage(frontend_stage_cfg)
 	if err != nil {
@@ -80,36 +116,161 @@ func main() {
 	}
 	brickready = true
 
-	ts_stage_cfg := &stages.TimeseriesStageConfig{
-		Upstream:     md_stage,
-		StageContext: maincontext,
-		BTrDBAddress: cfg.BTrDBAddr,
-	}
-	ts_stage, err := stages.NewTimeseriesQueryStage(ts_stage_cfg)
+	ts_stage, err := newTimeseriesStage(cfg, md_stage, maincontext)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	//	ts_stage_cfg := &stages.InfluxDBTimeseriesStageConfig{
-	//		Upstream:     md_stage,
-	//		StageContext: maincontext,
-	//		Address:      cfg.InfluxDBAddr,
-	//		Username:     cfg.InfluxDBUser,
-	//		Password:     cfg.InfluxDBPass,
-	//	}
-	//	ts_stage, err := stages.NewInfluxDBTimeseriesQueryStage(ts_stage_cfg)
-	//	if err != nil {
-	//		log.Fatal(err)
-	//	}
-
-	//_ = ts_stage
-
 	var end stages.Stage = ts_stage
 	for end != nil {
 		log.Println(end)
 		end = end.GetUpstream()
 	}
+	status.SetStages(ts_stage, health)
 
-	select {}
+	// apply changes to the configuration and TLS files while running
+	err = stages.WatchConfig(maincontext, configFile, cfg, func(newcfg *stages.Config) {
+		setLogLevel(newcfg.LogLevel)
+		for stage := ts_stage; stage != nil; stage = stage.GetUpstream() {
+			if reloader, ok := stage.(stages.Reloader); ok {
+				reloader.Reload(newcfg)
+			}
+		}
+	})
+	if err != nil {
+		log.Warning(err)
+	}
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Infof("Got %s, shutting down; send it again to exit right away", sig)
+	go func() {
+		<-signals
+		log.Warning("Exiting without finishing the shutdown")
+		os.Exit(1)
+	}()
+
+	// let the requests in flight finish, without taking new ones
+	shutdownPhase.Store("draining requests")
+	drainctx, drainCancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	if err := frontend_stage.Shutdown(drainctx); err != nil {
+		log.Warning(err)
+	}
+	drainCancel()
+
+	// stop the workers of every stage, then release their connections from the last
+	// stage up
+	shutdownPhase.Store("stopping stages")
 	cancel()
+	shutdownPhase.Store("closing connections")
+	for stage := ts_stage; stage != nil; stage = stage.GetUpstream() {
+		if closer, ok := stage.(io.Closer); ok {
+			log.Infof("Closing %s", stage)
+			if err := closer.Close(); err != nil {
+				log.Warning(err)
+			}
+		}
+	}
+	stages.CloseAuditLog()
+	flushctx, flushCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	stages.FlushTracing(flushctx)
+	flushCancel()
+	log.Info("Shut down")
+}
+
+// setLogLevel sets the level of our log and that of the stages
+func setLogLevel(level string) {
+	l, err := logrus.ParseLevel(level)
+	if err != nil {
+		log.Warningf("Invalid LogLevel %q; keeping %s", level, log.GetLevel())
+		return
+	}
+	log.SetLevel(l)
+	stages.SetLogLevel(l)
+}
+
+// newTimeseriesStage creates the timeseries stage selected by cfg.TimeseriesBackend
+func newTimeseriesStage(cfg *stages.Config, upstream stages.Stage, ctx context.Context) (stages.Stage, error) {
+	switch cfg.TimeseriesBackend {
+	case "btrdb", "":
+		return stages.NewTimeseriesQueryStage(&stages.TimeseriesStageConfig{
+			Upstream:     upstream,
+			StageContext: ctx,
+			BTrDBAddress: cfg.BTrDBAddr,
+
+			Clusters:               cfg.BTrDB.Clusters,
+			ConnectionsPerEndpoint: cfg.BTrDB.ConnectionsPerEndpoint,
+			HealthCheckInterval:    cfg.BTrDB.HealthCheckInterval,
+			Workers:                cfg.BTrDB.Workers,
+			Concurrency:            cfg.BTrDB.Concurrency,
+			OrderedDelivery:        cfg.BTrDB.OrderedDelivery,
+			SubscribePollInterval:  cfg.BTrDB.SubscribePollInterval,
+			SubscribeDelay:         cfg.BTrDB.SubscribeDelay,
+			MaxSubscriptions:       cfg.BTrDB.MaxSubscriptions,
+		})
+	case "influxdb":
+		return stages.NewInfluxDBTimeseriesQueryStage(&stages.InfluxDBTimeseriesStageConfig{
+			Upstream:     upstream,
+			StageContext: ctx,
+			Address:      cfg.InfluxDBAddr,
+			Username:     cfg.InfluxDBUser,
+			Password:     cfg.InfluxDBPass,
+			Database:     cfg.InfluxDBDatabase,
+			Measurement:  cfg.InfluxDBMeasurement,
+			UUIDTag:      cfg.InfluxDBUUIDTag,
+			ValueField:   cfg.InfluxDBValueField,
+			ChunkSize:    cfg.InfluxDBChunkSize,
+			Concurrency:  cfg.InfluxDBConcurrency,
+		})
+	case "influxdb2":
+		return stages.NewInfluxDB2TimeseriesQueryStage(&stages.InfluxDB2TimeseriesStageConfig{
+			Upstream:     upstream,
+			StageContext: ctx,
+			Address:      cfg.InfluxDB2.Address,
+			Token:        cfg.InfluxDB2.Token,
+			Org:          cfg.InfluxDB2.Org,
+			Bucket:       cfg.InfluxDB2.Bucket,
+			Measurement:  cfg.InfluxDB2.Measurement,
+			UUIDTag:      cfg.InfluxDB2.UUIDTag,
+			ValueField:   cfg.InfluxDB2.ValueField,
+			Concurrency:  cfg.InfluxDB2.Concurrency,
+		})
+	case "timescale":
+		return stages.NewTimescaleTimeseriesQueryStage(&stages.TimescaleTimeseriesStageConfig{
+			Upstream:       upstream,
+			StageContext:   ctx,
+			ConnString:     cfg.Timescale.ConnString,
+			Table:          cfg.Timescale.Table,
+			UUIDColumn:     cfg.Timescale.UUIDColumn,
+			TimeColumn:     cfg.Timescale.TimeColumn,
+			ValueColumn:    cfg.Timescale.ValueColumn,
+			Concurrency:    cfg.Timescale.Concurrency,
+			FetchSize:      cfg.Timescale.FetchSize,
+			MaxConnections: cfg.Timescale.MaxConnections,
+		})
+	case "arrow":
+		return stages.NewArrowTimeseriesQueryStage(&stages.ArrowTimeseriesStageConfig{
+			Upstream:     upstream,
+			StageContext: ctx,
+			Directory:    cfg.Arrow.Directory,
+			UUIDColumn:   cfg.Arrow.UUIDColumn,
+			TimeColumn:   cfg.Arrow.TimeColumn,
+			ValueColumn:  cfg.Arrow.ValueColumn,
+			Concurrency:  cfg.Arrow.Concurrency,
+		})
+	case "federated":
+		return stages.NewFederatedTimeseriesStage(&stages.FederatedTimeseriesStageConfig{
+			Upstream:     upstream,
+			StageContext: ctx,
+			Routes:       cfg.Federated.Routes,
+			Default:      cfg.Federated.Default,
+			NewBackend: func(backend string, upstream stages.Stage) (stages.Stage, error) {
+				backendcfg := *cfg
+				backendcfg.TimeseriesBackend = backend
+				return newTimeseriesStage(&backendcfg, upstream, ctx)
+			},
+		})
+	}
+	return nil, fmt.Errorf("Unknown TimeseriesBackend %s", cfg.TimeseriesBackend)
 }
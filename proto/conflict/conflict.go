@@ -0,0 +1,18 @@
+// Package conflict lets the WAVE packages register their protobuf files together.
+//
+// github.com/immesys/wave/eapi/pb and github.com/immesys/wavemq/mqpb both register
+// eapi.proto, which the protobuf runtime treats as a fatal conflict. Importing this package
+// from any package that uses them turns the conflict into a warning, unless
+// GOLANG_PROTOBUF_REGISTRATION_CONFLICT is already set. Because this package only imports
+// os and its import path sorts before theirs, it is initialized before them.
+package conflict
+
+import "os"
+
+const policyEnv = "GOLANG_PROTOBUF_REGISTRATION_CONFLICT"
+
+func init() {
+	if os.Getenv(policyEnv) == "" {
+		os.Setenv(policyEnv, "warn")
+	}
+}
@@ -22,6 +22,97 @@ var _ = math.Inf
 // proto package needs to be updated.
 const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
 
+type FailurePolicy int32
+
+const (
+	// fail the whole Fetch
+	FailurePolicy_FAILURE_POLICY_FAIL_FAST FailurePolicy = 0
+	// keep reading the other UUIDs. Each UUID that cannot be read gets a
+	// response with error and identifier set, and is listed in the summary
+	// the Fetch ends with
+	FailurePolicy_FAILURE_POLICY_BEST_EFFORT FailurePolicy = 1
+)
+
+var FailurePolicy_name = map[int32]string{
+	0: "FAILURE_POLICY_FAIL_FAST",
+	1: "FAILURE_POLICY_BEST_EFFORT",
+}
+
+var FailurePolicy_value = map[string]int32{
+	"FAILURE_POLICY_FAIL_FAST":   0,
+	"FAILURE_POLICY_BEST_EFFORT": 1,
+}
+
+func (x FailurePolicy) String() string {
+	return proto.EnumName(FailurePolicy_name, int32(x))
+}
+
+func (FailurePolicy) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_1d43959f7c3049fd, []int{0}
+}
+
+type ExportFormat int32
+
+const (
+	// one row per point: site, view, dataFrame, uuid, time, value
+	ExportFormat_EXPORT_FORMAT_CSV_LONG ExportFormat = 0
+	// one row per timestamp and one column per dataFrame/uuid
+	ExportFormat_EXPORT_FORMAT_CSV_WIDE ExportFormat = 1
+	// the long format as a Parquet file
+	ExportFormat_EXPORT_FORMAT_PARQUET ExportFormat = 2
+)
+
+var ExportFormat_name = map[int32]string{
+	0: "EXPORT_FORMAT_CSV_LONG",
+	1: "EXPORT_FORMAT_CSV_WIDE",
+	2: "EXPORT_FORMAT_PARQUET",
+}
+
+var ExportFormat_value = map[string]int32{
+	"EXPORT_FORMAT_CSV_LONG": 0,
+	"EXPORT_FORMAT_CSV_WIDE": 1,
+	"EXPORT_FORMAT_PARQUET":  2,
+}
+
+func (x ExportFormat) String() string {
+	return proto.EnumName(ExportFormat_name, int32(x))
+}
+
+func (ExportFormat) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_1d43959f7c3049fd, []int{1}
+}
+
+type FetchJobState int32
+
+const (
+	FetchJobState_FETCH_JOB_STATE_PENDING   FetchJobState = 0
+	FetchJobState_FETCH_JOB_STATE_RUNNING   FetchJobState = 1
+	FetchJobState_FETCH_JOB_STATE_COMPLETED FetchJobState = 2
+	FetchJobState_FETCH_JOB_STATE_FAILED    FetchJobState = 3
+)
+
+var FetchJobState_name = map[int32]string{
+	0: "FETCH_JOB_STATE_PENDING",
+	1: "FETCH_JOB_STATE_RUNNING",
+	2: "FETCH_JOB_STATE_COMPLETED",
+	3: "FETCH_JOB_STATE_FAILED",
+}
+
+var FetchJobState_value = map[string]int32{
+	"FETCH_JOB_STATE_PENDING":   0,
+	"FETCH_JOB_STATE_RUNNING":   1,
+	"FETCH_JOB_STATE_COMPLETED": 2,
+	"FETCH_JOB_STATE_FAILED":    3,
+}
+
+func (x FetchJobState) String() string {
+	return proto.EnumName(FetchJobState_name, int32(x))
+}
+
+func (FetchJobState) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_1d43959f7c3049fd, []int{2}
+}
+
 type AggFunc int32
 
 const (
@@ -59,7 +150,73 @@ func (x AggFunc) String() string {
 }
 
 func (AggFunc) EnumDescriptor() ([]byte, []int) {
-	return fileDescriptor_1d43959f7c3049fd, []int{0}
+	return fileDescriptor_1d43959f7c3049fd, []int{3}
+}
+
+type FillMethod int32
+
+const (
+	// leave gaps as they are
+	FillMethod_FILL_METHOD_NONE FillMethod = 0
+	// carry the last observed value forward
+	FillMethod_FILL_METHOD_PREVIOUS FillMethod = 1
+	// linearly interpolate between the surrounding observed values
+	FillMethod_FILL_METHOD_LINEAR FillMethod = 2
+	// fill gaps with FillPolicy.value
+	FillMethod_FILL_METHOD_CONSTANT FillMethod = 3
+)
+
+var FillMethod_name = map[int32]string{
+	0: "FILL_METHOD_NONE",
+	1: "FILL_METHOD_PREVIOUS",
+	2: "FILL_METHOD_LINEAR",
+	3: "FILL_METHOD_CONSTANT",
+}
+
+var FillMethod_value = map[string]int32{
+	"FILL_METHOD_NONE":     0,
+	"FILL_METHOD_PREVIOUS": 1,
+	"FILL_METHOD_LINEAR":   2,
+	"FILL_METHOD_CONSTANT": 3,
+}
+
+func (x FillMethod) String() string {
+	return proto.EnumName(FillMethod_name, int32(x))
+}
+
+func (FillMethod) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_1d43959f7c3049fd, []int{4}
+}
+
+type DataQuality int32
+
+const (
+	// value was read from the timeseries database
+	DataQuality_DATA_QUALITY_OBSERVED DataQuality = 0
+	// value was filled in according to the DataFrame's fill policy
+	DataQuality_DATA_QUALITY_IMPUTED DataQuality = 1
+	// no data for this window and the fill policy could not fill it
+	DataQuality_DATA_QUALITY_MISSING DataQuality = 2
+)
+
+var DataQuality_name = map[int32]string{
+	0: "DATA_QUALITY_OBSERVED",
+	1: "DATA_QUALITY_IMPUTED",
+	2: "DATA_QUALITY_MISSING",
+}
+
+var DataQuality_value = map[string]int32{
+	"DATA_QUALITY_OBSERVED": 0,
+	"DATA_QUALITY_IMPUTED":  1,
+	"DATA_QUALITY_MISSING":  2,
+}
+
+func (x DataQuality) String() string {
+	return proto.EnumName(DataQuality_name, int32(x))
+}
+
+func (DataQuality) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_1d43959f7c3049fd, []int{5}
 }
 
 type GetAPIKeyRequest struct {
@@ -270,12 +427,21 @@ type FetchRequest struct {
 	Streams []*Stream `protobuf:"bytes,2,rep,name=streams,proto3" json:"streams,omitempty"`
 	// temporal parameters for all streams
 	// (range of data to download, resolution)
-	Time                 *TimeParams  `protobuf:"bytes,3,opt,name=time,proto3" json:"time,omitempty"`
-	Views                []*View      `protobuf:"bytes,4,rep,name=views,proto3" json:"views,omitempty"`
-	DataFrames           []*DataFrame `protobuf:"bytes,5,rep,name=dataFrames,proto3" json:"dataFrames,omitempty"`
-	XXX_NoUnkeyedLiteral struct{}     `json:"-"`
-	XXX_unrecognized     []byte       `json:"-"`
-	XXX_sizecache        int32        `json:"-"`
+	Time       *TimeParams  `protobuf:"bytes,3,opt,name=time,proto3" json:"time,omitempty"`
+	Views      []*View      `protobuf:"bytes,4,rep,name=views,proto3" json:"views,omitempty"`
+	DataFrames []*DataFrame `protobuf:"bytes,5,rep,name=dataFrames,proto3" json:"dataFrames,omitempty"`
+	// deliver the data of each UUID in full before that of the next one, and
+	// set resumeToken on each response holding timeseries
+	Resumable bool `protobuf:"varint,6,opt,name=resumable,proto3" json:"resumable,omitempty"`
+	// resumeToken of the last response received from an interrupted Fetch of
+	// the same request: the Brick query results and all data up to and
+	// including that response are skipped. Implies resumable
+	ResumeToken string `protobuf:"bytes,7,opt,name=resumeToken,proto3" json:"resumeToken,omitempty"`
+	// what to do when the data of a UUID cannot be read
+	FailurePolicy        FailurePolicy `protobuf:"varint,8,opt,name=failurePolicy,proto3,enum=mortar.FailurePolicy" json:"failurePolicy,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}      `json:"-"`
+	XXX_unrecognized     []byte        `json:"-"`
+	XXX_sizecache        int32         `json:"-"`
 }
 
 func (m *FetchRequest) Reset()         { *m = FetchRequest{} }
@@ -338,208 +504,1465 @@ func (m *FetchRequest) GetDataFrames() []*DataFrame {
 	return nil
 }
 
-type Stream struct {
-	// name of the stream
-	Name string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
-	// Brick query (alternative)
-	Definition string   `protobuf:"bytes,2,opt,name=definition,proto3" json:"definition,omitempty"`
-	DataVars   []string `protobuf:"bytes,6,rep,name=dataVars,proto3" json:"dataVars,omitempty"`
-	// list of stream UUIDs
-	Uuids []string `protobuf:"bytes,3,rep,name=uuids,proto3" json:"uuids,omitempty"`
-	// aggregation function for this stream
-	Aggregation AggFunc `protobuf:"varint,4,opt,name=aggregation,proto3,enum=mortar.AggFunc" json:"aggregation,omitempty"`
-	// engineering units to convert the stream to
-	Units                string   `protobuf:"bytes,5,opt,name=units,proto3" json:"units,omitempty"`
+func (m *FetchRequest) GetResumable() bool {
+	if m != nil {
+		return m.Resumable
+	}
+	return false
+}
+
+func (m *FetchRequest) GetResumeToken() string {
+	if m != nil {
+		return m.ResumeToken
+	}
+	return ""
+}
+
+func (m *FetchRequest) GetFailurePolicy() FailurePolicy {
+	if m != nil {
+		return m.FailurePolicy
+	}
+	return FailurePolicy_FAILURE_POLICY_FAIL_FAST
+}
+
+// a site whose Brick query failed, or a UUID that could not be read
+type FetchFailure struct {
+	Site      string `protobuf:"bytes,1,opt,name=site,proto3" json:"site,omitempty"`
+	View      string `protobuf:"bytes,2,opt,name=view,proto3" json:"view,omitempty"`
+	DataFrame string `protobuf:"bytes,3,opt,name=dataFrame,proto3" json:"dataFrame,omitempty"`
+	// empty for a site
+	Identifier           string   `protobuf:"bytes,4,opt,name=identifier,proto3" json:"identifier,omitempty"`
+	Error                string   `protobuf:"bytes,5,opt,name=error,proto3" json:"error,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
 }
 
-func (m *Stream) Reset()         { *m = Stream{} }
-func (m *Stream) String() string { return proto.CompactTextString(m) }
-func (*Stream) ProtoMessage()    {}
-func (*Stream) Descriptor() ([]byte, []int) {
+func (m *FetchFailure) Reset()         { *m = FetchFailure{} }
+func (m *FetchFailure) String() string { return proto.CompactTextString(m) }
+func (*FetchFailure) ProtoMessage()    {}
+func (*FetchFailure) Descriptor() ([]byte, []int) {
 	return fileDescriptor_1d43959f7c3049fd, []int{5}
 }
 
-func (m *Stream) XXX_Unmarshal(b []byte) error {
-	return xxx_messageInfo_Stream.Unmarshal(m, b)
+func (m *FetchFailure) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_FetchFailure.Unmarshal(m, b)
 }
-func (m *Stream) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
-	return xxx_messageInfo_Stream.Marshal(b, m, deterministic)
+func (m *FetchFailure) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_FetchFailure.Marshal(b, m, deterministic)
 }
-func (m *Stream) XXX_Merge(src proto.Message) {
-	xxx_messageInfo_Stream.Merge(m, src)
+func (m *FetchFailure) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_FetchFailure.Merge(m, src)
 }
-func (m *Stream) XXX_Size() int {
-	return xxx_messageInfo_Stream.Size(m)
+func (m *FetchFailure) XXX_Size() int {
+	return xxx_messageInfo_FetchFailure.Size(m)
 }
-func (m *Stream) XXX_DiscardUnknown() {
-	xxx_messageInfo_Stream.DiscardUnknown(m)
+func (m *FetchFailure) XXX_DiscardUnknown() {
+	xxx_messageInfo_FetchFailure.DiscardUnknown(m)
 }
 
-var xxx_messageInfo_Stream proto.InternalMessageInfo
+var xxx_messageInfo_FetchFailure proto.InternalMessageInfo
 
-func (m *Stream) GetName() string {
+func (m *FetchFailure) GetSite() string {
 	if m != nil {
-		return m.Name
+		return m.Site
 	}
 	return ""
 }
 
-func (m *Stream) GetDefinition() string {
+func (m *FetchFailure) GetView() string {
 	if m != nil {
-		return m.Definition
+		return m.View
 	}
 	return ""
 }
 
-func (m *Stream) GetDataVars() []string {
-	if m != nil {
-		return m.DataVars
-	}
-	return nil
-}
-
-func (m *Stream) GetUuids() []string {
+func (m *FetchFailure) GetDataFrame() string {
 	if m != nil {
-		return m.Uuids
+		return m.DataFrame
 	}
-	return nil
+	return ""
 }
 
-func (m *Stream) GetAggregation() AggFunc {
+func (m *FetchFailure) GetIdentifier() string {
 	if m != nil {
-		return m.Aggregation
+		return m.Identifier
 	}
-	return AggFunc_AGG_FUNC_INVALID
+	return ""
 }
 
-func (m *Stream) GetUnits() string {
+func (m *FetchFailure) GetError() string {
 	if m != nil {
-		return m.Units
+		return m.Error
 	}
 	return ""
 }
 
-type FetchResponse struct {
-	// error from backend
-	Error string `protobuf:"bytes,1,opt,name=error,proto3" json:"error,omitempty"`
-	// stream definition fields:
-	// - site name
-	// - view name
-	// - data frame name
-	// - variable name (from View definition)
-	Site      string `protobuf:"bytes,2,opt,name=site,proto3" json:"site,omitempty"`
-	View      string `protobuf:"bytes,9,opt,name=view,proto3" json:"view,omitempty"`
-	DataFrame string `protobuf:"bytes,10,opt,name=dataFrame,proto3" json:"dataFrame,omitempty"`
-	Variable  string `protobuf:"bytes,3,opt,name=variable,proto3" json:"variable,omitempty"`
-	// uuid
-	Identifier string `protobuf:"bytes,4,opt,name=identifier,proto3" json:"identifier,omitempty"`
-	// timestamps and value should have same length
-	Times  []int64   `protobuf:"varint,5,rep,packed,name=times,proto3" json:"times,omitempty"`
-	Values []float64 `protobuf:"fixed64,6,rep,packed,name=values,proto3" json:"values,omitempty"`
-	// brick query contents related to this variable
-	Variables            []string `protobuf:"bytes,7,rep,name=variables,proto3" json:"variables,omitempty"`
-	Rows                 []*Row   `protobuf:"bytes,8,rep,name=rows,proto3" json:"rows,omitempty"`
+// sent as the last response of a Fetch that completed, so clients can tell
+// a Fetch that found no data from one that resolved nothing
+type FetchSummary struct {
+	// sites and UUIDs that could not be read; only a best-effort Fetch
+	// completes with failures
+	Failures []*FetchFailure `protobuf:"bytes,1,rep,name=failures,proto3" json:"failures,omitempty"`
+	// number of sites the Brick queries of the views ran against
+	SitesQueried int64 `protobuf:"varint,2,opt,name=sitesQueried,proto3" json:"sitesQueried,omitempty"`
+	// number of rows each view returned on each site it was queried on
+	ViewRows   []*ViewRows         `protobuf:"bytes,3,rep,name=viewRows,proto3" json:"viewRows,omitempty"`
+	DataFrames []*DataFrameSummary `protobuf:"bytes,4,rep,name=dataFrames,proto3" json:"dataFrames,omitempty"`
+	// time spent running the Brick queries, and then reading the
+	// timeseries (including time spent queued)
+	BrickSeconds      float64 `protobuf:"fixed64,5,opt,name=brickSeconds,proto3" json:"brickSeconds,omitempty"`
+	TimeseriesSeconds float64 `protobuf:"fixed64,6,opt,name=timeseriesSeconds,proto3" json:"timeseriesSeconds,omitempty"`
+	// the Brick models were queried as they were at this time, in Unix
+	// nanoseconds
+	BrickVersion         int64    `protobuf:"varint,7,opt,name=brickVersion,proto3" json:"brickVersion,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
 }
 
-func (m *FetchResponse) Reset()         { *m = FetchResponse{} }
-func (m *FetchResponse) String() string { return proto.CompactTextString(m) }
-func (*FetchResponse) ProtoMessage()    {}
-func (*FetchResponse) Descriptor() ([]byte, []int) {
+func (m *FetchSummary) Reset()         { *m = FetchSummary{} }
+func (m *FetchSummary) String() string { return proto.CompactTextString(m) }
+func (*FetchSummary) ProtoMessage()    {}
+func (*FetchSummary) Descriptor() ([]byte, []int) {
 	return fileDescriptor_1d43959f7c3049fd, []int{6}
 }
 
-func (m *FetchResponse) XXX_Unmarshal(b []byte) error {
-	return xxx_messageInfo_FetchResponse.Unmarshal(m, b)
+func (m *FetchSummary) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_FetchSummary.Unmarshal(m, b)
 }
-func (m *FetchResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
-	return xxx_messageInfo_FetchResponse.Marshal(b, m, deterministic)
+func (m *FetchSummary) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_FetchSummary.Marshal(b, m, deterministic)
 }
-func (m *FetchResponse) XXX_Merge(src proto.Message) {
-	xxx_messageInfo_FetchResponse.Merge(m, src)
+func (m *FetchSummary) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_FetchSummary.Merge(m, src)
 }
-func (m *FetchResponse) XXX_Size() int {
-	return xxx_messageInfo_FetchResponse.Size(m)
+func (m *FetchSummary) XXX_Size() int {
+	return xxx_messageInfo_FetchSummary.Size(m)
 }
-func (m *FetchResponse) XXX_DiscardUnknown() {
-	xxx_messageInfo_FetchResponse.DiscardUnknown(m)
+func (m *FetchSummary) XXX_DiscardUnknown() {
+	xxx_messageInfo_FetchSummary.DiscardUnknown(m)
 }
 
-var xxx_messageInfo_FetchResponse proto.InternalMessageInfo
+var xxx_messageInfo_FetchSummary proto.InternalMessageInfo
 
-func (m *FetchResponse) GetError() string {
+func (m *FetchSummary) GetFailures() []*FetchFailure {
 	if m != nil {
-		return m.Error
+		return m.Failures
 	}
-	return ""
+	return nil
 }
 
-func (m *FetchResponse) GetSite() string {
+func (m *FetchSummary) GetSitesQueried() int64 {
 	if m != nil {
-		return m.Site
+		return m.SitesQueried
 	}
-	return ""
+	return 0
 }
 
-func (m *FetchResponse) GetView() string {
+func (m *FetchSummary) GetViewRows() []*ViewRows {
 	if m != nil {
-		return m.View
+		return m.ViewRows
 	}
-	return ""
+	return nil
 }
 
-func (m *FetchResponse) GetDataFrame() string {
+func (m *FetchSummary) GetDataFrames() []*DataFrameSummary {
 	if m != nil {
-		return m.DataFrame
+		return m.DataFrames
+	}
+	return nil
+}
+
+func (m *FetchSummary) GetBrickSeconds() float64 {
+	if m != nil {
+		return m.BrickSeconds
+	}
+	return 0
+}
+
+func (m *FetchSummary) GetTimeseriesSeconds() float64 {
+	if m != nil {
+		return m.TimeseriesSeconds
+	}
+	return 0
+}
+
+func (m *FetchSummary) GetBrickVersion() int64 {
+	if m != nil {
+		return m.BrickVersion
+	}
+	return 0
+}
+
+type ViewRows struct {
+	Site                 string   `protobuf:"bytes,1,opt,name=site,proto3" json:"site,omitempty"`
+	View                 string   `protobuf:"bytes,2,opt,name=view,proto3" json:"view,omitempty"`
+	Rows                 int64    `protobuf:"varint,3,opt,name=rows,proto3" json:"rows,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ViewRows) Reset()         { *m = ViewRows{} }
+func (m *ViewRows) String() string { return proto.CompactTextString(m) }
+func (*ViewRows) ProtoMessage()    {}
+func (*ViewRows) Descriptor() ([]byte, []int) {
+	return fileDescriptor_1d43959f7c3049fd, []int{7}
+}
+
+func (m *ViewRows) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ViewRows.Unmarshal(m, b)
+}
+func (m *ViewRows) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ViewRows.Marshal(b, m, deterministic)
+}
+func (m *ViewRows) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ViewRows.Merge(m, src)
+}
+func (m *ViewRows) XXX_Size() int {
+	return xxx_messageInfo_ViewRows.Size(m)
+}
+func (m *ViewRows) XXX_DiscardUnknown() {
+	xxx_messageInfo_ViewRows.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ViewRows proto.InternalMessageInfo
+
+func (m *ViewRows) GetSite() string {
+	if m != nil {
+		return m.Site
 	}
 	return ""
 }
 
-func (m *FetchResponse) GetVariable() string {
+func (m *ViewRows) GetView() string {
 	if m != nil {
-		return m.Variable
+		return m.View
 	}
 	return ""
 }
 
-func (m *FetchResponse) GetIdentifier() string {
+func (m *ViewRows) GetRows() int64 {
 	if m != nil {
-		return m.Identifier
+		return m.Rows
+	}
+	return 0
+}
+
+type DataFrameSummary struct {
+	Name string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	// UUIDs found by the Brick queries or listed in the request
+	UuidsResolved int64 `protobuf:"varint,2,opt,name=uuidsResolved,proto3" json:"uuidsResolved,omitempty"`
+	// UUIDs the timeseries database has no stream for. Backends without
+	// streams (InfluxDB, TimescaleDB) count the UUIDs they returned no
+	// points for
+	UuidsMissing int64 `protobuf:"varint,3,opt,name=uuidsMissing,proto3" json:"uuidsMissing,omitempty"`
+	// points sent, including those added by the fill policy
+	Points               int64    `protobuf:"varint,4,opt,name=points,proto3" json:"points,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *DataFrameSummary) Reset()         { *m = DataFrameSummary{} }
+func (m *DataFrameSummary) String() string { return proto.CompactTextString(m) }
+func (*DataFrameSummary) ProtoMessage()    {}
+func (*DataFrameSummary) Descriptor() ([]byte, []int) {
+	return fileDescriptor_1d43959f7c3049fd, []int{8}
+}
+
+func (m *DataFrameSummary) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_DataFrameSummary.Unmarshal(m, b)
+}
+func (m *DataFrameSummary) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_DataFrameSummary.Marshal(b, m, deterministic)
+}
+func (m *DataFrameSummary) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_DataFrameSummary.Merge(m, src)
+}
+func (m *DataFrameSummary) XXX_Size() int {
+	return xxx_messageInfo_DataFrameSummary.Size(m)
+}
+func (m *DataFrameSummary) XXX_DiscardUnknown() {
+	xxx_messageInfo_DataFrameSummary.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_DataFrameSummary proto.InternalMessageInfo
+
+func (m *DataFrameSummary) GetName() string {
+	if m != nil {
+		return m.Name
 	}
 	return ""
 }
 
-func (m *FetchResponse) GetTimes() []int64 {
+func (m *DataFrameSummary) GetUuidsResolved() int64 {
 	if m != nil {
-		return m.Times
+		return m.UuidsResolved
 	}
-	return nil
+	return 0
 }
 
-func (m *FetchResponse) GetValues() []float64 {
+func (m *DataFrameSummary) GetUuidsMissing() int64 {
 	if m != nil {
-		return m.Values
+		return m.UuidsMissing
 	}
-	return nil
+	return 0
 }
 
-func (m *FetchResponse) GetVariables() []string {
+func (m *DataFrameSummary) GetPoints() int64 {
 	if m != nil {
-		return m.Variables
+		return m.Points
 	}
-	return nil
+	return 0
 }
 
-func (m *FetchResponse) GetRows() []*Row {
+// The responses to a Subscribe start with the Brick query results, like
+// Fetch. RAW DataFrames then get new points as they are written, including
+// points written at earlier times than those already sent (but not before
+// start); deleted points are not reported. Windowed DataFrames get each
+// window once it has closed, and points written into a window after that
+// are not sent. Servers limit the subscriptions served at once, and refuse
+// more with RESOURCE_EXHAUSTED
+type SubscribeRequest struct {
+	Sites []string `protobuf:"bytes,1,rep,name=sites,proto3" json:"sites,omitempty"`
+	Views []*View  `protobuf:"bytes,2,rep,name=views,proto3" json:"views,omitempty"`
+	// fill policies are not supported
+	DataFrames []*DataFrame `protobuf:"bytes,3,rep,name=dataFrames,proto3" json:"dataFrames,omitempty"`
+	// RFC3339 time to start from; defaults to now. Windows are aligned to
+	// multiples of their width since the Unix epoch
+	Start                string   `protobuf:"bytes,4,opt,name=start,proto3" json:"start,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *SubscribeRequest) Reset()         { *m = SubscribeRequest{} }
+func (m *SubscribeRequest) String() string { return proto.CompactTextString(m) }
+func (*SubscribeRequest) ProtoMessage()    {}
+func (*SubscribeRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_1d43959f7c3049fd, []int{9}
+}
+
+func (m *SubscribeRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SubscribeRequest.Unmarshal(m, b)
+}
+func (m *SubscribeRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SubscribeRequest.Marshal(b, m, deterministic)
+}
+func (m *SubscribeRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SubscribeRequest.Merge(m, src)
+}
+func (m *SubscribeRequest) XXX_Size() int {
+	return xxx_messageInfo_SubscribeRequest.Size(m)
+}
+func (m *SubscribeRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_SubscribeRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SubscribeRequest proto.InternalMessageInfo
+
+func (m *SubscribeRequest) GetSites() []string {
+	if m != nil {
+		return m.Sites
+	}
+	return nil
+}
+
+func (m *SubscribeRequest) GetViews() []*View {
+	if m != nil {
+		return m.Views
+	}
+	return nil
+}
+
+func (m *SubscribeRequest) GetDataFrames() []*DataFrame {
+	if m != nil {
+		return m.DataFrames
+	}
+	return nil
+}
+
+func (m *SubscribeRequest) GetStart() string {
+	if m != nil {
+		return m.Start
+	}
+	return ""
+}
+
+type Stream struct {
+	// name of the stream
+	Name string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	// Brick query (alternative)
+	Definition string   `protobuf:"bytes,2,opt,name=definition,proto3" json:"definition,omitempty"`
+	DataVars   []string `protobuf:"bytes,6,rep,name=dataVars,proto3" json:"dataVars,omitempty"`
+	// list of stream UUIDs
+	Uuids []string `protobuf:"bytes,3,rep,name=uuids,proto3" json:"uuids,omitempty"`
+	// aggregation function for this stream
+	Aggregation AggFunc `protobuf:"varint,4,opt,name=aggregation,proto3,enum=mortar.AggFunc" json:"aggregation,omitempty"`
+	// engineering units to convert the stream to
+	Units                string   `protobuf:"bytes,5,opt,name=units,proto3" json:"units,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Stream) Reset()         { *m = Stream{} }
+func (m *Stream) String() string { return proto.CompactTextString(m) }
+func (*Stream) ProtoMessage()    {}
+func (*Stream) Descriptor() ([]byte, []int) {
+	return fileDescriptor_1d43959f7c3049fd, []int{10}
+}
+
+func (m *Stream) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Stream.Unmarshal(m, b)
+}
+func (m *Stream) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Stream.Marshal(b, m, deterministic)
+}
+func (m *Stream) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Stream.Merge(m, src)
+}
+func (m *Stream) XXX_Size() int {
+	return xxx_messageInfo_Stream.Size(m)
+}
+func (m *Stream) XXX_DiscardUnknown() {
+	xxx_messageInfo_Stream.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Stream proto.InternalMessageInfo
+
+func (m *Stream) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *Stream) GetDefinition() string {
+	if m != nil {
+		return m.Definition
+	}
+	return ""
+}
+
+func (m *Stream) GetDataVars() []string {
+	if m != nil {
+		return m.DataVars
+	}
+	return nil
+}
+
+func (m *Stream) GetUuids() []string {
+	if m != nil {
+		return m.Uuids
+	}
+	return nil
+}
+
+func (m *Stream) GetAggregation() AggFunc {
+	if m != nil {
+		return m.Aggregation
+	}
+	return AggFunc_AGG_FUNC_INVALID
+}
+
+func (m *Stream) GetUnits() string {
+	if m != nil {
+		return m.Units
+	}
+	return ""
+}
+
+type FetchResponse struct {
+	// error from backend
+	Error string `protobuf:"bytes,1,opt,name=error,proto3" json:"error,omitempty"`
+	// stream definition fields:
+	// - site name
+	// - view name
+	// - data frame name
+	// - variable name (from View definition)
+	Site      string `protobuf:"bytes,2,opt,name=site,proto3" json:"site,omitempty"`
+	View      string `protobuf:"bytes,9,opt,name=view,proto3" json:"view,omitempty"`
+	DataFrame string `protobuf:"bytes,10,opt,name=dataFrame,proto3" json:"dataFrame,omitempty"`
+	Variable  string `protobuf:"bytes,3,opt,name=variable,proto3" json:"variable,omitempty"`
+	// uuid
+	Identifier string `protobuf:"bytes,4,opt,name=identifier,proto3" json:"identifier,omitempty"`
+	// timestamps and value should have same length
+	Times  []int64   `protobuf:"varint,5,rep,packed,name=times,proto3" json:"times,omitempty"`
+	Values []float64 `protobuf:"fixed64,6,rep,packed,name=values,proto3" json:"values,omitempty"`
+	// brick query contents related to this variable
+	Variables []string `protobuf:"bytes,7,rep,name=variables,proto3" json:"variables,omitempty"`
+	Rows      []*Row   `protobuf:"bytes,8,rep,name=rows,proto3" json:"rows,omitempty"`
+	// quality of each value; has the same length as times and values
+	// when the DataFrame has a fill policy, and is empty otherwise
+	Quality []DataQuality `protobuf:"varint,11,rep,packed,name=quality,proto3,enum=mortar.DataQuality" json:"quality,omitempty"`
+	// where the Fetch is up to after this response (set if the request is
+	// resumable). Tokens increase monotonically over the stream
+	ResumeToken string `protobuf:"bytes,12,opt,name=resumeToken,proto3" json:"resumeToken,omitempty"`
+	// set on the last response of a Fetch that completed, which holds
+	// nothing else
+	Summary              *FetchSummary `protobuf:"bytes,13,opt,name=summary,proto3" json:"summary,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}      `json:"-"`
+	XXX_unrecognized     []byte        `json:"-"`
+	XXX_sizecache        int32         `json:"-"`
+}
+
+func (m *FetchResponse) Reset()         { *m = FetchResponse{} }
+func (m *FetchResponse) String() string { return proto.CompactTextString(m) }
+func (*FetchResponse) ProtoMessage()    {}
+func (*FetchResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_1d43959f7c3049fd, []int{11}
+}
+
+func (m *FetchResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_FetchResponse.Unmarshal(m, b)
+}
+func (m *FetchResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_FetchResponse.Marshal(b, m, deterministic)
+}
+func (m *FetchResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_FetchResponse.Merge(m, src)
+}
+func (m *FetchResponse) XXX_Size() int {
+	return xxx_messageInfo_FetchResponse.Size(m)
+}
+func (m *FetchResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_FetchResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_FetchResponse proto.InternalMessageInfo
+
+func (m *FetchResponse) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
+
+func (m *FetchResponse) GetSite() string {
+	if m != nil {
+		return m.Site
+	}
+	return ""
+}
+
+func (m *FetchResponse) GetView() string {
+	if m != nil {
+		return m.View
+	}
+	return ""
+}
+
+func (m *FetchResponse) GetDataFrame() string {
+	if m != nil {
+		return m.DataFrame
+	}
+	return ""
+}
+
+func (m *FetchResponse) GetVariable() string {
+	if m != nil {
+		return m.Variable
+	}
+	return ""
+}
+
+func (m *FetchResponse) GetIdentifier() string {
+	if m != nil {
+		return m.Identifier
+	}
+	return ""
+}
+
+func (m *FetchResponse) GetTimes() []int64 {
+	if m != nil {
+		return m.Times
+	}
+	return nil
+}
+
+func (m *FetchResponse) GetValues() []float64 {
+	if m != nil {
+		return m.Values
+	}
+	return nil
+}
+
+func (m *FetchResponse) GetVariables() []string {
+	if m != nil {
+		return m.Variables
+	}
+	return nil
+}
+
+func (m *FetchResponse) GetRows() []*Row {
+	if m != nil {
+		return m.Rows
+	}
+	return nil
+}
+
+func (m *FetchResponse) GetQuality() []DataQuality {
+	if m != nil {
+		return m.Quality
+	}
+	return nil
+}
+
+func (m *FetchResponse) GetResumeToken() string {
+	if m != nil {
+		return m.ResumeToken
+	}
+	return ""
+}
+
+func (m *FetchResponse) GetSummary() *FetchSummary {
+	if m != nil {
+		return m.Summary
+	}
+	return nil
+}
+
+// The data of all ArrowResponses of a FetchArrow call, concatenated, is an
+// Arrow IPC stream of record batches with the columns site, view, dataFrame,
+// uuid, time (timestamp[ns, UTC]) and value (float64)
+type ArrowResponse struct {
+	// error from backend
+	Error string `protobuf:"bytes,1,opt,name=error,proto3" json:"error,omitempty"`
+	Data  []byte `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+	// set on the last response of a FetchArrow that completed, which holds
+	// nothing else
+	Summary              *FetchSummary `protobuf:"bytes,3,opt,name=summary,proto3" json:"summary,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}      `json:"-"`
+	XXX_unrecognized     []byte        `json:"-"`
+	XXX_sizecache        int32         `json:"-"`
+}
+
+func (m *ArrowResponse) Reset()         { *m = ArrowResponse{} }
+func (m *ArrowResponse) String() string { return proto.CompactTextString(m) }
+func (*ArrowResponse) ProtoMessage()    {}
+func (*ArrowResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_1d43959f7c3049fd, []int{12}
+}
+
+func (m *ArrowResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ArrowResponse.Unmarshal(m, b)
+}
+func (m *ArrowResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ArrowResponse.Marshal(b, m, deterministic)
+}
+func (m *ArrowResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ArrowResponse.Merge(m, src)
+}
+func (m *ArrowResponse) XXX_Size() int {
+	return xxx_messageInfo_ArrowResponse.Size(m)
+}
+func (m *ArrowResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_ArrowResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ArrowResponse proto.InternalMessageInfo
+
+func (m *ArrowResponse) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
+
+func (m *ArrowResponse) GetData() []byte {
+	if m != nil {
+		return m.Data
+	}
+	return nil
+}
+
+func (m *ArrowResponse) GetSummary() *FetchSummary {
+	if m != nil {
+		return m.Summary
+	}
+	return nil
+}
+
+type ExportRequest struct {
+	Fetch                *FetchRequest `protobuf:"bytes,1,opt,name=fetch,proto3" json:"fetch,omitempty"`
+	Format               ExportFormat  `protobuf:"varint,2,opt,name=format,proto3,enum=mortar.ExportFormat" json:"format,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}      `json:"-"`
+	XXX_unrecognized     []byte        `json:"-"`
+	XXX_sizecache        int32         `json:"-"`
+}
+
+func (m *ExportRequest) Reset()         { *m = ExportRequest{} }
+func (m *ExportRequest) String() string { return proto.CompactTextString(m) }
+func (*ExportRequest) ProtoMessage()    {}
+func (*ExportRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_1d43959f7c3049fd, []int{13}
+}
+
+func (m *ExportRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ExportRequest.Unmarshal(m, b)
+}
+func (m *ExportRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ExportRequest.Marshal(b, m, deterministic)
+}
+func (m *ExportRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ExportRequest.Merge(m, src)
+}
+func (m *ExportRequest) XXX_Size() int {
+	return xxx_messageInfo_ExportRequest.Size(m)
+}
+func (m *ExportRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_ExportRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ExportRequest proto.InternalMessageInfo
+
+func (m *ExportRequest) GetFetch() *FetchRequest {
+	if m != nil {
+		return m.Fetch
+	}
+	return nil
+}
+
+func (m *ExportRequest) GetFormat() ExportFormat {
+	if m != nil {
+		return m.Format
+	}
+	return ExportFormat_EXPORT_FORMAT_CSV_LONG
+}
+
+// Export sends the data file, then one file per View holding the Brick
+// query results for that View (one column per variable, and the site).
+// Each file is sent as a run of ExportResponses with the same file name;
+// concatenating their data gives the file
+type ExportResponse struct {
+	// error from backend
+	Error string `protobuf:"bytes,1,opt,name=error,proto3" json:"error,omitempty"`
+	// name of the file this chunk belongs to
+	File                 string   `protobuf:"bytes,2,opt,name=file,proto3" json:"file,omitempty"`
+	Data                 []byte   `protobuf:"bytes,3,opt,name=data,proto3" json:"data,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ExportResponse) Reset()         { *m = ExportResponse{} }
+func (m *ExportResponse) String() string { return proto.CompactTextString(m) }
+func (*ExportResponse) ProtoMessage()    {}
+func (*ExportResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_1d43959f7c3049fd, []int{14}
+}
+
+func (m *ExportResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ExportResponse.Unmarshal(m, b)
+}
+func (m *ExportResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ExportResponse.Marshal(b, m, deterministic)
+}
+func (m *ExportResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ExportResponse.Merge(m, src)
+}
+func (m *ExportResponse) XXX_Size() int {
+	return xxx_messageInfo_ExportResponse.Size(m)
+}
+func (m *ExportResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_ExportResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ExportResponse proto.InternalMessageInfo
+
+func (m *ExportResponse) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
+
+func (m *ExportResponse) GetFile() string {
+	if m != nil {
+		return m.File
+	}
+	return ""
+}
+
+func (m *ExportResponse) GetData() []byte {
+	if m != nil {
+		return m.Data
+	}
+	return nil
+}
+
+type FetchJob struct {
+	Id    string        `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	State FetchJobState `protobuf:"varint,2,opt,name=state,proto3,enum=mortar.FetchJobState" json:"state,omitempty"`
+	// why the job failed
+	Error string `protobuf:"bytes,3,opt,name=error,proto3" json:"error,omitempty"`
+	// RFC3339 times the job was submitted and finished, and after which its
+	// results are deleted (set when it finishes)
+	Submitted string `protobuf:"bytes,4,opt,name=submitted,proto3" json:"submitted,omitempty"`
+	Finished  string `protobuf:"bytes,5,opt,name=finished,proto3" json:"finished,omitempty"`
+	Expires   string `protobuf:"bytes,6,opt,name=expires,proto3" json:"expires,omitempty"`
+	// progress: UUIDs read so far out of those found by the Brick queries,
+	// and the number of points and responses stored
+	UuidsTotal     int64 `protobuf:"varint,7,opt,name=uuidsTotal,proto3" json:"uuidsTotal,omitempty"`
+	UuidsCompleted int64 `protobuf:"varint,8,opt,name=uuidsCompleted,proto3" json:"uuidsCompleted,omitempty"`
+	PointsReturned int64 `protobuf:"varint,9,opt,name=pointsReturned,proto3" json:"pointsReturned,omitempty"`
+	Responses      int64 `protobuf:"varint,10,opt,name=responses,proto3" json:"responses,omitempty"`
+	// the user who submitted the job (from the token); only they can see it
+	Owner string `protobuf:"bytes,11,opt,name=owner,proto3" json:"owner,omitempty"`
+	// what the Fetch found, set once the job completed
+	Summary              *FetchSummary `protobuf:"bytes,12,opt,name=summary,proto3" json:"summary,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}      `json:"-"`
+	XXX_unrecognized     []byte        `json:"-"`
+	XXX_sizecache        int32         `json:"-"`
+}
+
+func (m *FetchJob) Reset()         { *m = FetchJob{} }
+func (m *FetchJob) String() string { return proto.CompactTextString(m) }
+func (*FetchJob) ProtoMessage()    {}
+func (*FetchJob) Descriptor() ([]byte, []int) {
+	return fileDescriptor_1d43959f7c3049fd, []int{15}
+}
+
+func (m *FetchJob) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_FetchJob.Unmarshal(m, b)
+}
+func (m *FetchJob) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_FetchJob.Marshal(b, m, deterministic)
+}
+func (m *FetchJob) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_FetchJob.Merge(m, src)
+}
+func (m *FetchJob) XXX_Size() int {
+	return xxx_messageInfo_FetchJob.Size(m)
+}
+func (m *FetchJob) XXX_DiscardUnknown() {
+	xxx_messageInfo_FetchJob.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_FetchJob proto.InternalMessageInfo
+
+func (m *FetchJob) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *FetchJob) GetState() FetchJobState {
+	if m != nil {
+		return m.State
+	}
+	return FetchJobState_FETCH_JOB_STATE_PENDING
+}
+
+func (m *FetchJob) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
+
+func (m *FetchJob) GetSubmitted() string {
+	if m != nil {
+		return m.Submitted
+	}
+	return ""
+}
+
+func (m *FetchJob) GetFinished() string {
+	if m != nil {
+		return m.Finished
+	}
+	return ""
+}
+
+func (m *FetchJob) GetExpires() string {
+	if m != nil {
+		return m.Expires
+	}
+	return ""
+}
+
+func (m *FetchJob) GetUuidsTotal() int64 {
+	if m != nil {
+		return m.UuidsTotal
+	}
+	return 0
+}
+
+func (m *FetchJob) GetUuidsCompleted() int64 {
+	if m != nil {
+		return m.UuidsCompleted
+	}
+	return 0
+}
+
+func (m *FetchJob) GetPointsReturned() int64 {
+	if m != nil {
+		return m.PointsReturned
+	}
+	return 0
+}
+
+func (m *FetchJob) GetResponses() int64 {
+	if m != nil {
+		return m.Responses
+	}
+	return 0
+}
+
+func (m *FetchJob) GetOwner() string {
+	if m != nil {
+		return m.Owner
+	}
+	return ""
+}
+
+func (m *FetchJob) GetSummary() *FetchSummary {
+	if m != nil {
+		return m.Summary
+	}
+	return nil
+}
+
+type FetchJobRequest struct {
+	Id                   string   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *FetchJobRequest) Reset()         { *m = FetchJobRequest{} }
+func (m *FetchJobRequest) String() string { return proto.CompactTextString(m) }
+func (*FetchJobRequest) ProtoMessage()    {}
+func (*FetchJobRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_1d43959f7c3049fd, []int{16}
+}
+
+func (m *FetchJobRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_FetchJobRequest.Unmarshal(m, b)
+}
+func (m *FetchJobRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_FetchJobRequest.Marshal(b, m, deterministic)
+}
+func (m *FetchJobRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_FetchJobRequest.Merge(m, src)
+}
+func (m *FetchJobRequest) XXX_Size() int {
+	return xxx_messageInfo_FetchJobRequest.Size(m)
+}
+func (m *FetchJobRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_FetchJobRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_FetchJobRequest proto.InternalMessageInfo
+
+func (m *FetchJobRequest) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+type FetchJobResultsRequest struct {
+	Id string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	// where to continue from; empty for the first page
+	PageToken string `protobuf:"bytes,2,opt,name=pageToken,proto3" json:"pageToken,omitempty"`
+	// maximum number of responses in the page; defaults to 100
+	PageSize             int32    `protobuf:"varint,3,opt,name=pageSize,proto3" json:"pageSize,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *FetchJobResultsRequest) Reset()         { *m = FetchJobResultsRequest{} }
+func (m *FetchJobResultsRequest) String() string { return proto.CompactTextString(m) }
+func (*FetchJobResultsRequest) ProtoMessage()    {}
+func (*FetchJobResultsRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_1d43959f7c3049fd, []int{17}
+}
+
+func (m *FetchJobResultsRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_FetchJobResultsRequest.Unmarshal(m, b)
+}
+func (m *FetchJobResultsRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_FetchJobResultsRequest.Marshal(b, m, deterministic)
+}
+func (m *FetchJobResultsRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_FetchJobResultsRequest.Merge(m, src)
+}
+func (m *FetchJobResultsRequest) XXX_Size() int {
+	return xxx_messageInfo_FetchJobResultsRequest.Size(m)
+}
+func (m *FetchJobResultsRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_FetchJobResultsRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_FetchJobResultsRequest proto.InternalMessageInfo
+
+func (m *FetchJobResultsRequest) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *FetchJobResultsRequest) GetPageToken() string {
+	if m != nil {
+		return m.PageToken
+	}
+	return ""
+}
+
+func (m *FetchJobResultsRequest) GetPageSize() int32 {
+	if m != nil {
+		return m.PageSize
+	}
+	return 0
+}
+
+// Results can be read while the job is running. Keep requesting pages with
+// nextPageToken until it is empty: then the job has finished and all of its
+// results have been read
+type FetchJobResultsResponse struct {
+	// the FetchResponses of the job, in the order they were produced
+	Responses            []*FetchResponse `protobuf:"bytes,1,rep,name=responses,proto3" json:"responses,omitempty"`
+	NextPageToken        string           `protobuf:"bytes,2,opt,name=nextPageToken,proto3" json:"nextPageToken,omitempty"`
+	Job                  *FetchJob        `protobuf:"bytes,3,opt,name=job,proto3" json:"job,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}         `json:"-"`
+	XXX_unrecognized     []byte           `json:"-"`
+	XXX_sizecache        int32            `json:"-"`
+}
+
+func (m *FetchJobResultsResponse) Reset()         { *m = FetchJobResultsResponse{} }
+func (m *FetchJobResultsResponse) String() string { return proto.CompactTextString(m) }
+func (*FetchJobResultsResponse) ProtoMessage()    {}
+func (*FetchJobResultsResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_1d43959f7c3049fd, []int{18}
+}
+
+func (m *FetchJobResultsResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_FetchJobResultsResponse.Unmarshal(m, b)
+}
+func (m *FetchJobResultsResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_FetchJobResultsResponse.Marshal(b, m, deterministic)
+}
+func (m *FetchJobResultsResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_FetchJobResultsResponse.Merge(m, src)
+}
+func (m *FetchJobResultsResponse) XXX_Size() int {
+	return xxx_messageInfo_FetchJobResultsResponse.Size(m)
+}
+func (m *FetchJobResultsResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_FetchJobResultsResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_FetchJobResultsResponse proto.InternalMessageInfo
+
+func (m *FetchJobResultsResponse) GetResponses() []*FetchResponse {
+	if m != nil {
+		return m.Responses
+	}
+	return nil
+}
+
+func (m *FetchJobResultsResponse) GetNextPageToken() string {
+	if m != nil {
+		return m.NextPageToken
+	}
+	return ""
+}
+
+func (m *FetchJobResultsResponse) GetJob() *FetchJob {
+	if m != nil {
+		return m.Job
+	}
+	return nil
+}
+
+// AuditRecord is the audit log entry of one call that queried data
+type AuditRecord struct {
+	// RFC3339 time the call started
+	Time string `protobuf:"bytes,1,opt,name=time,proto3" json:"time,omitempty"`
+	// name of the RPC, e.g. Fetch
+	Rpc string `protobuf:"bytes,2,opt,name=rpc,proto3" json:"rpc,omitempty"`
+	// user name from the verified token; empty if the call was not
+	// authenticated with a token
+	Identity string `protobuf:"bytes,3,opt,name=identity,proto3" json:"identity,omitempty"`
+	// address of the client
+	Peer       string            `protobuf:"bytes,4,opt,name=peer,proto3" json:"peer,omitempty"`
+	Sites      []string          `protobuf:"bytes,5,rep,name=sites,proto3" json:"sites,omitempty"`
+	Views      []string          `protobuf:"bytes,6,rep,name=views,proto3" json:"views,omitempty"`
+	DataFrames []*AuditDataFrame `protobuf:"bytes,7,rep,name=dataFrames,proto3" json:"dataFrames,omitempty"`
+	// the required and optional queries of a Qualify
+	Queries []string `protobuf:"bytes,8,rep,name=queries,proto3" json:"queries,omitempty"`
+	// time range of the data requested
+	Start string `protobuf:"bytes,9,opt,name=start,proto3" json:"start,omitempty"`
+	End   string `protobuf:"bytes,10,opt,name=end,proto3" json:"end,omitempty"`
+	// what was returned: FetchResponses, points and bytes of timeseries
+	// and Brick results, or the number of sites found by a Qualify
+	Responses       int64   `protobuf:"varint,11,opt,name=responses,proto3" json:"responses,omitempty"`
+	Points          int64   `protobuf:"varint,12,opt,name=points,proto3" json:"points,omitempty"`
+	Bytes           int64   `protobuf:"varint,13,opt,name=bytes,proto3" json:"bytes,omitempty"`
+	QualifiedSites  int64   `protobuf:"varint,14,opt,name=qualifiedSites,proto3" json:"qualifiedSites,omitempty"`
+	DurationSeconds float64 `protobuf:"fixed64,15,opt,name=durationSeconds,proto3" json:"durationSeconds,omitempty"`
+	// why the call failed
+	Error                string   `protobuf:"bytes,16,opt,name=error,proto3" json:"error,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *AuditRecord) Reset()         { *m = AuditRecord{} }
+func (m *AuditRecord) String() string { return proto.CompactTextString(m) }
+func (*AuditRecord) ProtoMessage()    {}
+func (*AuditRecord) Descriptor() ([]byte, []int) {
+	return fileDescriptor_1d43959f7c3049fd, []int{19}
+}
+
+func (m *AuditRecord) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_AuditRecord.Unmarshal(m, b)
+}
+func (m *AuditRecord) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_AuditRecord.Marshal(b, m, deterministic)
+}
+func (m *AuditRecord) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_AuditRecord.Merge(m, src)
+}
+func (m *AuditRecord) XXX_Size() int {
+	return xxx_messageInfo_AuditRecord.Size(m)
+}
+func (m *AuditRecord) XXX_DiscardUnknown() {
+	xxx_messageInfo_AuditRecord.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_AuditRecord proto.InternalMessageInfo
+
+func (m *AuditRecord) GetTime() string {
+	if m != nil {
+		return m.Time
+	}
+	return ""
+}
+
+func (m *AuditRecord) GetRpc() string {
+	if m != nil {
+		return m.Rpc
+	}
+	return ""
+}
+
+func (m *AuditRecord) GetIdentity() string {
+	if m != nil {
+		return m.Identity
+	}
+	return ""
+}
+
+func (m *AuditRecord) GetPeer() string {
+	if m != nil {
+		return m.Peer
+	}
+	return ""
+}
+
+func (m *AuditRecord) GetSites() []string {
+	if m != nil {
+		return m.Sites
+	}
+	return nil
+}
+
+func (m *AuditRecord) GetViews() []string {
+	if m != nil {
+		return m.Views
+	}
+	return nil
+}
+
+func (m *AuditRecord) GetDataFrames() []*AuditDataFrame {
+	if m != nil {
+		return m.DataFrames
+	}
+	return nil
+}
+
+func (m *AuditRecord) GetQueries() []string {
+	if m != nil {
+		return m.Queries
+	}
+	return nil
+}
+
+func (m *AuditRecord) GetStart() string {
+	if m != nil {
+		return m.Start
+	}
+	return ""
+}
+
+func (m *AuditRecord) GetEnd() string {
+	if m != nil {
+		return m.End
+	}
+	return ""
+}
+
+func (m *AuditRecord) GetResponses() int64 {
+	if m != nil {
+		return m.Responses
+	}
+	return 0
+}
+
+func (m *AuditRecord) GetPoints() int64 {
+	if m != nil {
+		return m.Points
+	}
+	return 0
+}
+
+func (m *AuditRecord) GetBytes() int64 {
+	if m != nil {
+		return m.Bytes
+	}
+	return 0
+}
+
+func (m *AuditRecord) GetQualifiedSites() int64 {
+	if m != nil {
+		return m.QualifiedSites
+	}
+	return 0
+}
+
+func (m *AuditRecord) GetDurationSeconds() float64 {
+	if m != nil {
+		return m.DurationSeconds
+	}
+	return 0
+}
+
+func (m *AuditRecord) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
+
+type AuditDataFrame struct {
+	Name        string  `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Aggregation AggFunc `protobuf:"varint,2,opt,name=aggregation,proto3,enum=mortar.AggFunc" json:"aggregation,omitempty"`
+	Window      string  `protobuf:"bytes,3,opt,name=window,proto3" json:"window,omitempty"`
+	// number of UUIDs requested directly, before those of the Views
+	Uuids                int64    `protobuf:"varint,4,opt,name=uuids,proto3" json:"uuids,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *AuditDataFrame) Reset()         { *m = AuditDataFrame{} }
+func (m *AuditDataFrame) String() string { return proto.CompactTextString(m) }
+func (*AuditDataFrame) ProtoMessage()    {}
+func (*AuditDataFrame) Descriptor() ([]byte, []int) {
+	return fileDescriptor_1d43959f7c3049fd, []int{20}
+}
+
+func (m *AuditDataFrame) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_AuditDataFrame.Unmarshal(m, b)
+}
+func (m *AuditDataFrame) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_AuditDataFrame.Marshal(b, m, deterministic)
+}
+func (m *AuditDataFrame) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_AuditDataFrame.Merge(m, src)
+}
+func (m *AuditDataFrame) XXX_Size() int {
+	return xxx_messageInfo_AuditDataFrame.Size(m)
+}
+func (m *AuditDataFrame) XXX_DiscardUnknown() {
+	xxx_messageInfo_AuditDataFrame.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_AuditDataFrame proto.InternalMessageInfo
+
+func (m *AuditDataFrame) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *AuditDataFrame) GetAggregation() AggFunc {
+	if m != nil {
+		return m.Aggregation
+	}
+	return AggFunc_AGG_FUNC_INVALID
+}
+
+func (m *AuditDataFrame) GetWindow() string {
+	if m != nil {
+		return m.Window
+	}
+	return ""
+}
+
+func (m *AuditDataFrame) GetUuids() int64 {
+	if m != nil {
+		return m.Uuids
+	}
+	return 0
+}
+
+// All conditions must match; empty ones match any record
+type AuditSearchRequest struct {
+	// RFC3339 range of the time of the records
+	Start      string `protobuf:"bytes,1,opt,name=start,proto3" json:"start,omitempty"`
+	End        string `protobuf:"bytes,2,opt,name=end,proto3" json:"end,omitempty"`
+	Identity   string `protobuf:"bytes,3,opt,name=identity,proto3" json:"identity,omitempty"`
+	Site       string `protobuf:"bytes,4,opt,name=site,proto3" json:"site,omitempty"`
+	Rpc        string `protobuf:"bytes,5,opt,name=rpc,proto3" json:"rpc,omitempty"`
+	ErrorsOnly bool   `protobuf:"varint,6,opt,name=errorsOnly,proto3" json:"errorsOnly,omitempty"`
+	// where to continue from; empty for the first page
+	PageToken string `protobuf:"bytes,7,opt,name=pageToken,proto3" json:"pageToken,omitempty"`
+	// maximum number of records in the page; defaults to 100
+	PageSize             int32    `protobuf:"varint,8,opt,name=pageSize,proto3" json:"pageSize,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *AuditSearchRequest) Reset()         { *m = AuditSearchRequest{} }
+func (m *AuditSearchRequest) String() string { return proto.CompactTextString(m) }
+func (*AuditSearchRequest) ProtoMessage()    {}
+func (*AuditSearchRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_1d43959f7c3049fd, []int{21}
+}
+
+func (m *AuditSearchRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_AuditSearchRequest.Unmarshal(m, b)
+}
+func (m *AuditSearchRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_AuditSearchRequest.Marshal(b, m, deterministic)
+}
+func (m *AuditSearchRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_AuditSearchRequest.Merge(m, src)
+}
+func (m *AuditSearchRequest) XXX_Size() int {
+	return xxx_messageInfo_AuditSearchRequest.Size(m)
+}
+func (m *AuditSearchRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_AuditSearchRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_AuditSearchRequest proto.InternalMessageInfo
+
+func (m *AuditSearchRequest) GetStart() string {
+	if m != nil {
+		return m.Start
+	}
+	return ""
+}
+
+func (m *AuditSearchRequest) GetEnd() string {
+	if m != nil {
+		return m.End
+	}
+	return ""
+}
+
+func (m *AuditSearchRequest) GetIdentity() string {
+	if m != nil {
+		return m.Identity
+	}
+	return ""
+}
+
+func (m *AuditSearchRequest) GetSite() string {
+	if m != nil {
+		return m.Site
+	}
+	return ""
+}
+
+func (m *AuditSearchRequest) GetRpc() string {
+	if m != nil {
+		return m.Rpc
+	}
+	return ""
+}
+
+func (m *AuditSearchRequest) GetErrorsOnly() bool {
+	if m != nil {
+		return m.ErrorsOnly
+	}
+	return false
+}
+
+func (m *AuditSearchRequest) GetPageToken() string {
+	if m != nil {
+		return m.PageToken
+	}
+	return ""
+}
+
+func (m *AuditSearchRequest) GetPageSize() int32 {
+	if m != nil {
+		return m.PageSize
+	}
+	return 0
+}
+
+type AuditSearchResponse struct {
+	// matching records, oldest first
+	Records []*AuditRecord `protobuf:"bytes,1,rep,name=records,proto3" json:"records,omitempty"`
+	// empty once all matching records have been returned
+	NextPageToken        string   `protobuf:"bytes,2,opt,name=nextPageToken,proto3" json:"nextPageToken,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *AuditSearchResponse) Reset()         { *m = AuditSearchResponse{} }
+func (m *AuditSearchResponse) String() string { return proto.CompactTextString(m) }
+func (*AuditSearchResponse) ProtoMessage()    {}
+func (*AuditSearchResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_1d43959f7c3049fd, []int{22}
+}
+
+func (m *AuditSearchResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_AuditSearchResponse.Unmarshal(m, b)
+}
+func (m *AuditSearchResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_AuditSearchResponse.Marshal(b, m, deterministic)
+}
+func (m *AuditSearchResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_AuditSearchResponse.Merge(m, src)
+}
+func (m *AuditSearchResponse) XXX_Size() int {
+	return xxx_messageInfo_AuditSearchResponse.Size(m)
+}
+func (m *AuditSearchResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_AuditSearchResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_AuditSearchResponse proto.InternalMessageInfo
+
+func (m *AuditSearchResponse) GetRecords() []*AuditRecord {
+	if m != nil {
+		return m.Records
+	}
+	return nil
+}
+
+func (m *AuditSearchResponse) GetNextPageToken() string {
 	if m != nil {
-		return m.Rows
+		return m.NextPageToken
 	}
-	return nil
+	return ""
 }
 
 type Row struct {
@@ -553,7 +1976,7 @@ func (m *Row) Reset()         { *m = Row{} }
 func (m *Row) String() string { return proto.CompactTextString(m) }
 func (*Row) ProtoMessage()    {}
 func (*Row) Descriptor() ([]byte, []int) {
-	return fileDescriptor_1d43959f7c3049fd, []int{7}
+	return fileDescriptor_1d43959f7c3049fd, []int{23}
 }
 
 func (m *Row) XXX_Unmarshal(b []byte) error {
@@ -594,7 +2017,7 @@ func (m *URI) Reset()         { *m = URI{} }
 func (m *URI) String() string { return proto.CompactTextString(m) }
 func (*URI) ProtoMessage()    {}
 func (*URI) Descriptor() ([]byte, []int) {
-	return fileDescriptor_1d43959f7c3049fd, []int{8}
+	return fileDescriptor_1d43959f7c3049fd, []int{24}
 }
 
 func (m *URI) XXX_Unmarshal(b []byte) error {
@@ -643,7 +2066,7 @@ func (m *TimeParams) Reset()         { *m = TimeParams{} }
 func (m *TimeParams) String() string { return proto.CompactTextString(m) }
 func (*TimeParams) ProtoMessage()    {}
 func (*TimeParams) Descriptor() ([]byte, []int) {
-	return fileDescriptor_1d43959f7c3049fd, []int{9}
+	return fileDescriptor_1d43959f7c3049fd, []int{25}
 }
 
 func (m *TimeParams) XXX_Unmarshal(b []byte) error {
@@ -692,6 +2115,64 @@ func (m *TimeParams) GetAligned() bool {
 	return false
 }
 
+type FillPolicy struct {
+	Method FillMethod `protobuf:"varint,1,opt,name=method,proto3,enum=mortar.FillMethod" json:"method,omitempty"`
+	// for FILL_METHOD_PREVIOUS: do not carry a value forward further
+	// than this duration (e.g. "15m"). Empty means no limit
+	MaxStaleness string `protobuf:"bytes,2,opt,name=maxStaleness,proto3" json:"maxStaleness,omitempty"`
+	// for FILL_METHOD_CONSTANT: the value to fill gaps with
+	Value                float64  `protobuf:"fixed64,3,opt,name=value,proto3" json:"value,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *FillPolicy) Reset()         { *m = FillPolicy{} }
+func (m *FillPolicy) String() string { return proto.CompactTextString(m) }
+func (*FillPolicy) ProtoMessage()    {}
+func (*FillPolicy) Descriptor() ([]byte, []int) {
+	return fileDescriptor_1d43959f7c3049fd, []int{26}
+}
+
+func (m *FillPolicy) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_FillPolicy.Unmarshal(m, b)
+}
+func (m *FillPolicy) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_FillPolicy.Marshal(b, m, deterministic)
+}
+func (m *FillPolicy) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_FillPolicy.Merge(m, src)
+}
+func (m *FillPolicy) XXX_Size() int {
+	return xxx_messageInfo_FillPolicy.Size(m)
+}
+func (m *FillPolicy) XXX_DiscardUnknown() {
+	xxx_messageInfo_FillPolicy.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_FillPolicy proto.InternalMessageInfo
+
+func (m *FillPolicy) GetMethod() FillMethod {
+	if m != nil {
+		return m.Method
+	}
+	return FillMethod_FILL_METHOD_NONE
+}
+
+func (m *FillPolicy) GetMaxStaleness() string {
+	if m != nil {
+		return m.MaxStaleness
+	}
+	return ""
+}
+
+func (m *FillPolicy) GetValue() float64 {
+	if m != nil {
+		return m.Value
+	}
+	return 0
+}
+
 type View struct {
 	// name of the View
 	Name string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
@@ -708,7 +2189,7 @@ func (m *View) Reset()         { *m = View{} }
 func (m *View) String() string { return proto.CompactTextString(m) }
 func (*View) ProtoMessage()    {}
 func (*View) Descriptor() ([]byte, []int) {
-	return fileDescriptor_1d43959f7c3049fd, []int{10}
+	return fileDescriptor_1d43959f7c3049fd, []int{27}
 }
 
 func (m *View) XXX_Unmarshal(b []byte) error {
@@ -762,17 +2243,21 @@ type DataFrame struct {
 	// refer to variables in Views
 	Timeseries []*Timeseries `protobuf:"bytes,5,rep,name=timeseries,proto3" json:"timeseries,omitempty"`
 	// instead of vars in views, list the UUIDs explicitly.
-	Uuids                []string `protobuf:"bytes,6,rep,name=uuids,proto3" json:"uuids,omitempty"`
-	XXX_NoUnkeyedLiteral struct{} `json:"-"`
-	XXX_unrecognized     []byte   `json:"-"`
-	XXX_sizecache        int32    `json:"-"`
+	Uuids []string `protobuf:"bytes,6,rep,name=uuids,proto3" json:"uuids,omitempty"`
+	// how to fill gaps in the data. For windowed aggregations, gaps are
+	// empty windows; for RAW data, window gives the expected sampling
+	// interval and is required when a fill policy is set
+	Fill                 *FillPolicy `protobuf:"bytes,7,opt,name=fill,proto3" json:"fill,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}    `json:"-"`
+	XXX_unrecognized     []byte      `json:"-"`
+	XXX_sizecache        int32       `json:"-"`
 }
 
 func (m *DataFrame) Reset()         { *m = DataFrame{} }
 func (m *DataFrame) String() string { return proto.CompactTextString(m) }
 func (*DataFrame) ProtoMessage()    {}
 func (*DataFrame) Descriptor() ([]byte, []int) {
-	return fileDescriptor_1d43959f7c3049fd, []int{11}
+	return fileDescriptor_1d43959f7c3049fd, []int{28}
 }
 
 func (m *DataFrame) XXX_Unmarshal(b []byte) error {
@@ -835,6 +2320,13 @@ func (m *DataFrame) GetUuids() []string {
 	return nil
 }
 
+func (m *DataFrame) GetFill() *FillPolicy {
+	if m != nil {
+		return m.Fill
+	}
+	return nil
+}
+
 type Timeseries struct {
 	// name of the View
 	View string `protobuf:"bytes,1,opt,name=view,proto3" json:"view,omitempty"`
@@ -850,7 +2342,7 @@ func (m *Timeseries) Reset()         { *m = Timeseries{} }
 func (m *Timeseries) String() string { return proto.CompactTextString(m) }
 func (*Timeseries) ProtoMessage()    {}
 func (*Timeseries) Descriptor() ([]byte, []int) {
-	return fileDescriptor_1d43959f7c3049fd, []int{12}
+	return fileDescriptor_1d43959f7c3049fd, []int{29}
 }
 
 func (m *Timeseries) XXX_Unmarshal(b []byte) error {
@@ -886,17 +2378,39 @@ func (m *Timeseries) GetDataVars() []string {
 }
 
 func init() {
+	proto.RegisterEnum("mortar.FailurePolicy", FailurePolicy_name, FailurePolicy_value)
+	proto.RegisterEnum("mortar.ExportFormat", ExportFormat_name, ExportFormat_value)
+	proto.RegisterEnum("mortar.FetchJobState", FetchJobState_name, FetchJobState_value)
 	proto.RegisterEnum("mortar.AggFunc", AggFunc_name, AggFunc_value)
+	proto.RegisterEnum("mortar.FillMethod", FillMethod_name, FillMethod_value)
+	proto.RegisterEnum("mortar.DataQuality", DataQuality_name, DataQuality_value)
 	proto.RegisterType((*GetAPIKeyRequest)(nil), "mortar.GetAPIKeyRequest")
 	proto.RegisterType((*APIKeyResponse)(nil), "mortar.APIKeyResponse")
 	proto.RegisterType((*QualifyRequest)(nil), "mortar.QualifyRequest")
 	proto.RegisterType((*QualifyResponse)(nil), "mortar.QualifyResponse")
 	proto.RegisterType((*FetchRequest)(nil), "mortar.FetchRequest")
+	proto.RegisterType((*FetchFailure)(nil), "mortar.FetchFailure")
+	proto.RegisterType((*FetchSummary)(nil), "mortar.FetchSummary")
+	proto.RegisterType((*ViewRows)(nil), "mortar.ViewRows")
+	proto.RegisterType((*DataFrameSummary)(nil), "mortar.DataFrameSummary")
+	proto.RegisterType((*SubscribeRequest)(nil), "mortar.SubscribeRequest")
 	proto.RegisterType((*Stream)(nil), "mortar.Stream")
 	proto.RegisterType((*FetchResponse)(nil), "mortar.FetchResponse")
+	proto.RegisterType((*ArrowResponse)(nil), "mortar.ArrowResponse")
+	proto.RegisterType((*ExportRequest)(nil), "mortar.ExportRequest")
+	proto.RegisterType((*ExportResponse)(nil), "mortar.ExportResponse")
+	proto.RegisterType((*FetchJob)(nil), "mortar.FetchJob")
+	proto.RegisterType((*FetchJobRequest)(nil), "mortar.FetchJobRequest")
+	proto.RegisterType((*FetchJobResultsRequest)(nil), "mortar.FetchJobResultsRequest")
+	proto.RegisterType((*FetchJobResultsResponse)(nil), "mortar.FetchJobResultsResponse")
+	proto.RegisterType((*AuditRecord)(nil), "mortar.AuditRecord")
+	proto.RegisterType((*AuditDataFrame)(nil), "mortar.AuditDataFrame")
+	proto.RegisterType((*AuditSearchRequest)(nil), "mortar.AuditSearchRequest")
+	proto.RegisterType((*AuditSearchResponse)(nil), "mortar.AuditSearchResponse")
 	proto.RegisterType((*Row)(nil), "mortar.Row")
 	proto.RegisterType((*URI)(nil), "mortar.URI")
 	proto.RegisterType((*TimeParams)(nil), "mortar.TimeParams")
+	proto.RegisterType((*FillPolicy)(nil), "mortar.FillPolicy")
 	proto.RegisterType((*View)(nil), "mortar.View")
 	proto.RegisterType((*DataFrame)(nil), "mortar.DataFrame")
 	proto.RegisterType((*Timeseries)(nil), "mortar.Timeseries")
@@ -905,60 +2419,144 @@ func init() {
 func init() { proto.RegisterFile("mortar.proto", fileDescriptor_1d43959f7c3049fd) }
 
 var fileDescriptor_1d43959f7c3049fd = []byte{
-	// 838 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x55, 0xc1, 0x6e, 0xeb, 0x44,
-	0x14, 0xc5, 0xb1, 0xe3, 0x24, 0x37, 0x69, 0xea, 0x8e, 0x4a, 0xb1, 0x22, 0x04, 0x95, 0x91, 0x50,
-	0xd5, 0x45, 0x45, 0x83, 0x84, 0x04, 0xa2, 0x8b, 0xd0, 0x92, 0x12, 0x20, 0xa1, 0x4c, 0x9b, 0x82,
-	0xd8, 0x54, 0xd3, 0x7a, 0x92, 0x8e, 0x48, 0xec, 0x74, 0xc6, 0xae, 0xc5, 0x4f, 0xb0, 0xe2, 0x5f,
-	0x58, 0xbc, 0x1f, 0x78, 0x9b, 0xf7, 0x4f, 0x4f, 0x33, 0xe3, 0x71, 0xec, 0x34, 0xef, 0xe9, 0xed,
-	0x7c, 0xce, 0x3d, 0xbe, 0xbe, 0x73, 0xee, 0xbd, 0x1e, 0xe8, 0x2c, 0x63, 0x9e, 0x10, 0x7e, 0xb2,
-	0xe2, 0x71, 0x12, 0x23, 0x57, 0xa3, 0x20, 0x02, 0xef, 0x92, 0x26, 0x83, 0xab, 0xd1, 0x2f, 0xf4,
-	0x1f, 0x4c, 0x9f, 0x52, 0x2a, 0x12, 0xd4, 0x83, 0x66, 0x2a, 0x28, 0x8f, 0xc8, 0x92, 0xfa, 0xd6,
-	0xa1, 0x75, 0xd4, 0xc2, 0x05, 0x96, 0xb1, 0x15, 0x11, 0x22, 0x8b, 0x79, 0xe8, 0xd7, 0x74, 0xcc,
-	0x60, 0x14, 0x40, 0x87, 0xd3, 0x19, 0xa7, 0xe2, 0x31, 0x89, 0xff, 0xa6, 0x91, 0x6f, 0xab, 0x78,
-	0x85, 0x0b, 0x7e, 0x86, 0xae, 0xf9, 0x98, 0x58, 0xc5, 0x91, 0xa0, 0x68, 0x1f, 0xea, 0x5a, 0xae,
-	0x3f, 0xa5, 0xc1, 0x8b, 0x5c, 0xb5, 0x2d, 0xb9, 0x7e, 0x82, 0xee, 0xef, 0x29, 0x59, 0xb0, 0x59,
-	0xb9, 0x72, 0x4e, 0x9f, 0x52, 0xc6, 0x69, 0xe8, 0x5b, 0x87, 0xb6, 0xac, 0xce, 0x60, 0x19, 0x8b,
-	0x57, 0x09, 0x8b, 0x23, 0xb2, 0xf0, 0x6b, 0x3a, 0x66, 0x70, 0x70, 0x06, 0xbb, 0x45, 0xa6, 0x75,
-	0x59, 0x94, 0xf3, 0x98, 0x9b, 0xb2, 0x14, 0x90, 0xac, 0x60, 0x09, 0x15, 0x79, 0x06, 0x0d, 0x82,
-	0x37, 0x16, 0x74, 0x86, 0x34, 0x79, 0x78, 0x34, 0x75, 0x14, 0x32, 0xab, 0x24, 0x43, 0x47, 0xd0,
-	0x10, 0x09, 0xa7, 0x64, 0xa9, 0x5f, 0x6f, 0xf7, 0xbb, 0x27, 0x79, 0x4f, 0xae, 0x15, 0x8d, 0x4d,
-	0x18, 0x7d, 0x09, 0x4e, 0xc2, 0x96, 0x54, 0x39, 0xd8, 0xee, 0x23, 0x23, 0xbb, 0x61, 0x4b, 0x7a,
-	0x45, 0x38, 0x59, 0x0a, 0xac, 0xe2, 0x28, 0x80, 0xfa, 0x33, 0xa3, 0x99, 0xf0, 0x1d, 0x95, 0xaf,
-	0x63, 0x84, 0xb7, 0x8c, 0x66, 0x58, 0x87, 0xd0, 0x29, 0x40, 0x48, 0x12, 0x32, 0xe4, 0x64, 0x49,
-	0x85, 0x5f, 0x57, 0xc2, 0x3d, 0x23, 0xbc, 0x30, 0x11, 0x5c, 0x12, 0x05, 0xff, 0x5b, 0xe0, 0xea,
-	0x92, 0x10, 0x02, 0xa7, 0x34, 0x07, 0xea, 0x19, 0x7d, 0x06, 0x10, 0xd2, 0x19, 0x8b, 0x98, 0x74,
-	0x2f, 0xef, 0x4c, 0x89, 0x91, 0x4e, 0xcb, 0x64, 0xb7, 0x84, 0x0b, 0xdf, 0xd5, 0x4e, 0x1b, 0x2c,
-	0x9d, 0x49, 0x53, 0x16, 0x0a, 0xdf, 0xd6, 0xce, 0x28, 0x80, 0x4e, 0xa1, 0x4d, 0xe6, 0x73, 0x4e,
-	0xe7, 0x44, 0xa5, 0x74, 0x0e, 0xad, 0xa3, 0x6e, 0x7f, 0xd7, 0x14, 0x39, 0x98, 0xcf, 0x87, 0x69,
-	0xf4, 0x80, 0xcb, 0x1a, 0x95, 0x28, 0x62, 0x89, 0x3c, 0x91, 0xea, 0x8f, 0x02, 0xc1, 0x7f, 0x35,
-	0xd8, 0xc9, 0x3b, 0xf1, 0xde, 0x3e, 0x22, 0x70, 0x64, 0x4f, 0xf2, 0xe2, 0xd5, 0xb3, 0xe4, 0xa4,
-	0x63, 0x7e, 0x4b, 0x73, 0xf2, 0x19, 0x7d, 0x0a, 0xad, 0xc2, 0x17, 0x1f, 0x54, 0x60, 0x4d, 0xc8,
-	0x83, 0x3e, 0x13, 0xce, 0xc8, 0xfd, 0x82, 0xe6, 0xc3, 0x5e, 0x60, 0x69, 0x12, 0x0b, 0x69, 0x94,
-	0xb0, 0x19, 0xa3, 0x5c, 0x9d, 0xa8, 0x85, 0x4b, 0x8c, 0x1a, 0x7b, 0x66, 0x3a, 0x62, 0x63, 0x0d,
-	0xd0, 0x01, 0xb8, 0xcf, 0x64, 0x91, 0x52, 0x6d, 0x9c, 0x85, 0x73, 0x24, 0xeb, 0x30, 0x99, 0x85,
-	0xdf, 0x50, 0xd6, 0xad, 0x09, 0xf4, 0x39, 0x38, 0x3c, 0xce, 0x84, 0xdf, 0x54, 0xcd, 0x6d, 0x1b,
-	0xdf, 0x70, 0x9c, 0x61, 0x15, 0x08, 0x8e, 0xc1, 0xc6, 0x71, 0x86, 0xbe, 0x28, 0xb2, 0x5b, 0x55,
-	0xe5, 0x14, 0x8f, 0xcc, 0xa7, 0x82, 0x6f, 0xc1, 0x9e, 0xe2, 0x91, 0xfc, 0xa2, 0x6c, 0xb6, 0x58,
-	0x91, 0x07, 0xd3, 0xfd, 0x35, 0x21, 0xab, 0x57, 0xf2, 0xdc, 0x40, 0x0d, 0x82, 0x19, 0xc0, 0x7a,
-	0x44, 0xd5, 0x12, 0x24, 0x84, 0x27, 0xc6, 0x79, 0x05, 0x90, 0x07, 0x36, 0x8d, 0xcc, 0xbf, 0x43,
-	0x3e, 0xca, 0x33, 0x67, 0x2c, 0x0a, 0xe3, 0x2c, 0xf7, 0x30, 0x47, 0xc8, 0x87, 0x06, 0x59, 0xb0,
-	0x79, 0x44, 0x43, 0x65, 0x5f, 0x13, 0x1b, 0x18, 0x5c, 0x81, 0x23, 0x27, 0x7c, 0xeb, 0x70, 0x6e,
-	0xdd, 0xd0, 0x8d, 0x91, 0xb5, 0x37, 0x47, 0x36, 0x78, 0x6d, 0x41, 0xab, 0xd8, 0x85, 0xad, 0x79,
-	0x37, 0x46, 0xb4, 0xf6, 0x01, 0x23, 0xfa, 0xae, 0x83, 0x21, 0x70, 0xe4, 0xb4, 0xe6, 0x43, 0xa1,
-	0x9e, 0x51, 0x1f, 0x40, 0x4d, 0x00, 0xe5, 0xac, 0xd8, 0xd2, 0xca, 0xde, 0xeb, 0x08, 0x2e, 0xa9,
-	0xd6, 0xbb, 0xe4, 0x96, 0x76, 0x29, 0xf8, 0x5e, 0x37, 0x21, 0xd7, 0x98, 0xa1, 0xb6, 0x4a, 0x43,
-	0x5d, 0xde, 0xcf, 0x5a, 0x75, 0x3f, 0x8f, 0xff, 0xb5, 0xa0, 0x91, 0x1f, 0x06, 0xed, 0x83, 0x37,
-	0xb8, 0xbc, 0xbc, 0x1b, 0x4e, 0x27, 0xe7, 0x77, 0xa3, 0xc9, 0xed, 0xe0, 0xd7, 0xd1, 0x85, 0xf7,
-	0x11, 0xf2, 0xa0, 0x53, 0xb0, 0x78, 0xf0, 0x87, 0x67, 0xa1, 0x3d, 0xd8, 0x29, 0x98, 0xf1, 0x8f,
-	0x83, 0x89, 0x57, 0xab, 0x88, 0xc6, 0xa3, 0x89, 0x67, 0x57, 0x99, 0xc1, 0x9f, 0x9e, 0x83, 0x10,
-	0x74, 0x0b, 0xe6, 0xfc, 0xb7, 0xe9, 0xe4, 0xc6, 0xab, 0x57, 0x54, 0xd7, 0xd3, 0xb1, 0xe7, 0xf6,
-	0x5f, 0x59, 0xe0, 0x8e, 0x95, 0x0d, 0xe8, 0x0c, 0x5a, 0xc5, 0x5d, 0x85, 0x7c, 0x63, 0xce, 0xe6,
-	0xf5, 0xd5, 0x3b, 0x28, 0x9a, 0x52, 0xbd, 0x68, 0xbe, 0x83, 0x46, 0xfe, 0x93, 0x47, 0x85, 0xa4,
-	0x7a, 0x7f, 0xf4, 0x3e, 0x79, 0xc1, 0xe7, 0xef, 0x7e, 0x03, 0x75, 0xf5, 0x5b, 0x41, 0xfb, 0x46,
-	0x51, 0xfe, 0xdf, 0xf7, 0x3e, 0xde, 0x60, 0xf5, 0x5b, 0x5f, 0x59, 0x3f, 0xc0, 0x5f, 0x4d, 0x1d,
-	0x59, 0xdd, 0xdf, 0xbb, 0xea, 0xe6, 0xfd, 0xfa, 0x6d, 0x00, 0x00, 0x00, 0xff, 0xff, 0xd1, 0xf0,
-	0x82, 0xbe, 0x89, 0x07, 0x00, 0x00,
+	// 2178 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xbc, 0x38, 0xcb, 0x6e, 0x1b, 0xd7,
+	0xd9, 0x1e, 0x8e, 0x78, 0xfb, 0x48, 0xd1, 0xe3, 0x63, 0x5b, 0x9e, 0x28, 0xfe, 0x1d, 0xfd, 0xd3,
+	0xc0, 0x10, 0x54, 0xc7, 0x70, 0x14, 0x20, 0x70, 0x9a, 0xa6, 0x00, 0x2d, 0x0d, 0x6d, 0xba, 0xe2,
+	0xc5, 0x67, 0x48, 0x25, 0x29, 0x0a, 0x10, 0x43, 0xf1, 0x90, 0x9e, 0x84, 0x9c, 0xa1, 0xcf, 0x0c,
+	0x4d, 0xab, 0xeb, 0x06, 0x68, 0xbb, 0xe8, 0x2e, 0x40, 0xdf, 0xa4, 0xab, 0x6e, 0xba, 0xec, 0x13,
+	0xf4, 0x31, 0xfa, 0x08, 0xc5, 0xb9, 0xcd, 0x8d, 0x94, 0xad, 0x55, 0x77, 0xe7, 0xbb, 0xcc, 0x39,
+	0xdf, 0xfd, 0x32, 0x50, 0x5f, 0x04, 0x34, 0x72, 0xe9, 0xe3, 0x25, 0x0d, 0xa2, 0x00, 0x95, 0x04,
+	0x64, 0xf9, 0x60, 0x3c, 0x27, 0x51, 0xb3, 0xdf, 0xfe, 0x2d, 0xb9, 0xc4, 0xe4, 0xcd, 0x8a, 0x84,
+	0x11, 0xda, 0x87, 0xca, 0x2a, 0x24, 0xd4, 0x77, 0x17, 0xc4, 0xd4, 0x0e, 0xb4, 0xc3, 0x2a, 0x8e,
+	0x61, 0x46, 0x5b, 0xba, 0x61, 0xb8, 0x0e, 0xe8, 0xc4, 0x2c, 0x08, 0x9a, 0x82, 0x91, 0x05, 0x75,
+	0x4a, 0xa6, 0x94, 0x84, 0xaf, 0xa3, 0xe0, 0x47, 0xe2, 0x9b, 0x3a, 0xa7, 0x67, 0x70, 0xd6, 0x4b,
+	0x68, 0xa8, 0xc7, 0xc2, 0x65, 0xe0, 0x87, 0x04, 0xdd, 0x81, 0xa2, 0x60, 0x17, 0x4f, 0x09, 0x60,
+	0xe3, 0xae, 0xc2, 0x96, 0xbb, 0x5e, 0x40, 0xe3, 0xd5, 0xca, 0x9d, 0x7b, 0xd3, 0xb4, 0xe4, 0x94,
+	0xbc, 0x59, 0x79, 0x94, 0x4c, 0x4c, 0xed, 0x40, 0x67, 0xd2, 0x29, 0x98, 0xd1, 0x82, 0x65, 0xe4,
+	0x05, 0xbe, 0x3b, 0x37, 0x0b, 0x82, 0xa6, 0x60, 0xeb, 0x1b, 0xb8, 0x19, 0xdf, 0x94, 0x88, 0x45,
+	0x28, 0x0d, 0xa8, 0x12, 0x8b, 0x03, 0x0c, 0x1b, 0x7a, 0x11, 0x09, 0xe5, 0x0d, 0x02, 0xb0, 0xfe,
+	0x55, 0x80, 0x7a, 0x8b, 0x44, 0x17, 0xaf, 0x95, 0x1c, 0x31, 0x9b, 0x96, 0x62, 0x43, 0x87, 0x50,
+	0x0e, 0x23, 0x4a, 0xdc, 0x85, 0xf8, 0xbc, 0x76, 0xdc, 0x78, 0x2c, 0x7d, 0xe2, 0x70, 0x34, 0x56,
+	0x64, 0xf4, 0x10, 0x76, 0x22, 0x6f, 0x41, 0xb8, 0x05, 0x6b, 0xc7, 0x48, 0xb1, 0x0d, 0xbc, 0x05,
+	0xe9, 0xbb, 0xd4, 0x5d, 0x84, 0x98, 0xd3, 0x91, 0x05, 0xc5, 0xb7, 0x1e, 0x59, 0x87, 0xe6, 0x0e,
+	0xbf, 0xaf, 0xae, 0x18, 0xcf, 0x3d, 0xb2, 0xc6, 0x82, 0x84, 0x3e, 0x07, 0x98, 0xb8, 0x91, 0xdb,
+	0xa2, 0xee, 0x82, 0x84, 0x66, 0x91, 0x33, 0xde, 0x52, 0x8c, 0xa7, 0x8a, 0x82, 0x53, 0x4c, 0xe8,
+	0x3e, 0x54, 0x29, 0x09, 0x57, 0x0b, 0x77, 0x3c, 0x27, 0x66, 0xe9, 0x40, 0x3b, 0xac, 0xe0, 0x04,
+	0x81, 0x0e, 0xa0, 0xc6, 0x01, 0x32, 0xe0, 0x9e, 0x29, 0x73, 0xfb, 0xa4, 0x51, 0xe8, 0x6b, 0xd8,
+	0x9d, 0xba, 0xde, 0x7c, 0x45, 0x49, 0x3f, 0x98, 0x7b, 0x17, 0x97, 0x66, 0xe5, 0x40, 0x3b, 0x6c,
+	0x1c, 0xdf, 0x55, 0xaf, 0xb6, 0xd2, 0x44, 0x9c, 0xe5, 0xb5, 0xfe, 0xa2, 0x49, 0x63, 0x4a, 0x2e,
+	0x84, 0x60, 0x87, 0xd9, 0x4f, 0x3a, 0x82, 0x9f, 0x19, 0x8e, 0x69, 0x27, 0xc3, 0x82, 0x9f, 0x99,
+	0xd4, 0xb1, 0x0e, 0x32, 0xf6, 0x12, 0x04, 0x7a, 0x00, 0xe0, 0x4d, 0x88, 0x1f, 0x79, 0x53, 0x8f,
+	0x50, 0x73, 0x87, 0x93, 0x53, 0x98, 0xc4, 0xdf, 0xc5, 0x94, 0xbf, 0xad, 0x7f, 0x2a, 0xcf, 0x3a,
+	0xab, 0xc5, 0xc2, 0xa5, 0x97, 0xe8, 0x09, 0x54, 0xa4, 0xb8, 0xc2, 0xb9, 0xb5, 0xe3, 0x3b, 0xb1,
+	0x56, 0x29, 0xa1, 0x71, 0xcc, 0xc5, 0x22, 0x99, 0xbb, 0xff, 0xd5, 0x8a, 0x50, 0x8f, 0x88, 0xac,
+	0xd1, 0x71, 0x06, 0x87, 0x1e, 0x41, 0x85, 0xa9, 0x80, 0x83, 0x75, 0x68, 0xea, 0xfc, 0x56, 0x23,
+	0xe3, 0xca, 0x60, 0x1d, 0xe2, 0x98, 0x03, 0x3d, 0xcd, 0x78, 0x54, 0xb8, 0xde, 0xdc, 0xf0, 0xa8,
+	0x94, 0x38, 0xe3, 0x58, 0x0b, 0xea, 0x63, 0xea, 0x5d, 0xfc, 0xe8, 0x90, 0x8b, 0xc0, 0x9f, 0x84,
+	0x5c, 0x57, 0x0d, 0x67, 0x70, 0xe8, 0x11, 0xdc, 0x62, 0xb1, 0x15, 0x32, 0xc9, 0x42, 0xc5, 0x58,
+	0xe2, 0x8c, 0x9b, 0x84, 0xf8, 0xc6, 0x73, 0x42, 0x43, 0x2f, 0x10, 0xd1, 0xa0, 0xe3, 0x0c, 0xce,
+	0x6a, 0x41, 0x45, 0x69, 0x71, 0x6d, 0x67, 0x22, 0xd8, 0xa1, 0xc2, 0x1a, 0xec, 0x3e, 0x7e, 0xb6,
+	0xfe, 0xa4, 0x81, 0x91, 0x57, 0x8f, 0x31, 0xa6, 0x0a, 0x15, 0x3f, 0xa3, 0x4f, 0x61, 0x77, 0xb5,
+	0xf2, 0x26, 0x21, 0x26, 0x61, 0x30, 0x7f, 0x1b, 0xdb, 0x3c, 0x8b, 0x64, 0xa2, 0x73, 0x44, 0xc7,
+	0x0b, 0x43, 0xcf, 0x9f, 0xc9, 0xa7, 0x32, 0x38, 0xb4, 0x07, 0xa5, 0x65, 0xe0, 0xf9, 0x51, 0xc8,
+	0x23, 0x46, 0xc7, 0x12, 0xb2, 0x7e, 0xd6, 0xc0, 0x70, 0x56, 0xe3, 0xf0, 0x82, 0x7a, 0x63, 0xf2,
+	0xfe, 0xac, 0x8f, 0x73, 0xb4, 0x70, 0xdd, 0x1c, 0xd5, 0xaf, 0x93, 0xa3, 0xec, 0xb1, 0xc8, 0xa5,
+	0x91, 0x0c, 0x65, 0x01, 0x58, 0x7f, 0xd7, 0xa0, 0x24, 0x8a, 0xc9, 0x56, 0xc3, 0x3c, 0x00, 0x98,
+	0x90, 0xa9, 0xe7, 0x7b, 0xac, 0xee, 0x49, 0x7b, 0xa7, 0x30, 0xac, 0x46, 0xb2, 0x27, 0xce, 0x5d,
+	0xca, 0x5c, 0xce, 0x6b, 0xa4, 0x82, 0xd9, 0x83, 0xdc, 0x34, 0x5c, 0xbc, 0x2a, 0x16, 0x00, 0xfa,
+	0x1c, 0x6a, 0xee, 0x6c, 0x46, 0xc9, 0xcc, 0xe5, 0x57, 0xee, 0xf0, 0x44, 0xbf, 0xa9, 0x44, 0x6f,
+	0xce, 0x66, 0xad, 0x95, 0x7f, 0x81, 0xd3, 0x3c, 0xfc, 0x22, 0xdf, 0x8b, 0x42, 0x95, 0x69, 0x1c,
+	0xb0, 0x7e, 0xd6, 0x61, 0x57, 0xd6, 0xd0, 0xf7, 0x56, 0x60, 0x15, 0x40, 0x85, 0x2d, 0x01, 0x54,
+	0xbd, 0xaa, 0x1a, 0x40, 0xbe, 0x1a, 0xec, 0x43, 0xe5, 0xad, 0x4b, 0x3d, 0x5e, 0xe0, 0x44, 0xa9,
+	0x88, 0xe1, 0xeb, 0x54, 0x8a, 0xc8, 0x53, 0xb5, 0x54, 0xc7, 0x02, 0x60, 0x91, 0xf2, 0xd6, 0x9d,
+	0xaf, 0x88, 0x30, 0x9c, 0x86, 0x25, 0xc4, 0xe4, 0x50, 0x37, 0x87, 0x66, 0x99, 0x9b, 0x2e, 0x41,
+	0xa0, 0x4f, 0x64, 0x98, 0x57, 0xb8, 0xcb, 0x6b, 0xca, 0x6e, 0x38, 0x58, 0x8b, 0x98, 0x47, 0x9f,
+	0x41, 0xf9, 0x0d, 0xeb, 0x4c, 0xd1, 0xa5, 0x59, 0x3b, 0xd0, 0x0f, 0x1b, 0xc7, 0xb7, 0xd3, 0x61,
+	0xf1, 0x4a, 0x90, 0xb0, 0xe2, 0xc9, 0xd7, 0xe6, 0xfa, 0x66, 0x6d, 0x7e, 0x0c, 0xe5, 0x50, 0xa4,
+	0x8e, 0xb9, 0x7b, 0xa0, 0x6d, 0xd4, 0x2f, 0x55, 0x35, 0x14, 0x93, 0xe5, 0xc1, 0x6e, 0x93, 0xd2,
+	0x60, 0xfd, 0x61, 0xb7, 0x30, 0xeb, 0x72, 0xb7, 0xd4, 0x31, 0x3f, 0xa7, 0x9f, 0xd2, 0xaf, 0xf9,
+	0x94, 0xfd, 0x6e, 0x19, 0xd0, 0x48, 0x25, 0xd4, 0x11, 0x14, 0xa7, 0x8c, 0xd3, 0xd4, 0xb6, 0x7c,
+	0x2e, 0x99, 0xb0, 0x60, 0x41, 0x8f, 0xa0, 0x34, 0x0d, 0xe8, 0xc2, 0x8d, 0xb8, 0x08, 0x8d, 0x84,
+	0x59, 0x5c, 0xd9, 0xe2, 0x34, 0x2c, 0x79, 0xac, 0x2e, 0x34, 0xd4, 0x53, 0x1f, 0x52, 0x6b, 0xea,
+	0xcd, 0xe3, 0x68, 0x63, 0xe7, 0x58, 0x55, 0x3d, 0x51, 0xd5, 0xfa, 0x49, 0x87, 0x0a, 0x97, 0xea,
+	0x65, 0x30, 0x46, 0x0d, 0x28, 0x78, 0x13, 0x79, 0x4f, 0xc1, 0x9b, 0xa0, 0x5f, 0xf2, 0x54, 0x95,
+	0x31, 0x9b, 0x6e, 0x83, 0xf2, 0x03, 0x87, 0x11, 0xb1, 0xe0, 0x49, 0xe4, 0xd0, 0xd3, 0x72, 0xdc,
+	0x87, 0x6a, 0xb8, 0x1a, 0x2f, 0xbc, 0x28, 0x22, 0x13, 0x19, 0x92, 0x09, 0x82, 0x45, 0x33, 0x4b,
+	0xe1, 0xf0, 0x35, 0x99, 0xc8, 0xa4, 0x8a, 0x61, 0x64, 0x42, 0x99, 0xbc, 0x5b, 0x7a, 0x94, 0x88,
+	0x22, 0x5e, 0xc5, 0x0a, 0x64, 0x71, 0xce, 0x73, 0x78, 0x10, 0x44, 0xee, 0x5c, 0x16, 0xee, 0x14,
+	0x06, 0x3d, 0x84, 0x06, 0x87, 0x4e, 0x82, 0xc5, 0x72, 0x4e, 0xd8, 0xc3, 0x15, 0xce, 0x93, 0xc3,
+	0x32, 0x3e, 0x51, 0x15, 0x31, 0x89, 0x56, 0xd4, 0x27, 0x13, 0x9e, 0x87, 0x3a, 0xce, 0x61, 0xe5,
+	0x54, 0xc1, 0xad, 0x1d, 0xf2, 0x8c, 0xd4, 0x71, 0x82, 0x60, 0x7a, 0x07, 0x6b, 0x9f, 0x50, 0xb3,
+	0x26, 0xf4, 0xe6, 0x40, 0x3a, 0x84, 0xea, 0xd7, 0x09, 0xa1, 0xff, 0x87, 0x9b, 0xca, 0xaa, 0x2a,
+	0x88, 0x72, 0xde, 0xb0, 0xc6, 0xb0, 0x97, 0xb0, 0x84, 0xab, 0x79, 0x14, 0x5e, 0xc1, 0xc9, 0x04,
+	0x5e, 0xba, 0x33, 0x99, 0x4a, 0x22, 0x02, 0x12, 0x84, 0x98, 0x84, 0x67, 0xc4, 0xf1, 0xfe, 0x20,
+	0x4a, 0x48, 0x11, 0xc7, 0xb0, 0xf5, 0x37, 0x0d, 0xee, 0x6d, 0x3c, 0x22, 0x03, 0xed, 0x8b, 0xb4,
+	0x19, 0xc4, 0x08, 0x71, 0x37, 0x17, 0xd8, 0x82, 0x9a, 0xb6, 0xce, 0xa7, 0xb0, 0xeb, 0x93, 0x77,
+	0x51, 0x3f, 0x27, 0x4e, 0x16, 0x89, 0x2c, 0xd0, 0x7f, 0x08, 0xc6, 0x32, 0xd9, 0x8c, 0x7c, 0x98,
+	0x61, 0x46, 0xb4, 0xfe, 0xa1, 0x43, 0xad, 0xb9, 0x9a, 0x78, 0x11, 0x26, 0x17, 0x6c, 0x68, 0x47,
+	0x72, 0xd4, 0x94, 0x6d, 0x82, 0x9d, 0x91, 0x01, 0x3a, 0x5d, 0x5e, 0xc8, 0x37, 0xd8, 0x91, 0x29,
+	0x2b, 0x2a, 0x60, 0x74, 0xa9, 0xea, 0xa5, 0x82, 0xd9, 0x0d, 0x4b, 0x12, 0x57, 0x4a, 0x7e, 0x4e,
+	0x5a, 0x61, 0x31, 0xdd, 0x0a, 0xef, 0xa8, 0x56, 0x28, 0x7a, 0x8b, 0x00, 0xd0, 0x97, 0x99, 0xe6,
+	0x57, 0xe6, 0x16, 0xd9, 0x8b, 0x3b, 0x08, 0x13, 0x75, 0x7b, 0x07, 0x34, 0x59, 0x69, 0xe4, 0xc3,
+	0x08, 0x2f, 0x9f, 0x55, 0xac, 0xc0, 0xa4, 0x37, 0x56, 0x53, 0xbd, 0x91, 0x69, 0x45, 0xfc, 0x89,
+	0xec, 0x05, 0xec, 0x98, 0x8d, 0xc8, 0x5a, 0x3e, 0x22, 0x93, 0xde, 0x5f, 0x4f, 0xf7, 0x7e, 0x76,
+	0xfb, 0xf8, 0x92, 0xe9, 0xb6, 0xcb, 0xd1, 0x02, 0x60, 0x59, 0xc0, 0x8b, 0xf0, 0xd4, 0x23, 0x13,
+	0x87, 0xab, 0xde, 0x10, 0x59, 0x90, 0xc5, 0xa2, 0x43, 0xb8, 0x39, 0x59, 0x51, 0xde, 0x09, 0xd5,
+	0x70, 0x75, 0x93, 0x0f, 0x57, 0x79, 0x74, 0x52, 0x09, 0x8c, 0xf4, 0x44, 0xfa, 0x93, 0x06, 0x8d,
+	0xac, 0x51, 0xb6, 0x76, 0xfa, 0x5c, 0x5f, 0x2e, 0x5c, 0xa3, 0x2f, 0xef, 0x41, 0x69, 0xed, 0xf9,
+	0x93, 0x60, 0x2d, 0x3d, 0x2c, 0xa1, 0xa4, 0xf1, 0x8b, 0x11, 0x48, 0x00, 0xd6, 0xbf, 0x35, 0x40,
+	0x5c, 0x0e, 0x87, 0xb8, 0x34, 0xbb, 0xf9, 0x70, 0xd3, 0x6b, 0x5b, 0x4c, 0x5f, 0x48, 0x4c, 0xff,
+	0x81, 0x80, 0xe2, 0x2d, 0x7e, 0x27, 0xd5, 0xe2, 0x65, 0x48, 0x16, 0x93, 0x90, 0x7c, 0x00, 0xc0,
+	0x2d, 0x12, 0xf6, 0xfc, 0xf9, 0xa5, 0xdc, 0x52, 0x52, 0x98, 0x6c, 0xf6, 0x96, 0xdf, 0x97, 0xbd,
+	0x95, 0x5c, 0xf6, 0xfe, 0x00, 0xb7, 0x33, 0x9a, 0xc9, 0xc4, 0xfd, 0x0c, 0xca, 0x94, 0xe7, 0x8c,
+	0x4a, 0xdb, 0xdb, 0x99, 0x20, 0x15, 0xf9, 0x84, 0x15, 0xcf, 0xf5, 0x52, 0xd6, 0x3a, 0x02, 0x1d,
+	0x07, 0x6b, 0xf4, 0x8b, 0x78, 0x7a, 0xd0, 0xb2, 0x93, 0xc0, 0x10, 0xb7, 0xd5, 0x28, 0x61, 0x7d,
+	0x05, 0xfa, 0x10, 0xb7, 0x99, 0x62, 0xcc, 0xc5, 0xe1, 0xd2, 0xbd, 0x50, 0x3e, 0x4f, 0x10, 0x3c,
+	0xc7, 0x18, 0xbb, 0x7c, 0x4e, 0x00, 0xd6, 0x14, 0x20, 0x59, 0x1e, 0xaf, 0xed, 0xa4, 0xab, 0x22,
+	0xc2, 0x84, 0xb2, 0x3b, 0xf7, 0x66, 0xbe, 0xec, 0x45, 0x15, 0xac, 0x40, 0x8b, 0x02, 0xb4, 0xbc,
+	0xf9, 0x5c, 0xac, 0x72, 0xe8, 0x08, 0x4a, 0x0b, 0x12, 0xbd, 0x0e, 0x44, 0x51, 0x6d, 0x24, 0x8b,
+	0x2c, 0xe3, 0xe9, 0x70, 0x0a, 0x96, 0x1c, 0x6c, 0x1a, 0x5f, 0xb8, 0xef, 0x9c, 0xc8, 0x9d, 0x13,
+	0x9f, 0x84, 0xa1, 0x5a, 0xf8, 0xd3, 0xb8, 0x44, 0x37, 0x9d, 0x67, 0x8c, 0xd4, 0xad, 0x0f, 0x3b,
+	0xe7, 0x72, 0x65, 0xd8, 0x48, 0x83, 0xad, 0xfb, 0x7a, 0x6e, 0x0c, 0xd6, 0xf3, 0x63, 0xb0, 0xf5,
+	0x1f, 0x0d, 0xaa, 0xff, 0xb3, 0xf4, 0x42, 0xb0, 0xc3, 0x26, 0x60, 0x15, 0xed, 0xec, 0x8c, 0x8e,
+	0x01, 0x92, 0x55, 0x4b, 0xee, 0xec, 0x99, 0xbf, 0x00, 0x82, 0x82, 0x53, 0x5c, 0x49, 0x9a, 0x96,
+	0xd2, 0xf3, 0xf9, 0x43, 0x3e, 0xc0, 0x88, 0xf6, 0x5e, 0xcb, 0x3a, 0x40, 0xae, 0xdf, 0x9c, 0x6e,
+	0xfd, 0x5a, 0x04, 0x88, 0xbc, 0x4b, 0x0d, 0xd4, 0x5a, 0x6a, 0xa0, 0x4e, 0xef, 0x06, 0x85, 0xec,
+	0x6e, 0x70, 0xd4, 0x81, 0xdd, 0xcc, 0x4e, 0x8f, 0xee, 0x83, 0xd9, 0x6a, 0xb6, 0xcf, 0x86, 0xd8,
+	0x1e, 0xf5, 0x7b, 0x67, 0xed, 0x93, 0xef, 0x47, 0x0c, 0x1c, 0xb5, 0x9a, 0xce, 0xc0, 0xb8, 0x81,
+	0x1e, 0xc0, 0x7e, 0x8e, 0xfa, 0xcc, 0x76, 0x06, 0x23, 0xbb, 0xd5, 0xea, 0xe1, 0x81, 0xa1, 0x1d,
+	0xb9, 0x50, 0x4f, 0x4f, 0x6d, 0x68, 0x1f, 0xf6, 0xec, 0xef, 0xfa, 0x3d, 0x3c, 0x18, 0xb5, 0x7a,
+	0xb8, 0xd3, 0x1c, 0x8c, 0x4e, 0x9c, 0xf3, 0xd1, 0x59, 0xaf, 0xfb, 0xdc, 0xb8, 0xb1, 0x9d, 0xf6,
+	0x6d, 0xfb, 0xd4, 0x36, 0x34, 0xf4, 0x11, 0xdc, 0xcd, 0xd2, 0xfa, 0x4d, 0xfc, 0x6a, 0x68, 0x0f,
+	0x8c, 0xc2, 0xd1, 0x1f, 0x35, 0xd8, 0xcd, 0xcc, 0x5f, 0xe8, 0x63, 0xb8, 0xd7, 0xb2, 0x07, 0x27,
+	0x2f, 0x46, 0x2f, 0x7b, 0xcf, 0x46, 0xce, 0xa0, 0x39, 0xb0, 0x47, 0x7d, 0xbb, 0x7b, 0xda, 0xe6,
+	0xaf, 0x6c, 0x21, 0xe2, 0x61, 0xb7, 0xcb, 0x88, 0x1a, 0xfa, 0x3f, 0xf8, 0x28, 0x4f, 0x3c, 0xe9,
+	0x75, 0xfa, 0x67, 0xf6, 0xc0, 0x3e, 0x35, 0x0a, 0x4c, 0xc2, 0x3c, 0x99, 0x69, 0x6f, 0x9f, 0x1a,
+	0xfa, 0xd1, 0x5f, 0x35, 0x28, 0xcb, 0x68, 0x41, 0x77, 0xc0, 0x68, 0x3e, 0x7f, 0x3e, 0x6a, 0x0d,
+	0xbb, 0x27, 0xa3, 0x76, 0xf7, 0xbc, 0x79, 0xd6, 0x3e, 0x35, 0x6e, 0x20, 0x03, 0xea, 0x31, 0x16,
+	0x37, 0xbf, 0x35, 0x34, 0x74, 0x0b, 0x76, 0x63, 0x4c, 0xc7, 0x6e, 0x76, 0x8d, 0x42, 0x86, 0xa9,
+	0xd3, 0xee, 0x1a, 0x7a, 0x16, 0xd3, 0xfc, 0xce, 0xd8, 0x41, 0x08, 0x1a, 0x31, 0xe6, 0xa4, 0x37,
+	0xec, 0x0e, 0x8c, 0x62, 0x86, 0xcb, 0x19, 0x76, 0x8c, 0xd2, 0x91, 0x0f, 0x90, 0x24, 0x27, 0x13,
+	0xa9, 0xd5, 0x3e, 0x3b, 0x1b, 0x75, 0xec, 0xc1, 0x8b, 0xde, 0xe9, 0xa8, 0xdb, 0xeb, 0xda, 0xc6,
+	0x0d, 0x64, 0xc2, 0x9d, 0x34, 0xb6, 0x8f, 0xed, 0xf3, 0x76, 0x6f, 0xe8, 0x18, 0x1a, 0xda, 0x03,
+	0x94, 0xa6, 0x9c, 0xb5, 0xbb, 0x76, 0x13, 0x1b, 0x85, 0xfc, 0x17, 0x27, 0xbd, 0xae, 0x33, 0x68,
+	0x76, 0x07, 0x86, 0x7e, 0xf4, 0x7b, 0xa8, 0xa5, 0x16, 0x19, 0xe6, 0xb1, 0xd3, 0xe6, 0xa0, 0x39,
+	0x7a, 0x35, 0x6c, 0x9e, 0xb5, 0x07, 0xdf, 0x8f, 0x7a, 0xcf, 0x1c, 0x1b, 0x9f, 0xdb, 0xa7, 0xe2,
+	0xd5, 0x0c, 0xa9, 0xdd, 0xe9, 0x0f, 0x99, 0x81, 0xb5, 0x0d, 0x4a, 0xa7, 0xed, 0x38, 0xcc, 0x33,
+	0x85, 0xe3, 0x3f, 0x17, 0xa1, 0xd4, 0xe1, 0x11, 0x8f, 0xbe, 0x81, 0x6a, 0xfc, 0xa3, 0x13, 0xc5,
+	0x7f, 0x4b, 0xf2, 0xff, 0x3e, 0xf7, 0x93, 0xc1, 0x23, 0xfb, 0x97, 0xf2, 0x57, 0x50, 0x96, 0x7f,
+	0x08, 0x51, 0xcc, 0x92, 0xfd, 0xf9, 0xb8, 0x7f, 0x6f, 0x03, 0x2f, 0xbf, 0xfd, 0x12, 0x8a, 0x3c,
+	0xd4, 0xd0, 0xd6, 0x05, 0x66, 0x7f, 0xfb, 0xf4, 0xf7, 0x44, 0x43, 0x5f, 0x03, 0x70, 0x14, 0xdf,
+	0xbf, 0x3e, 0xf4, 0x71, 0x66, 0x49, 0x7b, 0xa2, 0xa1, 0xaf, 0xa0, 0x24, 0x72, 0x08, 0xdd, 0xcd,
+	0x6e, 0x42, 0x1b, 0x9a, 0x66, 0x17, 0xa1, 0x27, 0x1a, 0x7a, 0x0a, 0x0d, 0x87, 0xef, 0x16, 0xf1,
+	0x46, 0xb3, 0xfd, 0xed, 0x8d, 0x09, 0x13, 0x3d, 0x85, 0xda, 0x73, 0x92, 0x7c, 0x76, 0x2f, 0xcf,
+	0x70, 0xf5, 0x97, 0x43, 0x40, 0xa9, 0x2f, 0xe5, 0xcc, 0x8c, 0x1e, 0x6c, 0x5e, 0x90, 0x9e, 0xd8,
+	0xf7, 0x3f, 0xb9, 0x92, 0x2e, 0x4d, 0xff, 0x1b, 0xa8, 0xc6, 0xbf, 0x69, 0x12, 0xaf, 0xe7, 0xff,
+	0xdc, 0x5c, 0xed, 0x82, 0x36, 0x34, 0xc4, 0x14, 0xc0, 0x5b, 0xfc, 0x59, 0x30, 0x43, 0xfb, 0x99,
+	0xa6, 0x9f, 0x19, 0x7e, 0xf6, 0x3f, 0xde, 0x4a, 0x13, 0x97, 0x3d, 0x83, 0xdf, 0x55, 0x04, 0x75,
+	0x39, 0x1e, 0x97, 0xf8, 0x4f, 0xf8, 0x2f, 0xfe, 0x3b, 0x00, 0xfa, 0xb8, 0x67, 0xc9, 0x94, 0x17,
+	0x00, 0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -978,6 +2576,22 @@ type MortarClient interface {
 	Qualify(ctx context.Context, in *QualifyRequest, opts ...grpc.CallOption) (*QualifyResponse, error)
 	// pull data from Mortar
 	Fetch(ctx context.Context, in *FetchRequest, opts ...grpc.CallOption) (Mortar_FetchClient, error)
+	// pull data from Mortar as an Arrow IPC stream
+	FetchArrow(ctx context.Context, in *FetchRequest, opts ...grpc.CallOption) (Mortar_FetchArrowClient, error)
+	// pull data from Mortar as CSV or Parquet files
+	Export(ctx context.Context, in *ExportRequest, opts ...grpc.CallOption) (Mortar_ExportClient, error)
+	// run a Fetch in the background; the results are kept on the server
+	// and downloaded with GetFetchJobResults
+	SubmitFetchJob(ctx context.Context, in *FetchRequest, opts ...grpc.CallOption) (*FetchJob, error)
+	// status and progress of a job
+	GetFetchJob(ctx context.Context, in *FetchJobRequest, opts ...grpc.CallOption) (*FetchJob, error)
+	// download a page of the results of a job
+	GetFetchJobResults(ctx context.Context, in *FetchJobResultsRequest, opts ...grpc.CallOption) (*FetchJobResultsResponse, error)
+	// resolve the views once, then stream new data for the UUIDs they matched
+	// as it is written
+	Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Mortar_SubscribeClient, error)
+	// search the audit log of queries; only for the admins of the audit log
+	SearchAuditLog(ctx context.Context, in *AuditSearchRequest, opts ...grpc.CallOption) (*AuditSearchResponse, error)
 }
 
 type mortarClient struct {
@@ -1038,6 +2652,138 @@ func (x *mortarFetchClient) Recv() (*FetchResponse, error) {
 	return m, nil
 }
 
+func (c *mortarClient) FetchArrow(ctx context.Context, in *FetchRequest, opts ...grpc.CallOption) (Mortar_FetchArrowClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Mortar_serviceDesc.Streams[1], "/mortar.Mortar/FetchArrow", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &mortarFetchArrowClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Mortar_FetchArrowClient interface {
+	Recv() (*ArrowResponse, error)
+	grpc.ClientStream
+}
+
+type mortarFetchArrowClient struct {
+	grpc.ClientStream
+}
+
+func (x *mortarFetchArrowClient) Recv() (*ArrowResponse, error) {
+	m := new(ArrowResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *mortarClient) Export(ctx context.Context, in *ExportRequest, opts ...grpc.CallOption) (Mortar_ExportClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Mortar_serviceDesc.Streams[2], "/mortar.Mortar/Export", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &mortarExportClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Mortar_ExportClient interface {
+	Recv() (*ExportResponse, error)
+	grpc.ClientStream
+}
+
+type mortarExportClient struct {
+	grpc.ClientStream
+}
+
+func (x *mortarExportClient) Recv() (*ExportResponse, error) {
+	m := new(ExportResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *mortarClient) SubmitFetchJob(ctx context.Context, in *FetchRequest, opts ...grpc.CallOption) (*FetchJob, error) {
+	out := new(FetchJob)
+	err := c.cc.Invoke(ctx, "/mortar.Mortar/SubmitFetchJob", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mortarClient) GetFetchJob(ctx context.Context, in *FetchJobRequest, opts ...grpc.CallOption) (*FetchJob, error) {
+	out := new(FetchJob)
+	err := c.cc.Invoke(ctx, "/mortar.Mortar/GetFetchJob", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mortarClient) GetFetchJobResults(ctx context.Context, in *FetchJobResultsRequest, opts ...grpc.CallOption) (*FetchJobResultsResponse, error) {
+	out := new(FetchJobResultsResponse)
+	err := c.cc.Invoke(ctx, "/mortar.Mortar/GetFetchJobResults", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mortarClient) Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Mortar_SubscribeClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Mortar_serviceDesc.Streams[3], "/mortar.Mortar/Subscribe", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &mortarSubscribeClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Mortar_SubscribeClient interface {
+	Recv() (*FetchResponse, error)
+	grpc.ClientStream
+}
+
+type mortarSubscribeClient struct {
+	grpc.ClientStream
+}
+
+func (x *mortarSubscribeClient) Recv() (*FetchResponse, error) {
+	m := new(FetchResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *mortarClient) SearchAuditLog(ctx context.Context, in *AuditSearchRequest, opts ...grpc.CallOption) (*AuditSearchResponse, error) {
+	out := new(AuditSearchResponse)
+	err := c.cc.Invoke(ctx, "/mortar.Mortar/SearchAuditLog", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // MortarServer is the server API for Mortar service.
 type MortarServer interface {
 	GetAPIKey(context.Context, *GetAPIKeyRequest) (*APIKeyResponse, error)
@@ -1045,6 +2791,22 @@ type MortarServer interface {
 	Qualify(context.Context, *QualifyRequest) (*QualifyResponse, error)
 	// pull data from Mortar
 	Fetch(*FetchRequest, Mortar_FetchServer) error
+	// pull data from Mortar as an Arrow IPC stream
+	FetchArrow(*FetchRequest, Mortar_FetchArrowServer) error
+	// pull data from Mortar as CSV or Parquet files
+	Export(*ExportRequest, Mortar_ExportServer) error
+	// run a Fetch in the background; the results are kept on the server
+	// and downloaded with GetFetchJobResults
+	SubmitFetchJob(context.Context, *FetchRequest) (*FetchJob, error)
+	// status and progress of a job
+	GetFetchJob(context.Context, *FetchJobRequest) (*FetchJob, error)
+	// download a page of the results of a job
+	GetFetchJobResults(context.Context, *FetchJobResultsRequest) (*FetchJobResultsResponse, error)
+	// resolve the views once, then stream new data for the UUIDs they matched
+	// as it is written
+	Subscribe(*SubscribeRequest, Mortar_SubscribeServer) error
+	// search the audit log of queries; only for the admins of the audit log
+	SearchAuditLog(context.Context, *AuditSearchRequest) (*AuditSearchResponse, error)
 }
 
 func RegisterMortarServer(s *grpc.Server, srv MortarServer) {
@@ -1108,6 +2870,141 @@ func (x *mortarFetchServer) Send(m *FetchResponse) error {
 	return x.ServerStream.SendMsg(m)
 }
 
+func _Mortar_FetchArrow_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(FetchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(MortarServer).FetchArrow(m, &mortarFetchArrowServer{stream})
+}
+
+type Mortar_FetchArrowServer interface {
+	Send(*ArrowResponse) error
+	grpc.ServerStream
+}
+
+type mortarFetchArrowServer struct {
+	grpc.ServerStream
+}
+
+func (x *mortarFetchArrowServer) Send(m *ArrowResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Mortar_Export_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ExportRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(MortarServer).Export(m, &mortarExportServer{stream})
+}
+
+type Mortar_ExportServer interface {
+	Send(*ExportResponse) error
+	grpc.ServerStream
+}
+
+type mortarExportServer struct {
+	grpc.ServerStream
+}
+
+func (x *mortarExportServer) Send(m *ExportResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Mortar_SubmitFetchJob_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FetchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MortarServer).SubmitFetchJob(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mortar.Mortar/SubmitFetchJob",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MortarServer).SubmitFetchJob(ctx, req.(*FetchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Mortar_GetFetchJob_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FetchJobRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MortarServer).GetFetchJob(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mortar.Mortar/GetFetchJob",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MortarServer).GetFetchJob(ctx, req.(*FetchJobRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Mortar_GetFetchJobResults_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FetchJobResultsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MortarServer).GetFetchJobResults(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mortar.Mortar/GetFetchJobResults",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MortarServer).GetFetchJobResults(ctx, req.(*FetchJobResultsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Mortar_Subscribe_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(MortarServer).Subscribe(m, &mortarSubscribeServer{stream})
+}
+
+type Mortar_SubscribeServer interface {
+	Send(*FetchResponse) error
+	grpc.ServerStream
+}
+
+type mortarSubscribeServer struct {
+	grpc.ServerStream
+}
+
+func (x *mortarSubscribeServer) Send(m *FetchResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Mortar_SearchAuditLog_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AuditSearchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MortarServer).SearchAuditLog(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mortar.Mortar/SearchAuditLog",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MortarServer).SearchAuditLog(ctx, req.(*AuditSearchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _Mortar_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "mortar.Mortar",
 	HandlerType: (*MortarServer)(nil),
@@ -1120,6 +3017,22 @@ var _Mortar_serviceDesc = grpc.ServiceDesc{
 			MethodName: "Qualify",
 			Handler:    _Mortar_Qualify_Handler,
 		},
+		{
+			MethodName: "SubmitFetchJob",
+			Handler:    _Mortar_SubmitFetchJob_Handler,
+		},
+		{
+			MethodName: "GetFetchJob",
+			Handler:    _Mortar_GetFetchJob_Handler,
+		},
+		{
+			MethodName: "GetFetchJobResults",
+			Handler:    _Mortar_GetFetchJobResults_Handler,
+		},
+		{
+			MethodName: "SearchAuditLog",
+			Handler:    _Mortar_SearchAuditLog_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -1127,6 +3040,21 @@ var _Mortar_serviceDesc = grpc.ServiceDesc{
 			Handler:       _Mortar_Fetch_Handler,
 			ServerStreams: true,
 		},
+		{
+			StreamName:    "FetchArrow",
+			Handler:       _Mortar_FetchArrow_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Export",
+			Handler:       _Mortar_Export_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Subscribe",
+			Handler:       _Mortar_Subscribe_Handler,
+			ServerStreams: true,
+		},
 	},
 	Metadata: "mortar.proto",
 }
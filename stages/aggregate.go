@@ -0,0 +1,60 @@
+package stages
+
+import (
+	"math"
+
+	mortarpb "github.com/SoftwareDefinedBuildings/mortar/proto"
+	"gopkg.in/btrdb.v4"
+)
+
+// windowAggregator computes windowed statistics for backends that only give us raw points.
+// Windows are aligned to start, like BTrDB's Windows, and are labeled with their start time.
+// Points must be pushed in time order. Windows without points are not emitted
+type windowAggregator struct {
+	aggfunc mortarpb.AggFunc
+	start   int64
+	width   int64
+
+	// the window currently being accumulated
+	current btrdb.StatPoint
+	sum     float64
+
+	emit func(t int64, v float64)
+}
+
+func newWindowAggregator(aggfunc mortarpb.AggFunc, start, width int64, emit func(int64, float64)) *windowAggregator {
+	return &windowAggregator{
+		aggfunc: aggfunc,
+		start:   start,
+		width:   width,
+		emit:    emit,
+	}
+}
+
+func (w *windowAggregator) push(t int64, v float64) {
+	if t < w.start {
+		return
+	}
+	windowStart := w.start + ((t-w.start)/w.width)*w.width
+	if w.current.Count > 0 && windowStart != w.current.Time {
+		w.flush()
+	}
+	if w.current.Count == 0 {
+		w.current = btrdb.StatPoint{Time: windowStart, Min: math.Inf(1), Max: math.Inf(-1)}
+		w.sum = 0
+	}
+	w.current.Count++
+	w.sum += v
+	w.current.Min = math.Min(w.current.Min, v)
+	w.current.Max = math.Max(w.current.Max, v)
+}
+
+// flush emits the window currently being accumulated, if it has any points
+func (w *windowAggregator) flush() {
+	if w.current.Count == 0 {
+		return
+	}
+	w.current.Mean = w.sum / float64(w.current.Count)
+	w.emit(w.current.Time, valueFromAggFunc(w.current, w.aggfunc))
+	w.current = btrdb.StatPoint{}
+}
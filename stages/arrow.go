@@ -0,0 +1,405 @@
+package stages
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mortarpb "github.com/SoftwareDefinedBuildings/mortar/proto"
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/ipc"
+	"github.com/heptiolabs/healthcheck"
+	"github.com/pkg/errors"
+)
+
+// a data file without the uuid, time and value columns, such as the metadata of an Export
+var errNoTimeseriesColumns = errors.New("not a timeseries file")
+
+// ArrowTimeseriesQueryStage serves timeseries from a directory of Arrow IPC and Parquet
+// files, so an archived dataset (such as a Parquet Export) can be served without a
+// running timeseries database. Each file has a uuid (string), time (timestamp or int64
+// nanoseconds) and value (float64) column. Within a record batch (or Parquet row group)
+// the rows for a UUID must be in time order, and the batches holding a UUID must not
+// overlap in time
+type ArrowTimeseriesQueryStage struct {
+	upstream Stage
+	ctx      context.Context
+	output   chan *Request
+
+	uuidColumn  string
+	timeColumn  string
+	valueColumn string
+	concurrency int
+
+	// uuid -> record batches holding data for that uuid, sorted by time
+	index map[string][]arrowBatchRef
+
+	sync.Mutex
+}
+
+type ArrowTimeseriesStageConfig struct {
+	Upstream     Stage
+	StageContext context.Context
+	// directory searched (recursively) for .arrow and .parquet files
+	Directory string
+	// column names; default to "uuid", "time" and "value"
+	UUIDColumn  string
+	TimeColumn  string
+	ValueColumn string
+	// number of UUIDs read concurrently for each request; defaults to 4
+	Concurrency int
+}
+
+// arrowBatchRef points to the rows for one UUID in one record batch or row group
+type arrowBatchRef struct {
+	file    string
+	batch   int
+	minTime int64
+	maxTime int64
+}
+
+// the columns of a record batch we read from
+type arrowColumns struct {
+	uuids  *array.String
+	values *array.Float64
+	// converts the time column to nanoseconds
+	time func(i int) int64
+}
+
+// arrowDataFile is an open Arrow IPC or Parquet file, read one record batch (or row
+// group) at a time
+type arrowDataFile interface {
+	numBatches() int
+	// scanBatch calls fn with the uuid, time in nanoseconds and value of each row of the
+	// batch, in order. Rows with a null uuid or value are skipped
+	scanBatch(batch int, fn func(uu string, t int64, v float64)) error
+	Close() error
+}
+
+// arrowIPCFile reads an Arrow IPC file
+type arrowIPCFile struct {
+	f      *os.File
+	reader *ipc.FileReader
+	stage  *ArrowTimeseriesQueryStage
+}
+
+func NewArrowTimeseriesQueryStage(cfg *ArrowTimeseriesStageConfig) (*ArrowTimeseriesQueryStage, error) {
+	if cfg.Upstream == nil {
+		return nil, errors.New("Need to specify Upstream in Arrow Timeseries config")
+	}
+	stage := &ArrowTimeseriesQueryStage{
+		upstream:    cfg.Upstream,
+		output:      make(chan *Request),
+		ctx:         cfg.StageContext,
+		uuidColumn:  defaultString(cfg.UUIDColumn, "uuid"),
+		timeColumn:  defaultString(cfg.TimeColumn, "time"),
+		valueColumn: defaultString(cfg.ValueColumn, "value"),
+		concurrency: cfg.Concurrency,
+		index:       make(map[string][]arrowBatchRef),
+	}
+	if stage.concurrency <= 0 {
+		stage.concurrency = 4
+	}
+
+	log.Infof("Start indexing Arrow files in %s", cfg.Directory)
+	start := time.Now()
+	err := filepath.Walk(cfg.Directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !(strings.HasSuffix(info.Name(), ".arrow") || strings.HasSuffix(info.Name(), ".parquet")) {
+			return nil
+		}
+		err = stage.indexFile(path)
+		if errors.Cause(err) == errNoTimeseriesColumns {
+			log.Warningf("Skipping %s: %s", path, err)
+			return nil
+		}
+		return errors.Wrapf(err, "Could not index %s", path)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for uu := range stage.index {
+		refs := stage.index[uu]
+		sort.Slice(refs, func(i, j int) bool { return refs[i].minTime < refs[j].minTime })
+	}
+	log.Infof("Done indexing %d timeseries. Took %s", len(stage.index), time.Since(start))
+
+	// TODO: configure concurrent connections
+	num_workers := 20
+	busy := workerGauges(stage, "arrow", num_workers)
+	// consume function
+	for i := 0; i < num_workers; i++ {
+		go func() {
+			input := stage.upstream.GetQueue()
+			for {
+				select {
+				case req := <-input:
+					busy.Inc()
+					if !req.start() {
+						// the client gave up while the request was queued
+					} else if req.subscribe {
+						req.addError(errSubscribeNotSupported)
+					} else if len(req.fetch_request.Sites) > 0 && len(req.fetch_request.DataFrames) > 0 {
+						if err := stage.processQuery(req); err != nil {
+							req.addError(err)
+							log.Println(err)
+						} else {
+							req.finish()
+						}
+					} else {
+						req.finish()
+					}
+					busy.Dec()
+				case <-stage.ctx.Done():
+					// case that breaks the stage and releases resources
+					log.Info("Ending Timeseries Queue")
+					return
+				}
+			}
+		}()
+	}
+
+	return stage, nil
+}
+
+func (stage *ArrowTimeseriesQueryStage) GetUpstream() Stage {
+	stage.Lock()
+	defer stage.Unlock()
+	return stage.upstream
+}
+
+func (stage *ArrowTimeseriesQueryStage) SetUpstream(upstream Stage) {
+	stage.Lock()
+	defer stage.Unlock()
+	if stage != nil {
+		stage.upstream = upstream
+	}
+	log.Info("Updated stage to ", upstream)
+}
+
+func (stage *ArrowTimeseriesQueryStage) GetQueue() chan *Request {
+	return stage.output
+}
+
+func (stage *ArrowTimeseriesQueryStage) String() string {
+	return "<|arrow ts stage|>"
+}
+
+func (stage *ArrowTimeseriesQueryStage) ReadinessChecks() map[string]healthcheck.Check {
+	return workerChecks(stage, nil, false)
+}
+
+func (stage *ArrowTimeseriesQueryStage) LivenessChecks() map[string]healthcheck.Check {
+	return workerChecks(stage, nil, true)
+}
+
+// openDataFile opens an Arrow IPC (.arrow) or Parquet (.parquet) file
+func (stage *ArrowTimeseriesQueryStage) openDataFile(path string) (arrowDataFile, error) {
+	if strings.HasSuffix(path, ".parquet") {
+		return stage.openParquetFile(path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := ipc.NewFileReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &arrowIPCFile{f: f, reader: reader, stage: stage}, nil
+}
+
+func (file *arrowIPCFile) numBatches() int {
+	return file.reader.NumRecords()
+}
+
+func (file *arrowIPCFile) scanBatch(batch int, fn func(uu string, t int64, v float64)) error {
+	rec, err := file.reader.Record(batch)
+	if err != nil {
+		return err
+	}
+	cols, err := file.stage.columns(rec)
+	if err != nil {
+		return err
+	}
+	for row := 0; row < int(rec.NumRows()); row++ {
+		if cols.uuids.IsNull(row) || cols.values.IsNull(row) {
+			continue
+		}
+		fn(cols.uuids.Value(row), cols.time(row), cols.values.Value(row))
+	}
+	return nil
+}
+
+func (file *arrowIPCFile) Close() error {
+	file.reader.Close()
+	return file.f.Close()
+}
+
+// indexFile records the time range of each UUID in each record batch of the file
+func (stage *ArrowTimeseriesQueryStage) indexFile(path string) error {
+	file, err := stage.openDataFile(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for i := 0; i < file.numBatches(); i++ {
+		refs := make(map[string]*arrowBatchRef)
+		err := file.scanBatch(i, func(uu string, t int64, v float64) {
+			ref, found := refs[uu]
+			if !found {
+				ref = &arrowBatchRef{file: path, batch: i, minTime: t, maxTime: t}
+				refs[uu] = ref
+			}
+			if t < ref.minTime {
+				ref.minTime = t
+			}
+			if t > ref.maxTime {
+				ref.maxTime = t
+			}
+		})
+		if err != nil {
+			return err
+		}
+		for uu, ref := range refs {
+			stage.index[uu] = append(stage.index[uu], *ref)
+		}
+	}
+	return nil
+}
+
+// columns finds the uuid, time and value columns of the record batch
+func (stage *ArrowTimeseriesQueryStage) columns(rec array.Record) (*arrowColumns, error) {
+	cols := &arrowColumns{}
+	schema := rec.Schema()
+	for idx, field := range schema.Fields() {
+		col := rec.Column(idx)
+		switch field.Name {
+		case stage.uuidColumn:
+			uuids, ok := col.(*array.String)
+			if !ok {
+				return nil, errors.Errorf("Column %s must be a string, not %s", field.Name, field.Type)
+			}
+			cols.uuids = uuids
+		case stage.valueColumn:
+			values, ok := col.(*array.Float64)
+			if !ok {
+				return nil, errors.Errorf("Column %s must be a float64, not %s", field.Name, field.Type)
+			}
+			cols.values = values
+		case stage.timeColumn:
+			switch times := col.(type) {
+			case *array.Int64:
+				cols.time = func(i int) int64 { return times.Value(i) }
+			case *array.Timestamp:
+				var scale int64
+				switch field.Type.(*arrow.TimestampType).Unit {
+				case arrow.Second:
+					scale = int64(time.Second)
+				case arrow.Millisecond:
+					scale = int64(time.Millisecond)
+				case arrow.Microsecond:
+					scale = int64(time.Microsecond)
+				default:
+					scale = 1
+				}
+				cols.time = func(i int) int64 { return int64(times.Value(i)) * scale }
+			default:
+				return nil, errors.Errorf("Column %s must be a timestamp or int64, not %s", field.Name, field.Type)
+			}
+		}
+	}
+	if cols.uuids == nil || cols.values == nil || cols.time == nil {
+		return nil, errors.Wrapf(errNoTimeseriesColumns, "Need columns %s, %s and %s", stage.uuidColumn, stage.timeColumn, stage.valueColumn)
+	}
+	return cols, nil
+}
+
+func (stage *ArrowTimeseriesQueryStage) processQuery(req *Request) error {
+	// parse timestamps for the query
+	start_time, err := time.Parse(time.RFC3339, req.fetch_request.Time.Start)
+	if err != nil {
+		return invalidArgument(errors.Wrapf(err, "Could not parse Start time (%s)", req.fetch_request.Time.Start))
+	}
+	end_time, err := time.Parse(time.RFC3339, req.fetch_request.Time.End)
+	if err != nil {
+		return invalidArgument(errors.Wrapf(err, "Could not parse End time (%s)", req.fetch_request.Time.End))
+	}
+
+	err = fetchConcurrently(req, "arrow", stage.concurrency, false, func(ctx context.Context, out *Request, dataFrame *mortarpb.DataFrame, uuStr string) error {
+		return stage.readUUID(ctx, out, dataFrame, uuStr, start_time.UnixNano(), end_time.UnixNano())
+	})
+	return err
+}
+
+// readUUID sends the points (or windows) for one UUID in [start, end) to the client,
+// reading one record batch (or row group) at a time
+func (stage *ArrowTimeseriesQueryStage) readUUID(ctx context.Context, req *Request, dataFrame *mortarpb.DataFrame, uuStr string, start, end int64) error {
+	refs, found := stage.index[uuStr]
+	if !found {
+		return errors.Wrapf(errStreamNotExist, "No data for %s", uuStr)
+	}
+	batcher, err := newFetchBatcher(req, dataFrame, uuStr, start, end)
+	if err != nil {
+		return err
+	}
+
+	add := batcher.add
+	var agg *windowAggregator
+	if dataFrame.Aggregation != mortarpb.AggFunc_AGG_FUNC_RAW {
+		window, err := ParseDuration(dataFrame.Window)
+		if err != nil {
+			return err
+		}
+		agg = newWindowAggregator(dataFrame.Aggregation, start, window.Nanoseconds(), batcher.add)
+		add = agg.push
+	}
+
+	// files are opened once per UUID even if they hold several of its batches
+	files := make(map[string]arrowDataFile)
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	for _, ref := range refs {
+		if ref.maxTime < start || ref.minTime >= end {
+			continue
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		file, found := files[ref.file]
+		if !found {
+			var err error
+			if file, err = stage.openDataFile(ref.file); err != nil {
+				return errors.Wrapf(err, "Could not read %s", ref.file)
+			}
+			files[ref.file] = file
+		}
+		err := file.scanBatch(ref.batch, func(uu string, t int64, v float64) {
+			if uu == uuStr && t >= start && t < end {
+				add(t, v)
+			}
+		})
+		if err != nil {
+			return errors.Wrapf(err, "Could not read batch %d of %s", ref.batch, ref.file)
+		}
+	}
+	if agg != nil {
+		agg.flush()
+	}
+	// any left over
+	batcher.flush()
+	return nil
+}
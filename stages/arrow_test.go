@@ -0,0 +1,268 @@
+package stages
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mortarpb "github.com/SoftwareDefinedBuildings/mortar/proto"
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/ipc"
+	"github.com/apache/arrow/go/arrow/memory"
+	"github.com/xitongsys/parquet-go/writer"
+	"google.golang.org/grpc"
+)
+
+const (
+	arrowTestUUID1 = "5b4c3d2e-1f0a-4b9c-8d7e-6f5a4b3c2d11"
+	arrowTestUUID2 = "6c5d4e3f-2a1b-4c0d-9e8f-7a6b5c4d3e22"
+)
+
+var arrowTestStart = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// arrowTestRows are a minute apart, alternating between the two UUIDs
+func arrowTestRows(n int) []exportParquetRow {
+	rows := make([]exportParquetRow, n)
+	for i := range rows {
+		uu := arrowTestUUID1
+		if i%2 == 1 {
+			uu = arrowTestUUID2
+		}
+		t := arrowTestStart.Add(time.Duration(i) * time.Minute)
+		rows[i] = exportParquetRow{UUID: uu, Time: t.UnixNano() / int64(time.Microsecond), Value: float64(i)}
+	}
+	return rows
+}
+
+// writeTestParquet writes the rows like a Parquet Export, with small row groups
+func writeTestParquet(t *testing.T, path string, rows []exportParquetRow) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw, err := writer.NewParquetWriter(parquetLocalFile{f}, new(exportParquetRow), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw.RowGroupSize = 512
+	pw.PageSize = 128
+	for _, row := range rows {
+		if err := pw.Write(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pw.WriteStop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTestArrow writes the rows to an Arrow IPC file, in batches of batchSize
+func writeTestArrow(t *testing.T, path string, rows []exportParquetRow, batchSize int) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := arrow.NewSchema([]arrow.Field{
+		{Name: "uuid", Type: arrow.BinaryTypes.String},
+		{Name: "time", Type: arrow.FixedWidthTypes.Timestamp_us},
+		{Name: "value", Type: arrow.PrimitiveTypes.Float64},
+	}, nil)
+	w, err := ipc.NewFileWriter(f, ipc.WithSchema(schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := memory.NewGoAllocator()
+	for start := 0; start < len(rows); start += batchSize {
+		uuids := array.NewStringBuilder(mem)
+		times := array.NewTimestampBuilder(mem, arrow.FixedWidthTypes.Timestamp_us.(*arrow.TimestampType))
+		values := array.NewFloat64Builder(mem)
+		end := start + batchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		for _, row := range rows[start:end] {
+			uuids.Append(row.UUID)
+			times.Append(arrow.Timestamp(row.Time))
+			values.Append(row.Value)
+		}
+		rec := array.NewRecord(schema, []array.Interface{uuids.NewArray(), times.NewArray(), values.NewArray()}, int64(end-start))
+		if err := w.Write(rec); err != nil {
+			t.Fatal(err)
+		}
+		rec.Release()
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func arrowFetch(t *testing.T, upstream *testStage, uuStr string, start, end time.Time) ([]int64, []float64) {
+	req := NewFetchRequest(context.Background(), &mortarpb.FetchRequest{
+		Sites: []string{"site"},
+		Time:  &mortarpb.TimeParams{Start: start.Format(time.RFC3339), End: end.Format(time.RFC3339)},
+		DataFrames: []*mortarpb.DataFrame{{
+			Name:        "df",
+			Aggregation: mortarpb.AggFunc_AGG_FUNC_RAW,
+			Uuids:       []string{uuStr},
+		}},
+	})
+	upstream.queue <- req
+	responses, err := consumeFetch(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		times  []int64
+		values []float64
+	)
+	for _, resp := range responses {
+		times = append(times, resp.Times...)
+		values = append(values, resp.Values...)
+	}
+	return times, values
+}
+
+func TestArrowStageFiles(t *testing.T) {
+	rows := arrowTestRows(400)
+	for _, test := range []struct {
+		name  string
+		write func(t *testing.T, dir string)
+	}{
+		{"parquet", func(t *testing.T, dir string) {
+			writeTestParquet(t, filepath.Join(dir, "data.parquet"), rows)
+			// the metadata of an Export is skipped
+			meta, err := os.Create(filepath.Join(dir, "metadata_view.parquet"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			pw, err := writer.NewCSVWriter([]string{"name=point, type=UTF8"}, parquetLocalFile{meta}, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pw.Write([]interface{}{"temp"})
+			if err := pw.WriteStop(); err != nil {
+				t.Fatal(err)
+			}
+			meta.Close()
+		}},
+		{"arrow", func(t *testing.T, dir string) {
+			writeTestArrow(t, filepath.Join(dir, "data.arrow"), rows, 64)
+		}},
+		{"both", func(t *testing.T, dir string) {
+			writeTestParquet(t, filepath.Join(dir, "first.parquet"), rows[:200])
+			writeTestArrow(t, filepath.Join(dir, "second.arrow"), rows[200:], 64)
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "mortar-arrow")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			test.write(t, dir)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			upstream := newTestStage()
+			stage, err := NewArrowTimeseriesQueryStage(&ArrowTimeseriesStageConfig{Upstream: upstream, StageContext: ctx, Directory: dir})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(stage.index[arrowTestUUID1]) < 2 {
+				t.Fatalf("%s is in %d batches; want several", arrowTestUUID1, len(stage.index[arrowTestUUID1]))
+			}
+
+			// rows 100 to 299 fall in the range; every other one is UUID 2
+			times, values := arrowFetch(t, upstream, arrowTestUUID2, arrowTestStart.Add(100*time.Minute), arrowTestStart.Add(300*time.Minute))
+			if len(times) != 100 || len(values) != 100 {
+				t.Fatalf("got %d times and %d values", len(times), len(values))
+			}
+			for i := range times {
+				row := 101 + 2*i
+				if times[i] != arrowTestStart.Add(time.Duration(row)*time.Minute).UnixNano() || values[i] != float64(row) {
+					t.Fatalf("point %d is (%d, %v), want row %d", i, times[i], values[i], row)
+				}
+			}
+		})
+	}
+}
+
+// arrowTestClient collects the responses of FetchArrow
+type arrowTestClient struct {
+	grpc.ServerStream
+	ctx       context.Context
+	responses []*mortarpb.ArrowResponse
+}
+
+func (client *arrowTestClient) Context() context.Context {
+	return client.ctx
+}
+
+func (client *arrowTestClient) Send(resp *mortarpb.ArrowResponse) error {
+	client.responses = append(client.responses, resp)
+	return nil
+}
+
+func TestFetchArrowSummary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mortar-arrow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestParquet(t, filepath.Join(dir, "data.parquet"), arrowTestRows(400))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// admission does not wait for the stage to take the request
+	upstream := &testStage{queue: make(chan *Request, 1)}
+	if _, err := NewArrowTimeseriesQueryStage(&ArrowTimeseriesStageConfig{Upstream: upstream, StageContext: ctx, Directory: dir}); err != nil {
+		t.Fatal(err)
+	}
+
+	unknownUUID := "7d6e5f4a-3b2c-4d1e-8f9a-0b1c2d3e4f55"
+	client := &arrowTestClient{ctx: ctx}
+	err = fetchArrow(ctx, upstream.queue, &mortarpb.FetchRequest{
+		Sites:         []string{"site"},
+		Time:          &mortarpb.TimeParams{Start: arrowTestStart.Format(time.RFC3339), End: arrowTestStart.Add(time.Hour).Format(time.RFC3339)},
+		FailurePolicy: mortarpb.FailurePolicy_FAILURE_POLICY_BEST_EFFORT,
+		DataFrames: []*mortarpb.DataFrame{{
+			Name:        "df",
+			Aggregation: mortarpb.AggFunc_AGG_FUNC_RAW,
+			Uuids:       []string{arrowTestUUID1, unknownUUID},
+		}},
+	}, client, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var data, errs int
+	for _, resp := range client.responses[:len(client.responses)-1] {
+		if resp.Summary != nil {
+			t.Fatalf("summary %v before the end of the stream", resp.Summary)
+		}
+		data += len(resp.Data)
+		if resp.Error != "" {
+			errs++
+		}
+	}
+	if data == 0 || errs != 1 {
+		t.Errorf("sent %d bytes of data and %d errors", data, errs)
+	}
+	summary := client.responses[len(client.responses)-1].Summary
+	if summary == nil || len(summary.DataFrames) != 1 || len(summary.Failures) != 1 {
+		t.Fatalf("last response is %v", client.responses[len(client.responses)-1])
+	}
+	if df := summary.DataFrames[0]; df.UuidsResolved != 2 || df.UuidsMissing != 1 || df.Points != 30 {
+		t.Errorf("DataFrame summary is %v", df)
+	}
+}
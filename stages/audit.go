@@ -0,0 +1,520 @@
+package stages
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mortarpb "github.com/SoftwareDefinedBuildings/mortar/proto"
+	"github.com/dgraph-io/badger"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultAuditPageSize = 100
+	maxAuditPageSize     = 1000
+	// how often space is reclaimed from the audit store
+	auditStoreGCInterval = 10 * time.Minute
+)
+
+var errAuditStoreDisabled = status.Error(codes.FailedPrecondition, "The audit log has no store to search")
+
+type AuditConfig struct {
+	// JSON-lines file every query is recorded in. Auditing is off if empty
+	File string
+	// the file is rotated once it grows past this many megabytes, keeping MaxBackups
+	// old files as File.1 (newest) to File.<MaxBackups>
+	MaxSizeMB  int
+	MaxBackups int
+
+	// directory of a local database of the records, searched by SearchAuditLog.
+	// Not kept if empty
+	Store string
+	// how long records are kept in the store; forever if 0
+	StoreRetention time.Duration
+	// identities allowed to call SearchAuditLog
+	Admins []string
+}
+
+// auditLog records who queried which data. Each record is appended to a rotating
+// JSON-lines file and, if configured, to a badger database keyed by time so it can be
+// searched
+type auditLog struct {
+	file       string
+	maxSize    int64
+	maxBackups int
+	retention  time.Duration
+	admins     map[string]bool
+
+	sync.Mutex
+	out  *os.File
+	size int64
+
+	// held for writing only to close the store, so searches do not hold up writes
+	storeLock sync.RWMutex
+	store     *badger.DB
+}
+
+// the audit log of the process; nil if auditing is off
+var activeAudit *auditLog
+
+// StartAuditLog records every query in the audit log until ctx is done
+func StartAuditLog(ctx context.Context, cfg AuditConfig) error {
+	if cfg.File == "" {
+		return nil
+	}
+	a := &auditLog{
+		file:       cfg.File,
+		maxSize:    int64(cfg.MaxSizeMB) << 20,
+		maxBackups: cfg.MaxBackups,
+		retention:  cfg.StoreRetention,
+		admins:     make(map[string]bool),
+	}
+	if a.maxSize <= 0 {
+		a.maxSize = 100 << 20
+	}
+	for _, admin := range cfg.Admins {
+		a.admins[admin] = true
+	}
+	if err := a.open(); err != nil {
+		return err
+	}
+	if cfg.Store != "" {
+		db, err := badger.Open(badger.DefaultOptions(cfg.Store).WithLogger(log))
+		if err != nil {
+			a.out.Close()
+			return errors.Wrapf(err, "Could not open audit store %s", cfg.Store)
+		}
+		a.store = db
+		go a.collectGarbage(ctx)
+	}
+	activeAudit = a
+	go func() {
+		<-ctx.Done()
+		a.close()
+	}()
+	log.Infof("Writing audit log to %s", cfg.File)
+	return nil
+}
+
+// CloseAuditLog closes the audit log file and store. Calls finishing later are not recorded
+func CloseAuditLog() {
+	if a := activeAudit; a != nil {
+		a.close()
+	}
+}
+
+func (a *auditLog) open() error {
+	if err := os.MkdirAll(filepath.Dir(a.file), 0755); err != nil {
+		return errors.Wrapf(err, "Could not create directory of audit log %s", a.file)
+	}
+	f, err := os.OpenFile(a.file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "Could not open audit log %s", a.file)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrapf(err, "Could not open audit log %s", a.file)
+	}
+	a.out = f
+	a.size = info.Size()
+	return nil
+}
+
+func (a *auditLog) close() {
+	a.Lock()
+	if a.out != nil {
+		a.out.Close()
+		a.out = nil
+	}
+	a.Unlock()
+
+	a.storeLock.Lock()
+	defer a.storeLock.Unlock()
+	if a.store != nil {
+		a.store.Close()
+		a.store = nil
+	}
+}
+
+// rotate moves the current file to File.1, shifting the older ones, and starts a new one
+func (a *auditLog) rotate() error {
+	a.out.Close()
+	a.out = nil
+	if a.maxBackups <= 0 {
+		if err := os.Remove(a.file); err != nil {
+			return errors.Wrap(err, "Could not rotate audit log")
+		}
+		return a.open()
+	}
+	os.Remove(fmt.Sprintf("%s.%d", a.file, a.maxBackups))
+	for i := a.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", a.file, i), fmt.Sprintf("%s.%d", a.file, i+1))
+	}
+	if err := os.Rename(a.file, a.file+".1"); err != nil {
+		return errors.Wrap(err, "Could not rotate audit log")
+	}
+	return a.open()
+}
+
+func (a *auditLog) write(record *mortarpb.AuditRecord) {
+	var line bytes.Buffer
+	if err := gatewayMarshaler.Marshal(&line, record); err != nil {
+		log.Error(errors.Wrap(err, "Could not encode audit record"))
+		return
+	}
+	line.WriteByte('\n')
+
+	a.Lock()
+	if a.out != nil {
+		if a.size > 0 && a.size+int64(line.Len()) > a.maxSize {
+			if err := a.rotate(); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+	if a.out != nil {
+		n, err := a.out.Write(line.Bytes())
+		a.size += int64(n)
+		if err != nil {
+			log.Error(errors.Wrap(err, "Could not write audit record"))
+		}
+	}
+	a.Unlock()
+
+	a.storeLock.RLock()
+	defer a.storeLock.RUnlock()
+	if a.store != nil {
+		if err := a.storeRecord(record); err != nil {
+			log.Error(errors.Wrap(err, "Could not store audit record"))
+		}
+	}
+}
+
+// storeRecord adds the record to the store under its time followed by random bytes, so
+// records are iterated in time order
+func (a *auditLog) storeRecord(record *mortarpb.AuditRecord) error {
+	t, err := time.Parse(time.RFC3339Nano, record.Time)
+	if err != nil {
+		return err
+	}
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	rand.Read(key[8:])
+	value, err := proto.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return a.store.Update(func(txn *badger.Txn) error {
+		entry := badger.NewEntry(key, value)
+		if a.retention > 0 {
+			entry = entry.WithTTL(a.retention)
+		}
+		return txn.SetEntry(entry)
+	})
+}
+
+func (a *auditLog) collectGarbage(ctx context.Context) {
+	ticker := time.NewTicker(auditStoreGCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.storeLock.RLock()
+			if a.store != nil {
+				// returns an error once there is nothing to collect
+				for a.store.RunValueLogGC(0.5) == nil {
+				}
+			}
+			a.storeLock.RUnlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// search returns the stored records matching the request, oldest first. The page token
+// is the key of the next record
+func (a *auditLog) search(request *mortarpb.AuditSearchRequest) (*mortarpb.AuditSearchResponse, error) {
+	var start, end time.Time
+	var err error
+	if request.Start != "" {
+		if start, err = time.Parse(time.RFC3339, request.Start); err != nil {
+			return nil, errors.Wrapf(err, "Could not parse start time (%s)", request.Start)
+		}
+	}
+	if request.End != "" {
+		if end, err = time.Parse(time.RFC3339, request.End); err != nil {
+			return nil, errors.Wrapf(err, "Could not parse end time (%s)", request.End)
+		}
+	}
+	seek := make([]byte, 8)
+	if !start.IsZero() {
+		binary.BigEndian.PutUint64(seek, uint64(start.UnixNano()))
+	}
+	if request.PageToken != "" {
+		if seek, err = base64.RawURLEncoding.DecodeString(request.PageToken); err != nil || len(seek) != 16 {
+			return nil, errors.Errorf("Invalid pageToken %q", request.PageToken)
+		}
+	}
+	pageSize := int(request.PageSize)
+	if pageSize <= 0 {
+		pageSize = defaultAuditPageSize
+	}
+	if pageSize > maxAuditPageSize {
+		pageSize = maxAuditPageSize
+	}
+
+	a.storeLock.RLock()
+	defer a.storeLock.RUnlock()
+	if a.store == nil {
+		return nil, errAuditStoreDisabled
+	}
+	resp := &mortarpb.AuditSearchResponse{}
+	err = a.store.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(seek); it.Valid(); it.Next() {
+			key := it.Item().Key()
+			if !end.IsZero() && int64(binary.BigEndian.Uint64(key)) >= end.UnixNano() {
+				break
+			}
+			record := &mortarpb.AuditRecord{}
+			if err := it.Item().Value(func(value []byte) error {
+				return proto.Unmarshal(value, record)
+			}); err != nil {
+				return err
+			}
+			if !auditRecordMatches(record, request) {
+				continue
+			}
+			if len(resp.Records) == pageSize {
+				resp.NextPageToken = base64.RawURLEncoding.EncodeToString(key)
+				break
+			}
+			resp.Records = append(resp.Records, record)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not search audit store")
+	}
+	return resp, nil
+}
+
+func auditRecordMatches(record *mortarpb.AuditRecord, request *mortarpb.AuditSearchRequest) bool {
+	if request.Identity != "" && record.Identity != request.Identity {
+		return false
+	}
+	if request.Rpc != "" && record.Rpc != request.Rpc {
+		return false
+	}
+	if request.ErrorsOnly && record.Error == "" {
+		return false
+	}
+	if request.Site != "" {
+		for _, site := range record.Sites {
+			if site == request.Site {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// searchAuditLog runs SearchAuditLog for a caller with the given identity
+func searchAuditLog(identity string, request *mortarpb.AuditSearchRequest) (*mortarpb.AuditSearchResponse, error) {
+	a := activeAudit
+	if a == nil {
+		return nil, errAuditStoreDisabled
+	}
+	if identity == "" || !a.admins[identity] {
+		return nil, status.Error(codes.PermissionDenied, "Only the admins of the audit log can search it")
+	}
+	return a.search(request)
+}
+
+// SearchAuditLog returns the audit records matching the request, if the caller is an admin
+func (stage *ApiFrontendBasicStage) SearchAuditLog(ctx context.Context, request *mortarpb.AuditSearchRequest) (*mortarpb.AuditSearchResponse, error) {
+	authRequests.Inc()
+	if err := stage.authenticate(ctx); err != nil {
+		return nil, err
+	}
+	authRequestsSuccessful.Inc()
+	return searchAuditLog(tokenIdentity(ctx), request)
+}
+
+// SearchAuditLog is not available on the WAVE frontend: its callers have no identity to
+// check against the admins
+func (stage *ApiFrontendWAVEAuthStage) SearchAuditLog(ctx context.Context, request *mortarpb.AuditSearchRequest) (*mortarpb.AuditSearchResponse, error) {
+	return nil, status.Error(codes.PermissionDenied, "SearchAuditLog needs a token from GetAPIKey")
+}
+
+// tokenIdentity is the user name in the token of the call. The token must have been
+// verified already
+func tokenIdentity(ctx context.Context) string {
+	headers, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(headers["token"]) == 0 {
+		return ""
+	}
+	token, _, err := new(jwt.Parser).ParseUnverified(headers["token"][0], jwt.MapClaims{})
+	if err != nil {
+		return ""
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return ""
+	}
+	for _, key := range []string{"username", "sub"} {
+		if name, ok := claims[key].(string); ok && name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// auditEntry collects the audit record of a call while it runs. A nil *auditEntry ignores
+// all calls, so code can audit unconditionally
+type auditEntry struct {
+	record *mortarpb.AuditRecord
+	start  time.Time
+
+	responses int64
+	points    int64
+	bytes     int64
+
+	sync.Mutex
+	// first error sent to the client in a response
+	respErr string
+}
+
+// startAudit starts the record of a call to the RPC
+func startAudit(ctx context.Context, rpc string) *auditEntry {
+	if activeAudit == nil {
+		return nil
+	}
+	a := &auditEntry{
+		record: &mortarpb.AuditRecord{Rpc: rpc},
+		start:  time.Now(),
+	}
+	a.record.Time = a.start.UTC().Format(time.RFC3339Nano)
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		a.record.Peer = p.Addr.String()
+	}
+	return a
+}
+
+// identify records who made the call, once they are authenticated
+func (a *auditEntry) identify(identity string) {
+	if a == nil {
+		return
+	}
+	a.record.Identity = identity
+}
+
+// fetch records what data a Fetch or any of its variants asked for
+func (a *auditEntry) fetch(request *mortarpb.FetchRequest) {
+	if a == nil || request == nil {
+		return
+	}
+	a.record.Sites = request.Sites
+	for _, view := range request.Views {
+		a.record.Views = append(a.record.Views, view.Name)
+	}
+	for _, dataFrame := range request.DataFrames {
+		a.record.DataFrames = append(a.record.DataFrames, &mortarpb.AuditDataFrame{
+			Name:        dataFrame.Name,
+			Aggregation: dataFrame.Aggregation,
+			Window:      dataFrame.Window,
+			Uuids:       int64(len(dataFrame.Uuids)),
+		})
+	}
+	if request.Time != nil {
+		a.record.Start = request.Time.Start
+		a.record.End = request.Time.End
+	}
+}
+
+func (a *auditEntry) subscribe(request *mortarpb.SubscribeRequest) {
+	if a == nil {
+		return
+	}
+	a.fetch(&mortarpb.FetchRequest{
+		Sites:      request.Sites,
+		Views:      request.Views,
+		DataFrames: request.DataFrames,
+		Time:       &mortarpb.TimeParams{Start: request.Start},
+	})
+}
+
+func (a *auditEntry) qualify(request *mortarpb.QualifyRequest) {
+	if a == nil {
+		return
+	}
+	a.record.Queries = append(append(a.record.Queries, request.Required...), request.Optional...)
+}
+
+// sent counts a response delivered to the client. Call before the response is recycled
+func (a *auditEntry) sent(resp *mortarpb.FetchResponse) {
+	if a == nil {
+		return
+	}
+	atomic.AddInt64(&a.responses, 1)
+	atomic.AddInt64(&a.points, int64(len(resp.Times)))
+	atomic.AddInt64(&a.bytes, int64(proto.Size(resp)))
+	if resp.Error != "" {
+		a.Lock()
+		if a.respErr == "" {
+			a.respErr = resp.Error
+		}
+		a.Unlock()
+	}
+}
+
+func (a *auditEntry) qualified(resp *mortarpb.QualifyResponse) {
+	if a == nil || resp == nil {
+		return
+	}
+	a.record.QualifiedSites = int64(len(resp.Sites))
+	if resp.Error != "" {
+		a.Lock()
+		a.respErr = resp.Error
+		a.Unlock()
+	}
+}
+
+// finish completes the record, with err as the result of the call, and writes it
+func (a *auditEntry) finish(err error) {
+	if a == nil {
+		return
+	}
+	a.record.Responses = atomic.LoadInt64(&a.responses)
+	a.record.Points = atomic.LoadInt64(&a.points)
+	a.record.Bytes = atomic.LoadInt64(&a.bytes)
+	a.record.DurationSeconds = time.Since(a.start).Seconds()
+	a.Lock()
+	a.record.Error = a.respErr
+	a.Unlock()
+	if err != nil {
+		a.record.Error = err.Error()
+	}
+	if audit := activeAudit; audit != nil {
+		audit.write(a.record)
+	}
+}
@@ -85,9 +85,16 @@ type CognitoAuth struct {
 	region       string
 
 	m map[string]rsa.PublicKey
+	// when the keys were last fetched
+	refreshed time.Time
+	// fetches the keys right away, after the JWKS URL changed
+	refresh chan struct{}
 	sync.RWMutex
 }
 
+// keys older than this mean the JWKS endpoint has not been reachable for several refreshes
+const jwksMaxAge = 5 * time.Minute
+
 //type CognitoAuthConfig struct {
 //	ClientId     string
 //	ClientSecret string
@@ -103,6 +110,7 @@ func NewCognitoAuth(cfg CognitoAuthConfig) (*CognitoAuth, error) {
 		jwks_url:     cfg.JWKUrl,
 		region:       cfg.Region,
 		m:            make(map[string]rsa.PublicKey),
+		refresh:      make(chan struct{}, 1),
 	}
 
 	client := &http.Client{
@@ -112,7 +120,10 @@ func NewCognitoAuth(cfg CognitoAuthConfig) (*CognitoAuth, error) {
 	go func() {
 		for {
 			time.Sleep(1 * time.Second)
-			cognitoResp, err := client.Get(auth.jwks_url)
+			auth.RLock()
+			jwksURL := auth.jwks_url
+			auth.RUnlock()
+			cognitoResp, err := client.Get(jwksURL)
 			if err != nil {
 				log.Error(err)
 				continue
@@ -157,16 +168,66 @@ func NewCognitoAuth(cfg CognitoAuthConfig) (*CognitoAuth, error) {
 				}
 
 				auth.Lock()
-				auth.m[key.Kid] = rsa.PublicKey{N: N, E: int(E)}
+				// skip the keys of a pool we switched away from while fetching
+				if auth.jwks_url == jwksURL {
+					auth.m[key.Kid] = rsa.PublicKey{N: N, E: int(E)}
+				}
 				auth.Unlock()
 			}
-			time.Sleep(60 * time.Second)
+			auth.Lock()
+			if auth.jwks_url == jwksURL {
+				auth.refreshed = time.Now()
+			}
+			auth.Unlock()
+			select {
+			case <-time.After(60 * time.Second):
+			case <-auth.refresh:
+			}
 		}
 	}()
 
 	return auth, nil
 }
 
+// update switches to the user pool and app client of cfg. If the JWKS URL changed, the keys
+// of the old pool are dropped and those of the new one fetched
+func (auth *CognitoAuth) update(cfg CognitoAuthConfig) {
+	auth.Lock()
+	defer auth.Unlock()
+	if auth.clientid != cfg.AppClientId || auth.clientsecret != cfg.AppClientSecret || auth.poolid != cfg.PoolId || auth.region != cfg.Region {
+		log.Infof("Using Cognito pool %s, app client %s in %s", cfg.PoolId, cfg.AppClientId, cfg.Region)
+	}
+	auth.clientid = cfg.AppClientId
+	auth.clientsecret = cfg.AppClientSecret
+	auth.poolid = cfg.PoolId
+	auth.region = cfg.Region
+	if auth.jwks_url == cfg.JWKUrl {
+		return
+	}
+	log.Infof("Fetching token keys from %s", cfg.JWKUrl)
+	auth.jwks_url = cfg.JWKUrl
+	auth.m = make(map[string]rsa.PublicKey)
+	auth.refreshed = time.Time{}
+	select {
+	case auth.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// checkKeys fails if there are no keys to verify tokens with, or they have not been
+// refreshed recently
+func (auth *CognitoAuth) checkKeys() error {
+	auth.RLock()
+	defer auth.RUnlock()
+	if len(auth.m) == 0 {
+		return errors.Errorf("No keys fetched from %s", auth.jwks_url)
+	}
+	if age := time.Since(auth.refreshed); age > jwksMaxAge {
+		return errors.Errorf("Keys last fetched from %s %s ago", auth.jwks_url, age.Truncate(time.Second))
+	}
+	return nil
+}
+
 func (auth *CognitoAuth) verifyToken(tokenStr string) (refreshToken string, err error) {
 	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
@@ -189,15 +250,26 @@ func (auth *CognitoAuth) verifyToken(tokenStr string) (refreshToken string, err
 		return &pk, nil
 	})
 	if err != nil {
+		if verr, ok := err.(*jwt.ValidationError); ok && verr.Errors&jwt.ValidationErrorExpired != 0 {
+			authFailures.WithLabelValues("expired").Inc()
+		} else {
+			authFailures.WithLabelValues("parse").Inc()
+		}
 		return "", errors.Wrapf(err, "parse jwt token err")
 	}
 
+	auth.RLock()
+	clientid, jwksURL := auth.clientid, auth.jwks_url
+	auth.RUnlock()
+
 	// How to validate
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok {
+		authFailures.WithLabelValues("claims").Inc()
 		return "", errors.New("not good claims")
 	}
-	if !verifyKey(claims, "client_id", auth.clientid) {
+	if !verifyKey(claims, "client_id", clientid) {
+		authFailures.WithLabelValues("client_id").Inc()
 		err = errors.New("client_id not match")
 		return "", err
 	}
@@ -205,44 +277,53 @@ func (auth *CognitoAuth) verifyToken(tokenStr string) (refreshToken string, err
 	//		err = errors.New(fmt.Sprintf("username not match %s", claims["username"]))
 	//		return err
 	//	}
-	if !verifyKey(claims, "iss", strings.TrimSuffix(auth.jwks_url, "/.well-known/jwks.json")) {
+	if !verifyKey(claims, "iss", strings.TrimSuffix(jwksURL, "/.well-known/jwks.json")) {
+		authFailures.WithLabelValues("issuer").Inc()
 		err = errors.New(fmt.Sprintf("iss not match %s", claims["iss"]))
 		return "", err
 	}
 	if !verifyKey(claims, "token_use", "access") {
+		authFailures.WithLabelValues("token_use").Inc()
 		err = errors.New("invalid token use not access")
 		return "", err
 	}
 
 	if !token.Valid {
+		authFailures.WithLabelValues("invalid").Inc()
 		return "", errors.New("invalid token")
 	}
 	return "", nil
 }
 
 func (auth *CognitoAuth) verifyUserPass(user, pass string) (accessToken string, refreshToken string, err error) {
+	auth.RLock()
+	clientid, clientsecret, poolid, region := auth.clientid, auth.clientsecret, auth.poolid, auth.region
+	auth.RUnlock()
+
 	session := session.Must(session.NewSession())
-	svc := cognitoidentityprovider.New(session, aws.NewConfig().WithRegion(auth.region))
+	svc := cognitoidentityprovider.New(session, aws.NewConfig().WithRegion(region))
 	params := make(map[string]*string)
 	params["USERNAME"] = &user
 	params["PASSWORD"] = &pass
 
-	sig := hmac.New(sha256.New, []byte(auth.clientsecret))
-	sig.Write([]byte(user + auth.clientid))
+	sig := hmac.New(sha256.New, []byte(clientsecret))
+	sig.Write([]byte(user + clientid))
 	secret_hash := base64.StdEncoding.EncodeToString(sig.Sum(nil))
 	params["SECRET_HASH"] = &secret_hash
 
 	req := &cognitoidentityprovider.AdminInitiateAuthInput{}
 	req = req.SetAuthFlow("ADMIN_NO_SRP_AUTH").
 		SetAuthParameters(params).
-		SetClientId(auth.clientid).
-		SetUserPoolId(auth.poolid)
+		SetClientId(clientid).
+		SetUserPoolId(poolid)
 	if validateErr := req.Validate(); validateErr != nil {
+		authFailures.WithLabelValues("credentials").Inc()
 		return "", "", errors.Wrap(validateErr, "got validation error")
 	}
 
 	output, err := svc.AdminInitiateAuth(req)
 	if err != nil {
+		authFailures.WithLabelValues("credentials").Inc()
 		return "", "", errors.Wrap(err, "initiate auth err")
 	}
 
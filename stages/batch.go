@@ -0,0 +1,279 @@
+package stages
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	mortarpb "github.com/SoftwareDefinedBuildings/mortar/proto"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// fetchBatcher collects the points for one UUID of a DataFrame and sends them
+// to the client in TS_BATCH_SIZE chunks, applying the DataFrame's fill policy
+// on the way
+type fetchBatcher struct {
+	req         *Request
+	dataFrame   string
+	identifier  string
+	aggregation mortarpb.AggFunc
+
+	resp   *mortarpb.FetchResponse
+	filler *gapFiller
+	// for resumable fetches, the position of the UUID; points at or before its time are
+	// not sent again
+	resume *resumePosition
+	// false once the request is done; we stop sending but callers keep
+	// draining their sources
+	live bool
+	// number of points the backend returned, before filling gaps
+	read int64
+}
+
+func newFetchBatcher(req *Request, dataFrame *mortarpb.DataFrame, identifier string, start, end int64) (*fetchBatcher, error) {
+	b := &fetchBatcher{
+		req:         req,
+		dataFrame:   dataFrame.Name,
+		identifier:  identifier,
+		aggregation: dataFrame.Aggregation,
+		resp:        &mortarpb.FetchResponse{},
+		live:        true,
+		resume:      req.resume,
+	}
+	filler, err := newGapFiller(dataFrame, start, end, b.emit)
+	if err != nil {
+		return nil, err
+	}
+	b.filler = filler
+	return b, nil
+}
+
+// add a point to the current batch
+func (b *fetchBatcher) add(t int64, v float64) {
+	b.read++
+	if b.filler != nil {
+		b.filler.push(t, v)
+	} else {
+		b.emit(t, v, mortarpb.DataQuality_DATA_QUALITY_OBSERVED)
+	}
+}
+
+func (b *fetchBatcher) emit(t int64, v float64, q mortarpb.DataQuality) {
+	if b.resume != nil && t <= b.resume.time {
+		return
+	}
+	b.resp.Times = append(b.resp.Times, t)
+	b.resp.Values = append(b.resp.Values, v)
+	if b.filler != nil {
+		b.resp.Quality = append(b.resp.Quality, q)
+	}
+	if len(b.resp.Times) == TS_BATCH_SIZE {
+		b.send()
+	}
+}
+
+// flush sends any points left over
+func (b *fetchBatcher) flush() {
+	if b.filler != nil {
+		b.filler.flush()
+	}
+	if len(b.resp.Times) > 0 {
+		b.send()
+	}
+}
+
+// finish sends any points left over at the end of the UUID, and counts the UUID as missing
+// if the backend returned no points for it. For backends without streams, which cannot
+// tell a UUID they do not have from one with no data in the time range
+func (b *fetchBatcher) finish() {
+	b.flush()
+	if b.read == 0 {
+		b.req.stats.uuidMissing(b.dataFrame)
+	}
+}
+
+func (b *fetchBatcher) send() {
+	resp := b.resp
+	b.resp = &mortarpb.FetchResponse{}
+	if !b.live {
+		return
+	}
+	resp.DataFrame = b.dataFrame
+	resp.Identifier = b.identifier
+	if b.resume != nil {
+		b.resume.time = resp.Times[len(resp.Times)-1]
+		resp.ResumeToken = b.resume.token()
+	}
+	select {
+	case b.req.fetch_responses <- resp:
+		b.req.stats.addPoints(b.dataFrame, len(resp.Times))
+		pointsReturned.WithLabelValues(b.req.uuid_sites[b.identifier], b.aggregation.String()).Add(float64(len(resp.Times)))
+	case <-b.req.Done():
+		b.live = false
+	}
+}
+
+// how many batches of each UUID are buffered while waiting to be delivered in order
+const orderedFetchBuffer = 4
+
+// fetchConcurrently calls fetch for each UUID of each DataFrame in the request, running up to
+// concurrency calls at once, and records how long each call to the backend takes. The context passed to fetch is
+// cancelled when the request is done or any call fails; the first error is returned. In a
+// best-effort Fetch, UUIDs that cannot be parsed or read are reported to the client instead,
+// and the others are still read.
+//
+// fetch sends its responses to out. Unless ordered, out is the request itself and responses
+// of different UUIDs are interleaved as they arrive. If ordered, all responses of a UUID are
+// delivered before those of the next one, in the order of the request; later UUIDs are read
+// ahead but only buffer a few batches each. Resumable requests are always ordered, and UUIDs
+// before the resume token are skipped
+func fetchConcurrently(req *Request, backend string, concurrency int, ordered bool, fetch func(ctx context.Context, out *Request, dataFrame *mortarpb.DataFrame, uuStr string) error) (fetchErr error) {
+	ctx, span := startSpan(req.ctx, "read timeseries")
+	defer func() { endSpan(span, fetchErr) }()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	resumable := isResumable(req)
+	resume := resumeFrom(req)
+	ordered = ordered || resumable
+	bestEffort := isBestEffort(req)
+
+	var (
+		wg      sync.WaitGroup
+		errOnce sync.Once
+		sem     = make(chan struct{}, concurrency)
+		// response channels of the UUIDs in order; drained by forwardOrdered
+		pending   = make(chan chan *mortarpb.FetchResponse, concurrency)
+		forwarded = make(chan struct{})
+	)
+	if ordered {
+		go func() {
+			defer close(forwarded)
+			forwardOrdered(ctx, req, pending)
+		}()
+	} else {
+		close(forwarded)
+	}
+
+	var numUUIDs int
+	for _, dataFrame := range req.fetch_request.DataFrames {
+		for _, uuStr := range dataFrame.Uuids {
+			if uuid.Parse(uuStr) != nil {
+				numUUIDs++
+			}
+		}
+	}
+	req.progress.addUUIDs(numUUIDs)
+	span.SetAttributes(attribute.Int("uuids", numUUIDs), attribute.Int("concurrency", concurrency))
+
+fetchLoop:
+	for dfIdx, dataFrame := range req.fetch_request.DataFrames {
+		for uuIdx, uuStr := range dataFrame.Uuids {
+			if uuid.Parse(uuStr) == nil {
+				err := errors.Errorf("Could not parse uuid %s", uuStr)
+				if !bestEffort {
+					errOnce.Do(func() {
+						fetchErr = invalidArgument(err)
+						cancel()
+					})
+					break fetchLoop
+				}
+				req.partialError(req.uuidFailure(dataFrame.Name, uuStr, err))
+				continue
+			}
+			var position *resumePosition
+			if resumable {
+				pos := uuidPosition(req, dfIdx, uuIdx, resume)
+				if resume != nil && pos.uuidBefore(*resume) {
+					// delivered before the fetch was interrupted
+					req.progress.uuidDone()
+					continue
+				}
+				position = &pos
+			}
+
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				break fetchLoop
+			}
+
+			out := req
+			if ordered {
+				out = &Request{
+					ctx:             ctx,
+					fetch_request:   req.fetch_request,
+					fetch_responses: make(chan *mortarpb.FetchResponse, orderedFetchBuffer),
+					uuid_sites:      req.uuid_sites,
+					uuid_views:      req.uuid_views,
+					stats:           req.stats,
+					resume:          position,
+				}
+				select {
+				case pending <- out.fetch_responses:
+				case <-ctx.Done():
+					<-sem
+					break fetchLoop
+				}
+			}
+
+			wg.Add(1)
+			go func(out *Request, dataFrame *mortarpb.DataFrame, uuStr string) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				if ordered {
+					defer close(out.fetch_responses)
+				}
+				uuidCtx, uuidSpan := startSpan(ctx, "read uuid")
+				uuidSpan.SetAttributes(
+					attribute.String("uuid", uuStr),
+					attribute.String("dataFrame", dataFrame.Name),
+					attribute.String("aggregation", dataFrame.Aggregation.String()),
+					attribute.String("window", dataFrame.Window),
+				)
+				start := time.Now()
+				err := fetch(uuidCtx, out, dataFrame, uuStr)
+				timeseriesReadTimes.WithLabelValues(backend, dataFrame.Aggregation.String()).Observe(time.Since(start).Seconds())
+				endSpan(uuidSpan, err)
+				if errors.Cause(err) == errStreamNotExist {
+					req.stats.uuidMissing(dataFrame.Name)
+				}
+				if err != nil && bestEffort && ctx.Err() == nil {
+					// the other UUIDs are still read
+					failure := req.uuidFailure(dataFrame.Name, uuStr, err)
+					if req.recordFailure(failure) {
+						out.send(failure.response())
+					}
+				} else if err != nil {
+					errOnce.Do(func() {
+						fetchErr = err
+						cancel()
+					})
+					return
+				}
+				req.progress.uuidDone()
+			}(out, dataFrame, uuStr)
+		}
+	}
+	wg.Wait()
+	close(pending)
+	<-forwarded
+
+	return fetchErr
+}
+
+// forwardOrdered sends the responses of each channel in pending to the request, one
+// channel at a time, until pending is closed or ctx is done
+func forwardOrdered(ctx context.Context, req *Request, pending chan chan *mortarpb.FetchResponse) {
+	for responses := range pending {
+		for resp := range responses {
+			select {
+			case req.fetch_responses <- resp:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
@@ -6,8 +6,10 @@ import (
 	"github.com/gtfierro/hoddb/hod"
 	logpb "github.com/gtfierro/hoddb/proto"
 	mortarpb "github.com/SoftwareDefinedBuildings/mortar/proto"
+	"github.com/heptiolabs/healthcheck"
 	"github.com/pkg/errors"
 	logrus "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 	"os"
 	"strings"
 	"sync"
@@ -22,6 +24,9 @@ func init() {
 	log.SetLevel(logrus.DebugLevel)
 }
 
+// number of Brick workers that only take Qualify requests
+const priorityWorkers = 2
+
 type BrickQueryStage struct {
 	upstream Stage
 	ctx      context.Context
@@ -30,6 +35,7 @@ type BrickQueryStage struct {
 	db            *hod.HodDB
 	highwatermark int64
 
+	workers sync.WaitGroup
 	sync.Mutex
 }
 
@@ -45,7 +51,7 @@ func NewBrickQueryStage(cfg *BrickQueryStageConfig) (*BrickQueryStage, error) {
 	}
 	stage := &BrickQueryStage{
 		upstream: cfg.Upstream,
-		output:   make(chan *Request),
+		output:   newQueue("timeseries"),
 		ctx:      cfg.StageContext,
 	}
 
@@ -72,39 +78,57 @@ func NewBrickQueryStage(cfg *BrickQueryStageConfig) (*BrickQueryStage, error) {
 	log.Infof("Done loading Brick. Took %s", time.Since(start))
 
 	num_workers := 10
+	busy := workerGauges(stage, "brick", num_workers)
+	var priority chan *Request
+	if queuer, ok := stage.upstream.(PriorityQueuer); ok {
+		priority = queuer.GetPriorityQueue()
+	}
 	// consume function
 	for i := 0; i < num_workers; i++ {
+		input := stage.upstream.GetQueue()
+		if i < priorityWorkers && priority != nil {
+			// keep some workers for Qualify requests, so they are not stuck behind
+			// Fetches waiting on a saturated timeseries stage
+			input = nil
+		}
+		stage.workers.Add(1)
 		go func() {
-			input := stage.upstream.GetQueue()
+			defer stage.workers.Done()
 			for {
-				select {
-				case req := <-input:
-					if req.fetch_request != nil {
-						// handle metadata stage of fetch request
-						if len(req.fetch_request.Sites) > 0 && len(req.fetch_request.Views) > 0 {
-							if err := stage.processQuery(req); err != nil {
-								log.Println(err)
-								req.addError(err)
-							}
-						}
-						stage.output <- req
-					} else if req.qualify_request != nil {
-						// handle qualify request
-						if len(req.qualify_request.Required) > 0 {
-							if err := stage.processQualify(req); err != nil {
-								req.addError(err)
-								req.qualify_responses <- &mortarpb.QualifyResponse{
-									Error: err.Error(),
-								}
-							}
-						}
-					}
-
-				case <-stage.ctx.Done():
+				req := takeRequest(stage.ctx, priority, input)
+				if req == nil {
 					// case that breaks the stage and releases resources
 					fmt.Println("Ending Brick Queue")
 					return
 				}
+				if !req.start() {
+					// the client gave up while the request was queued
+					continue
+				}
+				busy.Inc()
+				if req.fetch_request != nil {
+					var err error
+					// handle metadata stage of fetch request
+					if len(req.fetch_request.Sites) > 0 && len(req.fetch_request.Views) > 0 {
+						err = stage.processQuery(req)
+					}
+					if err == nil {
+						// waits while the timeseries stage is saturated, for as long as
+						// the request lasts
+						err = enqueue(req.ctx, "timeseries", stage.output, req)
+					}
+					if err != nil {
+						log.Println(err)
+						req.addError(err)
+					}
+				} else if req.qualify_request != nil {
+					// handle qualify request
+					if err := stage.processQualify(req); err != nil {
+						log.Error(err)
+						req.addError(err)
+					}
+				}
+				busy.Dec()
 			}
 		}()
 	}
@@ -112,6 +136,12 @@ func NewBrickQueryStage(cfg *BrickQueryStageConfig) (*BrickQueryStage, error) {
 	return stage, nil
 }
 
+// Close closes HodDB once the workers have stopped. The StageContext must be done
+func (stage *BrickQueryStage) Close() error {
+	stage.workers.Wait()
+	return stage.db.Close()
+}
+
 // get the stage we pull from
 func (stage *BrickQueryStage) GetUpstream() Stage {
 	stage.Lock()
@@ -137,6 +167,15 @@ func (stage *BrickQueryStage) String() string {
 	return "<| brick stage |>"
 }
 
+func (stage *BrickQueryStage) ReadinessChecks() map[string]healthcheck.Check {
+	return workerChecks(stage, nil, false)
+}
+
+// Brick queries cannot be cancelled, so workers stuck on one are only freed by a restart
+func (stage *BrickQueryStage) LivenessChecks() map[string]healthcheck.Check {
+	return workerChecks(stage, nil, true)
+}
+
 func (stage *BrickQueryStage) processQualify(req *Request) error {
 	brickresp := &mortarpb.QualifyResponse{}
 
@@ -149,15 +188,10 @@ func (stage *BrickQueryStage) processQualify(req *Request) error {
 	}
 	version_response, err := stage.db.Versions(req.ctx, version_query)
 	if err != nil {
-		req.addError(err)
-		log.Error(err)
 		return err
 	}
 	if version_response.Error != "" {
-		err = errors.New(version_response.Error)
-		log.Error(err)
-		req.addError(err)
-		return err
+		return errors.New(version_response.Error)
 	}
 
 	for _, row := range version_response.Rows {
@@ -167,18 +201,18 @@ func (stage *BrickQueryStage) processQualify(req *Request) error {
 	for _, querystring := range req.qualify_request.Required {
 		query, err := stage.db.ParseQuery(querystring, 0)
 		if err != nil {
-			req.addError(err)
-			log.Error(err)
-			return err
+			return invalidArgument(err)
 		}
 
 		for site := range sites {
 			query.Graphs = []string{site}
+			selectStart := time.Now()
 			res, err := stage.db.Select(req.ctx, query)
+			brickQueryTimes.WithLabelValues(site).Observe(time.Since(selectStart).Seconds())
 			if err != nil {
-				log.Error(err)
-				req.addError(err)
-				//return err
+				// we cannot tell whether the site qualifies
+				req.partialError(requestFailure{site: site, err: err})
+				delete(sites, site)
 			} else if len(res.Rows) == 0 {
 				delete(sites, site)
 			}
@@ -187,14 +221,21 @@ func (stage *BrickQueryStage) processQualify(req *Request) error {
 	for site := range sites {
 		brickresp.Sites = append(brickresp.Sites, site)
 	}
-	req.qualify_responses <- brickresp
+	brickresp.Error = req.failureSummary()
+	req.respond(brickresp)
 
 	return nil
 }
 
 // We need to rethink how the Brick stage handles the view + dataFrame processing
 
-func (stage *BrickQueryStage) processQuery(req *Request) error {
+func (stage *BrickQueryStage) processQuery(req *Request) (err error) {
+	ctx, span := startSpan(req.ctx, "brick query")
+	defer func() { endSpan(span, err) }()
+	start := time.Now()
+	defer func() { req.stats.brickFinished(time.Since(start)) }()
+	req.stats.brickQueried(len(req.fetch_request.Sites), stage.highwatermark)
+
 	// store view name -> list of dataVars
 	var viewDataVars = make(map[string][]string)
 	// store view name -> list of indexes to dependent dataFrames
@@ -219,11 +260,13 @@ func (stage *BrickQueryStage) processQuery(req *Request) error {
 	log.Info("DataVars: ", viewDataVars)
 	log.Info("DataFrames: ", viewDataFrames)
 
+	req.uuid_sites = make(map[string]string)
+	req.uuid_views = make(map[string]string)
+
 	for _, view := range req.fetch_request.Views {
 		query, err := stage.db.ParseQuery(view.Definition, stage.highwatermark)
 		if err != nil {
-			req.addError(err)
-			return err
+			return invalidArgument(errors.Wrapf(err, "Could not parse view %s", view.Name))
 		}
 
 		// this rewrites the incoming query so that it extracts the UUIDs (bf:uuid property) for each of the
@@ -233,12 +276,20 @@ func (stage *BrickQueryStage) processQuery(req *Request) error {
 		mapping, _ := rewriteQuery(viewDataVars[view.Name], query)
 		for _, sitename := range req.fetch_request.Sites {
 			query.Graphs = []string{sitename}
+			_, selectSpan := startSpan(ctx, "select")
+			selectSpan.SetAttributes(attribute.String("view", view.Name), attribute.String("site", sitename))
+			selectStart := time.Now()
 			res, err := stage.db.Select(req.ctx, query)
+			brickQueryTimes.WithLabelValues(sitename).Observe(time.Since(selectStart).Seconds())
+			if err == nil {
+				selectSpan.SetAttributes(attribute.Int("rows", len(res.Rows)))
+				req.stats.addViewRows(sitename, view.Name, len(res.Rows))
+			}
+			endSpan(selectSpan, err)
 			if err != nil {
-				log.Error(err)
-				req.addError(err)
+				// the other sites can still be read
+				req.partialError(requestFailure{site: sitename, view: view.Name, err: err})
 				continue
-				//return err
 			}
 
 			// collate the UUIDs from query results and push into context.
@@ -266,7 +317,10 @@ func (stage *BrickQueryStage) processQuery(req *Request) error {
 						if ts.View == view.Name {
 							for _, dataVar := range ts.DataVars {
 								uuidx := mapping[dataVar]
-								dataFrame.Uuids = append(dataFrame.Uuids, stripQuotes(row.Values[uuidx].Value))
+								uuStr := stripQuotes(row.Values[uuidx].Value)
+								dataFrame.Uuids = append(dataFrame.Uuids, uuStr)
+								req.uuid_sites[uuStr] = sitename
+								req.uuid_views[uuStr] = view.Name
 							}
 						}
 					}
@@ -278,8 +332,10 @@ func (stage *BrickQueryStage) processQuery(req *Request) error {
 				brickresp.Rows = append(brickresp.Rows, transformRow(row))
 			}
 
-			// send the query results to the client
-			req.fetch_responses <- brickresp
+			// send the query results to the client, unless it got them before being interrupted
+			if req.fetch_request.ResumeToken == "" && !req.send(brickresp) {
+				return nil
+			}
 		}
 
 	}
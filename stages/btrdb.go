@@ -0,0 +1,268 @@
+package stages
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+	"gopkg.in/btrdb.v4"
+)
+
+// how long a single health check of an endpoint may take
+const btrdbHealthCheckTimeout = 5 * time.Second
+
+// BTrDBClusterConfig names one BTrDB cluster and the endpoints we can reach it through
+type BTrDBClusterConfig struct {
+	Name      string
+	Endpoints []string
+}
+
+// btrdbCluster keeps a pool of connections to each endpoint of one BTrDB cluster.
+// Endpoints that fail a health check are taken out of rotation until they pass one again
+type btrdbCluster struct {
+	name string
+	// connections opened through each endpoint
+	poolSize int
+	// round-robin counter over conns
+	next uint32
+
+	// conns change when the endpoints are reconfigured
+	sync.RWMutex
+	conns []*btrdbConn
+}
+
+// btrdbConn is one connection in a cluster's pool
+type btrdbConn struct {
+	endpoint string
+	sync.Mutex
+	conn    *btrdb.BTrDB
+	healthy bool
+}
+
+// connectCluster opens poolSize connections through each endpoint of the cluster. Endpoints
+// that cannot be reached are kept and retried by the health checks; it is an error if none
+// of them can be reached
+func connectCluster(ctx context.Context, cfg BTrDBClusterConfig, poolSize int) (*btrdbCluster, error) {
+	if len(cfg.Endpoints) == 0 {
+		return nil, errors.Errorf("Need to specify Endpoints for BTrDB cluster %s", cfg.Name)
+	}
+	if poolSize <= 0 {
+		poolSize = 1
+	}
+	cluster := &btrdbCluster{name: cfg.Name, poolSize: poolSize}
+	var healthy int
+	for _, endpoint := range cfg.Endpoints {
+		for i := 0; i < poolSize; i++ {
+			c := &btrdbConn{endpoint: endpoint}
+			if err := c.check(ctx); err != nil {
+				log.Warningf("Could not connect to BTrDB cluster %s at %s: %v", cfg.Name, endpoint, err)
+			} else {
+				healthy++
+			}
+			cluster.conns = append(cluster.conns, c)
+		}
+	}
+	if healthy == 0 {
+		return nil, errors.Errorf("Could not connect to BTrDB cluster %s at any of %v", cfg.Name, cfg.Endpoints)
+	}
+	log.Infof("Connected to BTrDB cluster %s (%d/%d connections healthy)", cfg.Name, healthy, len(cluster.conns))
+	return cluster, nil
+}
+
+// check connects if needed and asks the endpoint for cluster info, updating the health of the connection
+func (c *btrdbConn) check(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, btrdbHealthCheckTimeout)
+	defer cancel()
+
+	c.Lock()
+	conn := c.conn
+	c.Unlock()
+
+	err := func() error {
+		if conn == nil {
+			var err error
+			if conn, err = btrdb.Connect(ctx, c.endpoint); err != nil {
+				return err
+			}
+		}
+		ep, err := conn.GetAnyEndpoint(ctx)
+		if err != nil {
+			return err
+		}
+		_, _, err = ep.Info(ctx)
+		return err
+	}()
+
+	c.Lock()
+	defer c.Unlock()
+	if conn != nil && c.conn == nil {
+		c.conn = conn
+	} else if conn != nil && c.conn != conn {
+		// another check connected first
+		if err := conn.Disconnect(); err != nil {
+			log.Warning(errors.Wrapf(err, "Could not disconnect from BTrDB at %s", c.endpoint))
+		}
+	}
+	c.healthy = err == nil
+	return err
+}
+
+// markUnhealthy takes the connection out of rotation after a request on conn failed,
+// until the next health check passes
+func (c *btrdbConn) markUnhealthy(conn *btrdb.BTrDB) {
+	c.Lock()
+	defer c.Unlock()
+	if c.conn == conn {
+		c.healthy = false
+	}
+}
+
+// get returns a healthy connection, rotating through the pool
+func (cluster *btrdbCluster) get() (*btrdb.BTrDB, error) {
+	_, conn, err := cluster.pick()
+	return conn, err
+}
+
+// pick returns a healthy connection and the pool entry it came from
+func (cluster *btrdbCluster) pick() (*btrdbConn, *btrdb.BTrDB, error) {
+	conns := cluster.connections()
+	n := uint32(len(conns))
+	start := atomic.AddUint32(&cluster.next, 1)
+	for i := uint32(0); i < n; i++ {
+		c := conns[(start+i)%n]
+		c.Lock()
+		conn, healthy := c.conn, c.healthy
+		c.Unlock()
+		if healthy && conn != nil {
+			return c, conn, nil
+		}
+	}
+	return nil, nil, errors.Errorf("No healthy endpoints for BTrDB cluster %s", cluster.name)
+}
+
+func (cluster *btrdbCluster) connections() []*btrdbConn {
+	cluster.RLock()
+	defer cluster.RUnlock()
+	return cluster.conns
+}
+
+// close disconnects every connection of the cluster
+func (cluster *btrdbCluster) close() {
+	for _, c := range cluster.connections() {
+		c.close(cluster.name)
+	}
+}
+
+func (c *btrdbConn) close(cluster string) {
+	c.Lock()
+	defer c.Unlock()
+	if c.conn != nil {
+		if err := c.conn.Disconnect(); err != nil {
+			log.Warning(errors.Wrapf(err, "Could not disconnect from BTrDB cluster %s at %s", cluster, c.endpoint))
+		}
+		c.conn = nil
+	}
+	c.healthy = false
+}
+
+// setEndpoints opens connections through the endpoints added to the cluster and takes those
+// through removed endpoints out of rotation. The removed connections are closed once the
+// requests that may be using them have timed out
+func (cluster *btrdbCluster) setEndpoints(ctx context.Context, endpoints []string) {
+	wanted := make(map[string]bool)
+	for _, endpoint := range endpoints {
+		wanted[endpoint] = true
+	}
+
+	cluster.Lock()
+	var conns, added, removed []*btrdbConn
+	have := make(map[string]bool)
+	for _, c := range cluster.conns {
+		if wanted[c.endpoint] {
+			conns = append(conns, c)
+			have[c.endpoint] = true
+		} else {
+			removed = append(removed, c)
+		}
+	}
+	for _, endpoint := range endpoints {
+		if have[endpoint] {
+			continue
+		}
+		have[endpoint] = true
+		log.Infof("Adding endpoint %s to BTrDB cluster %s", endpoint, cluster.name)
+		for i := 0; i < cluster.poolSize; i++ {
+			added = append(added, &btrdbConn{endpoint: endpoint})
+		}
+	}
+	cluster.conns = append(conns, added...)
+	cluster.Unlock()
+
+	for _, c := range added {
+		go func(c *btrdbConn) {
+			if err := c.check(ctx); err != nil {
+				log.Warningf("Could not connect to BTrDB cluster %s at %s: %v", cluster.name, c.endpoint, err)
+			}
+		}(c)
+	}
+	for _, c := range removed {
+		if have[c.endpoint] {
+			continue
+		}
+		have[c.endpoint] = true
+		log.Infof("Removing endpoint %s from BTrDB cluster %s", c.endpoint, cluster.name)
+	}
+	for _, c := range removed {
+		c := c
+		time.AfterFunc(requestTimeout, func() { c.close(cluster.name) })
+	}
+}
+
+// healthCheck checks every connection of the cluster each interval until ctx is done
+func (cluster *btrdbCluster) healthCheck(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, c := range cluster.connections() {
+				c.Lock()
+				wasHealthy := c.healthy
+				c.Unlock()
+				err := c.check(ctx)
+				if err != nil && wasHealthy {
+					log.Warningf("BTrDB cluster %s endpoint %s is unhealthy; removing from rotation: %v", cluster.name, c.endpoint, err)
+				} else if err == nil && !wasHealthy {
+					log.Infof("BTrDB cluster %s endpoint %s is healthy again", cluster.name, c.endpoint)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// exists checks if the stream is stored in the cluster
+func (cluster *btrdbCluster) exists(ctx context.Context, streamuuid uuid.UUID) (bool, error) {
+	c, conn, err := cluster.pick()
+	if err != nil {
+		return false, err
+	}
+	exists, err := conn.StreamFromUUID(streamuuid).Exists(ctx)
+	if err != nil {
+		// 501 from the cluster means the stream is not there. Other errors, like a lost
+		// connection, tell us nothing about the stream
+		if e, ok := err.(*btrdb.CodedError); ok && e.Code == 501 {
+			return false, nil
+		}
+		if ctx.Err() == nil {
+			log.Warningf("BTrDB cluster %s endpoint %s is unhealthy; removing from rotation: %v", cluster.name, c.endpoint, err)
+			c.markUnhealthy(conn)
+		}
+		return false, errors.Wrapf(err, "Could not fetch stream from cluster %s", cluster.name)
+	}
+	return exists, nil
+}
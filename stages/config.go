@@ -1,8 +1,14 @@
 package stages
 
 import (
+	"fmt"
+	"github.com/pkg/errors"
 	"github.com/spf13/viper"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"time"
 )
 
 type Config struct {
@@ -22,9 +28,125 @@ type Config struct {
 	InfluxDBUser   string
 	InfluxDBPass   string
 	PrometheusAddr string
+	// HTTP API (JSON gateway and Export); disabled if empty
+	HTTPListenAddr string
+	// origins allowed to call the HTTP API from a browser
+	CORSAllowedOrigins []string
+
+	// BTrDB clusters, connection pool and concurrency
+	BTrDB BTrDBConfig
+
+	// InfluxDB data layout
+	InfluxDBDatabase    string
+	InfluxDBMeasurement string
+	InfluxDBUUIDTag     string
+	InfluxDBValueField  string
+	InfluxDBChunkSize   int
+	// number of UUIDs queried concurrently per request
+	InfluxDBConcurrency int
 
 	TLSCrtFile string
 	TLSKeyFile string
+
+	// InfluxDB 2.x
+	InfluxDB2 InfluxDB2Config
+
+	// PostgreSQL/TimescaleDB
+	Timescale TimescaleConfig
+
+	// directory of Arrow and Parquet files
+	Arrow ArrowConfig
+
+	// routes UUIDs to backends when TimeseriesBackend is federated
+	Federated FederatedConfig
+
+	// storage of fetch job results
+	Jobs FetchJobsConfig
+
+	// export of request traces
+	Tracing TracingConfig
+
+	// record of who queried which data
+	Audit AuditConfig
+
+	// size of the queues between stages and admission of requests when they are full
+	Queues QueueConfig
+
+	// how long requests in flight get to finish on shutdown
+	ShutdownTimeout time.Duration
+
+	// one of the logrus levels: panic, fatal, error, warning, info, debug or trace
+	LogLevel string
+
+	// which timeseries stage to run: btrdb, influxdb, influxdb2, timescale, arrow or federated
+	TimeseriesBackend string
+}
+
+type FederatedConfig struct {
+	// backend for UUIDs that match no route
+	Default string
+	// checked in order; the first route matching a UUID wins
+	Routes []RouteConfig
+}
+
+type ArrowConfig struct {
+	// directory searched for .arrow and .parquet files
+	Directory   string
+	UUIDColumn  string
+	TimeColumn  string
+	ValueColumn string
+	// number of UUIDs read concurrently per request
+	Concurrency int
+}
+
+type TimescaleConfig struct {
+	// lib/pq connection string
+	ConnString string
+	// table holding (uuid, time, value) rows
+	Table       string
+	UUIDColumn  string
+	TimeColumn  string
+	ValueColumn string
+	// number of UUIDs queried concurrently per request
+	Concurrency int
+	// rows fetched from the cursor at a time
+	FetchSize      int
+	MaxConnections int
+}
+
+type BTrDBConfig struct {
+	// if empty, BTrDBAddr is used as the only endpoint of a single cluster
+	Clusters []BTrDBClusterConfig
+	// connections opened through each endpoint
+	ConnectionsPerEndpoint int
+	// how often endpoints are checked; unhealthy ones are taken out of rotation
+	HealthCheckInterval time.Duration
+	// number of requests handled at once
+	Workers int
+	// number of UUIDs read concurrently per request
+	Concurrency int
+	// send each UUID's data in request order rather than interleaved
+	OrderedDelivery bool
+	// how often Subscribe checks streams for new data
+	SubscribePollInterval time.Duration
+	// how long after a window closes Subscribe waits for late points before reading it
+	SubscribeDelay time.Duration
+	// number of subscriptions served at once
+	MaxSubscriptions int
+}
+
+type InfluxDB2Config struct {
+	// base URL of the server, e.g. http://localhost:8086
+	Address string
+	Token   string
+	Org     string
+	Bucket  string
+	// if empty, all measurements are searched for each UUID
+	Measurement string
+	UUIDTag     string
+	ValueField  string
+	// number of UUIDs queried concurrently per request
+	Concurrency int
 }
 
 type WAVEConfig struct {
@@ -62,7 +184,7 @@ type CognitoAuthConfig struct {
 	Region string
 }
 
-func getCfg() *Config {
+func getCfg() (*Config, error) {
 	viper.SetDefault("Cognito.AppClientId", os.Getenv("COGNITO_APP_CLIENT_ID"))
 	viper.SetDefault("Cognito.AppClientSecret", os.Getenv("COGNITO_APP_CLIENT_SECRET"))
 	viper.SetDefault("Cognito.PoolId", os.Getenv("COGNITO_POOL_ID"))
@@ -82,11 +204,61 @@ func getCfg() *Config {
 
 	viper.SetDefault("HodConfig", os.Getenv("HODCONFIG_LOCATION"))
 	viper.SetDefault("BTrDBAddr", os.Getenv("BTRDB_ADDRESS"))
+	viper.SetDefault("BTrDB.ConnectionsPerEndpoint", 1)
+	viper.SetDefault("BTrDB.HealthCheckInterval", "30s")
+	viper.SetDefault("BTrDB.Workers", 20)
+	viper.SetDefault("BTrDB.Concurrency", 4)
+	viper.SetDefault("BTrDB.SubscribePollInterval", "5s")
+	viper.SetDefault("BTrDB.SubscribeDelay", "10s")
+	viper.SetDefault("BTrDB.MaxSubscriptions", 100)
 	viper.SetDefault("InfluxDBAddr", os.Getenv("INFLUXDB_ADDRESS"))
 	viper.SetDefault("InfluxDBUser", os.Getenv("INFLUXDB_USER"))
 	viper.SetDefault("InfluxDBPass", os.Getenv("INFLUXDB_PASS"))
+	viper.SetDefault("InfluxDBDatabase", "xbos")
+	viper.SetDefault("InfluxDBMeasurement", "timeseries")
+	viper.SetDefault("InfluxDBUUIDTag", "uuid")
+	viper.SetDefault("InfluxDBValueField", "value")
+	viper.SetDefault("InfluxDBChunkSize", 10000)
+	viper.SetDefault("InfluxDBConcurrency", 4)
+	viper.SetDefault("InfluxDB2.Address", os.Getenv("INFLUXDB2_ADDRESS"))
+	viper.SetDefault("InfluxDB2.Token", os.Getenv("INFLUXDB2_TOKEN"))
+	viper.SetDefault("InfluxDB2.Org", os.Getenv("INFLUXDB2_ORG"))
+	viper.SetDefault("InfluxDB2.Bucket", os.Getenv("INFLUXDB2_BUCKET"))
+	viper.SetDefault("InfluxDB2.UUIDTag", "uuid")
+	viper.SetDefault("InfluxDB2.ValueField", "value")
+	viper.SetDefault("InfluxDB2.Concurrency", 4)
+	viper.SetDefault("Timescale.ConnString", os.Getenv("TIMESCALE_CONNSTRING"))
+	viper.SetDefault("Timescale.Table", "timeseries")
+	viper.SetDefault("Timescale.UUIDColumn", "uuid")
+	viper.SetDefault("Timescale.TimeColumn", "time")
+	viper.SetDefault("Timescale.ValueColumn", "value")
+	viper.SetDefault("Timescale.Concurrency", 4)
+	viper.SetDefault("Timescale.FetchSize", 5000)
+	viper.SetDefault("Arrow.Directory", os.Getenv("MORTAR_ARROW_DIRECTORY"))
+	viper.SetDefault("Arrow.UUIDColumn", "uuid")
+	viper.SetDefault("Arrow.TimeColumn", "time")
+	viper.SetDefault("Arrow.ValueColumn", "value")
+	viper.SetDefault("Arrow.Concurrency", 4)
+	viper.SetDefault("Jobs.Directory", filepath.Join(os.TempDir(), "mortar-jobs"))
+	viper.SetDefault("Jobs.TTL", "24h")
+	viper.SetDefault("Jobs.MaxRunning", 4)
+	viper.SetDefault("Jobs.Timeout", 0)
+	viper.SetDefault("Tracing.Endpoint", os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"))
+	viper.SetDefault("Tracing.ServiceName", "mortar")
+	viper.SetDefault("Tracing.SampleRatio", 1.0)
+	viper.SetDefault("Audit.File", os.Getenv("MORTAR_AUDIT_LOG"))
+	viper.SetDefault("Audit.MaxSizeMB", 100)
+	viper.SetDefault("Audit.MaxBackups", 10)
+	viper.SetDefault("Queues.Capacity", 100)
+	viper.SetDefault("Queues.PriorityCapacity", 100)
+	viper.SetDefault("Queues.AdmissionWait", "1s")
+	viper.SetDefault("Queues.RetryAfter", "5s")
+	viper.SetDefault("ShutdownTimeout", "30s")
+	viper.SetDefault("LogLevel", "debug")
+	viper.SetDefault("TimeseriesBackend", "btrdb")
 	viper.SetDefault("ListenAddr", os.Getenv("LISTEN_ADDRESS"))
 	viper.SetDefault("PrometheusAddr", os.Getenv("PROMETHEUS_ADDRESS"))
+	viper.SetDefault("HTTPListenAddr", os.Getenv("MORTAR_HTTP_ADDRESS"))
 	viper.SetDefault("TLSCrtFile", os.Getenv("MORTAR_TLS_CRT_FILE"))
 	viper.SetDefault("TLSKeyFile", os.Getenv("MORTAR_TLS_KEY_FILE"))
 
@@ -113,6 +285,84 @@ func getCfg() *Config {
 		Agent:      viper.GetString("WAVE.Agent"),
 	}
 
+	influxdb2cfg := InfluxDB2Config{
+		Address:     viper.GetString("InfluxDB2.Address"),
+		Token:       viper.GetString("InfluxDB2.Token"),
+		Org:         viper.GetString("InfluxDB2.Org"),
+		Bucket:      viper.GetString("InfluxDB2.Bucket"),
+		Measurement: viper.GetString("InfluxDB2.Measurement"),
+		UUIDTag:     viper.GetString("InfluxDB2.UUIDTag"),
+		ValueField:  viper.GetString("InfluxDB2.ValueField"),
+		Concurrency: viper.GetInt("InfluxDB2.Concurrency"),
+	}
+
+	timescalecfg := TimescaleConfig{
+		ConnString:     viper.GetString("Timescale.ConnString"),
+		Table:          viper.GetString("Timescale.Table"),
+		UUIDColumn:     viper.GetString("Timescale.UUIDColumn"),
+		TimeColumn:     viper.GetString("Timescale.TimeColumn"),
+		ValueColumn:    viper.GetString("Timescale.ValueColumn"),
+		Concurrency:    viper.GetInt("Timescale.Concurrency"),
+		FetchSize:      viper.GetInt("Timescale.FetchSize"),
+		MaxConnections: viper.GetInt("Timescale.MaxConnections"),
+	}
+
+	arrowcfg := ArrowConfig{
+		Directory:   viper.GetString("Arrow.Directory"),
+		UUIDColumn:  viper.GetString("Arrow.UUIDColumn"),
+		TimeColumn:  viper.GetString("Arrow.TimeColumn"),
+		ValueColumn: viper.GetString("Arrow.ValueColumn"),
+		Concurrency: viper.GetInt("Arrow.Concurrency"),
+	}
+
+	jobscfg := FetchJobsConfig{
+		Directory:  viper.GetString("Jobs.Directory"),
+		TTL:        viper.GetDuration("Jobs.TTL"),
+		MaxRunning: viper.GetInt("Jobs.MaxRunning"),
+		Timeout:    viper.GetDuration("Jobs.Timeout"),
+	}
+
+	tracingcfg := TracingConfig{
+		Endpoint:    viper.GetString("Tracing.Endpoint"),
+		ServiceName: viper.GetString("Tracing.ServiceName"),
+		SampleRatio: viper.GetFloat64("Tracing.SampleRatio"),
+	}
+
+	auditcfg := AuditConfig{
+		File:           viper.GetString("Audit.File"),
+		MaxSizeMB:      viper.GetInt("Audit.MaxSizeMB"),
+		MaxBackups:     viper.GetInt("Audit.MaxBackups"),
+		Store:          viper.GetString("Audit.Store"),
+		StoreRetention: viper.GetDuration("Audit.StoreRetention"),
+		Admins:         viper.GetStringSlice("Audit.Admins"),
+	}
+
+	queuescfg := QueueConfig{
+		Capacity:         viper.GetInt("Queues.Capacity"),
+		PriorityCapacity: viper.GetInt("Queues.PriorityCapacity"),
+		AdmissionWait:    viper.GetDuration("Queues.AdmissionWait"),
+		RetryAfter:       viper.GetDuration("Queues.RetryAfter"),
+	}
+
+	btrdbcfg := BTrDBConfig{
+		ConnectionsPerEndpoint: viper.GetInt("BTrDB.ConnectionsPerEndpoint"),
+		HealthCheckInterval:    viper.GetDuration("BTrDB.HealthCheckInterval"),
+		Workers:                viper.GetInt("BTrDB.Workers"),
+		Concurrency:            viper.GetInt("BTrDB.Concurrency"),
+		OrderedDelivery:        viper.GetBool("BTrDB.OrderedDelivery"),
+		SubscribePollInterval:  viper.GetDuration("BTrDB.SubscribePollInterval"),
+		SubscribeDelay:         viper.GetDuration("BTrDB.SubscribeDelay"),
+		MaxSubscriptions:       viper.GetInt("BTrDB.MaxSubscriptions"),
+	}
+	if err := viper.UnmarshalKey("BTrDB.Clusters", &btrdbcfg.Clusters); err != nil {
+		return nil, errors.Wrap(err, "Could not read BTrDB clusters")
+	}
+
+	var federatedcfg FederatedConfig
+	if err := viper.UnmarshalKey("Federated", &federatedcfg); err != nil {
+		return nil, errors.Wrap(err, "Could not read Federated config")
+	}
+
 	return &Config{
 		Cognito:        cognito,
 		WAVEMQ:         wavemqcfg,
@@ -124,9 +374,34 @@ func getCfg() *Config {
 		InfluxDBUser:   viper.GetString("InfluxDBUser"),
 		InfluxDBPass:   viper.GetString("InfluxDBPass"),
 		PrometheusAddr: viper.GetString("PrometheusAddr"),
+		HTTPListenAddr: viper.GetString("HTTPListenAddr"),
+		BTrDB:          btrdbcfg,
 		TLSCrtFile:     viper.GetString("TLSCrtFile"),
 		TLSKeyFile:     viper.GetString("TLSKeyFile"),
-	}
+
+		CORSAllowedOrigins: viper.GetStringSlice("CORSAllowedOrigins"),
+
+		InfluxDBDatabase:    viper.GetString("InfluxDBDatabase"),
+		InfluxDBMeasurement: viper.GetString("InfluxDBMeasurement"),
+		InfluxDBUUIDTag:     viper.GetString("InfluxDBUUIDTag"),
+		InfluxDBValueField:  viper.GetString("InfluxDBValueField"),
+		InfluxDBChunkSize:   viper.GetInt("InfluxDBChunkSize"),
+		InfluxDBConcurrency: viper.GetInt("InfluxDBConcurrency"),
+
+		InfluxDB2: influxdb2cfg,
+		Timescale: timescalecfg,
+		Arrow:     arrowcfg,
+		Federated: federatedcfg,
+		Jobs:      jobscfg,
+		Tracing:   tracingcfg,
+		Audit:     auditcfg,
+		Queues:    queuescfg,
+
+		ShutdownTimeout: viper.GetDuration("ShutdownTimeout"),
+		LogLevel:        viper.GetString("LogLevel"),
+
+		TimeseriesBackend: viper.GetString("TimeseriesBackend"),
+	}, nil
 }
 
 func ReadConfig(file string) (*Config, error) {
@@ -137,5 +412,44 @@ func ReadConfig(file string) (*Config, error) {
 		return nil, err
 	}
 
-	return getCfg(), nil
+	return getCfg()
+}
+
+const redacted = "REDACTED"
+
+// password=... in a key/value connection string, with the value optionally quoted
+var connStringPassword = regexp.MustCompile(`(password\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)`)
+
+// String formats the config for logging, with passwords, tokens and secrets masked
+func (cfg Config) String() string {
+	// the fields of a copy are replaced, so the Config is formatted without its String method
+	type config Config
+	masked := config(cfg)
+	if masked.InfluxDBPass != "" {
+		masked.InfluxDBPass = redacted
+	}
+	if masked.InfluxDB2.Token != "" {
+		masked.InfluxDB2.Token = redacted
+	}
+	if masked.Cognito.AppClientSecret != "" {
+		masked.Cognito.AppClientSecret = redacted
+	}
+	masked.Timescale.ConnString = redactConnString(masked.Timescale.ConnString)
+	return fmt.Sprintf("%+v", masked)
+}
+
+// redactConnString masks the password of a lib/pq connection string, which is either a
+// postgres:// URL or a list of key=value pairs
+func redactConnString(conn string) string {
+	if u, err := url.Parse(conn); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
+		if _, hasPassword := u.User.Password(); hasPassword {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+		}
+		if query := u.Query(); query.Get("password") != "" {
+			query.Set("password", redacted)
+			u.RawQuery = query.Encode()
+		}
+		return u.String()
+	}
+	return connStringPassword.ReplaceAllString(conn, "${1}"+redacted)
 }
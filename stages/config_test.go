@@ -0,0 +1,44 @@
+package stages
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConfigStringRedacts(t *testing.T) {
+	cfg := Config{
+		InfluxDBUser: "reader",
+		InfluxDBPass: "influx-pass",
+		InfluxDB2:    InfluxDB2Config{Address: "http://influx:8086", Token: "influx2-token"},
+		Cognito:      CognitoAuthConfig{AppClientId: "client", AppClientSecret: "cognito-secret"},
+		Timescale:    TimescaleConfig{ConnString: "host=db user=mortar password=pg-pass dbname=data"},
+	}
+	for _, format := range []string{(&cfg).String(), cfg.String()} {
+		for _, secret := range []string{"influx-pass", "influx2-token", "cognito-secret", "pg-pass"} {
+			if strings.Contains(format, secret) {
+				t.Errorf("%s is logged: %s", secret, format)
+			}
+		}
+		for _, kept := range []string{"reader", "http://influx:8086", "client", "host=db user=mortar", "dbname=data"} {
+			if !strings.Contains(format, kept) {
+				t.Errorf("%s is missing: %s", kept, format)
+			}
+		}
+	}
+}
+
+func TestRedactConnString(t *testing.T) {
+	for conn, want := range map[string]string{
+		"":                                    "",
+		"host=db dbname=data":                 "host=db dbname=data",
+		"host=db password=secret dbname=data": "host=db password=REDACTED dbname=data",
+		"host=db password = 'sec ret\\' x' sslmode=disable": "host=db password = REDACTED sslmode=disable",
+		"postgres://mortar:secret@db:5432/data":             "postgres://mortar:REDACTED@db:5432/data",
+		"postgresql://mortar@db/data?password=secret":       "postgresql://mortar@db/data?password=REDACTED",
+		"postgres://db/data?sslmode=disable":                "postgres://db/data?sslmode=disable",
+	} {
+		if got := redactConnString(conn); got != want {
+			t.Errorf("redactConnString(%q) = %q, want %q", conn, got, want)
+		}
+	}
+}
@@ -0,0 +1,757 @@
+package stages
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	mortarpb "github.com/SoftwareDefinedBuildings/mortar/proto"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/pkg/errors"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// size of the chunks Export sends files in
+const exportChunkSize = 1 << 20
+
+// size of the row groups of exported Parquet files; each row group is held in memory
+// until it is written
+const exportParquetRowGroupSize = 16 * 1024 * 1024
+
+// exportSink receives the files of an export one after the other
+type exportSink interface {
+	// create starts the next file; the previous one is complete
+	create(name string) (io.Writer, error)
+	// close finishes the last file
+	close() error
+}
+
+// exportParquetRow is a row of the long format Parquet file
+type exportParquetRow struct {
+	Site      string  `parquet:"name=site, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	View      string  `parquet:"name=view, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	DataFrame string  `parquet:"name=dataFrame, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	UUID      string  `parquet:"name=uuid, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	Time      int64   `parquet:"name=time, type=TIMESTAMP_MICROS"`
+	Value     float64 `parquet:"name=value, type=DOUBLE"`
+}
+
+// exportTable holds the Brick query results of one View for its sidecar file
+type exportTable struct {
+	columns []string
+	rows    [][]string
+}
+
+// exporter writes the responses of a Fetch as files to a sink. The long formats are
+// written as the responses arrive; the wide format spools each timeseries to disk and
+// merges them at the end. Brick query results are kept in memory and written last
+type exporter struct {
+	req    *Request
+	format mortarpb.ExportFormat
+	sink   exportSink
+
+	// view name -> query results
+	tables map[string]*exportTable
+
+	csv     *csv.Writer
+	parquet *writer.ParquetWriter
+	spool   *exportSpool
+}
+
+func newExporter(req *Request, format mortarpb.ExportFormat, sink exportSink) (*exporter, error) {
+	e := &exporter{
+		req:    req,
+		format: format,
+		sink:   sink,
+		tables: make(map[string]*exportTable),
+	}
+	switch format {
+	case mortarpb.ExportFormat_EXPORT_FORMAT_CSV_LONG:
+		w, err := sink.create("data.csv")
+		if err != nil {
+			return nil, err
+		}
+		e.csv = csv.NewWriter(w)
+		if err := e.csv.Write([]string{"site", "view", "dataFrame", "uuid", "time", "value"}); err != nil {
+			return nil, err
+		}
+	case mortarpb.ExportFormat_EXPORT_FORMAT_CSV_WIDE:
+		spool, err := newExportSpool(req.fetch_request)
+		if err != nil {
+			return nil, err
+		}
+		e.spool = spool
+	case mortarpb.ExportFormat_EXPORT_FORMAT_PARQUET:
+		w, err := sink.create("data.parquet")
+		if err != nil {
+			return nil, err
+		}
+		pw, err := writer.NewParquetWriter(parquetStreamFile{w}, new(exportParquetRow), 1)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not create Parquet writer")
+		}
+		pw.RowGroupSize = exportParquetRowGroupSize
+		e.parquet = pw
+	default:
+		return nil, errors.Errorf("Unknown export format %s", format)
+	}
+	return e, nil
+}
+
+// add writes or stores one response of the Fetch
+func (e *exporter) add(resp *mortarpb.FetchResponse) error {
+	if len(resp.Variables) > 0 {
+		e.addRows(resp)
+	}
+	if len(resp.Times) == 0 {
+		return nil
+	}
+
+	site, view := resp.Site, resp.View
+	if site == "" {
+		site = e.req.uuid_sites[resp.Identifier]
+	}
+	if view == "" {
+		view = e.req.uuid_views[resp.Identifier]
+	}
+	switch {
+	case e.csv != nil:
+		for idx, t := range resp.Times {
+			record := []string{site, view, resp.DataFrame, resp.Identifier, formatExportTime(t), formatExportValue(resp.Values[idx])}
+			if err := e.csv.Write(record); err != nil {
+				return err
+			}
+		}
+	case e.parquet != nil:
+		for idx, t := range resp.Times {
+			row := &exportParquetRow{
+				Site:      site,
+				View:      view,
+				DataFrame: resp.DataFrame,
+				UUID:      resp.Identifier,
+				Time:      t / 1e3,
+				Value:     resp.Values[idx],
+			}
+			if err := e.parquet.Write(row); err != nil {
+				return errors.Wrap(err, "Could not write Parquet row")
+			}
+		}
+	case e.spool != nil:
+		return e.spool.add(resp.DataFrame, resp.Identifier, resp.Times, resp.Values)
+	}
+	return nil
+}
+
+// addRows keeps the Brick query results of a View. The columns are the variables of the
+// View's query, then the site, like the tables pymortar builds
+func (e *exporter) addRows(resp *mortarpb.FetchResponse) {
+	table, found := e.tables[resp.View]
+	if !found {
+		table = &exportTable{}
+		for _, variable := range resp.Variables {
+			table.columns = append(table.columns, strings.TrimPrefix(variable, "?"))
+		}
+		table.columns = append(table.columns, "site")
+		e.tables[resp.View] = table
+	}
+	for _, row := range resp.Rows {
+		record := make([]string, 0, len(row.Values)+1)
+		for _, uri := range row.Values {
+			record = append(record, formatURI(uri))
+		}
+		record = append(record, resp.Site)
+		table.rows = append(table.rows, record)
+	}
+}
+
+// finish completes the data file and writes one sidecar file per View
+func (e *exporter) finish() error {
+	switch {
+	case e.csv != nil:
+		e.csv.Flush()
+		if err := e.csv.Error(); err != nil {
+			return err
+		}
+	case e.parquet != nil:
+		if err := e.parquet.WriteStop(); err != nil {
+			return errors.Wrap(err, "Could not finish Parquet file")
+		}
+	case e.spool != nil:
+		w, err := e.sink.create("data.csv")
+		if err != nil {
+			return err
+		}
+		if err := e.spool.merge(w); err != nil {
+			return err
+		}
+	}
+
+	views := make([]string, 0, len(e.tables))
+	for view := range e.tables {
+		views = append(views, view)
+	}
+	sort.Strings(views)
+	for _, view := range views {
+		if err := e.writeTable(view, e.tables[view]); err != nil {
+			return errors.Wrapf(err, "Could not write metadata for view %s", view)
+		}
+	}
+	return e.sink.close()
+}
+
+func (e *exporter) writeTable(view string, table *exportTable) error {
+	name := "metadata_" + exportFileName(view)
+	if e.format != mortarpb.ExportFormat_EXPORT_FORMAT_PARQUET {
+		w, err := e.sink.create(name + ".csv")
+		if err != nil {
+			return err
+		}
+		cw := csv.NewWriter(w)
+		cw.Write(table.columns)
+		cw.WriteAll(table.rows)
+		return cw.Error()
+	}
+
+	w, err := e.sink.create(name + ".parquet")
+	if err != nil {
+		return err
+	}
+	md := make([]string, len(table.columns))
+	for idx, col := range table.columns {
+		md[idx] = "name=" + col + ", type=UTF8"
+	}
+	pw, err := writer.NewCSVWriter(md, parquetStreamFile{w}, 1)
+	if err != nil {
+		return err
+	}
+	for _, row := range table.rows {
+		values := make([]interface{}, len(row))
+		for idx := range row {
+			values[idx] = row[idx]
+		}
+		if err := pw.Write(values); err != nil {
+			return err
+		}
+	}
+	return pw.WriteStop()
+}
+
+// cleanup removes any temporary files
+func (e *exporter) cleanup() {
+	if e.spool != nil {
+		e.spool.cleanup()
+	}
+}
+
+// runExport dispatches the Fetch of the request to output and writes the result to the
+// sink. Unlike Fetch, any error aborts the export, since the files would be incomplete,
+// unless the Fetch is best-effort
+func runExport(ctx context.Context, output chan *Request, request *mortarpb.ExportRequest, sink exportSink, audit *auditEntry) error {
+	req := NewFetchRequest(ctx, request.Fetch)
+	defer req.cancel()
+
+	exp, err := newExporter(req, request.Format, sink)
+	if err != nil {
+		return err
+	}
+	defer exp.cleanup()
+
+	if err := admit(ctx, "brick", output, req); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case resp := <-req.fetch_responses:
+			if resp.Error != "" && !isBestEffort(req) {
+				return errors.New(resp.Error)
+			} else if resp.Error != "" || resp.Summary != nil {
+				// best-effort: the export holds whatever could be read
+				continue
+			}
+			audit.sent(resp)
+			err := exp.add(resp)
+			finishResponse(resp)
+			if err != nil {
+				return errors.Wrap(err, "Could not export data")
+			}
+		case <-req.Ended():
+			if err := req.Err(); err != nil {
+				return err
+			}
+			return exp.finish()
+		case <-req.Done():
+			// the client went away or the request ran out of time
+			if err := req.abandon(errors.Wrap(req.ctx.Err(), "export timeout on response")); err != nil {
+				return err
+			}
+			return exp.finish()
+		}
+	}
+}
+
+// exportStreamSink sends the files of an export over an Export call in chunks
+type exportStreamSink struct {
+	client mortarpb.Mortar_ExportServer
+	file   string
+	buf    bytes.Buffer
+}
+
+func (s *exportStreamSink) create(name string) (io.Writer, error) {
+	if err := s.flush(); err != nil {
+		return nil, err
+	}
+	s.file = name
+	return s, nil
+}
+
+func (s *exportStreamSink) Write(p []byte) (int, error) {
+	s.buf.Write(p)
+	for s.buf.Len() >= exportChunkSize {
+		if err := s.send(s.buf.Next(exportChunkSize)); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (s *exportStreamSink) flush() error {
+	if s.buf.Len() == 0 {
+		return nil
+	}
+	return s.send(s.buf.Next(s.buf.Len()))
+}
+
+func (s *exportStreamSink) send(chunk []byte) error {
+	// the buffer reuses its memory, so hand over a copy
+	data := make([]byte, len(chunk))
+	copy(data, chunk)
+	if err := s.client.Send(&mortarpb.ExportResponse{File: s.file, Data: data}); err != nil {
+		return err
+	}
+	messagesSent.Inc()
+	return nil
+}
+
+func (s *exportStreamSink) close() error {
+	return s.flush()
+}
+
+// exportZipSink writes the files of an export into a zip archive
+type exportZipSink struct {
+	w  io.Writer
+	zw *zip.Writer
+	// bytes of the archive passed on to w
+	written int64
+}
+
+func (s *exportZipSink) create(name string) (io.Writer, error) {
+	if s.zw == nil {
+		s.zw = zip.NewWriter(s)
+	}
+	return s.zw.Create(name)
+}
+
+func (s *exportZipSink) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	s.written += int64(n)
+	return n, err
+}
+
+func (s *exportZipSink) close() error {
+	if s.zw == nil {
+		s.zw = zip.NewWriter(s)
+	}
+	return s.zw.Close()
+}
+
+// started is true once part of the archive has been sent. Until then the archive is only
+// buffered, and the export can still fail with an error response
+func (s *exportZipSink) started() bool {
+	return s.written > 0
+}
+
+// parquetStreamFile lets the Parquet writer write to a stream; the writer only ever
+// appends to the file
+type parquetStreamFile struct {
+	io.Writer
+}
+
+func (f parquetStreamFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, errors.New("Cannot seek in export stream")
+}
+
+func (f parquetStreamFile) Read(p []byte) (int, error) {
+	return 0, errors.New("Cannot read from export stream")
+}
+
+func (f parquetStreamFile) Close() error {
+	return nil
+}
+
+func (f parquetStreamFile) Open(name string) (source.ParquetFile, error) {
+	return nil, errors.New("Cannot open files in export stream")
+}
+
+func (f parquetStreamFile) Create(name string) (source.ParquetFile, error) {
+	return nil, errors.New("Cannot create files in export stream")
+}
+
+// exportSpool stores each timeseries of a wide format export in its own temporary
+// file, so they can be merged by time once all of them have arrived
+type exportSpool struct {
+	dir    string
+	series map[string]*spooledSeries
+	// dataFrame name -> position in the request, to order the columns
+	dataFrames map[string]int
+}
+
+// spooledSeries is one timeseries in the spool, stored as (time, value) pairs
+type spooledSeries struct {
+	column    string
+	dataFrame int
+	uuid      string
+	f         *os.File
+	w         *bufio.Writer
+}
+
+func newExportSpool(request *mortarpb.FetchRequest) (*exportSpool, error) {
+	dir, err := ioutil.TempDir("", "mortar-export")
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not create export directory")
+	}
+	spool := &exportSpool{
+		dir:        dir,
+		series:     make(map[string]*spooledSeries),
+		dataFrames: make(map[string]int),
+	}
+	for idx, dataFrame := range request.DataFrames {
+		spool.dataFrames[dataFrame.Name] = idx
+	}
+	return spool, nil
+}
+
+func (spool *exportSpool) add(dataFrame, uuid string, times []int64, values []float64) error {
+	column := dataFrame + "/" + uuid
+	series, found := spool.series[column]
+	if !found {
+		f, err := os.Create(filepath.Join(spool.dir, strconv.Itoa(len(spool.series))))
+		if err != nil {
+			return errors.Wrap(err, "Could not create export spool file")
+		}
+		series = &spooledSeries{
+			column:    column,
+			dataFrame: spool.dataFrames[dataFrame],
+			uuid:      uuid,
+			f:         f,
+			w:         bufio.NewWriter(f),
+		}
+		spool.series[column] = series
+	}
+	var buf [16]byte
+	for idx, t := range times {
+		binary.LittleEndian.PutUint64(buf[:8], uint64(t))
+		binary.LittleEndian.PutUint64(buf[8:], math.Float64bits(values[idx]))
+		if _, err := series.w.Write(buf[:]); err != nil {
+			return errors.Wrap(err, "Could not write export spool file")
+		}
+	}
+	return nil
+}
+
+// merge writes the spooled timeseries as a CSV file with a time column and one column per
+// timeseries, ordered by DataFrame and then UUID. Each timeseries must have been added in
+// time order
+func (spool *exportSpool) merge(w io.Writer) error {
+	columns := make([]*spooledSeries, 0, len(spool.series))
+	for _, series := range spool.series {
+		columns = append(columns, series)
+	}
+	sort.Slice(columns, func(i, j int) bool {
+		if columns[i].dataFrame != columns[j].dataFrame {
+			return columns[i].dataFrame < columns[j].dataFrame
+		}
+		return columns[i].uuid < columns[j].uuid
+	})
+
+	cw := csv.NewWriter(w)
+	header := []string{"time"}
+	var cursors spoolHeap
+	for idx, series := range columns {
+		header = append(header, series.column)
+		if err := series.w.Flush(); err != nil {
+			return err
+		}
+		if _, err := series.f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		cursor := &spoolCursor{column: idx, r: bufio.NewReader(series.f)}
+		if ok, err := cursor.next(); err != nil {
+			return err
+		} else if ok {
+			cursors = append(cursors, cursor)
+		}
+	}
+	heap.Init(&cursors)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	record := make([]string, len(columns)+1)
+	for len(cursors) > 0 {
+		t := cursors[0].t
+		for idx := range record {
+			record[idx] = ""
+		}
+		record[0] = formatExportTime(t)
+		// take the first value of each timeseries at this time
+		for len(cursors) > 0 && cursors[0].t == t {
+			cursor := cursors[0]
+			if record[cursor.column+1] == "" {
+				record[cursor.column+1] = formatExportValue(cursor.v)
+			}
+			if ok, err := cursor.next(); err != nil {
+				return err
+			} else if ok {
+				heap.Fix(&cursors, 0)
+			} else {
+				heap.Pop(&cursors)
+			}
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (spool *exportSpool) cleanup() {
+	for _, series := range spool.series {
+		series.f.Close()
+	}
+	os.RemoveAll(spool.dir)
+}
+
+// spoolCursor reads one spooled timeseries during the merge
+type spoolCursor struct {
+	column int
+	r      *bufio.Reader
+	t      int64
+	v      float64
+}
+
+func (c *spoolCursor) next() (bool, error) {
+	var buf [16]byte
+	if _, err := io.ReadFull(c.r, buf[:]); err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrap(err, "Could not read export spool file")
+	}
+	c.t = int64(binary.LittleEndian.Uint64(buf[:8]))
+	c.v = math.Float64frombits(binary.LittleEndian.Uint64(buf[8:]))
+	return true, nil
+}
+
+// spoolHeap orders cursors by their current time
+type spoolHeap []*spoolCursor
+
+func (h spoolHeap) Len() int { return len(h) }
+func (h spoolHeap) Less(i, j int) bool {
+	if h[i].t != h[j].t {
+		return h[i].t < h[j].t
+	}
+	return h[i].column < h[j].column
+}
+func (h spoolHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *spoolHeap) Push(x interface{}) { *h = append(*h, x.(*spoolCursor)) }
+func (h *spoolHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+func formatExportTime(t int64) string {
+	return time.Unix(0, t).UTC().Format(time.RFC3339Nano)
+}
+
+func formatExportValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// formatURI renders a URI from a Brick query result the way pymortar does
+func formatURI(uri *mortarpb.URI) string {
+	if uri.Namespace != "" {
+		return uri.Namespace + "#" + uri.Value
+	}
+	return strings.Trim(uri.Value, `"`)
+}
+
+var exportFileNameUnsafe = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// exportFileName makes a View name safe to use as a file name
+func exportFileName(name string) string {
+	return exportFileNameUnsafe.ReplaceAllString(name, "_")
+}
+
+// Export runs a Fetch and sends the result as CSV or Parquet files
+func (stage *ApiFrontendBasicStage) Export(request *mortarpb.ExportRequest, client mortarpb.Mortar_ExportServer) (err error) {
+	audit := startAudit(client.Context(), "Export")
+	audit.fetch(request.Fetch)
+	defer func() { audit.finish(err) }()
+
+	t := time.Now()
+	defer func() {
+		log.Info("Export took ", time.Since(t))
+		fetchProcessingTimes.Observe(float64(time.Since(t).Nanoseconds() / 1e6))
+	}()
+
+	authRequests.Inc()
+	activeQueries.Inc()
+	defer activeQueries.Dec()
+
+	ctx := client.Context()
+	if err := stage.authenticate(ctx); err != nil {
+		return err
+	}
+	authRequestsSuccessful.Inc()
+	audit.identify(tokenIdentity(ctx))
+
+	// here we are authenticated to the service.
+	validateErr := validateExportRequest(request)
+	if validateErr != nil {
+		return invalidArgument(validateErr)
+	}
+
+	fetchQueriesProcessed.Inc()
+
+	select {
+	case sem := <-stage.sem:
+		defer func() { stage.sem <- sem }()
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "export timeout on getting semaphore")
+	}
+
+	return runExport(ctx, stage.output, request, &exportStreamSink{client: client}, audit)
+}
+
+// serveExport is the HTTP version of Export. It takes an ExportRequest as JSON and
+// responds with a zip archive of the exported files
+func (stage *ApiFrontendBasicStage) serveExport(w http.ResponseWriter, r *http.Request) {
+	t := time.Now()
+	defer func() {
+		log.Info("Export took ", time.Since(t))
+		fetchProcessingTimes.Observe(float64(time.Since(t).Nanoseconds() / 1e6))
+	}()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Export needs POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	authRequests.Inc()
+	activeQueries.Inc()
+	defer activeQueries.Dec()
+
+	var exportErr error
+	audit := startAudit(gatewayContext(r), "Export")
+	defer func() { audit.finish(exportErr) }()
+
+	if exportErr = stage.checkToken(r.Header.Get("token")); exportErr != nil {
+		http.Error(w, exportErr.Error(), http.StatusUnauthorized)
+		return
+	}
+	authRequestsSuccessful.Inc()
+	audit.identify(tokenIdentity(gatewayContext(r)))
+
+	var request mortarpb.ExportRequest
+	if err := jsonpb.Unmarshal(r.Body, &request); err != nil {
+		exportErr = errors.Wrap(err, "Could not parse ExportRequest")
+		http.Error(w, exportErr.Error(), http.StatusBadRequest)
+		return
+	}
+	audit.fetch(request.Fetch)
+	if exportErr = validateExportRequest(&request); exportErr != nil {
+		http.Error(w, exportErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fetchQueriesProcessed.Inc()
+
+	ctx := r.Context()
+	select {
+	case sem := <-stage.sem:
+		defer func() { stage.sem <- sem }()
+	case <-ctx.Done():
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="mortar-export.zip"`)
+	sink := &exportZipSink{w: w}
+	if exportErr = runExport(ctx, stage.output, &request, sink, audit); exportErr != nil {
+		log.Error(errors.Wrap(exportErr, "Export failed"))
+		// once the archive has started we can only cut it short
+		if !sink.started() {
+			w.Header().Del("Content-Disposition")
+			code := http.StatusInternalServerError
+			if setRetryAfter(w, exportErr) {
+				code = http.StatusServiceUnavailable
+			}
+			http.Error(w, exportErr.Error(), code)
+		}
+	}
+}
+
+// Export runs a Fetch and sends the result as CSV or Parquet files
+func (stage *ApiFrontendWAVEAuthStage) Export(request *mortarpb.ExportRequest, client mortarpb.Mortar_ExportServer) (err error) {
+	audit := startAudit(client.Context(), "Export")
+	audit.fetch(request.Fetch)
+	defer func() { audit.finish(err) }()
+
+	t := time.Now()
+	defer func() {
+		log.Info("Export took ", time.Since(t))
+		fetchProcessingTimes.Observe(float64(time.Since(t).Nanoseconds() / 1e6))
+	}()
+
+	activeQueries.Inc()
+	defer activeQueries.Dec()
+
+	ctx, cancel := context.WithTimeout(client.Context(), requestTimeout)
+	defer cancel()
+
+	validateErr := validateExportRequest(request)
+	if validateErr != nil {
+		return invalidArgument(validateErr)
+	}
+
+	fetchQueriesProcessed.Inc()
+
+	select {
+	case sem := <-stage.sem:
+		defer func() { stage.sem <- sem }()
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "export timeout on getting semaphore")
+	}
+
+	return runExport(ctx, stage.output, request, &exportStreamSink{client: client}, audit)
+}
@@ -0,0 +1,111 @@
+package stages
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	mortarpb "github.com/SoftwareDefinedBuildings/mortar/proto"
+)
+
+func TestServeExportErrors(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := gatewayTestToken(t, key, "alice")
+	body := `{"format": "EXPORT_FORMAT_CSV_LONG", "fetch": {"sites": ["site"], "time": {"start": "2020-01-01T00:00:00Z", "end": "2020-01-02T00:00:00Z"}, "dataFrames": [{"name": "df", "aggregation": "AGG_FUNC_RAW", "uuids": ["` + arrowTestUUID1 + `"]}]}}`
+
+	// serve runs an export against a pipeline that handles each request with brick, or
+	// turns every request away if brick is nil
+	serve := func(brick func(req *Request)) *httptest.ResponseRecorder {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		// admission does not wait, so only a queue with room takes the request
+		output := make(chan *Request)
+		if brick != nil {
+			output = make(chan *Request, 1)
+			go func() {
+				for {
+					select {
+					case req := <-output:
+						if req.start() {
+							brick(req)
+						}
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+		}
+		stage := &ApiFrontendBasicStage{
+			ctx:    ctx,
+			output: output,
+			sem:    make(chan struct{}, 1),
+			auth: &CognitoAuth{
+				clientid: "client",
+				jwks_url: gatewayTestIssuer + "/.well-known/jwks.json",
+				m:        map[string]rsa.PublicKey{"key": key.PublicKey},
+			},
+		}
+		stage.sem <- struct{}{}
+		r := httptest.NewRequest(http.MethodPost, "/export", strings.NewReader(body))
+		r.Header.Set("token", token)
+		w := httptest.NewRecorder()
+		stage.httpHandler(nil).ServeHTTP(w, r)
+		return w
+	}
+	point := &mortarpb.FetchResponse{Site: "site", DataFrame: "df", Identifier: arrowTestUUID1, Times: []int64{1577836800000000000}, Values: []float64{1}}
+
+	// the pipeline is full
+	w := serve(nil)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "5" {
+		t.Errorf("rejected export got %d %q: %s", w.Code, w.Header().Get("Retry-After"), w.Body)
+	}
+	if w.Header().Get("Content-Type") == "application/zip" || w.Header().Get("Content-Disposition") != "" {
+		t.Errorf("rejected export is an archive: %v", w.Header())
+	}
+
+	// the archive is still buffered when the Fetch fails
+	w = serve(func(req *Request) {
+		req.send(point)
+		req.addError(errors.New("Brick is down"))
+	})
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "Brick is down") {
+		t.Errorf("failed export got %d: %s", w.Code, w.Body)
+	}
+
+	w = serve(func(req *Request) {
+		req.send(point)
+		req.finish()
+	})
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("export got %d %v", w.Code, w.Header())
+	}
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archive.File) != 1 || archive.File[0].Name != "data.csv" {
+		t.Fatalf("archive holds %v", archive.File)
+	}
+	f, err := archive.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), arrowTestUUID1+",2020-01-01T00:00:00Z,1") {
+		t.Errorf("data.csv is %s", data)
+	}
+}
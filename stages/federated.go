@@ -0,0 +1,446 @@
+package stages
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	mortarpb "github.com/SoftwareDefinedBuildings/mortar/proto"
+	"github.com/heptiolabs/healthcheck"
+	"github.com/pkg/errors"
+)
+
+// FederatedTimeseriesStage routes the UUIDs of each Fetch to one of several timeseries
+// backends, based on the site the Brick stage found them in or on a UUID prefix. Each
+// backend is a regular timeseries stage pulling from a queue owned by this stage; the
+// backends are queried concurrently and their responses merged into the client's stream
+type FederatedTimeseriesStage struct {
+	upstream Stage
+	ctx      context.Context
+	output   chan *Request
+
+	routes         []RouteConfig
+	defaultBackend string
+	// backend name -> queue the backend stage pulls from
+	queues map[string]*routeQueue
+	// the backend stages, closed with this one
+	backends []Stage
+
+	sync.Mutex
+}
+
+type FederatedTimeseriesStageConfig struct {
+	Upstream     Stage
+	StageContext context.Context
+	// checked in order; the first route matching a UUID wins
+	Routes []RouteConfig
+	// backend for UUIDs that match no route. If empty, those UUIDs are an error
+	Default string
+	// creates the timeseries stage for the named backend, pulling from upstream
+	NewBackend func(backend string, upstream Stage) (Stage, error)
+}
+
+type RouteConfig struct {
+	// backend type: btrdb, influxdb, influxdb2, timescale or arrow
+	Backend string
+	// UUIDs found in these sites are read from the backend. The site of a UUID is only
+	// known if the Brick stage resolved it from a View, or if the Fetch names one site
+	Sites []string
+	// UUIDs starting with any of these (hex) prefixes are read from the backend
+	UUIDPrefixes []string
+}
+
+func NewFederatedTimeseriesStage(cfg *FederatedTimeseriesStageConfig) (*FederatedTimeseriesStage, error) {
+	if cfg.Upstream == nil {
+		return nil, errors.New("Need to specify Upstream in Federated Timeseries config")
+	}
+	if cfg.NewBackend == nil {
+		return nil, errors.New("Need to specify NewBackend in Federated Timeseries config")
+	}
+	stage := &FederatedTimeseriesStage{
+		upstream:       cfg.Upstream,
+		output:         make(chan *Request),
+		ctx:            cfg.StageContext,
+		routes:         cfg.Routes,
+		defaultBackend: cfg.Default,
+		queues:         make(map[string]*routeQueue),
+	}
+
+	backends := []string{}
+	for _, route := range cfg.Routes {
+		for _, prefix := range route.UUIDPrefixes {
+			if strings.Trim(strings.ToLower(prefix), "0123456789abcdef-") != "" {
+				return nil, errors.Errorf("UUID prefix %q of the %s route can never match a UUID", prefix, route.Backend)
+			}
+		}
+		backends = append(backends, route.Backend)
+	}
+	if cfg.Default != "" {
+		backends = append(backends, cfg.Default)
+	}
+	for _, backend := range backends {
+		if _, found := stage.queues[backend]; found {
+			continue
+		}
+		if backend == "federated" {
+			return nil, errors.New("Federated backends cannot be nested")
+		}
+		queue := &routeQueue{router: stage, backend: backend, output: newQueue("federated/" + backend)}
+		backendStage, err := cfg.NewBackend(backend, queue)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not create %s backend", backend)
+		}
+		stage.queues[backend] = queue
+		stage.backends = append(stage.backends, backendStage)
+		log.Infof("Federated timeseries backend %s ready", backend)
+	}
+
+	num_workers := 20
+	busy := workerGauges(stage, "federated", num_workers)
+	// consume function
+	for i := 0; i < num_workers; i++ {
+		go func() {
+			input := stage.upstream.GetQueue()
+			for {
+				select {
+				case req := <-input:
+					busy.Inc()
+					if !req.start() {
+						// the client gave up while the request was queued
+					} else if req.subscribe {
+						req.addError(errSubscribeNotSupported)
+					} else if len(req.fetch_request.Sites) > 0 && len(req.fetch_request.DataFrames) > 0 {
+						if err := stage.processQuery(req); err != nil {
+							req.addError(err)
+							log.Println(err)
+						} else {
+							req.finish()
+						}
+					} else {
+						req.finish()
+					}
+					busy.Dec()
+				case <-stage.ctx.Done():
+					// case that breaks the stage and releases resources
+					log.Info("Ending Federated Timeseries Queue")
+					return
+				}
+			}
+		}()
+	}
+
+	return stage, nil
+}
+
+// Close closes the backend stages. The StageContext must be done
+func (stage *FederatedTimeseriesStage) Close() error {
+	var closeErr error
+	for _, backend := range stage.backends {
+		if closer, ok := backend.(io.Closer); ok {
+			if err := closer.Close(); err != nil && closeErr == nil {
+				closeErr = err
+			}
+		}
+	}
+	return closeErr
+}
+
+func (stage *FederatedTimeseriesStage) GetUpstream() Stage {
+	stage.Lock()
+	defer stage.Unlock()
+	return stage.upstream
+}
+
+func (stage *FederatedTimeseriesStage) SetUpstream(upstream Stage) {
+	stage.Lock()
+	defer stage.Unlock()
+	if stage != nil {
+		stage.upstream = upstream
+	}
+	log.Info("Updated stage to ", upstream)
+}
+
+func (stage *FederatedTimeseriesStage) GetQueue() chan *Request {
+	return stage.output
+}
+
+func (stage *FederatedTimeseriesStage) String() string {
+	return "<|federated ts stage|>"
+}
+
+// Reload passes the configuration on to the backends
+func (stage *FederatedTimeseriesStage) Reload(cfg *Config) {
+	for _, backend := range stage.backends {
+		if reloader, ok := backend.(Reloader); ok {
+			reloader.Reload(cfg)
+		}
+	}
+}
+
+// the checks of the backends are included, since the stages do not appear in the pipeline
+func (stage *FederatedTimeseriesStage) ReadinessChecks() map[string]healthcheck.Check {
+	checks := workerChecks(stage, nil, false)
+	for _, backend := range stage.backends {
+		if reporter, ok := backend.(HealthReporter); ok {
+			for name, check := range reporter.ReadinessChecks() {
+				checks[name] = check
+			}
+		}
+	}
+	return checks
+}
+
+func (stage *FederatedTimeseriesStage) LivenessChecks() map[string]healthcheck.Check {
+	checks := workerChecks(stage, nil, true)
+	for _, backend := range stage.backends {
+		if reporter, ok := backend.(HealthReporter); ok {
+			for name, check := range reporter.LivenessChecks() {
+				checks[name] = check
+			}
+		}
+	}
+	return checks
+}
+
+// route returns the backend for the UUID. Only the UUIDs the Brick stage resolved from
+// the Views have a known site; UUIDs listed in a DataFrame are taken to be from the site
+// of the Fetch if it names exactly one, and can otherwise only be routed by prefix
+func (stage *FederatedTimeseriesStage) route(req *Request, uuStr string) (string, error) {
+	site, found := req.uuid_sites[uuStr]
+	if !found && len(req.fetch_request.Sites) == 1 {
+		site = req.fetch_request.Sites[0]
+	}
+	for _, route := range stage.routes {
+		for _, s := range route.Sites {
+			if site != "" && s == site {
+				return route.Backend, nil
+			}
+		}
+		for _, prefix := range route.UUIDPrefixes {
+			if strings.HasPrefix(strings.ToLower(uuStr), strings.ToLower(prefix)) {
+				return route.Backend, nil
+			}
+		}
+	}
+	if stage.defaultBackend == "" {
+		return "", errors.Errorf("No timeseries backend for %s (site %s)", uuStr, site)
+	}
+	return stage.defaultBackend, nil
+}
+
+func (stage *FederatedTimeseriesStage) processQuery(req *Request) error {
+	// split the request into one request per backend, each with the same DataFrames
+	// but only the UUIDs that backend is responsible for
+	subrequests := make(map[string]*mortarpb.FetchRequest)
+	// backend -> index in the client's request of each UUID of each DataFrame
+	indexes := make(map[string][][]int)
+	for idx, dataFrame := range req.fetch_request.DataFrames {
+		for uuIdx, uuStr := range dataFrame.Uuids {
+			backend, err := stage.route(req, uuStr)
+			if err != nil && isBestEffort(req) {
+				req.partialError(req.uuidFailure(dataFrame.Name, uuStr, err))
+				continue
+			} else if err != nil {
+				return err
+			}
+			sub, found := subrequests[backend]
+			if !found {
+				sub = &mortarpb.FetchRequest{
+					Sites:         req.fetch_request.Sites,
+					Time:          req.fetch_request.Time,
+					Resumable:     req.fetch_request.Resumable,
+					ResumeToken:   req.fetch_request.ResumeToken,
+					FailurePolicy: req.fetch_request.FailurePolicy,
+				}
+				for _, df := range req.fetch_request.DataFrames {
+					sub.DataFrames = append(sub.DataFrames, &mortarpb.DataFrame{
+						Name:        df.Name,
+						Aggregation: df.Aggregation,
+						Window:      df.Window,
+						Unit:        df.Unit,
+						Fill:        df.Fill,
+					})
+				}
+				subrequests[backend] = sub
+				indexes[backend] = make([][]int, len(sub.DataFrames))
+			}
+			sub.DataFrames[idx].Uuids = append(sub.DataFrames[idx].Uuids, uuStr)
+			indexes[backend][idx] = append(indexes[backend][idx], req.uuidIndex(idx, uuIdx))
+		}
+	}
+
+	ctx, cancel := context.WithCancel(req.ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		routeErr error
+	)
+	subs := make(map[string]*Request)
+	for backend, fetch := range subrequests {
+		sub := NewFetchRequest(ctx, fetch)
+		sub.uuid_sites = req.uuid_sites
+		sub.uuid_views = req.uuid_views
+		sub.progress = req.progress
+		sub.stats = req.stats
+		sub.uuid_indexes = indexes[backend]
+		if err := enqueue(ctx, "federated/"+backend, stage.queues[backend].output, sub); err != nil {
+			sub.cancel()
+			errOnce.Do(func() {
+				routeErr = errors.Wrapf(err, "%s backend", backend)
+				cancel()
+			})
+			continue
+		}
+		if isResumable(req) {
+			// forwarded together below, to keep the responses in order
+			subs[backend] = sub
+			continue
+		}
+		wg.Add(1)
+		go func(backend string, sub *Request) {
+			defer wg.Done()
+			defer sub.cancel()
+			if err := stage.forward(req, sub); err != nil {
+				errOnce.Do(func() {
+					routeErr = errors.Wrapf(err, "%s backend", backend)
+					cancel()
+				})
+			}
+		}(backend, sub)
+	}
+	if len(subs) > 0 {
+		if err := stage.forwardMerged(req, subs); err != nil {
+			errOnce.Do(func() { routeErr = err })
+		}
+		for _, sub := range subs {
+			sub.cancel()
+		}
+	}
+	wg.Wait()
+
+	return routeErr
+}
+
+// forward copies the backend's responses for sub into the client's stream until the
+// backend ends sub, returning the error it failed with
+func (stage *FederatedTimeseriesStage) forward(req, sub *Request) error {
+	for {
+		select {
+		case resp := <-sub.fetch_responses:
+			if resp.Summary != nil {
+				// the failures were forwarded already, and the statistics are
+				// shared; req sends its own summary
+				continue
+			}
+			if resp.Error != "" {
+				req.partialError(failureOf(resp))
+				continue
+			}
+			if !req.send(resp) {
+				return nil
+			}
+		case <-sub.Ended():
+			return sub.Err()
+		case <-sub.Done():
+			return sub.abandon(nil)
+		}
+	}
+}
+
+// forwardMerged copies the responses of resumable requests to the client's stream. Each
+// backend sends its responses in order of their resume tokens; they are merged so that the
+// client's stream is in order too
+func (stage *FederatedTimeseriesStage) forwardMerged(req *Request, subs map[string]*Request) error {
+	type head struct {
+		backend string
+		sub     *Request
+		resp    *mortarpb.FetchResponse
+		pos     resumePosition
+	}
+	// next reads the next response of the backend; returns false once it is done
+	next := func(h *head) (bool, error) {
+		for {
+			select {
+			case resp := <-h.sub.fetch_responses:
+				if resp.Summary != nil {
+					continue
+				}
+				if resp.Error != "" {
+					req.partialError(failureOf(resp))
+					continue
+				}
+				pos, err := parseResumeToken(resp.ResumeToken)
+				if err != nil {
+					return false, errors.Wrapf(err, "%s backend", h.backend)
+				}
+				h.resp, h.pos = resp, pos
+				return true, nil
+			case <-h.sub.Ended():
+				return false, errors.Wrapf(h.sub.Err(), "%s backend", h.backend)
+			case <-h.sub.Done():
+				return false, errors.Wrapf(h.sub.abandon(nil), "%s backend", h.backend)
+			}
+		}
+	}
+
+	var heads []*head
+	for backend, sub := range subs {
+		h := &head{backend: backend, sub: sub}
+		more, err := next(h)
+		if err != nil {
+			return err
+		}
+		if more {
+			heads = append(heads, h)
+		}
+	}
+	for len(heads) > 0 {
+		first := 0
+		for idx, h := range heads {
+			if h.pos.before(heads[first].pos) {
+				first = idx
+			}
+		}
+		h := heads[first]
+		select {
+		case req.fetch_responses <- h.resp:
+		case <-req.Done():
+			return nil
+		}
+		more, err := next(h)
+		if err != nil {
+			return err
+		}
+		if !more {
+			heads = append(heads[:first], heads[first+1:]...)
+		}
+	}
+	return nil
+}
+
+// routeQueue is the upstream of each backend stage of a FederatedTimeseriesStage
+type routeQueue struct {
+	router  *FederatedTimeseriesStage
+	backend string
+	output  chan *Request
+}
+
+func (queue *routeQueue) GetUpstream() Stage {
+	return queue.router
+}
+
+func (queue *routeQueue) SetUpstream(upstream Stage) {
+	// always pulls from the router
+}
+
+func (queue *routeQueue) GetQueue() chan *Request {
+	return queue.output
+}
+
+func (queue *routeQueue) String() string {
+	return fmt.Sprintf("<| route queue %s |>", queue.backend)
+}
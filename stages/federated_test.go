@@ -0,0 +1,354 @@
+package stages
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mortarpb "github.com/SoftwareDefinedBuildings/mortar/proto"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFederatedRoute(t *testing.T) {
+	stage := &FederatedTimeseriesStage{
+		routes: []RouteConfig{
+			{Backend: "influxdb2", Sites: []string{"ciee"}},
+			{Backend: "arrow", UUIDPrefixes: []string{"A0C4"}},
+		},
+		defaultBackend: "btrdb",
+	}
+	const (
+		resolved = "11111111-2222-4333-8444-555555555555"
+		listed   = "66666666-7777-4888-9999-aaaaaaaaaaaa"
+		archived = "a0c4e5f6-7777-4888-9999-aaaaaaaaaaaa"
+	)
+	for _, test := range []struct {
+		sites   []string
+		uuid    string
+		backend string
+	}{
+		// resolved from a View in ciee
+		{[]string{"ciee", "soda"}, resolved, "influxdb2"},
+		// listed in a DataFrame of a Fetch of ciee alone
+		{[]string{"ciee"}, listed, "influxdb2"},
+		// listed in a DataFrame of a Fetch of several sites
+		{[]string{"ciee", "soda"}, listed, "btrdb"},
+		{[]string{"soda"}, listed, "btrdb"},
+		{[]string{"soda"}, archived, "arrow"},
+	} {
+		req := NewFetchRequest(context.Background(), &mortarpb.FetchRequest{Sites: test.sites})
+		req.uuid_sites = map[string]string{resolved: "ciee"}
+		backend, err := stage.route(req, test.uuid)
+		if err != nil || backend != test.backend {
+			t.Errorf("%s in %v: got %s, %v; want %s", test.uuid, test.sites, backend, err, test.backend)
+		}
+		req.cancel()
+	}
+
+	stage.defaultBackend = ""
+	req := NewFetchRequest(context.Background(), &mortarpb.FetchRequest{Sites: []string{"soda"}})
+	defer req.cancel()
+	if backend, err := stage.route(req, listed); err == nil {
+		t.Errorf("routed %s to %s without a default", listed, backend)
+	}
+}
+
+func TestFederatedPrefixes(t *testing.T) {
+	_, err := NewFederatedTimeseriesStage(&FederatedTimeseriesStageConfig{
+		Upstream:     newTestStage(),
+		StageContext: context.Background(),
+		Routes:       []RouteConfig{{Backend: "arrow", UUIDPrefixes: []string{"archive-"}}},
+		NewBackend: func(backend string, upstream Stage) (Stage, error) {
+			t.Fatalf("created the %s backend", backend)
+			return nil, nil
+		},
+	})
+	if err == nil {
+		t.Error("accepted a prefix no UUID can match")
+	}
+}
+
+const (
+	federatedUUID1 = "a1000000-0000-4000-8000-000000000001"
+	federatedUUID2 = "b2000000-0000-4000-8000-000000000002"
+	federatedUUID3 = "a3000000-0000-4000-8000-000000000003"
+	federatedUUID4 = "b4000000-0000-4000-8000-000000000004"
+)
+
+// fakeBackend is a timeseries stage that sends a point for each UUID of the requests it
+// gets, at times 1 and 2, unless fail returns an error for the UUID
+type fakeBackend struct {
+	upstream Stage
+	fail     func(uuStr string) error
+	// if set, requests are held until they are cancelled, which closes cancelled
+	block     bool
+	cancelled chan struct{}
+
+	sync.Mutex
+	requests []*mortarpb.FetchRequest
+}
+
+func (backend *fakeBackend) run(ctx context.Context) {
+	for {
+		select {
+		case req := <-backend.upstream.GetQueue():
+			backend.Lock()
+			backend.requests = append(backend.requests, req.fetch_request)
+			backend.Unlock()
+			if !req.start() {
+				continue
+			}
+			if err := backend.handle(req); err != nil {
+				req.addError(err)
+			} else {
+				req.finish()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (backend *fakeBackend) handle(req *Request) error {
+	if backend.block {
+		<-req.Done()
+		close(backend.cancelled)
+		return req.ctx.Err()
+	}
+	for dfIdx, dataFrame := range req.fetch_request.DataFrames {
+		for uuIdx, uuStr := range dataFrame.Uuids {
+			if backend.fail != nil {
+				if err := backend.fail(uuStr); err != nil && isBestEffort(req) {
+					req.partialError(req.uuidFailure(dataFrame.Name, uuStr, err))
+					continue
+				} else if err != nil {
+					return err
+				}
+			}
+			for _, t := range []int64{1, 2} {
+				resp := &mortarpb.FetchResponse{DataFrame: dataFrame.Name, Identifier: uuStr, Times: []int64{t}, Values: []float64{float64(t)}}
+				if isResumable(req) {
+					resp.ResumeToken = resumePosition{dataFrame: dfIdx, uuid: req.uuidIndex(dfIdx, uuIdx), time: t}.token()
+				}
+				if !req.send(resp) {
+					return nil
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (backend *fakeBackend) requestsSeen() []*mortarpb.FetchRequest {
+	backend.Lock()
+	defer backend.Unlock()
+	return backend.requests
+}
+
+func (backend *fakeBackend) GetUpstream() Stage         { return backend.upstream }
+func (backend *fakeBackend) SetUpstream(upstream Stage) {}
+func (backend *fakeBackend) GetQueue() chan *Request    { return nil }
+func (backend *fakeBackend) String() string             { return "<|fake backend|>" }
+
+// newTestFederatedStage routes UUIDs in site ciee and those starting with b to backend b,
+// and the others to backend a
+func newTestFederatedStage(t *testing.T, ctx context.Context, a, b *fakeBackend) *testStage {
+	upstream := newTestStage()
+	_, err := NewFederatedTimeseriesStage(&FederatedTimeseriesStageConfig{
+		Upstream:     upstream,
+		StageContext: ctx,
+		Routes:       []RouteConfig{{Backend: "b", Sites: []string{"ciee"}, UUIDPrefixes: []string{"b"}}},
+		Default:      "a",
+		NewBackend: func(name string, queue Stage) (Stage, error) {
+			backend := map[string]*fakeBackend{"a": a, "b": b}[name]
+			backend.upstream = queue
+			go backend.run(ctx)
+			return backend, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return upstream
+}
+
+func federatedFetch(upstream *testStage, request *mortarpb.FetchRequest, sites map[string]string) ([]*mortarpb.FetchResponse, error) {
+	request.Sites = []string{"ciee", "soda"}
+	request.Time = &mortarpb.TimeParams{Start: "2020-01-01T00:00:00Z", End: "2020-01-02T00:00:00Z"}
+	req := NewFetchRequest(context.Background(), request)
+	req.uuid_sites = sites
+	upstream.queue <- req
+	return consumeFetch(req)
+}
+
+// federatedPoints lists the UUID and time of each point in the responses
+func federatedPoints(responses []*mortarpb.FetchResponse) []string {
+	var points []string
+	for _, resp := range responses {
+		for _, t := range resp.Times {
+			points = append(points, fmt.Sprintf("%s/%s@%d", resp.DataFrame, resp.Identifier[:2], t))
+		}
+	}
+	return points
+}
+
+func TestFederatedSplit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a, b := &fakeBackend{}, &fakeBackend{}
+	upstream := newTestFederatedStage(t, ctx, a, b)
+
+	responses, err := federatedFetch(upstream, &mortarpb.FetchRequest{DataFrames: []*mortarpb.DataFrame{
+		{Name: "x", Aggregation: mortarpb.AggFunc_AGG_FUNC_RAW, Uuids: []string{federatedUUID1, federatedUUID2}},
+		{Name: "y", Aggregation: mortarpb.AggFunc_AGG_FUNC_MEAN, Window: "1h", Uuids: []string{federatedUUID3}},
+	}}, map[string]string{federatedUUID3: "ciee"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	points := federatedPoints(responses)
+	sort.Strings(points)
+	if fmt.Sprint(points) != "[x/a1@1 x/a1@2 x/b2@1 x/b2@2 y/a3@1 y/a3@2]" {
+		t.Errorf("got %v", points)
+	}
+
+	// each backend gets every DataFrame, with only its own UUIDs
+	for _, test := range []struct {
+		name    string
+		backend *fakeBackend
+		uuids   string
+	}{
+		{"a", a, "[[" + federatedUUID1 + "] []]"},
+		// by prefix, and by the site the Brick stage found it in
+		{"b", b, "[[" + federatedUUID2 + "] [" + federatedUUID3 + "]]"},
+	} {
+		requests := test.backend.requestsSeen()
+		if len(requests) != 1 {
+			t.Fatalf("backend %s got %d requests", test.name, len(requests))
+		}
+		request := requests[0]
+		var uuids [][]string
+		for _, dataFrame := range request.DataFrames {
+			uuids = append(uuids, dataFrame.Uuids)
+		}
+		if fmt.Sprint(uuids) != test.uuids {
+			t.Errorf("backend %s got %v, want %s", test.name, uuids, test.uuids)
+		}
+		if request.DataFrames[1].Window != "1h" || request.Time.Start != "2020-01-01T00:00:00Z" {
+			t.Errorf("backend %s got %v", test.name, request)
+		}
+	}
+}
+
+func TestFederatedMergedOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	upstream := newTestFederatedStage(t, ctx, &fakeBackend{}, &fakeBackend{})
+
+	// the backends alternate, but the client gets the UUIDs in the order of its request
+	responses, err := federatedFetch(upstream, &mortarpb.FetchRequest{Resumable: true, DataFrames: []*mortarpb.DataFrame{
+		{Name: "x", Aggregation: mortarpb.AggFunc_AGG_FUNC_RAW, Uuids: []string{federatedUUID2, federatedUUID1, federatedUUID4}},
+		{Name: "y", Aggregation: mortarpb.AggFunc_AGG_FUNC_RAW, Uuids: []string{federatedUUID3, federatedUUID2}},
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	points := federatedPoints(responses)
+	if fmt.Sprint(points) != "[x/b2@1 x/b2@2 x/a1@1 x/a1@2 x/b4@1 x/b4@2 y/a3@1 y/a3@2 y/b2@1 y/b2@2]" {
+		t.Errorf("got %v", points)
+	}
+	var last resumePosition
+	for idx, resp := range responses {
+		if resp.Summary != nil {
+			continue
+		}
+		pos, err := parseResumeToken(resp.ResumeToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if idx > 0 && !last.before(pos) {
+			t.Errorf("response %d at %v after %v", idx, pos, last)
+		}
+		last = pos
+	}
+}
+
+func TestFederatedBackendFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fail := func(uuStr string) error {
+		if uuStr == federatedUUID2 {
+			return errors.New("disk on fire")
+		}
+		return nil
+	}
+	upstream := newTestFederatedStage(t, ctx, &fakeBackend{}, &fakeBackend{fail: fail})
+	request := func(policy mortarpb.FailurePolicy) *mortarpb.FetchRequest {
+		return &mortarpb.FetchRequest{FailurePolicy: policy, DataFrames: []*mortarpb.DataFrame{
+			{Name: "x", Aggregation: mortarpb.AggFunc_AGG_FUNC_RAW, Uuids: []string{federatedUUID1, federatedUUID2, federatedUUID4}},
+		}}
+	}
+
+	// fail fast: the request fails with the error of the backend
+	_, err := federatedFetch(upstream, request(mortarpb.FailurePolicy_FAILURE_POLICY_FAIL_FAST), nil)
+	if err == nil || !strings.Contains(err.Error(), "b backend") || !strings.Contains(err.Error(), "disk on fire") {
+		t.Errorf("fail-fast fetch got %v", err)
+	}
+
+	// best-effort: the client is told about the UUID and gets the others
+	responses, err := federatedFetch(upstream, request(mortarpb.FailurePolicy_FAILURE_POLICY_BEST_EFFORT), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	points := federatedPoints(responses)
+	sort.Strings(points)
+	if fmt.Sprint(points) != "[x/a1@1 x/a1@2 x/b4@1 x/b4@2]" {
+		t.Errorf("best-effort fetch got %v", points)
+	}
+	var failures []string
+	for _, resp := range responses {
+		if resp.Error != "" {
+			failures = append(failures, resp.Identifier+": "+resp.Error)
+		}
+	}
+	if fmt.Sprint(failures) != "["+federatedUUID2+": disk on fire]" {
+		t.Errorf("best-effort fetch reported %v", failures)
+	}
+}
+
+func TestFederatedCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a := &fakeBackend{block: true, cancelled: make(chan struct{})}
+	upstream := newTestFederatedStage(t, ctx, a, &fakeBackend{})
+
+	reqCtx, reqCancel := context.WithCancel(context.Background())
+	req := NewFetchRequest(reqCtx, &mortarpb.FetchRequest{
+		Sites: []string{"soda"},
+		Time:  &mortarpb.TimeParams{Start: "2020-01-01T00:00:00Z", End: "2020-01-02T00:00:00Z"},
+		DataFrames: []*mortarpb.DataFrame{
+			{Name: "x", Aggregation: mortarpb.AggFunc_AGG_FUNC_RAW, Uuids: []string{federatedUUID1, federatedUUID2}},
+		},
+	})
+	upstream.queue <- req
+	// the client goes away while backend a is reading
+	go func() {
+		for len(a.requestsSeen()) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		reqCancel()
+	}()
+	if _, err := consumeFetch(req); status.Code(err) != codes.Canceled {
+		t.Errorf("got %v", err)
+	}
+	select {
+	case <-a.cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the backend request was not cancelled")
+	}
+}
@@ -0,0 +1,275 @@
+package stages
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	mortarpb "github.com/SoftwareDefinedBuildings/mortar/proto"
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/ipc"
+	"github.com/apache/arrow/go/arrow/memory"
+	"github.com/pkg/errors"
+)
+
+// number of rows in each record batch sent by FetchArrow
+const arrowFetchBatchRows = 64 * 1024
+
+// arrowFetchSchema is the schema of the record batches sent by FetchArrow
+var arrowFetchSchema = arrow.NewSchema([]arrow.Field{
+	{Name: "site", Type: arrow.BinaryTypes.String},
+	{Name: "view", Type: arrow.BinaryTypes.String},
+	{Name: "dataFrame", Type: arrow.BinaryTypes.String},
+	{Name: "uuid", Type: arrow.BinaryTypes.String},
+	{Name: "time", Type: arrow.FixedWidthTypes.Timestamp_ns},
+	{Name: "value", Type: arrow.PrimitiveTypes.Float64},
+}, nil)
+
+// arrowFetchWriter turns the timeseries responses of a Fetch into an Arrow IPC stream.
+// Each encoded message (the schema, then one message per record batch) is passed to send
+type arrowFetchWriter struct {
+	site      *array.StringBuilder
+	view      *array.StringBuilder
+	dataFrame *array.StringBuilder
+	uuid      *array.StringBuilder
+	time      *array.TimestampBuilder
+	value     *array.Float64Builder
+	rows      int
+
+	// the ipc writer encodes into buf, which is handed to send after each write
+	buf    bytes.Buffer
+	writer *ipc.Writer
+	send   func(data []byte) error
+}
+
+func newArrowFetchWriter(send func(data []byte) error) *arrowFetchWriter {
+	mem := memory.NewGoAllocator()
+	w := &arrowFetchWriter{
+		site:      array.NewStringBuilder(mem),
+		view:      array.NewStringBuilder(mem),
+		dataFrame: array.NewStringBuilder(mem),
+		uuid:      array.NewStringBuilder(mem),
+		time:      array.NewTimestampBuilder(mem, arrow.FixedWidthTypes.Timestamp_ns.(*arrow.TimestampType)),
+		value:     array.NewFloat64Builder(mem),
+		send:      send,
+	}
+	w.writer = ipc.NewWriter(&w.buf, ipc.WithSchema(arrowFetchSchema), ipc.WithAllocator(mem))
+	return w
+}
+
+// add appends the points of a timeseries response, sending a record batch when enough rows
+// have accumulated. The site and view come from what the Brick stage resolved for the UUID
+func (w *arrowFetchWriter) add(req *Request, resp *mortarpb.FetchResponse) error {
+	site, view := resp.Site, resp.View
+	if site == "" {
+		site = req.uuid_sites[resp.Identifier]
+	}
+	if view == "" {
+		view = req.uuid_views[resp.Identifier]
+	}
+	for idx := range resp.Times {
+		w.site.Append(site)
+		w.view.Append(view)
+		w.dataFrame.Append(resp.DataFrame)
+		w.uuid.Append(resp.Identifier)
+		w.time.Append(arrow.Timestamp(resp.Times[idx]))
+		w.value.Append(resp.Values[idx])
+		w.rows++
+		if w.rows == arrowFetchBatchRows {
+			if err := w.flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// flush sends the rows accumulated so far as one record batch
+func (w *arrowFetchWriter) flush() error {
+	if w.rows == 0 {
+		return nil
+	}
+	cols := []array.Interface{
+		w.site.NewArray(),
+		w.view.NewArray(),
+		w.dataFrame.NewArray(),
+		w.uuid.NewArray(),
+		w.time.NewArray(),
+		w.value.NewArray(),
+	}
+	rec := array.NewRecord(arrowFetchSchema, cols, int64(w.rows))
+	for _, col := range cols {
+		col.Release()
+	}
+	defer rec.Release()
+	w.rows = 0
+
+	if err := w.writer.Write(rec); err != nil {
+		return errors.Wrap(err, "Could not encode record batch")
+	}
+	return w.sendBuffer()
+}
+
+// close sends any rows left over and the end of the stream. The schema is always sent,
+// even if there were no rows
+func (w *arrowFetchWriter) close() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	if err := w.writer.Close(); err != nil {
+		return errors.Wrap(err, "Could not close Arrow stream")
+	}
+	return w.sendBuffer()
+}
+
+func (w *arrowFetchWriter) sendBuffer() error {
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	// send may hold on to the slice, so hand over a copy
+	data := make([]byte, w.buf.Len())
+	copy(data, w.buf.Bytes())
+	w.buf.Reset()
+	return w.send(data)
+}
+
+// fetchArrow dispatches the request to output and streams the timeseries in the responses
+// to the client as Arrow record batches. Brick query results are not included. Errors from
+// the pipeline are sent to the client as they happen, like Fetch does
+func fetchArrow(ctx context.Context, output chan *Request, request *mortarpb.FetchRequest, client mortarpb.Mortar_FetchArrowServer, audit *auditEntry) error {
+	req := NewFetchRequest(ctx, request)
+	defer req.cancel()
+
+	if err := admit(ctx, "brick", output, req); err != nil {
+		return err
+	}
+
+	writer := newArrowFetchWriter(func(data []byte) error {
+		if err := client.Send(&mortarpb.ArrowResponse{Data: data}); err != nil {
+			return err
+		}
+		messagesSent.Inc()
+		return nil
+	})
+
+	// the summary comes last, after the Arrow stream is complete
+	var summary *mortarpb.FetchSummary
+	finish := func() error {
+		if err := writer.close(); err != nil {
+			return err
+		}
+		if summary == nil {
+			return nil
+		}
+		return client.Send(&mortarpb.ArrowResponse{Summary: summary})
+	}
+
+	for {
+		select {
+		case resp := <-req.fetch_responses:
+			audit.sent(resp)
+			var err error
+			if resp.Error != "" {
+				err = client.Send(&mortarpb.ArrowResponse{Error: resp.Error})
+			} else if resp.Summary != nil {
+				summary = resp.Summary
+			} else if len(resp.Times) > 0 {
+				err = writer.add(req, resp)
+			}
+			finishResponse(resp)
+			if err != nil {
+				// we have an error on sending, so we tear it all down
+				log.Error(errors.Wrap(err, "Error on sending"))
+				return err
+			}
+		case <-req.Ended():
+			if err := req.Err(); err != nil {
+				return err
+			}
+			return finish()
+		case <-req.Done():
+			// the client went away or the request ran out of time
+			if err := req.abandon(errors.Wrap(req.ctx.Err(), "fetch timeout on response")); err != nil {
+				return err
+			}
+			return finish()
+		}
+	}
+}
+
+// FetchArrow is Fetch, but sends the timeseries as an Arrow IPC stream
+func (stage *ApiFrontendBasicStage) FetchArrow(request *mortarpb.FetchRequest, client mortarpb.Mortar_FetchArrowServer) (err error) {
+	audit := startAudit(client.Context(), "FetchArrow")
+	audit.fetch(request)
+	defer func() { audit.finish(err) }()
+
+	t := time.Now()
+	defer func() {
+		log.Info("FetchArrow took ", time.Since(t))
+		fetchProcessingTimes.Observe(float64(time.Since(t).Nanoseconds() / 1e6))
+	}()
+
+	authRequests.Inc()
+	activeQueries.Inc()
+	defer activeQueries.Dec()
+
+	ctx := client.Context()
+	if err := stage.authenticate(ctx); err != nil {
+		return err
+	}
+	authRequestsSuccessful.Inc()
+	audit.identify(tokenIdentity(ctx))
+
+	// here we are authenticated to the service.
+	validateErr := validateFetchRequest(request)
+	if validateErr != nil {
+		return invalidArgument(validateErr)
+	}
+
+	fetchQueriesProcessed.Inc()
+
+	select {
+	case sem := <-stage.sem:
+		defer func() { stage.sem <- sem }()
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "fetch timeout on getting semaphore")
+	}
+
+	return fetchArrow(ctx, stage.output, request, client, audit)
+}
+
+// FetchArrow is Fetch, but sends the timeseries as an Arrow IPC stream
+func (stage *ApiFrontendWAVEAuthStage) FetchArrow(request *mortarpb.FetchRequest, client mortarpb.Mortar_FetchArrowServer) (err error) {
+	audit := startAudit(client.Context(), "FetchArrow")
+	audit.fetch(request)
+	defer func() { audit.finish(err) }()
+
+	t := time.Now()
+	defer func() {
+		log.Info("FetchArrow took ", time.Since(t))
+		fetchProcessingTimes.Observe(float64(time.Since(t).Nanoseconds() / 1e6))
+	}()
+
+	activeQueries.Inc()
+	defer activeQueries.Dec()
+
+	ctx, cancel := context.WithTimeout(client.Context(), requestTimeout)
+	defer cancel()
+
+	validateErr := validateFetchRequest(request)
+	if validateErr != nil {
+		return invalidArgument(validateErr)
+	}
+
+	fetchQueriesProcessed.Inc()
+
+	select {
+	case sem := <-stage.sem:
+		defer func() { stage.sem <- sem }()
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "fetch timeout on getting semaphore")
+	}
+
+	return fetchArrow(ctx, stage.output, request, client, audit)
+}
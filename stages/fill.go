@@ -0,0 +1,158 @@
+package stages
+
+import (
+	"math"
+
+	mortarpb "github.com/SoftwareDefinedBuildings/mortar/proto"
+	"github.com/pkg/errors"
+)
+
+// gapFiller applies a DataFrame's FillPolicy to the points of a single timeseries.
+// Points are pushed in time order; the filler works out which grid positions are
+// missing (either because no point arrived for them, or because the point's value
+// is NaN, e.g. an empty window) and fills them according to the policy.
+// Positions that cannot be filled are dropped if they were never in the source data,
+// and passed through as NaN with DATA_QUALITY_MISSING otherwise.
+type gapFiller struct {
+	method    mortarpb.FillMethod
+	value     float64
+	staleness int64
+
+	// expected distance between points, and the query range
+	step  int64
+	start int64
+	end   int64
+
+	// the last grid position we have seen (observed or not)
+	last int64
+	// the last observed point
+	haveObserved bool
+	lastTime     int64
+	lastValue    float64
+
+	// positions waiting on the next observed point (for linear interpolation). A gap of
+	// any length is a single run, so long gaps do not use more memory
+	pending []pendingRun
+
+	emit func(t int64, v float64, q mortarpb.DataQuality)
+}
+
+// pendingRun is count positions a step apart, starting at time
+type pendingRun struct {
+	time      int64
+	count     int64
+	generated bool
+}
+
+// newGapFiller returns nil if the DataFrame does not need gap filling
+func newGapFiller(dataFrame *mortarpb.DataFrame, start, end int64, emit func(int64, float64, mortarpb.DataQuality)) (*gapFiller, error) {
+	policy := dataFrame.Fill
+	if policy == nil || policy.Method == mortarpb.FillMethod_FILL_METHOD_NONE {
+		return nil, nil
+	}
+	if dataFrame.Window == "" {
+		return nil, errors.Errorf("DataFrame %s needs a Window to use a fill policy", dataFrame.Name)
+	}
+	step, err := ParseDuration(dataFrame.Window)
+	if err != nil {
+		return nil, err
+	}
+	if step <= 0 {
+		return nil, errors.Errorf("DataFrame %s has a non-positive Window", dataFrame.Name)
+	}
+	f := &gapFiller{
+		method: policy.Method,
+		value:  policy.Value,
+		step:   step.Nanoseconds(),
+		start:  start,
+		end:    end,
+		last:   start - step.Nanoseconds(),
+		emit:   emit,
+	}
+	if policy.MaxStaleness != "" {
+		staleness, err := ParseDuration(policy.MaxStaleness)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not parse MaxStaleness for DataFrame %s", dataFrame.Name)
+		}
+		f.staleness = staleness.Nanoseconds()
+	}
+	return f, nil
+}
+
+// push handles the next point of the timeseries
+func (f *gapFiller) push(t int64, v float64) {
+	// generate the grid positions between the last point and this one. Positions
+	// within half a step of t are considered covered by t (this absorbs jitter in RAW data)
+	for p := f.last + f.step; p+f.step/2 <= t; p += f.step {
+		f.missing(p, true)
+	}
+	f.last = t
+
+	if math.IsNaN(v) {
+		f.missing(t, false)
+		return
+	}
+
+	if f.method == mortarpb.FillMethod_FILL_METHOD_LINEAR {
+		for _, run := range f.pending {
+			for i := int64(0); i < run.count; i++ {
+				p := run.time + i*f.step
+				if f.haveObserved {
+					frac := float64(p-f.lastTime) / float64(t-f.lastTime)
+					f.emit(p, f.lastValue+(v-f.lastValue)*frac, mortarpb.DataQuality_DATA_QUALITY_IMPUTED)
+				} else if !run.generated {
+					f.emit(p, math.NaN(), mortarpb.DataQuality_DATA_QUALITY_MISSING)
+				}
+			}
+		}
+		f.pending = f.pending[:0]
+	}
+
+	f.haveObserved = true
+	f.lastTime = t
+	f.lastValue = v
+	f.emit(t, v, mortarpb.DataQuality_DATA_QUALITY_OBSERVED)
+}
+
+// flush fills the rest of the query range after the last point
+func (f *gapFiller) flush() {
+	for p := f.last + f.step; p < f.end; p += f.step {
+		f.missing(p, true)
+	}
+	// nothing to interpolate towards
+	for _, run := range f.pending {
+		if run.generated {
+			continue
+		}
+		for i := int64(0); i < run.count; i++ {
+			f.emit(run.time+i*f.step, math.NaN(), mortarpb.DataQuality_DATA_QUALITY_MISSING)
+		}
+	}
+	f.pending = nil
+}
+
+func (f *gapFiller) missing(t int64, generated bool) {
+	switch f.method {
+	case mortarpb.FillMethod_FILL_METHOD_CONSTANT:
+		f.emit(t, f.value, mortarpb.DataQuality_DATA_QUALITY_IMPUTED)
+		return
+	case mortarpb.FillMethod_FILL_METHOD_PREVIOUS:
+		if f.haveObserved && (f.staleness == 0 || t-f.lastTime <= f.staleness) {
+			f.emit(t, f.lastValue, mortarpb.DataQuality_DATA_QUALITY_IMPUTED)
+			return
+		}
+	case mortarpb.FillMethod_FILL_METHOD_LINEAR:
+		if n := len(f.pending); n > 0 {
+			run := &f.pending[n-1]
+			if run.generated == generated && run.time+run.count*f.step == t {
+				run.count++
+				return
+			}
+		}
+		f.pending = append(f.pending, pendingRun{time: t, count: 1, generated: generated})
+		return
+	}
+	if !generated {
+		f.emit(t, math.NaN(), mortarpb.DataQuality_DATA_QUALITY_MISSING)
+	}
+}
@@ -0,0 +1,149 @@
+package stages
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	mortarpb "github.com/SoftwareDefinedBuildings/mortar/proto"
+)
+
+const fillTestStep = int64(time.Minute)
+
+// filledPoint is a point the filler emitted, with its time in steps
+type filledPoint struct {
+	step    int64
+	value   float64
+	quality mortarpb.DataQuality
+}
+
+var (
+	fillObserved = mortarpb.DataQuality_DATA_QUALITY_OBSERVED
+	fillImputed  = mortarpb.DataQuality_DATA_QUALITY_IMPUTED
+	fillMissing  = mortarpb.DataQuality_DATA_QUALITY_MISSING
+)
+
+// fillPoints runs the points, given in steps, through the fill policy over steps
+// [0, steps), like fetchBatcher does
+func fillPoints(t *testing.T, policy *mortarpb.FillPolicy, steps int64, points []filledPoint) []filledPoint {
+	var out []filledPoint
+	emit := func(ts int64, v float64, q mortarpb.DataQuality) {
+		out = append(out, filledPoint{ts / fillTestStep, v, q})
+	}
+	dataFrame := &mortarpb.DataFrame{Name: "df", Window: "1m", Fill: policy}
+	filler, err := newGapFiller(dataFrame, 0, steps*fillTestStep, emit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range points {
+		if filler == nil {
+			emit(p.step*fillTestStep, p.value, fillObserved)
+		} else {
+			filler.push(p.step*fillTestStep, p.value)
+		}
+	}
+	if filler != nil {
+		filler.flush()
+	}
+	return out
+}
+
+func TestGapFiller(t *testing.T) {
+	// steps 0-1, 4-5 and 7-9 have no data
+	gaps := []filledPoint{{2, 20, fillObserved}, {3, 30, fillObserved}, {6, 60, fillObserved}}
+	// steps 0, 4 and 8 are empty windows; 1, 5, 7 and 9 have no data
+	nanWindows := []filledPoint{{0, math.NaN(), fillObserved}, {2, 20, fillObserved}, {3, 30, fillObserved}, {4, math.NaN(), fillObserved}, {6, 60, fillObserved}, {8, math.NaN(), fillObserved}}
+
+	for _, test := range []struct {
+		name   string
+		policy *mortarpb.FillPolicy
+		points []filledPoint
+		want   []filledPoint
+	}{
+		{"none", nil, gaps, gaps},
+		{"none method", &mortarpb.FillPolicy{Method: mortarpb.FillMethod_FILL_METHOD_NONE}, gaps, gaps},
+		{"constant", &mortarpb.FillPolicy{Method: mortarpb.FillMethod_FILL_METHOD_CONSTANT, Value: -1}, gaps, []filledPoint{
+			{0, -1, fillImputed}, {1, -1, fillImputed}, {2, 20, fillObserved}, {3, 30, fillObserved}, {4, -1, fillImputed},
+			{5, -1, fillImputed}, {6, 60, fillObserved}, {7, -1, fillImputed}, {8, -1, fillImputed}, {9, -1, fillImputed},
+		}},
+		{"constant with empty windows", &mortarpb.FillPolicy{Method: mortarpb.FillMethod_FILL_METHOD_CONSTANT, Value: -1}, nanWindows, []filledPoint{
+			{0, -1, fillImputed}, {1, -1, fillImputed}, {2, 20, fillObserved}, {3, 30, fillObserved}, {4, -1, fillImputed},
+			{5, -1, fillImputed}, {6, 60, fillObserved}, {7, -1, fillImputed}, {8, -1, fillImputed}, {9, -1, fillImputed},
+		}},
+		// nothing to carry into the leading gap
+		{"previous", &mortarpb.FillPolicy{Method: mortarpb.FillMethod_FILL_METHOD_PREVIOUS}, gaps, []filledPoint{
+			{2, 20, fillObserved}, {3, 30, fillObserved}, {4, 30, fillImputed}, {5, 30, fillImputed},
+			{6, 60, fillObserved}, {7, 60, fillImputed}, {8, 60, fillImputed}, {9, 60, fillImputed},
+		}},
+		{"previous with staleness", &mortarpb.FillPolicy{Method: mortarpb.FillMethod_FILL_METHOD_PREVIOUS, MaxStaleness: "2m"}, gaps, []filledPoint{
+			{2, 20, fillObserved}, {3, 30, fillObserved}, {4, 30, fillImputed}, {5, 30, fillImputed},
+			{6, 60, fillObserved}, {7, 60, fillImputed}, {8, 60, fillImputed},
+		}},
+		{"previous with empty windows", &mortarpb.FillPolicy{Method: mortarpb.FillMethod_FILL_METHOD_PREVIOUS}, nanWindows, []filledPoint{
+			{0, math.NaN(), fillMissing}, {2, 20, fillObserved}, {3, 30, fillObserved}, {4, 30, fillImputed}, {5, 30, fillImputed},
+			{6, 60, fillObserved}, {7, 60, fillImputed}, {8, 60, fillImputed}, {9, 60, fillImputed},
+		}},
+		// only interior gaps have values on both sides
+		{"linear", &mortarpb.FillPolicy{Method: mortarpb.FillMethod_FILL_METHOD_LINEAR}, gaps, []filledPoint{
+			{2, 20, fillObserved}, {3, 30, fillObserved}, {4, 40, fillImputed}, {5, 50, fillImputed}, {6, 60, fillObserved},
+		}},
+		{"linear with empty windows", &mortarpb.FillPolicy{Method: mortarpb.FillMethod_FILL_METHOD_LINEAR}, nanWindows, []filledPoint{
+			{0, math.NaN(), fillMissing}, {2, 20, fillObserved}, {3, 30, fillObserved}, {4, 40, fillImputed}, {5, 50, fillImputed},
+			{6, 60, fillObserved}, {8, math.NaN(), fillMissing},
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got := fillPoints(t, test.policy, 10, test.points)
+			if len(got) != len(test.want) {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+			for i := range got {
+				same := got[i].value == test.want[i].value || math.IsNaN(got[i].value) && math.IsNaN(test.want[i].value)
+				if got[i].step != test.want[i].step || !same || got[i].quality != test.want[i].quality {
+					t.Fatalf("got %v, want %v", got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestGapFillerLinearLongGap(t *testing.T) {
+	const steps = 1000000
+	dataFrame := &mortarpb.DataFrame{Name: "df", Window: "1m", Fill: &mortarpb.FillPolicy{Method: mortarpb.FillMethod_FILL_METHOD_LINEAR}}
+
+	// the gap is buffered as one run rather than a position per step
+	filler, err := newGapFiller(dataFrame, 0, steps*fillTestStep, func(int64, float64, mortarpb.DataQuality) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	filler.push(0, 0)
+	for p := int64(1); p < steps; p++ {
+		filler.missing(p*fillTestStep, true)
+	}
+	if len(filler.pending) != 1 {
+		t.Fatalf("%d runs pending for one gap", len(filler.pending))
+	}
+
+	// and still interpolated at every step
+	var (
+		emitted int64
+		last    = int64(-1)
+	)
+	filler, err = newGapFiller(dataFrame, 0, steps*fillTestStep, func(ts int64, v float64, q mortarpb.DataQuality) {
+		step := ts / fillTestStep
+		if step != last+1 || math.Abs(v-float64(step)) > 1e-6 {
+			t.Fatalf("step %d after %d has value %v (%s)", step, last, v, q)
+		}
+		last = step
+		emitted++
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	filler.push(0, 0)
+	filler.push((steps-1)*fillTestStep, steps-1)
+	filler.flush()
+	if emitted != steps {
+		t.Fatalf("emitted %d points", emitted)
+	}
+}
@@ -3,13 +3,20 @@ package stages
 import (
 	"context"
 	mortarpb "github.com/SoftwareDefinedBuildings/mortar/proto"
+	"github.com/heptiolabs/healthcheck"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/encoding"
 	_ "google.golang.org/grpc/encoding/gzip"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"net"
+	"net/http"
 	"sync"
 	"time"
 )
@@ -19,8 +26,7 @@ func init() {
 }
 
 var (
-	unauthorizedErr = errors.New("Unauthorized")
-	requestTimeout  = 60 * time.Minute
+	requestTimeout = 60 * time.Minute
 )
 
 type ApiFrontendBasicStage struct {
@@ -28,6 +34,16 @@ type ApiFrontendBasicStage struct {
 	output chan *Request
 	auth   *CognitoAuth
 	sem    chan struct{}
+	jobs   *fetchJobs
+
+	// Qualify requests, taken by the next stage before those in output
+	priority chan *Request
+
+	server     *grpc.Server
+	httpServer *http.Server
+	*drainer
+	// nil if TLS is off
+	cert *certificate
 	sync.Mutex
 }
 
@@ -38,13 +54,23 @@ type ApiFrontendBasicStageConfig struct {
 	AuthConfig   CognitoAuthConfig
 	Upstream     Stage
 	StageContext context.Context
+
+	// address for the HTTP API (JSON versions of the RPCs, and Export); not served if empty
+	HTTPListenAddr string
+	// origins allowed to call the HTTP API from a browser; "*" allows any
+	CORSAllowedOrigins []string
+
+	// where and for how long the results of fetch jobs are kept
+	Jobs FetchJobsConfig
 }
 
 func NewApiFrontendBasicStage(cfg *ApiFrontendBasicStageConfig) (*ApiFrontendBasicStage, error) {
 	stage := &ApiFrontendBasicStage{
-		output: make(chan *Request),
-		ctx:    cfg.StageContext,
-		sem:    make(chan struct{}, 20),
+		output:   newQueue("brick"),
+		priority: newPriorityQueue("brick"),
+		ctx:      cfg.StageContext,
+		sem:      make(chan struct{}, 20),
+		drainer:  newDrainer(),
 	}
 	for i := 0; i < 20; i++ {
 		stage.sem <- struct{}{}
@@ -56,15 +82,23 @@ func NewApiFrontendBasicStage(cfg *ApiFrontendBasicStageConfig) (*ApiFrontendBas
 	}
 	stage.auth = auth
 
+	jobs, err := newFetchJobs(stage.ctx, stage.output, cfg.Jobs)
+	if err != nil {
+		return nil, err
+	}
+	stage.jobs = jobs
+
 	var server *grpc.Server
 
 	// handle TLS if it is configured
 	log.Infof("Cert file: %s, Key file: %s", cfg.TLSCrtFile, cfg.TLSKeyFile)
 	if cfg.TLSCrtFile != "" && cfg.TLSKeyFile != "" {
-		creds, err := credentials.NewServerTLSFromFile(cfg.TLSCrtFile, cfg.TLSKeyFile)
+		cert, err := loadCertificate(cfg.TLSCrtFile, cfg.TLSKeyFile)
 		if err != nil {
 			return nil, errors.Wrap(err, "could not load TLS keys")
 		}
+		stage.cert = cert
+		creds := credentials.NewTLS(cert.tlsConfig())
 		// this is the lets-encrypt code that we aren't using
 		//tls, err := GetTLS(cfg.TLSHost, cfg.TLSCacheDir)
 		//if err != nil {
@@ -74,9 +108,14 @@ func NewApiFrontendBasicStage(cfg *ApiFrontendBasicStageConfig) (*ApiFrontendBas
 		log.Info("Using TLS")
 		server = grpc.NewServer(
 			grpc.Creds(creds),
+			grpc.ChainUnaryInterceptor(otelgrpc.UnaryServerInterceptor(), instrumentUnary),
+			grpc.ChainStreamInterceptor(otelgrpc.StreamServerInterceptor(), instrumentStream),
 		)
 	} else {
-		server = grpc.NewServer()
+		server = grpc.NewServer(
+			grpc.ChainUnaryInterceptor(otelgrpc.UnaryServerInterceptor(), instrumentUnary),
+			grpc.ChainStreamInterceptor(otelgrpc.StreamServerInterceptor(), instrumentStream),
+		)
 	}
 
 	l, err := net.Listen("tcp", cfg.ListenAddr)
@@ -84,18 +123,85 @@ func NewApiFrontendBasicStage(cfg *ApiFrontendBasicStageConfig) (*ApiFrontendBas
 		return nil, errors.Wrapf(err, "Could not listen on address %s", cfg.ListenAddr)
 	}
 	mortarpb.RegisterMortarServer(server, stage)
+	stage.server = server
 	go func() {
 		for {
 			e := server.Serve(l)
+			if stage.isDraining() {
+				return
+			}
 			log.Error(errors.Wrap(e, "Error GRPC serving. Restarting in 10 sec"))
 			time.Sleep(10 * time.Second)
 		}
 	}()
 	log.Infof("Listening GRPC on %s", cfg.ListenAddr)
 
+	if cfg.HTTPListenAddr != "" {
+		stage.httpServer = &http.Server{
+			Addr:    cfg.HTTPListenAddr,
+			Handler: stage.httpHandler(cfg.CORSAllowedOrigins),
+		}
+		if stage.cert != nil {
+			stage.httpServer.TLSConfig = stage.cert.tlsConfig()
+		}
+		go func() {
+			for {
+				var e error
+				if stage.cert != nil {
+					// the certificate comes from TLSConfig
+					e = stage.httpServer.ListenAndServeTLS("", "")
+				} else {
+					e = stage.httpServer.ListenAndServe()
+				}
+				if e == http.ErrServerClosed {
+					return
+				}
+				log.Error(errors.Wrap(e, "Error HTTP serving. Restarting in 10 sec"))
+				time.Sleep(10 * time.Second)
+			}
+		}()
+		log.Infof("Listening HTTP on %s", cfg.HTTPListenAddr)
+	}
+
 	return stage, nil
 }
 
+// Shutdown stops accepting new requests and waits for those in flight, including running
+// fetch jobs, until ctx is done; then the remaining ones are cut off. Subscriptions are ended
+// right away. The StageContext should be cancelled afterwards to stop the other stages
+func (stage *ApiFrontendBasicStage) Shutdown(ctx context.Context) error {
+	return stage.drain(ctx, stage.server, stage.httpServer, stage.jobs)
+}
+
+// Reload rotates the TLS certificate and switches to the Cognito pool of cfg
+func (stage *ApiFrontendBasicStage) Reload(cfg *Config) {
+	stage.auth.update(cfg.Cognito)
+
+	useTLS := cfg.TLSCrtFile != "" && cfg.TLSKeyFile != ""
+	if useTLS != (stage.cert != nil) {
+		log.Warning("TLS turned on or off; restart to apply it")
+		return
+	}
+	if stage.cert == nil {
+		return
+	}
+	changed, err := stage.cert.load(cfg.TLSCrtFile, cfg.TLSKeyFile)
+	if err != nil {
+		log.Error(errors.Wrap(err, "Keeping the current TLS certificate"))
+	} else if changed {
+		log.Infof("Loaded new TLS certificate from %s", cfg.TLSCrtFile)
+	}
+}
+
+// the keys used to verify tokens must be fresh
+func (stage *ApiFrontendBasicStage) ReadinessChecks() map[string]healthcheck.Check {
+	return map[string]healthcheck.Check{"cognito-jwks": stage.auth.checkKeys}
+}
+
+func (stage *ApiFrontendBasicStage) LivenessChecks() map[string]healthcheck.Check {
+	return nil
+}
+
 // get the stage we pull from
 func (stage *ApiFrontendBasicStage) GetUpstream() Stage {
 	return nil
@@ -109,12 +215,44 @@ func (stage *ApiFrontendBasicStage) SetUpstream(upstream Stage) {
 func (stage *ApiFrontendBasicStage) GetQueue() chan *Request {
 	return stage.output
 }
+
+func (stage *ApiFrontendBasicStage) GetPriorityQueue() chan *Request {
+	return stage.priority
+}
 func (stage *ApiFrontendBasicStage) String() string {
 	return "<| api frontend basic stage |>"
 }
 
+// authenticate checks the token in the metadata of the call; clients without a valid
+// token get Unauthenticated
+func (stage *ApiFrontendBasicStage) authenticate(ctx context.Context) error {
+	var token string
+	if headers, ok := metadata.FromIncomingContext(ctx); ok && len(headers["token"]) > 0 {
+		token = headers["token"][0]
+	}
+	if err := stage.checkToken(token); err != nil {
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+	return nil
+}
+
+// checkToken verifies a token from GetAPIKey
+func (stage *ApiFrontendBasicStage) checkToken(token string) error {
+	if len(token) == 0 {
+		authFailures.WithLabelValues("missing_token").Inc()
+		return errors.New("no auth key")
+	}
+	if _, authErr := stage.auth.verifyToken(token); authErr != nil {
+		return authErr
+	}
+	return nil
+}
+
 // identify which sites meet the requirements of the queries
-func (stage *ApiFrontendBasicStage) Qualify(ctx context.Context, request *mortarpb.QualifyRequest) (*mortarpb.QualifyResponse, error) {
+func (stage *ApiFrontendBasicStage) Qualify(ctx context.Context, request *mortarpb.QualifyRequest) (_ *mortarpb.QualifyResponse, err error) {
+	audit := startAudit(ctx, "Qualify")
+	audit.qualify(request)
+	defer func() { audit.finish(err) }()
 
 	defer func() {
 		if r := recover(); r != nil {
@@ -131,23 +269,15 @@ func (stage *ApiFrontendBasicStage) Qualify(ctx context.Context, request *mortar
 	activeQueries.Inc()
 	defer activeQueries.Dec()
 	authRequests.Inc()
-	headers, ok := metadata.FromIncomingContext(ctx)
-	if !ok {
-		return nil, unauthorizedErr
-	}
-	if _tokens, ok := headers["token"]; ok && len(_tokens) > 0 && len(_tokens[0]) > 0 {
-		token := _tokens[0]
-		if _, authErr := stage.auth.verifyToken(token); authErr != nil {
-			return nil, authErr
-		}
-	} else {
-		return nil, errors.New("no auth key")
+	if authErr := stage.authenticate(ctx); authErr != nil {
+		return nil, authErr
 	}
 	authRequestsSuccessful.Inc()
+	audit.identify(tokenIdentity(ctx))
 	// here we are authenticated to the service.
 	validateErr := validateQualifyRequest(request)
 	if validateErr != nil {
-		return nil, validateErr
+		return nil, invalidArgument(validateErr)
 	}
 
 	qualifyQueriesProcessed.Inc()
@@ -156,33 +286,29 @@ func (stage *ApiFrontendBasicStage) Qualify(ctx context.Context, request *mortar
 
 	// send the request to the output of this stage so it
 	// can be handled by the next stage
-	select {
-	case stage.output <- req:
-	case <-ctx.Done():
-		return nil, errors.Wrap(ctx.Err(), "qualify timeout on dispatching query")
+	if err := admit(ctx, "brick", stage.priority, req); err != nil {
+		return nil, err
 	}
 
-	select {
-	case resp := <-req.qualify_responses:
-		if resp.Error != "" {
-			log.Warning(resp.Error)
-		}
-		if req.err != nil && resp.Error == "" {
-			resp.Error = req.err.Error()
-		}
-		close(req.qualify_responses)
-		return resp, nil
-	case <-ctx.Done():
-		return nil, errors.Wrap(ctx.Err(), "qualify timeout on getting query response")
+	resp, err := awaitQualify(req)
+	if err != nil {
+		return nil, err
 	}
-
-	return nil, errors.New("impossible error")
-
+	if resp.Error != "" {
+		log.Warning(resp.Error)
+	}
+	audit.qualified(resp)
+	return resp, nil
 }
 
 // pull data from Mortar
 // gets called from frontend by GRPC server
-func (stage *ApiFrontendBasicStage) Fetch(request *mortarpb.FetchRequest, client mortarpb.Mortar_FetchServer) error {
+func (stage *ApiFrontendBasicStage) Fetch(request *mortarpb.FetchRequest, client mortarpb.Mortar_FetchServer) (err error) {
+	ctx := client.Context()
+	audit := startAudit(ctx, "Fetch")
+	audit.fetch(request)
+	defer func() { audit.finish(err) }()
+
 	t := time.Now()
 	defer func() {
 		log.Info("Fetch took ", time.Since(t))
@@ -193,40 +319,38 @@ func (stage *ApiFrontendBasicStage) Fetch(request *mortarpb.FetchRequest, client
 	activeQueries.Inc()
 	defer activeQueries.Dec()
 
-	ctx := client.Context()
-
-	headers, ok := metadata.FromIncomingContext(ctx)
-	if !ok {
-		return unauthorizedErr
-	}
-	if _tokens, ok := headers["token"]; ok && len(_tokens) > 0 && len(_tokens[0]) > 0 {
-		token := _tokens[0]
-		if _, authErr := stage.auth.verifyToken(token); authErr != nil {
-			return authErr
-		}
-	} else {
-		return errors.New("no auth key")
+	if authErr := stage.authenticate(ctx); authErr != nil {
+		return authErr
 	}
 	authRequestsSuccessful.Inc()
+	audit.identify(tokenIdentity(ctx))
 
 	// here we are authenticated to the service.
 	validateErr := validateFetchRequest(request)
 	if validateErr != nil {
-		return validateErr
+		return invalidArgument(validateErr)
 	}
 
 	fetchQueriesProcessed.Inc()
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.Int("sites", len(request.Sites)),
+		attribute.Int("views", len(request.Views)),
+		attribute.Int("dataFrames", len(request.DataFrames)),
+	)
 
+	_, semSpan := startSpan(ctx, "wait for semaphore")
 	select {
 	case sem := <-stage.sem:
+		endSpan(semSpan, nil)
 		defer func() { stage.sem <- sem }()
 	case <-ctx.Done():
+		endSpan(semSpan, ctx.Err())
 		return errors.Wrap(ctx.Err(), "fetch timeout on getting semaphore")
 	}
 
 	req := NewFetchRequest(ctx, request)
 
-	ret := make(chan error)
+	ret := make(chan error, 1)
 	go func() {
 		var err error
 
@@ -234,36 +358,33 @@ func (stage *ApiFrontendBasicStage) Fetch(request *mortarpb.FetchRequest, client
 		for {
 			select {
 			case resp := <-req.fetch_responses:
-				if resp == nil {
-					// if this is nil then we are done, but there's no error (yet)
-					break sendloop
-				}
 				if err = client.Send(resp); err != nil {
 					// we have an error on sending, so we tear it all down
 					log.Error(errors.Wrap(err, "Error on sending"))
 					finishResponse(resp)
+					req.abandon(err)
 					break sendloop
 				} else {
 					// happy path
+					audit.sent(resp)
 					finishResponse(resp)
 					messagesSent.Inc()
 				}
-			case <-ctx.Done():
-				// this branch gets triggered because context gets cancelled
-				err = errors.Wrapf(ctx.Err(), "fetch timeout on response %v", req.err)
+			case <-req.Ended():
+				// the request ended; err is why, if it failed
+				err = req.Err()
+				break sendloop
+			case <-req.Done():
+				// the client went away or the request ran out of time
+				err = req.abandon(errors.Wrap(req.ctx.Err(), "fetch timeout on response"))
 				break sendloop
 			}
 		}
 		ret <- err
-		req.Lock()
-		close(req.fetch_responses)
-		req.Unlock()
 	}()
 
-	select {
-	case stage.output <- req:
-	case <-ctx.Done():
-		return errors.New("timeout")
+	if err := admit(ctx, "brick", stage.output, req); err != nil {
+		return err
 	}
 
 	select {
@@ -0,0 +1,350 @@
+package stages
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+
+	mortarpb "github.com/SoftwareDefinedBuildings/mortar/proto"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// the HTTP/JSON gateway renders messages with the field names of mortar.proto
+var gatewayMarshaler = &jsonpb.Marshaler{OrigName: true}
+
+// httpHandler serves the HTTP API: a JSON version of each RPC, plus the Export download.
+// Calls are authenticated with the same token as the gRPC API, passed in the "token" header.
+// Streaming calls respond with newline-delimited JSON, one message per line
+func (stage *ApiFrontendBasicStage) httpHandler(corsOrigins []string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/export", stage.serveExport)
+	mux.HandleFunc("/v1/getapikey", stage.serveGetAPIKey)
+	mux.HandleFunc("/v1/qualify", stage.serveQualify)
+	mux.HandleFunc("/v1/fetch", stage.serveFetch)
+	mux.HandleFunc("/v1/metadata", stage.serveMetadata)
+	mux.HandleFunc("/v1/subscribe", stage.serveSubscribe)
+	mux.HandleFunc("/v1/jobs/submit", stage.serveSubmitFetchJob)
+	mux.HandleFunc("/v1/jobs/get", stage.serveGetFetchJob)
+	mux.HandleFunc("/v1/jobs/results", stage.serveGetFetchJobResults)
+	mux.HandleFunc("/v1/audit/search", stage.serveSearchAuditLog)
+	// the server span of each call continues the trace in the traceparent header
+	traced := otelhttp.NewHandler(mux, "gateway", otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		return r.URL.Path
+	}))
+	return withCORS(corsOrigins, traced)
+}
+
+// withCORS adds CORS headers for requests from the allowed origins ("*" allows any origin)
+// and answers preflight requests
+func withCORS(origins []string, next http.Handler) http.Handler {
+	allowed := make(map[string]bool)
+	for _, origin := range origins {
+		allowed[origin] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin != "" && (allowed["*"] || allowed[origin]) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, token, traceparent")
+			w.Header().Set("Access-Control-Expose-Headers", "Content-Disposition")
+			w.Header().Add("Vary", "Origin")
+		}
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// gatewayContext passes the token header of the HTTP request on as gRPC metadata, and the
+// client address as the gRPC peer, so the RPC implementations handle them as usual. In
+// particular the RPCs authenticate the token, so handlers must not check it themselves. The
+// context keeps the span of the HTTP request
+func gatewayContext(r *http.Request) context.Context {
+	md := metadata.Pairs("token", r.Header.Get("token"))
+	ctx := peer.NewContext(r.Context(), &peer.Peer{Addr: gatewayAddr(r.RemoteAddr)})
+	return metadata.NewIncomingContext(ctx, md)
+}
+
+// gatewayAddr is the address of an HTTP client
+type gatewayAddr string
+
+func (addr gatewayAddr) Network() string {
+	return "tcp"
+}
+
+func (addr gatewayAddr) String() string {
+	return string(addr)
+}
+
+// readGatewayRequest parses the JSON body of a POST into msg
+func readGatewayRequest(w http.ResponseWriter, r *http.Request, msg proto.Message) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Need POST", http.StatusMethodNotAllowed)
+		return false
+	}
+	if err := jsonpb.Unmarshal(r.Body, msg); err != nil {
+		http.Error(w, errors.Wrapf(err, "Could not parse %s", proto.MessageName(msg)).Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeGatewayResponse(w http.ResponseWriter, msg proto.Message) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := gatewayMarshaler.Marshal(w, msg); err != nil {
+		log.Error(errors.Wrap(err, "Could not write response"))
+	}
+}
+
+// setRetryAfter tells a client turned away because the pipeline is full when to retry.
+// Returns false for any other error
+func setRetryAfter(w http.ResponseWriter, err error) bool {
+	delay, ok := retryDelay(err)
+	if ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+	}
+	return ok
+}
+
+func writeGatewayError(w http.ResponseWriter, err error, code int) {
+	if setRetryAfter(w, err) {
+		code = http.StatusServiceUnavailable
+	}
+	msg := err.Error()
+	if s, ok := status.FromError(err); ok {
+		msg = s.Message()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// gatewayStatus is the HTTP status for an error returned by an RPC, or code if its gRPC
+// status has no closer match
+func gatewayStatus(err error, code int) int {
+	switch status.Code(err) {
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	}
+	return code
+}
+
+func (stage *ApiFrontendBasicStage) serveGetAPIKey(w http.ResponseWriter, r *http.Request) {
+	var request mortarpb.GetAPIKeyRequest
+	if !readGatewayRequest(w, r, &request) {
+		return
+	}
+	resp, err := stage.GetAPIKey(r.Context(), &request)
+	if err != nil {
+		writeGatewayError(w, err, http.StatusUnauthorized)
+		return
+	}
+	writeGatewayResponse(w, resp)
+}
+
+func (stage *ApiFrontendBasicStage) serveQualify(w http.ResponseWriter, r *http.Request) {
+	var request mortarpb.QualifyRequest
+	if !readGatewayRequest(w, r, &request) {
+		return
+	}
+	resp, err := stage.Qualify(gatewayContext(r), &request)
+	if err != nil {
+		writeGatewayError(w, err, gatewayStatus(err, http.StatusInternalServerError))
+		return
+	}
+	writeGatewayResponse(w, resp)
+}
+
+func (stage *ApiFrontendBasicStage) serveFetch(w http.ResponseWriter, r *http.Request) {
+	var request mortarpb.FetchRequest
+	if !readGatewayRequest(w, r, &request) {
+		return
+	}
+	stage.streamFetch(w, r, &request)
+}
+
+// serveMetadata runs only the Brick queries of a FetchRequest: the responses hold the
+// query results of each View for each site, and no timeseries
+func (stage *ApiFrontendBasicStage) serveMetadata(w http.ResponseWriter, r *http.Request) {
+	var request mortarpb.FetchRequest
+	if !readGatewayRequest(w, r, &request) {
+		return
+	}
+	request.DataFrames = nil
+	request.Streams = nil
+	stage.streamFetch(w, r, &request)
+}
+
+// serveSubscribe streams the responses of Subscribe as they come, one line of JSON each
+func (stage *ApiFrontendBasicStage) serveSubscribe(w http.ResponseWriter, r *http.Request) {
+	var request mortarpb.SubscribeRequest
+	if !readGatewayRequest(w, r, &request) {
+		return
+	}
+	stream := newNDJSONFetchServer(w, r)
+	if err := stage.Subscribe(&request, stream); err != nil {
+		stream.fail(err)
+	}
+}
+
+func (stage *ApiFrontendBasicStage) serveSubmitFetchJob(w http.ResponseWriter, r *http.Request) {
+	var request mortarpb.FetchRequest
+	if !readGatewayRequest(w, r, &request) {
+		return
+	}
+	resp, err := stage.SubmitFetchJob(gatewayContext(r), &request)
+	if err != nil {
+		writeGatewayError(w, err, gatewayStatus(err, http.StatusInternalServerError))
+		return
+	}
+	writeGatewayResponse(w, resp)
+}
+
+func (stage *ApiFrontendBasicStage) serveGetFetchJob(w http.ResponseWriter, r *http.Request) {
+	var request mortarpb.FetchJobRequest
+	if !readGatewayRequest(w, r, &request) {
+		return
+	}
+	resp, err := stage.GetFetchJob(gatewayContext(r), &request)
+	if err != nil {
+		writeGatewayError(w, err, gatewayStatus(err, http.StatusBadRequest))
+		return
+	}
+	writeGatewayResponse(w, resp)
+}
+
+func (stage *ApiFrontendBasicStage) serveGetFetchJobResults(w http.ResponseWriter, r *http.Request) {
+	var request mortarpb.FetchJobResultsRequest
+	if !readGatewayRequest(w, r, &request) {
+		return
+	}
+	resp, err := stage.GetFetchJobResults(gatewayContext(r), &request)
+	if err != nil {
+		writeGatewayError(w, err, gatewayStatus(err, http.StatusBadRequest))
+		return
+	}
+	writeGatewayResponse(w, resp)
+}
+
+func (stage *ApiFrontendBasicStage) serveSearchAuditLog(w http.ResponseWriter, r *http.Request) {
+	var request mortarpb.AuditSearchRequest
+	if !readGatewayRequest(w, r, &request) {
+		return
+	}
+	resp, err := stage.SearchAuditLog(gatewayContext(r), &request)
+	if err != nil {
+		code := gatewayStatus(err, http.StatusBadRequest)
+		if status.Code(err) == codes.FailedPrecondition {
+			// the audit store is not configured
+			code = http.StatusNotFound
+		}
+		writeGatewayError(w, err, code)
+		return
+	}
+	writeGatewayResponse(w, resp)
+}
+
+// streamFetch runs Fetch and writes each FetchResponse as a line of JSON
+func (stage *ApiFrontendBasicStage) streamFetch(w http.ResponseWriter, r *http.Request, request *mortarpb.FetchRequest) {
+	stream := newNDJSONFetchServer(w, r)
+	if err := stage.Fetch(request, stream); err != nil {
+		stream.fail(err)
+	}
+}
+
+// ndjsonFetchServer lets Fetch stream its responses to an HTTP response as
+// newline-delimited JSON
+type ndjsonFetchServer struct {
+	ctx     context.Context
+	w       http.ResponseWriter
+	buf     *bufio.Writer
+	flusher http.Flusher
+	started bool
+}
+
+func newNDJSONFetchServer(w http.ResponseWriter, r *http.Request) *ndjsonFetchServer {
+	s := &ndjsonFetchServer{ctx: gatewayContext(r), w: w, buf: bufio.NewWriter(w)}
+	if flusher, ok := w.(http.Flusher); ok {
+		s.flusher = flusher
+	}
+	return s
+}
+
+// fail reports the error of the call: as an HTTP error if nothing has been written yet,
+// otherwise as a last line
+func (s *ndjsonFetchServer) fail(err error) {
+	if !s.started {
+		writeGatewayError(s.w, err, gatewayStatus(err, http.StatusInternalServerError))
+		return
+	}
+	s.Send(&mortarpb.FetchResponse{Error: err.Error()})
+}
+
+func (s *ndjsonFetchServer) Send(resp *mortarpb.FetchResponse) error {
+	if !s.started {
+		s.w.Header().Set("Content-Type", "application/x-ndjson")
+		s.started = true
+	}
+	if err := gatewayMarshaler.Marshal(s.buf, resp); err != nil {
+		return err
+	}
+	if err := s.buf.WriteByte('\n'); err != nil {
+		return err
+	}
+	// send each message as it comes, so clients can process the stream incrementally
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+	return nil
+}
+
+func (s *ndjsonFetchServer) Context() context.Context {
+	return s.ctx
+}
+
+func (s *ndjsonFetchServer) SetHeader(metadata.MD) error {
+	return nil
+}
+
+func (s *ndjsonFetchServer) SendHeader(metadata.MD) error {
+	return nil
+}
+
+func (s *ndjsonFetchServer) SetTrailer(metadata.MD) {
+}
+
+func (s *ndjsonFetchServer) SendMsg(m interface{}) error {
+	resp, ok := m.(*mortarpb.FetchResponse)
+	if !ok {
+		return errors.Errorf("Cannot send %T", m)
+	}
+	return s.Send(resp)
+}
+
+func (s *ndjsonFetchServer) RecvMsg(m interface{}) error {
+	return errors.New("Fetch does not receive messages")
+}
@@ -0,0 +1,146 @@
+package stages
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const gatewayTestIssuer = "https://cognito-idp.test/pool"
+
+// gatewayTestToken signs an access token for username; tokens signed with another key
+// fail verification
+func gatewayTestToken(t *testing.T, key *rsa.PrivateKey, username string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"client_id": "client",
+		"iss":       gatewayTestIssuer,
+		"token_use": "access",
+		"username":  username,
+	})
+	token.Header["kid"] = "key"
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func counterValue(t *testing.T, counter prometheus.Counter) float64 {
+	var m dto.Metric
+	if err := counter.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.Counter.GetValue()
+}
+
+func TestGatewayAuthenticatesOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mortar-gateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// stands in for the Brick stage: every Fetch completes without data
+	output := make(chan *Request)
+	go func() {
+		for req := range output {
+			if req.start() {
+				req.finish()
+			}
+		}
+	}()
+	defer close(output)
+	jobs, err := newFetchJobs(ctx, output, FetchJobsConfig{Directory: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jobs.wait()
+	stage := &ApiFrontendBasicStage{
+		ctx:  ctx,
+		jobs: jobs,
+		auth: &CognitoAuth{
+			clientid: "client",
+			jwks_url: gatewayTestIssuer + "/.well-known/jwks.json",
+			m:        map[string]rsa.PublicKey{"key": key.PublicKey},
+		},
+	}
+	handler := stage.httpHandler(nil)
+
+	post := func(path, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("token", token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	valid := `{"sites": ["site"], "time": {"start": "2020-01-01T00:00:00Z", "end": "2020-01-02T00:00:00Z"}, "dataFrames": [{"name": "df", "aggregation": "AGG_FUNC_RAW", "uuids": ["` + arrowTestUUID1 + `"]}]}`
+
+	for _, test := range []struct {
+		name       string
+		token      string
+		body       string
+		code       int
+		successful float64
+	}{
+		{"no token", "", valid, http.StatusUnauthorized, 0},
+		// authentication comes before validation
+		{"no token, bad request", "", `{}`, http.StatusUnauthorized, 0},
+		{"forged token", gatewayTestToken(t, otherKey, "alice"), valid, http.StatusUnauthorized, 0},
+		{"bad request", gatewayTestToken(t, key, "alice"), `{}`, http.StatusBadRequest, 1},
+		{"valid", gatewayTestToken(t, key, "alice"), valid, http.StatusOK, 1},
+	} {
+		requests, successful := counterValue(t, authRequests), counterValue(t, authRequestsSuccessful)
+		w := post("/v1/jobs/submit", test.token, test.body)
+		if w.Code != test.code {
+			t.Errorf("%s: got %d %s, want %d", test.name, w.Code, w.Body, test.code)
+		}
+		if got := counterValue(t, authRequests) - requests; got != 1 {
+			t.Errorf("%s: counted %v auth requests, want 1", test.name, got)
+		}
+		if got := counterValue(t, authRequestsSuccessful) - successful; got != test.successful {
+			t.Errorf("%s: counted %v successful auth requests, want %v", test.name, got, test.successful)
+		}
+	}
+
+	// jobs of other users are not found
+	w := post("/v1/jobs/submit", gatewayTestToken(t, key, "alice"), valid)
+	var job struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&job); err != nil || job.ID == "" {
+		t.Fatalf("submit returned %s", w.Body)
+	}
+	request := `{"id": "` + job.ID + `"}`
+	if w := post("/v1/jobs/get", gatewayTestToken(t, key, "bob"), request); w.Code != http.StatusNotFound {
+		t.Errorf("bob got %d %s", w.Code, w.Body)
+	}
+	if w := post("/v1/jobs/get", "", request); w.Code != http.StatusUnauthorized {
+		t.Errorf("no token got %d %s", w.Code, w.Body)
+	}
+	if w := post("/v1/jobs/get", gatewayTestToken(t, key, "alice"), request); w.Code != http.StatusOK {
+		t.Errorf("alice got %d %s", w.Code, w.Body)
+	}
+}
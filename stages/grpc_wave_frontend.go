@@ -8,9 +8,13 @@ import (
 	"time"
 
 	mortarpb "github.com/SoftwareDefinedBuildings/mortar/proto"
+	// wavemq and wave both register eapi.proto
+	_ "github.com/SoftwareDefinedBuildings/mortar/proto/conflict"
 	"github.com/gtfierro/xboswave/grpcauth"
+	"github.com/heptiolabs/healthcheck"
 	eapi "github.com/immesys/wave/eapi/pb"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
 	_ "google.golang.org/grpc/encoding/gzip"
 )
@@ -19,6 +23,14 @@ type ApiFrontendWAVEAuthStage struct {
 	ctx    context.Context
 	output chan *Request
 	sem    chan struct{}
+
+	// Qualify requests, taken by the next stage before those in output
+	priority chan *Request
+
+	server *grpc.Server
+	*drainer
+	// address of the WAVE agent
+	agent string
 	sync.Mutex
 }
 
@@ -35,9 +47,12 @@ type ApiFrontendWAVEAuthStageConfig struct {
 func NewApiFrontendWAVEAuthStage(cfg *ApiFrontendWAVEAuthStageConfig) (*ApiFrontendWAVEAuthStage, error) {
 
 	stage := &ApiFrontendWAVEAuthStage{
-		output: make(chan *Request),
-		ctx:    cfg.StageContext,
-		sem:    make(chan struct{}, 20),
+		output:   newQueue("brick"),
+		priority: newPriorityQueue("brick"),
+		ctx:      cfg.StageContext,
+		sem:      make(chan struct{}, 20),
+		drainer:  newDrainer(),
+		agent:    cfg.Agent,
 	}
 	for i := 0; i < 20; i++ {
 		stage.sem <- struct{}{}
@@ -59,7 +74,11 @@ func NewApiFrontendWAVEAuthStage(cfg *ApiFrontendWAVEAuthStageConfig) (*ApiFront
 		log.Fatalf("Could not use WAVE frontend: %v", err)
 	}
 
-	server := grpc.NewServer(grpc.Creds(serverwavecreds))
+	server := grpc.NewServer(
+		grpc.Creds(serverwavecreds),
+		grpc.ChainUnaryInterceptor(otelgrpc.UnaryServerInterceptor(), instrumentUnary),
+		grpc.ChainStreamInterceptor(otelgrpc.StreamServerInterceptor(), instrumentStream),
+	)
 
 	l, err := net.Listen("tcp", cfg.ListenAddr)
 	if err != nil {
@@ -74,9 +93,13 @@ func NewApiFrontendWAVEAuthStage(cfg *ApiFrontendWAVEAuthStageConfig) (*ApiFront
 
 	log.Infof("Authorized for namespace %s", ns)
 
+	stage.server = server
 	go func() {
 		for {
 			e := server.Serve(l)
+			if stage.isDraining() {
+				return
+			}
 			log.Error(errors.Wrap(e, "Error GRPC serving. Restarting in 10 sec"))
 			time.Sleep(10 * time.Second)
 		}
@@ -86,6 +109,23 @@ func NewApiFrontendWAVEAuthStage(cfg *ApiFrontendWAVEAuthStageConfig) (*ApiFront
 	return stage, nil
 }
 
+// Shutdown stops accepting new requests and waits for those in flight until ctx is done;
+// then the remaining ones are cut off. Subscriptions are ended right away. The StageContext should be cancelled afterwards to stop the other stages
+func (stage *ApiFrontendWAVEAuthStage) Shutdown(ctx context.Context) error {
+	return stage.drain(ctx, stage.server, nil, nil)
+}
+
+// the WAVE agent verifying the callers' proofs must be reachable
+func (stage *ApiFrontendWAVEAuthStage) ReadinessChecks() map[string]healthcheck.Check {
+	return map[string]healthcheck.Check{
+		"wave-agent": dependencyCheck(stage.ctx, healthcheck.TCPDialCheck(stage.agent, dependencyCheckTimeout)),
+	}
+}
+
+func (stage *ApiFrontendWAVEAuthStage) LivenessChecks() map[string]healthcheck.Check {
+	return nil
+}
+
 // get the stage we pull from
 func (stage *ApiFrontendWAVEAuthStage) GetUpstream() Stage {
 	return nil
@@ -99,12 +139,19 @@ func (stage *ApiFrontendWAVEAuthStage) SetUpstream(upstream Stage) {
 func (stage *ApiFrontendWAVEAuthStage) GetQueue() chan *Request {
 	return stage.output
 }
+
+func (stage *ApiFrontendWAVEAuthStage) GetPriorityQueue() chan *Request {
+	return stage.priority
+}
 func (stage *ApiFrontendWAVEAuthStage) String() string {
 	return "<| api frontend wave auth stage |>"
 }
 
 // identify which sites meet the requirements of the queries
-func (stage *ApiFrontendWAVEAuthStage) Qualify(ctx context.Context, request *mortarpb.QualifyRequest) (*mortarpb.QualifyResponse, error) {
+func (stage *ApiFrontendWAVEAuthStage) Qualify(ctx context.Context, request *mortarpb.QualifyRequest) (_ *mortarpb.QualifyResponse, err error) {
+	audit := startAudit(ctx, "Qualify")
+	audit.qualify(request)
+	defer func() { audit.finish(err) }()
 
 	t := time.Now()
 	defer func() {
@@ -128,29 +175,27 @@ func (stage *ApiFrontendWAVEAuthStage) Qualify(ctx context.Context, request *mor
 	// prepare context for the execution
 	req := NewQualifyRequest(ctx, request)
 
-	select {
-	case stage.output <- req:
-	case <-ctx.Done():
-		return nil, errors.Wrap(ctx.Err(), "qualify timeout on dispatching query")
+	if err := admit(ctx, "brick", stage.priority, req); err != nil {
+		return nil, err
 	}
 
-	select {
-	case resp := <-req.qualify_responses:
-		if resp.Error != "" {
-			log.Warning(resp.Error)
-		}
-		return resp, nil
-	case <-ctx.Done():
-		return nil, errors.Wrap(ctx.Err(), "qualify timeout on getting query response")
+	resp, err := awaitQualify(req)
+	if err != nil {
+		return nil, err
 	}
-
-	return nil, errors.New("impossible error")
-
+	if resp.Error != "" {
+		log.Warning(resp.Error)
+	}
+	audit.qualified(resp)
+	return resp, nil
 }
 
 // pull data from Mortar
 // gets called from frontend by GRPC server
-func (stage *ApiFrontendWAVEAuthStage) Fetch(request *mortarpb.FetchRequest, client mortarpb.Mortar_FetchServer) error {
+func (stage *ApiFrontendWAVEAuthStage) Fetch(request *mortarpb.FetchRequest, client mortarpb.Mortar_FetchServer) (err error) {
+	audit := startAudit(client.Context(), "Fetch")
+	audit.fetch(request)
+	defer func() { audit.finish(err) }()
 	t := time.Now()
 	defer func() {
 		log.Info("Fetch took ", time.Since(t))
@@ -178,7 +223,7 @@ func (stage *ApiFrontendWAVEAuthStage) Fetch(request *mortarpb.FetchRequest, cli
 	}
 
 	req := NewFetchRequest(ctx, request)
-	ret := make(chan error)
+	ret := make(chan error, 1)
 	go func() {
 		var err error
 
@@ -186,33 +231,33 @@ func (stage *ApiFrontendWAVEAuthStage) Fetch(request *mortarpb.FetchRequest, cli
 		for {
 			select {
 			case resp := <-req.fetch_responses:
-				if resp == nil {
-					// if this is nil then we are done, but there's no error (yet)
-					break sendloop
-				} else if err = client.Send(resp); err != nil {
+				if err = client.Send(resp); err != nil {
 					// we have an error on sending, so we tear it all down
 					log.Error(errors.Wrap(err, "Error on sending"))
-					// have to remember to call cancel() here
 					finishResponse(resp)
+					req.abandon(err)
 					break sendloop
 				} else {
 					// happy path
+					audit.sent(resp)
 					finishResponse(resp)
 					messagesSent.Inc()
 				}
-			case <-ctx.Done():
-				// this branch gets triggered because context gets cancelled
-				err = errors.Wrapf(ctx.Err(), "fetch timeout on response %v", req.err)
+			case <-req.Ended():
+				// the request ended; err is why, if it failed
+				err = req.Err()
+				break sendloop
+			case <-req.Done():
+				// the client went away or the request ran out of time
+				err = req.abandon(errors.Wrap(req.ctx.Err(), "fetch timeout on response"))
 				break sendloop
 			}
 		}
 		ret <- err
 	}()
 
-	select {
-	case stage.output <- req:
-	case <-ctx.Done():
-		return errors.New("timeout")
+	if err := admit(ctx, "brick", stage.output, req); err != nil {
+		return err
 	}
 
 	select {
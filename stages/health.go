@@ -0,0 +1,362 @@
+package stages
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/heptiolabs/healthcheck"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// a stage whose workers have all been busy for this long is not ready for more requests
+	saturationGrace = 10 * time.Second
+	// how often the throughput of the worker pools is computed
+	throughputInterval = 10 * time.Second
+	// checks that talk to a service are run in the background this often, so probes
+	// answer right away
+	dependencyCheckInterval = 10 * time.Second
+	dependencyCheckTimeout  = 5 * time.Second
+)
+
+// a stage whose workers have all been busy for longer than any request may run is stuck
+var stuckAfter = requestTimeout + 5*time.Minute
+
+// HealthReporter is implemented by stages that can tell whether they are able to
+// handle requests
+type HealthReporter interface {
+	// checks that fail while the stage cannot handle requests, e.g. when a service it
+	// depends on is down
+	ReadinessChecks() map[string]healthcheck.Check
+	// checks that fail if the stage is stuck and the process should be restarted
+	LivenessChecks() map[string]healthcheck.Check
+}
+
+// workerPool tracks how busy the workers of a stage are
+type workerPool struct {
+	name    string
+	total   int64
+	busy    int64
+	handled int64
+	// unix nanoseconds since all workers are busy; 0 while some are idle
+	saturatedSince int64
+	// requests handled per second over the last throughputInterval, as float64 bits
+	rate uint64
+
+	busyGauge prometheus.Gauge
+}
+
+// stage -> *workerPool
+var workerPools sync.Map
+var startThroughput sync.Once
+
+// workerGauges records the number of workers of the stage and returns the pool they
+// report to when they start and finish handling a request
+func workerGauges(stage Stage, name string, num int) *workerPool {
+	stageWorkers.WithLabelValues(name).Add(float64(num))
+	pool := &workerPool{name: name, total: int64(num), busyGauge: stageWorkersBusy.WithLabelValues(name)}
+	workerPools.Store(stage, pool)
+	startThroughput.Do(func() { go sampleThroughput() })
+	return pool
+}
+
+// subscriptionPool bounds the number of subscriptions a stage serves at once. They do not
+// hold a worker while they run
+type subscriptionPool struct {
+	max    int64
+	active int64
+}
+
+// stage -> *subscriptionPool
+var subscriptionPools sync.Map
+
+// subscriptionGauges records that the stage serves up to max subscriptions, and returns
+// the pool they take a place in
+func subscriptionGauges(stage Stage, max int) *subscriptionPool {
+	pool := &subscriptionPool{max: int64(max)}
+	subscriptionPools.Store(stage, pool)
+	return pool
+}
+
+func subscriptionsOf(stage Stage) *subscriptionPool {
+	pool, ok := subscriptionPools.Load(stage)
+	if !ok {
+		return nil
+	}
+	return pool.(*subscriptionPool)
+}
+
+// acquire takes a place for a subscription; false if all are taken
+func (pool *subscriptionPool) acquire() bool {
+	for {
+		active := atomic.LoadInt64(&pool.active)
+		if active >= pool.max {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&pool.active, active, active+1) {
+			activeSubscriptions.Inc()
+			return true
+		}
+	}
+}
+
+// release gives back the place of a subscription that ended
+func (pool *subscriptionPool) release() {
+	atomic.AddInt64(&pool.active, -1)
+	activeSubscriptions.Dec()
+}
+
+func poolOf(stage Stage) *workerPool {
+	pool, ok := workerPools.Load(stage)
+	if !ok {
+		return nil
+	}
+	return pool.(*workerPool)
+}
+
+// Inc marks a worker busy
+func (pool *workerPool) Inc() {
+	pool.busyGauge.Inc()
+	if atomic.AddInt64(&pool.busy, 1) == pool.total {
+		atomic.CompareAndSwapInt64(&pool.saturatedSince, 0, time.Now().UnixNano())
+	}
+}
+
+// Dec marks a worker idle again after handling a request
+func (pool *workerPool) Dec() {
+	pool.busyGauge.Dec()
+	atomic.AddInt64(&pool.handled, 1)
+	if atomic.AddInt64(&pool.busy, -1) < pool.total {
+		atomic.StoreInt64(&pool.saturatedSince, 0)
+	}
+}
+
+// saturated is how long all workers have been busy
+func (pool *workerPool) saturated() time.Duration {
+	since := atomic.LoadInt64(&pool.saturatedSince)
+	if since == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, since))
+}
+
+func (pool *workerPool) throughput() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&pool.rate))
+}
+
+// readiness fails while new requests would have to wait for a worker
+func (pool *workerPool) readiness() error {
+	if d := pool.saturated(); d > saturationGrace {
+		return errors.Errorf("All %d %s workers busy for %s", pool.total, pool.name, d.Truncate(time.Second))
+	}
+	return nil
+}
+
+// liveness fails if the workers have been busy for longer than any request may take
+func (pool *workerPool) liveness() error {
+	if d := pool.saturated(); d > stuckAfter {
+		return errors.Errorf("All %d %s workers stuck for %s", pool.total, pool.name, d.Truncate(time.Second))
+	}
+	return nil
+}
+
+func sampleThroughput() {
+	last := make(map[*workerPool]int64)
+	for range time.Tick(throughputInterval) {
+		workerPools.Range(func(_, value interface{}) bool {
+			pool := value.(*workerPool)
+			handled := atomic.LoadInt64(&pool.handled)
+			rate := float64(handled-last[pool]) / throughputInterval.Seconds()
+			atomic.StoreUint64(&pool.rate, math.Float64bits(rate))
+			last[pool] = handled
+			return true
+		})
+	}
+}
+
+// workerChecks adds the saturation checks of the stage's workers to checks
+func workerChecks(stage Stage, checks map[string]healthcheck.Check, liveness bool) map[string]healthcheck.Check {
+	if checks == nil {
+		checks = make(map[string]healthcheck.Check)
+	}
+	if pool := poolOf(stage); pool != nil {
+		if liveness {
+			checks[pool.name+"-workers-stuck"] = pool.liveness
+		} else {
+			checks[pool.name+"-workers"] = pool.readiness
+		}
+	}
+	return checks
+}
+
+// dependencyCheck runs check in the background until ctx is done, so probes do not wait
+// on the service
+func dependencyCheck(ctx context.Context, check healthcheck.Check) healthcheck.Check {
+	return healthcheck.AsyncWithContext(ctx, healthcheck.Timeout(check, dependencyCheckTimeout), dependencyCheckInterval)
+}
+
+// StatusPage serves an overview of the stages of the pipeline with their health and
+// throughput. It shows nothing until the stages are set
+type StatusPage struct {
+	started time.Time
+	sync.RWMutex
+	// from the frontend down
+	stages []*stageChecks
+}
+
+// the checks of a stage, created once since some of them run in the background
+type stageChecks struct {
+	stage     Stage
+	liveness  map[string]healthcheck.Check
+	readiness map[string]healthcheck.Check
+}
+
+func NewStatusPage() *StatusPage {
+	return &StatusPage{started: time.Now()}
+}
+
+// SetStages walks the pipeline from its last stage up, adding the checks of each stage to
+// health and showing them on the page. Check names must be unique across stages
+func (page *StatusPage) SetStages(last Stage, health healthcheck.Handler) {
+	var stages []*stageChecks
+	for stage := last; stage != nil; stage = stage.GetUpstream() {
+		checks := &stageChecks{stage: stage}
+		if reporter, ok := stage.(HealthReporter); ok {
+			checks.liveness = reporter.LivenessChecks()
+			checks.readiness = reporter.ReadinessChecks()
+		}
+		for name, check := range checks.liveness {
+			health.AddLivenessCheck(name, check)
+		}
+		for name, check := range checks.readiness {
+			health.AddReadinessCheck(name, check)
+		}
+		stages = append([]*stageChecks{checks}, stages...)
+	}
+	page.Lock()
+	defer page.Unlock()
+	page.stages = stages
+}
+
+type stageStatus struct {
+	Name              string            `json:"name"`
+	Healthy           bool              `json:"healthy"`
+	Checks            map[string]string `json:"checks"`
+	Workers           int64             `json:"workers"`
+	BusyWorkers       int64             `json:"busyWorkers"`
+	Handled           int64             `json:"handled"`
+	RequestsPerSecond float64           `json:"requestsPerSecond"`
+	SaturatedSeconds  float64           `json:"saturatedSeconds"`
+	Subscriptions     int64             `json:"subscriptions"`
+	MaxSubscriptions  int64             `json:"maxSubscriptions"`
+}
+
+type pipelineStatus struct {
+	Uptime   string        `json:"uptime"`
+	InFlight int           `json:"inFlightRequests"`
+	Stages   []stageStatus `json:"stages"`
+}
+
+func (page *StatusPage) status() pipelineStatus {
+	page.RLock()
+	stages := page.stages
+	page.RUnlock()
+
+	status := pipelineStatus{
+		Uptime:   time.Since(page.started).Truncate(time.Second).String(),
+		InFlight: InFlightRequests(),
+	}
+	for _, checks := range stages {
+		s := stageStatus{Name: checks.stage.String(), Healthy: true, Checks: make(map[string]string)}
+		for _, group := range []map[string]healthcheck.Check{checks.readiness, checks.liveness} {
+			for name, check := range group {
+				if err := check(); err != nil {
+					s.Healthy = false
+					s.Checks[name] = err.Error()
+				} else if _, failed := s.Checks[name]; !failed {
+					s.Checks[name] = "OK"
+				}
+			}
+		}
+		if pool := poolOf(checks.stage); pool != nil {
+			s.Workers = pool.total
+			s.BusyWorkers = atomic.LoadInt64(&pool.busy)
+			s.Handled = atomic.LoadInt64(&pool.handled)
+			s.RequestsPerSecond = pool.throughput()
+			s.SaturatedSeconds = pool.saturated().Seconds()
+		}
+		if pool := subscriptionsOf(checks.stage); pool != nil {
+			s.Subscriptions = atomic.LoadInt64(&pool.active)
+			s.MaxSubscriptions = pool.max
+		}
+		status.Stages = append(status.Stages, s)
+	}
+	return status
+}
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"sorted": func(m map[string]string) []string {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return keys
+	},
+	"rate": func(r float64) string { return fmt.Sprintf("%.2f", r) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><title>Mortar status</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+.ok { color: #080; }
+.failed { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Mortar status</h1>
+<p>Up {{.Uptime}}, {{.InFlight}} requests in flight</p>
+{{if not .Stages}}<p>Starting: the stages are not ready yet</p>{{else}}
+<table>
+<tr><th>Stage</th><th>Health</th><th>Busy workers</th><th>Handled</th><th>Requests/s</th><th>Subscriptions</th></tr>
+{{range .Stages}}{{$checks := .Checks}}
+<tr>
+<td>{{.Name}}</td>
+<td>{{range sorted $checks}}{{$result := index $checks .}}<div class="{{if eq $result "OK"}}ok{{else}}failed{{end}}">{{.}}: {{$result}}</div>{{else}}-{{end}}</td>
+<td>{{if .Workers}}{{.BusyWorkers}}/{{.Workers}}{{else}}-{{end}}</td>
+<td>{{if .Workers}}{{.Handled}}{{else}}-{{end}}</td>
+<td>{{if .Workers}}{{rate .RequestsPerSecond}}{{else}}-{{end}}</td>
+<td>{{if .MaxSubscriptions}}{{.Subscriptions}}/{{.MaxSubscriptions}}{{else}}-{{end}}</td>
+</tr>
+{{end}}
+</table>{{end}}
+</body>
+</html>
+`))
+
+// ServeHTTP renders the status as HTML, or as JSON with ?format=json
+func (page *StatusPage) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	status := page.status()
+	if req.URL.Query().Get("format") == "json" {
+		rw.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(rw).Encode(status); err != nil {
+			log.Error(errors.Wrap(err, "Could not write status"))
+		}
+		return
+	}
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(rw, status); err != nil {
+		log.Error(errors.Wrap(err, "Could not render status"))
+	}
+}
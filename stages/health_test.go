@@ -0,0 +1,48 @@
+package stages
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestSubscriptionPool(t *testing.T) {
+	stage := newTestStage()
+	pool := subscriptionGauges(stage, 3)
+
+	var (
+		wg       sync.WaitGroup
+		acquired = make(chan bool, 10)
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			acquired <- pool.acquire()
+		}()
+	}
+	wg.Wait()
+	close(acquired)
+	granted := 0
+	for ok := range acquired {
+		if ok {
+			granted++
+		}
+	}
+	if granted != 3 {
+		t.Fatalf("granted %d of 3 subscriptions", granted)
+	}
+
+	page := NewStatusPage()
+	page.stages = []*stageChecks{{stage: stage}}
+	if status := page.status().Stages[0]; status.Subscriptions != 3 || status.MaxSubscriptions != 3 {
+		t.Errorf("status shows %d/%d subscriptions", status.Subscriptions, status.MaxSubscriptions)
+	}
+
+	pool.release()
+	if !pool.acquire() {
+		t.Error("a released place was not reused")
+	}
+	if pool.acquire() {
+		t.Error("granted more than 3 subscriptions")
+	}
+}
@@ -4,26 +4,43 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"strings"
 	"sync"
 	"time"
 
 	mortarpb "github.com/SoftwareDefinedBuildings/mortar/proto"
+	"github.com/heptiolabs/healthcheck"
 	//influx "github.com/influxdata/influxdb/client/v2"
 	influx "github.com/hamilton-lima/influxdb1-client/client"
-	//"github.com/pborman/uuid"
 	"github.com/pkg/errors"
 )
 
+// how often the UUID -> measurement index gets rebuilt
+var influxIndexRefresh = 5 * time.Minute
+
 type InfluxDBTimeseriesQueryStage struct {
 	upstream Stage
 	ctx      context.Context
 	output   chan *Request
 
-	conn influx.Client
-	// timeseries database stuff
-	//conn        *btrdb.BTrDB
-	//streamCache sync.Map
+	// replaced when the address or credentials change
+	conn     influx.Client
+	connCfg  influx.HTTPConfig
+	connLock sync.RWMutex
+
+	database    string
+	measurement string
+	uuidTag     string
+	valueField  string
+	chunkSize   int
+	concurrency int
 
+	// uuid -> measurement, used when the stage is not configured with a single measurement
+	measurementIndex map[string]string
+	indexLock        sync.RWMutex
+
+	workers sync.WaitGroup
 	sync.Mutex
 }
 
@@ -33,45 +50,123 @@ type InfluxDBTimeseriesStageConfig struct {
 	Username     string
 	Password     string
 	Address      string
+
+	// database to query; defaults to "xbos"
+	Database string
+	// measurement holding all timeseries. If empty, each collection is expected to be in
+	// its own measurement and the stage keeps an index of which measurement each UUID is in
+	Measurement string
+	// tag holding the UUID of the timeseries; defaults to "uuid"
+	UUIDTag string
+	// field holding the value of the timeseries; defaults to "value"
+	ValueField string
+
+	// number of points per chunk when streaming results; defaults to 10000
+	ChunkSize int
+	// number of UUIDs queried concurrently for each request; defaults to 4
+	Concurrency int
 }
 
 func NewInfluxDBTimeseriesQueryStage(cfg *InfluxDBTimeseriesStageConfig) (*InfluxDBTimeseriesQueryStage, error) {
+	if cfg.Upstream == nil {
+		return nil, errors.New("Need to specify Upstream in InfluxDB Timeseries config")
+	}
 
-	conn, err := influx.NewHTTPClient(influx.HTTPConfig{
+	connCfg := influx.HTTPConfig{
 		Addr:     cfg.Address,
 		Username: cfg.Username,
 		Password: cfg.Password,
-	})
+	}
+	conn, err := influx.NewHTTPClient(connCfg)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not connect influx")
 	}
 	log.Info("Connected to InfluxDB!")
 
 	stage := &InfluxDBTimeseriesQueryStage{
-		upstream: cfg.Upstream,
-		output:   make(chan *Request),
-		ctx:      cfg.StageContext,
-		conn:     conn,
+		upstream:         cfg.Upstream,
+		output:           make(chan *Request),
+		ctx:              cfg.StageContext,
+		conn:             conn,
+		connCfg:          connCfg,
+		database:         cfg.Database,
+		measurement:      cfg.Measurement,
+		uuidTag:          cfg.UUIDTag,
+		valueField:       cfg.ValueField,
+		chunkSize:        cfg.ChunkSize,
+		concurrency:      cfg.Concurrency,
+		measurementIndex: make(map[string]string),
+	}
+	if stage.database == "" {
+		stage.database = "xbos"
+	}
+	if stage.uuidTag == "" {
+		stage.uuidTag = "uuid"
+	}
+	if stage.valueField == "" {
+		stage.valueField = "value"
+	}
+	if stage.chunkSize <= 0 {
+		stage.chunkSize = 10000
+	}
+	if stage.concurrency <= 0 {
+		stage.concurrency = 4
+	}
+
+	// each collection from a plugin is in its own measurement, but we query by UUID
+	// so we need to know which measurement holds each UUID
+	if stage.measurement == "" {
+		if err := stage.buildMeasurementIndex(); err != nil {
+			return nil, errors.Wrap(err, "could not build influx measurement index")
+		}
+		go func() {
+			ticker := time.NewTicker(influxIndexRefresh)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if err := stage.buildMeasurementIndex(); err != nil {
+						log.Error(errors.Wrap(err, "could not rebuild influx measurement index"))
+					}
+				case <-stage.ctx.Done():
+					return
+				}
+			}
+		}()
 	}
 
 	// TODO: configure concurrent connections
 	num_workers := 20
+	busy := workerGauges(stage, "influxdb", num_workers)
 	// consume function
 	for i := 0; i < num_workers; i++ {
+		stage.workers.Add(1)
 		go func() {
+			defer stage.workers.Done()
 			input := stage.upstream.GetQueue()
 			for {
 				select {
 				case req := <-input:
-					if len(req.fetch_request.Sites) > 0 && len(req.fetch_request.DataFrames) > 0 {
+					busy.Inc()
+					if !req.start() {
+						// the client gave up while the request was queued
+					} else if req.subscribe {
+						req.addError(errSubscribeNotSupported)
+					} else if len(req.fetch_request.Sites) > 0 && len(req.fetch_request.DataFrames) > 0 {
 						if err := stage.processQuery(req); err != nil {
+							req.addError(err)
 							log.Println(err)
+						} else {
+							req.finish()
 						}
+					} else {
+						req.finish()
 					}
+					busy.Dec()
 					//stage.output <- req
 				case <-stage.ctx.Done():
 					// case that breaks the stage and releases resources
-					fmt.Println("Ending Timeseries Queue")
+					log.Info("Ending Timeseries Queue")
 					return
 				}
 			}
@@ -82,6 +177,13 @@ func NewInfluxDBTimeseriesQueryStage(cfg *InfluxDBTimeseriesStageConfig) (*Influ
 
 }
 
+// Close closes the connection to InfluxDB once the workers have stopped. The StageContext
+// must be done
+func (stage *InfluxDBTimeseriesQueryStage) Close() error {
+	stage.workers.Wait()
+	return stage.client().Close()
+}
+
 func (stage *InfluxDBTimeseriesQueryStage) GetUpstream() Stage {
 	stage.Lock()
 	defer stage.Unlock()
@@ -105,133 +207,270 @@ func (stage *InfluxDBTimeseriesQueryStage) String() string {
 	return "<|influx ts stage|>"
 }
 
+func (stage *InfluxDBTimeseriesQueryStage) client() influx.Client {
+	stage.connLock.RLock()
+	defer stage.connLock.RUnlock()
+	return stage.conn
+}
+
+// Reload switches to the InfluxDB address and credentials of cfg
+func (stage *InfluxDBTimeseriesQueryStage) Reload(cfg *Config) {
+	connCfg := influx.HTTPConfig{
+		Addr:     cfg.InfluxDBAddr,
+		Username: cfg.InfluxDBUser,
+		Password: cfg.InfluxDBPass,
+	}
+	stage.connLock.Lock()
+	defer stage.connLock.Unlock()
+	if connCfg.Addr == stage.connCfg.Addr && connCfg.Username == stage.connCfg.Username && connCfg.Password == stage.connCfg.Password {
+		return
+	}
+	conn, err := influx.NewHTTPClient(connCfg)
+	if err != nil {
+		log.Error(errors.Wrapf(err, "Could not connect to InfluxDB at %s; keeping the current connection", connCfg.Addr))
+		return
+	}
+	// requests in flight finish on the old client, which only drops its idle connections
+	stage.conn.Close()
+	stage.conn = conn
+	stage.connCfg = connCfg
+	log.Infof("Using InfluxDB at %s", connCfg.Addr)
+}
+
+func (stage *InfluxDBTimeseriesQueryStage) ReadinessChecks() map[string]healthcheck.Check {
+	checks := workerChecks(stage, nil, false)
+	checks["influxdb"] = dependencyCheck(stage.ctx, func() error {
+		_, _, err := stage.client().Ping(dependencyCheckTimeout)
+		return err
+	})
+	return checks
+}
+
+func (stage *InfluxDBTimeseriesQueryStage) LivenessChecks() map[string]healthcheck.Check {
+	return workerChecks(stage, nil, true)
+}
+
+// query runs an InfluxQL statement against the configured database and returns
+// the first result, surfacing any errors reported by the server
+func (stage *InfluxDBTimeseriesQueryStage) query(command string, params map[string]interface{}) (*influx.Result, error) {
+	q := influx.NewQueryWithParameters(command, stage.database, "ns", params)
+	resp, err := stage.client().Query(q)
+	if err != nil {
+		return nil, errors.Wrap(err, "influx query failed")
+	}
+	if err := resp.Error(); err != nil {
+		return nil, errors.Wrap(err, "influx query returned error")
+	}
+	if len(resp.Results) < 1 {
+		return &influx.Result{}, nil
+	}
+	return &resp.Results[0], nil
+}
+
+// buildMeasurementIndex rebuilds the uuid -> measurement index from the tag values in the database
+func (stage *InfluxDBTimeseriesQueryStage) buildMeasurementIndex() error {
+	res, err := stage.query(fmt.Sprintf(`SHOW TAG VALUES WITH KEY = %s`, quoteInfluxIdent(stage.uuidTag)), nil)
+	if err != nil {
+		return err
+	}
+	index := make(map[string]string)
+	for _, ser := range res.Series {
+		for _, row := range ser.Values {
+			// rows are [key, value]
+			if len(row) < 2 {
+				continue
+			}
+			if uu, ok := row[1].(string); ok {
+				index[uu] = ser.Name
+			}
+		}
+	}
+	stage.indexLock.Lock()
+	stage.measurementIndex = index
+	stage.indexLock.Unlock()
+	log.Infof("Indexed %d influx timeseries", len(index))
+	return nil
+}
+
+// getMeasurement returns the measurement holding the given UUID, looking it up
+// in the database if it was added since the index was last built
+func (stage *InfluxDBTimeseriesQueryStage) getMeasurement(uuStr string) (string, error) {
+	if stage.measurement != "" {
+		return stage.measurement, nil
+	}
+	stage.indexLock.RLock()
+	measurement, found := stage.measurementIndex[uuStr]
+	stage.indexLock.RUnlock()
+	if found {
+		return measurement, nil
+	}
+
+	res, err := stage.query(fmt.Sprintf(`SHOW TAG VALUES WITH KEY = %s WHERE %s = $uuid`, quoteInfluxIdent(stage.uuidTag), quoteInfluxIdent(stage.uuidTag)), map[string]interface{}{
+		"uuid": uuStr,
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(res.Series) == 0 {
+		return "", errStreamNotExist
+	}
+	measurement = res.Series[0].Name
+	stage.indexLock.Lock()
+	stage.measurementIndex[uuStr] = measurement
+	stage.indexLock.Unlock()
+	return measurement, nil
+}
+
 func (stage *InfluxDBTimeseriesQueryStage) processQuery(req *Request) error {
 	// parse timestamps for the query
 	start_time, err := time.Parse(time.RFC3339, req.fetch_request.Time.Start)
 	if err != nil {
-		err = errors.Wrapf(err, "Could not parse Start time (%s)", req.fetch_request.Time.Start)
-		req.addError(err)
-		return err
+		return invalidArgument(errors.Wrapf(err, "Could not parse Start time (%s)", req.fetch_request.Time.Start))
 	}
 	end_time, err := time.Parse(time.RFC3339, req.fetch_request.Time.End)
 	if err != nil {
-		err = errors.Wrapf(err, "Could not parse End time (%s)", req.fetch_request.Time.End)
-		req.addError(err)
-		return err
+		return invalidArgument(errors.Wrapf(err, "Could not parse End time (%s)", req.fetch_request.Time.End))
 	}
 
-	// TODO: there is an awkward design artifact we have inherited. Essentially,
-	// we put each collection from a plugin in its own "measurement". But, we want to query
-	// by UUID, and we don't know the measurement. Either need to build some index of UUID
-	// to measurement, or just insert into a single measurement that we know from the beginning
-	for _, dataFrame := range req.fetch_request.DataFrames {
-		for _, uuStr := range dataFrame.Uuids {
-
-			// default for RAW
-			selector := "value"
-			var groupby string
-			if dataFrame.Aggregation != mortarpb.AggFunc_AGG_FUNC_RAW {
-				window, err := ParseDuration(dataFrame.Window)
-				if err != nil {
-					req.addError(err)
-					return err
-				}
-				groupby = fmt.Sprintf("GROUP BY time(%s)", window)
-			}
+	err = fetchConcurrently(req, "influxdb", stage.concurrency, false, func(ctx context.Context, out *Request, dataFrame *mortarpb.DataFrame, uuStr string) error {
+		return stage.streamUUID(ctx, out, dataFrame, uuStr, start_time.UnixNano(), end_time.UnixNano())
+	})
+	return err
+}
 
-			// TODO: this is automatically interpolating?
-
-			switch dataFrame.Aggregation {
-			case mortarpb.AggFunc_AGG_FUNC_MEAN:
-				selector = `mean("value")`
-			case mortarpb.AggFunc_AGG_FUNC_MIN:
-				selector = `min("value")`
-			case mortarpb.AggFunc_AGG_FUNC_MAX:
-				selector = `max("value")`
-			case mortarpb.AggFunc_AGG_FUNC_SUM:
-				selector = `sum("value")`
-			case mortarpb.AggFunc_AGG_FUNC_COUNT:
-				selector = `count("value")`
-			}
+// streamUUID runs a chunked query for one UUID of the DataFrame and sends the results
+// to the client as the chunks arrive. Returns nil without sending everything if ctx is cancelled
+func (stage *InfluxDBTimeseriesQueryStage) streamUUID(ctx context.Context, req *Request, dataFrame *mortarpb.DataFrame, uuStr string, start, end int64) error {
+	measurement, err := stage.getMeasurement(uuStr)
+	if err != nil {
+		return errors.Wrapf(err, "Could not find measurement for %s", uuStr)
+	}
+	command, err := stage.buildQuery(dataFrame, measurement)
+	if err != nil {
+		return err
+	}
+	batcher, err := newFetchBatcher(req, dataFrame, uuStr, start, end)
+	if err != nil {
+		return err
+	}
 
-			q_str := fmt.Sprintf(`SELECT time, %s
-                             FROM "timeseries"
-                             WHERE uuid='%s' 
-                               AND time >= %d 
-                               AND time < %d
-                             %s
-                             ;`, selector, uuStr, start_time.UnixNano(), end_time.UnixNano(), groupby)
-			q := influx.Query{
-				Command:   q_str,
-				Database:  "xbos",
-				Precision: "ns",
-			}
-			resp, err := stage.conn.Query(q)
-			if err != nil {
-				log.Error(err)
-				continue
-			}
-			if len(resp.Results) < 1 {
-				log.Error("nil results")
-				continue
-			}
-			if len(resp.Results[0].Series) < 1 {
-				log.Error("nil series")
-				continue
-			}
+	q := influx.NewQueryWithParameters(command, stage.database, "ns", map[string]interface{}{
+		"uuid":  uuStr,
+		"start": start,
+		"end":   end,
+	})
+	q.ChunkSize = stage.chunkSize
+	chunks, err := stage.client().QueryAsChunk(q)
+	if err != nil {
+		return errors.Wrapf(err, "Could not fetch data for %s", uuStr)
+	}
 
-			tsresp := &mortarpb.FetchResponse{}
-			var pcount = 0
+	// closing the response unblocks NextResponse if we get cancelled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		chunks.Close()
+	}()
 
-			for _, ser := range resp.Results[0].Series {
+	for {
+		resp, err := chunks.NextResponse()
+		if err == io.EOF {
+			break
+		} else if ctx.Err() != nil {
+			return nil
+		} else if err != nil {
+			return errors.Wrapf(err, "Could not fetch data for %s", uuStr)
+		}
+		if err := resp.Error(); err != nil {
+			return errors.Wrapf(err, "Could not fetch data for %s", uuStr)
+		}
+		for _, result := range resp.Results {
+			for _, ser := range result.Series {
 				for _, row := range ser.Values {
-					if row[1] == nil {
-						continue
-					}
-
-					time, err := row[0].(json.Number).Int64()
-					if err != nil {
-						log.Error(err)
-						continue
-					}
-					value, err := row[1].(json.Number).Float64()
+					time, value, ok, err := parseInfluxRow(row)
 					if err != nil {
-						log.Error(err)
+						return errors.Wrapf(err, "Bad data for %s", uuStr)
+					} else if !ok {
 						continue
 					}
-					pcount += 1
-					tsresp.Times = append(tsresp.Times, time)
-					tsresp.Values = append(tsresp.Values, value)
-
-					if pcount == TS_BATCH_SIZE {
-						tsresp.DataFrame = dataFrame.Name
-						tsresp.Identifier = uuStr
-						select {
-						case req.fetch_responses <- tsresp:
-						case <-req.Done():
-							continue
-						}
-						//stage.output <- ctx
-						tsresp = &mortarpb.FetchResponse{}
-						pcount = 0
-					}
+					batcher.add(time, value)
 				}
 			}
-			// any left over
-			if len(tsresp.Times) > 0 {
-				tsresp.DataFrame = dataFrame.Name
-				tsresp.Identifier = uuStr
-				select {
-				case req.fetch_responses <- tsresp:
-				case <-req.Done():
-					continue
-				}
-				//stage.output <- ctx
-			}
+		}
+	}
+	// any left over; without any points the UUID is reported missing
+	batcher.finish()
+	return nil
+}
 
+// buildQuery returns the InfluxQL for one UUID of the DataFrame. Only identifiers
+// from the stage configuration are interpolated; the UUID and time range are bound
+// as the $uuid, $start and $end parameters
+func (stage *InfluxDBTimeseriesQueryStage) buildQuery(dataFrame *mortarpb.DataFrame, measurement string) (string, error) {
+	field := quoteInfluxIdent(stage.valueField)
+
+	// default for RAW
+	selector := field
+	var groupby string
+	if dataFrame.Aggregation != mortarpb.AggFunc_AGG_FUNC_RAW {
+		window, err := ParseDuration(dataFrame.Window)
+		if err != nil {
+			return "", err
 		}
+		// skip empty windows; gaps are handled by the DataFrame's fill policy
+		groupby = fmt.Sprintf("GROUP BY time(%dns) fill(none)", window.Nanoseconds())
 	}
-	req.fetch_responses <- nil
 
-	return nil
+	switch dataFrame.Aggregation {
+	case mortarpb.AggFunc_AGG_FUNC_MEAN:
+		selector = fmt.Sprintf("mean(%s)", field)
+	case mortarpb.AggFunc_AGG_FUNC_MIN:
+		selector = fmt.Sprintf("min(%s)", field)
+	case mortarpb.AggFunc_AGG_FUNC_MAX:
+		selector = fmt.Sprintf("max(%s)", field)
+	case mortarpb.AggFunc_AGG_FUNC_SUM:
+		selector = fmt.Sprintf("sum(%s)", field)
+	case mortarpb.AggFunc_AGG_FUNC_COUNT:
+		selector = fmt.Sprintf("count(%s)", field)
+	}
+
+	return fmt.Sprintf(`SELECT %s FROM %s WHERE %s = $uuid AND time >= $start AND time < $end %s`,
+		selector, quoteInfluxIdent(measurement), quoteInfluxIdent(stage.uuidTag), groupby), nil
+}
+
+// parseInfluxRow extracts the time and value from a [time, value] row. ok is false
+// if the row has no value
+func parseInfluxRow(row []interface{}) (t int64, v float64, ok bool, err error) {
+	if len(row) < 2 || row[1] == nil {
+		return
+	}
+	_t, isNum := row[0].(json.Number)
+	if !isNum {
+		err = fmt.Errorf("time column is %T, not a number", row[0])
+		return
+	}
+	if t, err = _t.Int64(); err != nil {
+		return
+	}
+	_v, isNum := row[1].(json.Number)
+	if !isNum {
+		err = fmt.Errorf("value column is %T, not a number", row[1])
+		return
+	}
+	if v, err = _v.Float64(); err != nil {
+		return
+	}
+	ok = true
+	return
+}
+
+// quoteInfluxIdent returns the identifier as a double-quoted InfluxQL identifier
+func quoteInfluxIdent(ident string) string {
+	ident = strings.Replace(ident, `\`, `\\`, -1)
+	ident = strings.Replace(ident, `"`, `\"`, -1)
+	return `"` + ident + `"`
 }
@@ -0,0 +1,432 @@
+package stages
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mortarpb "github.com/SoftwareDefinedBuildings/mortar/proto"
+	"github.com/heptiolabs/healthcheck"
+	"github.com/pkg/errors"
+)
+
+// InfluxDB2TimeseriesQueryStage reads timeseries from an InfluxDB 2.x server
+// using Flux over the HTTP API
+type InfluxDB2TimeseriesQueryStage struct {
+	upstream Stage
+	ctx      context.Context
+	output   chan *Request
+
+	client *http.Client
+	// replaced when the address or token change
+	server     influxDB2Server
+	serverLock sync.RWMutex
+
+	bucket      string
+	measurement string
+	uuidTag     string
+	valueField  string
+	concurrency int
+
+	sync.Mutex
+}
+
+// influxDB2Server is where the stage sends its queries
+type influxDB2Server struct {
+	address string
+	org     string
+	token   string
+	// the /api/v2/query URL including the org parameter
+	queryURL string
+	// the /health URL
+	healthURL string
+}
+
+func newInfluxDB2Server(address, org, token string) (influxDB2Server, error) {
+	base, err := url.Parse(address)
+	if err != nil {
+		return influxDB2Server{}, errors.Wrapf(err, "Invalid InfluxDB2 address %s", address)
+	}
+	health := *base
+	health.Path = strings.TrimSuffix(base.Path, "/") + "/health"
+	base.Path = strings.TrimSuffix(base.Path, "/") + "/api/v2/query"
+	base.RawQuery = url.Values{"org": []string{org}}.Encode()
+	return influxDB2Server{
+		address:   address,
+		org:       org,
+		token:     token,
+		queryURL:  base.String(),
+		healthURL: health.String(),
+	}, nil
+}
+
+type InfluxDB2TimeseriesStageConfig struct {
+	Upstream     Stage
+	StageContext context.Context
+	// base URL of the server, e.g. http://localhost:8086
+	Address string
+	// API token sent as "Authorization: Token ..."
+	Token  string
+	Org    string
+	Bucket string
+	// measurement holding the timeseries. If empty, all measurements are searched for the UUID
+	Measurement string
+	// tag holding the UUID of the timeseries; defaults to "uuid"
+	UUIDTag string
+	// field holding the value of the timeseries; defaults to "value"
+	ValueField string
+	// number of UUIDs queried concurrently for each request; defaults to 4
+	Concurrency int
+	// client used for requests; defaults to http.DefaultClient
+	HTTPClient *http.Client
+}
+
+func NewInfluxDB2TimeseriesQueryStage(cfg *InfluxDB2TimeseriesStageConfig) (*InfluxDB2TimeseriesQueryStage, error) {
+	if cfg.Upstream == nil {
+		return nil, errors.New("Need to specify Upstream in InfluxDB2 Timeseries config")
+	}
+	if cfg.Bucket == "" {
+		return nil, errors.New("Need to specify Bucket in InfluxDB2 Timeseries config")
+	}
+	server, err := newInfluxDB2Server(cfg.Address, cfg.Org, cfg.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	stage := &InfluxDB2TimeseriesQueryStage{
+		upstream:    cfg.Upstream,
+		output:      make(chan *Request),
+		ctx:         cfg.StageContext,
+		client:      cfg.HTTPClient,
+		server:      server,
+		bucket:      cfg.Bucket,
+		measurement: cfg.Measurement,
+		uuidTag:     cfg.UUIDTag,
+		valueField:  cfg.ValueField,
+		concurrency: cfg.Concurrency,
+	}
+	if stage.client == nil {
+		stage.client = http.DefaultClient
+	}
+	if stage.uuidTag == "" {
+		stage.uuidTag = "uuid"
+	}
+	if stage.valueField == "" {
+		stage.valueField = "value"
+	}
+	if stage.concurrency <= 0 {
+		stage.concurrency = 4
+	}
+
+	// TODO: configure concurrent connections
+	num_workers := 20
+	busy := workerGauges(stage, "influxdb2", num_workers)
+	// consume function
+	for i := 0; i < num_workers; i++ {
+		go func() {
+			input := stage.upstream.GetQueue()
+			for {
+				select {
+				case req := <-input:
+					busy.Inc()
+					if !req.start() {
+						// the client gave up while the request was queued
+					} else if req.subscribe {
+						req.addError(errSubscribeNotSupported)
+					} else if len(req.fetch_request.Sites) > 0 && len(req.fetch_request.DataFrames) > 0 {
+						if err := stage.processQuery(req); err != nil {
+							req.addError(err)
+							log.Println(err)
+						} else {
+							req.finish()
+						}
+					} else {
+						req.finish()
+					}
+					busy.Dec()
+				case <-stage.ctx.Done():
+					// case that breaks the stage and releases resources
+					log.Info("Ending Timeseries Queue")
+					return
+				}
+			}
+		}()
+	}
+
+	return stage, nil
+}
+
+// Close releases the idle connections to InfluxDB
+func (stage *InfluxDB2TimeseriesQueryStage) Close() error {
+	stage.client.CloseIdleConnections()
+	return nil
+}
+
+func (stage *InfluxDB2TimeseriesQueryStage) GetUpstream() Stage {
+	stage.Lock()
+	defer stage.Unlock()
+	return stage.upstream
+}
+
+func (stage *InfluxDB2TimeseriesQueryStage) SetUpstream(upstream Stage) {
+	stage.Lock()
+	defer stage.Unlock()
+	if stage != nil {
+		stage.upstream = upstream
+	}
+	log.Info("Updated stage to ", upstream)
+}
+
+func (stage *InfluxDB2TimeseriesQueryStage) GetQueue() chan *Request {
+	return stage.output
+}
+
+func (stage *InfluxDB2TimeseriesQueryStage) String() string {
+	return "<|influx2 ts stage|>"
+}
+
+func (stage *InfluxDB2TimeseriesQueryStage) currentServer() influxDB2Server {
+	stage.serverLock.RLock()
+	defer stage.serverLock.RUnlock()
+	return stage.server
+}
+
+// Reload switches to the InfluxDB2 address and token of cfg
+func (stage *InfluxDB2TimeseriesQueryStage) Reload(cfg *Config) {
+	stage.serverLock.Lock()
+	defer stage.serverLock.Unlock()
+	if cfg.InfluxDB2.Address == stage.server.address && cfg.InfluxDB2.Token == stage.server.token {
+		return
+	}
+	server, err := newInfluxDB2Server(cfg.InfluxDB2.Address, stage.server.org, cfg.InfluxDB2.Token)
+	if err != nil {
+		log.Error(errors.Wrap(err, "Keeping the current InfluxDB2 server"))
+		return
+	}
+	stage.server = server
+	log.Infof("Using InfluxDB2 at %s", server.address)
+}
+
+func (stage *InfluxDB2TimeseriesQueryStage) ReadinessChecks() map[string]healthcheck.Check {
+	checks := workerChecks(stage, nil, false)
+	checks["influxdb2"] = dependencyCheck(stage.ctx, func() error {
+		resp, err := stage.client.Get(stage.currentServer().healthURL)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return errors.Errorf("InfluxDB2 health returned %s", resp.Status)
+		}
+		return nil
+	})
+	return checks
+}
+
+func (stage *InfluxDB2TimeseriesQueryStage) LivenessChecks() map[string]healthcheck.Check {
+	return workerChecks(stage, nil, true)
+}
+
+func (stage *InfluxDB2TimeseriesQueryStage) processQuery(req *Request) error {
+	// parse timestamps for the query
+	start_time, err := time.Parse(time.RFC3339, req.fetch_request.Time.Start)
+	if err != nil {
+		return invalidArgument(errors.Wrapf(err, "Could not parse Start time (%s)", req.fetch_request.Time.Start))
+	}
+	end_time, err := time.Parse(time.RFC3339, req.fetch_request.Time.End)
+	if err != nil {
+		return invalidArgument(errors.Wrapf(err, "Could not parse End time (%s)", req.fetch_request.Time.End))
+	}
+
+	err = fetchConcurrently(req, "influxdb2", stage.concurrency, false, func(ctx context.Context, out *Request, dataFrame *mortarpb.DataFrame, uuStr string) error {
+		return stage.streamUUID(ctx, out, dataFrame, uuStr, start_time, end_time)
+	})
+	return err
+}
+
+// streamUUID runs the Flux query for one UUID of the DataFrame and sends the results
+// to the client as the CSV response is read
+func (stage *InfluxDB2TimeseriesQueryStage) streamUUID(ctx context.Context, req *Request, dataFrame *mortarpb.DataFrame, uuStr string, start, end time.Time) error {
+	flux, err := stage.buildQuery(dataFrame, uuStr, start, end)
+	if err != nil {
+		return err
+	}
+	batcher, err := newFetchBatcher(req, dataFrame, uuStr, start.UnixNano(), end.UnixNano())
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"query": flux,
+		"type":  "flux",
+		"dialect": map[string]interface{}{
+			"header":      true,
+			"annotations": []string{},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	server := stage.currentServer()
+	httpreq, err := http.NewRequest("POST", server.queryURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpreq = httpreq.WithContext(ctx)
+	httpreq.Header.Set("Authorization", "Token "+server.token)
+	httpreq.Header.Set("Content-Type", "application/json")
+	httpreq.Header.Set("Accept", "application/csv")
+
+	resp, err := stage.client.Do(httpreq)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return errors.Wrapf(err, "Could not fetch data for %s", uuStr)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.Errorf("Could not fetch data for %s: influx returned %d: %s", uuStr, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	err = readFluxCSV(resp.Body, func(t int64, v float64) {
+		batcher.add(t, v)
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return errors.Wrapf(err, "Could not read data for %s", uuStr)
+	}
+	// any left over; without any points the UUID is reported missing
+	batcher.finish()
+	return nil
+}
+
+// buildQuery returns the Flux query for one UUID of the DataFrame. Windowed aggregations
+// are labeled with the start of the window, like the BTrDB stage
+func (stage *InfluxDB2TimeseriesQueryStage) buildQuery(dataFrame *mortarpb.DataFrame, uuStr string, start, end time.Time) (string, error) {
+	filter := fmt.Sprintf(`r[%s] == %s and r._field == %s`, fluxString(stage.uuidTag), fluxString(uuStr), fluxString(stage.valueField))
+	if stage.measurement != "" {
+		filter += fmt.Sprintf(` and r._measurement == %s`, fluxString(stage.measurement))
+	}
+
+	var query strings.Builder
+	fmt.Fprintf(&query, "from(bucket: %s)\n", fluxString(stage.bucket))
+	fmt.Fprintf(&query, "  |> range(start: %s, stop: %s)\n", start.UTC().Format(time.RFC3339Nano), end.UTC().Format(time.RFC3339Nano))
+	fmt.Fprintf(&query, "  |> filter(fn: (r) => %s)\n", filter)
+
+	if dataFrame.Aggregation != mortarpb.AggFunc_AGG_FUNC_RAW {
+		window, err := ParseDuration(dataFrame.Window)
+		if err != nil {
+			return "", err
+		}
+		var fn string
+		switch dataFrame.Aggregation {
+		case mortarpb.AggFunc_AGG_FUNC_MEAN:
+			fn = "mean"
+		case mortarpb.AggFunc_AGG_FUNC_MIN:
+			fn = "min"
+		case mortarpb.AggFunc_AGG_FUNC_MAX:
+			fn = "max"
+		case mortarpb.AggFunc_AGG_FUNC_SUM:
+			fn = "sum"
+		case mortarpb.AggFunc_AGG_FUNC_COUNT:
+			fn = "count"
+		default:
+			return "", errors.Errorf("Unsupported aggregation %s", dataFrame.Aggregation)
+		}
+		// skip empty windows; gaps are handled by the DataFrame's fill policy
+		fmt.Fprintf(&query, "  |> aggregateWindow(every: %dns, fn: %s, timeSrc: \"_start\", createEmpty: false)\n", window.Nanoseconds(), fn)
+	}
+	query.WriteString(`  |> keep(columns: ["_time", "_value"])`)
+	return query.String(), nil
+}
+
+// readFluxCSV parses a Flux CSV response and calls add for each row, in order. Each table
+// in the response starts with its own header row; annotation rows (#datatype etc.) are skipped
+func readFluxCSV(r io.Reader, add func(t int64, v float64)) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	timeIdx, valueIdx, errorIdx := -1, -1, -1
+	inHeader := true
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if len(row) > 0 && strings.HasPrefix(row[0], "#") {
+			// an annotation row; the header comes after
+			inHeader = true
+			continue
+		}
+		if inHeader || isFluxHeader(row) {
+			timeIdx, valueIdx, errorIdx = -1, -1, -1
+			for idx, col := range row {
+				switch col {
+				case "_time":
+					timeIdx = idx
+				case "_value":
+					valueIdx = idx
+				case "error":
+					errorIdx = idx
+				}
+			}
+			inHeader = false
+			continue
+		}
+
+		if errorIdx >= 0 && errorIdx < len(row) {
+			return errors.New(row[errorIdx])
+		}
+		if timeIdx < 0 || valueIdx < 0 || timeIdx >= len(row) || valueIdx >= len(row) {
+			continue
+		}
+		if row[valueIdx] == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, row[timeIdx])
+		if err != nil {
+			return errors.Wrapf(err, "Could not parse time %s", row[timeIdx])
+		}
+		v, err := strconv.ParseFloat(row[valueIdx], 64)
+		if err != nil {
+			return errors.Wrapf(err, "Could not parse value %s", row[valueIdx])
+		}
+		add(t.UnixNano(), v)
+	}
+}
+
+// header rows name the columns; data rows never contain these values
+func isFluxHeader(row []string) bool {
+	for _, col := range row {
+		if col == "_time" || col == "_value" || col == "error" {
+			return true
+		}
+	}
+	return false
+}
+
+// fluxString returns s as a quoted Flux string literal
+func fluxString(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	s = strings.Replace(s, `${`, `\${`, -1)
+	return `"` + s + `"`
+}
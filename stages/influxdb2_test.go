@@ -0,0 +1,228 @@
+package stages
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mortarpb "github.com/SoftwareDefinedBuildings/mortar/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// testStage is the upstream of a stage under test; requests sent on queue are handled
+type testStage struct {
+	queue chan *Request
+}
+
+func newTestStage() *testStage {
+	return &testStage{queue: make(chan *Request)}
+}
+
+func (stage *testStage) GetUpstream() Stage         { return nil }
+func (stage *testStage) SetUpstream(upstream Stage) {}
+func (stage *testStage) GetQueue() chan *Request    { return stage.queue }
+func (stage *testStage) String() string             { return "<|test stage|>" }
+
+const (
+	influxTablesUUID = "0d3ed8b3-4d4a-4d69-9a5b-14f3d4c6e7a1"
+	influxEmptyUUID  = "1c5e2f0a-8b4d-4e0f-a3c6-2b7d9e1f4a52"
+	influxErrorUUID  = "2a9b4c1d-3e5f-4a6b-8c7d-9e0f1a2b3c43"
+)
+
+// two tables of annotated CSV, the second with its own annotations and header because it
+// has another column
+var influxTables = strings.Join([]string{
+	"#datatype,string,long,dateTime:RFC3339,double",
+	"#group,false,false,false,false",
+	"#default,_result,,,",
+	",result,table,_time,_value",
+	",,0,2020-01-01T00:00:00Z,1.5",
+	",,0,2020-01-01T00:01:00Z,2.5",
+	"",
+	"#datatype,string,long,string,dateTime:RFC3339,double",
+	"#group,false,false,true,false,false",
+	"#default,_result,,,,",
+	",result,table,host,_time,_value",
+	",,1,a,2020-01-01T00:02:00Z,3.5",
+	"",
+}, "\r\n")
+
+// fakeInfluxDB2 answers Flux queries for the test UUIDs, and records the queries it got
+type fakeInfluxDB2 struct {
+	sync.Mutex
+	queries []string
+}
+
+func (influx *fakeInfluxDB2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/v2/query" || r.URL.Query().Get("org") != "org" || r.Header.Get("Authorization") != "Token secret" {
+		http.Error(w, `{"code":"unauthorized","message":"unauthorized access"}`, http.StatusUnauthorized)
+		return
+	}
+	var body struct {
+		Query string `json:"query"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	influx.Lock()
+	influx.queries = append(influx.queries, body.Query)
+	influx.Unlock()
+
+	switch {
+	case strings.Contains(body.Query, influxTablesUUID):
+		w.Write([]byte(influxTables))
+	case strings.Contains(body.Query, influxEmptyUUID):
+		w.Write([]byte("\r\n"))
+	case strings.Contains(body.Query, influxErrorUUID):
+		http.Error(w, `{"code":"invalid","message":"bucket \"bucket\" not found"}`, http.StatusNotFound)
+	default:
+		w.Write([]byte(",error,reference\r\n,unexpected query,\r\n"))
+	}
+}
+
+func newTestInfluxDB2Stage(t *testing.T, ctx context.Context, address, measurement string) (*InfluxDB2TimeseriesQueryStage, *testStage) {
+	upstream := newTestStage()
+	stage, err := NewInfluxDB2TimeseriesQueryStage(&InfluxDB2TimeseriesStageConfig{
+		Upstream:     upstream,
+		StageContext: ctx,
+		Address:      address,
+		Token:        "secret",
+		Org:          "org",
+		Bucket:       "bucket",
+		Measurement:  measurement,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stage, upstream
+}
+
+func influxFetch(upstream *testStage, uuids ...string) ([]*mortarpb.FetchResponse, error) {
+	req := NewFetchRequest(context.Background(), &mortarpb.FetchRequest{
+		Sites: []string{"site"},
+		Time:  &mortarpb.TimeParams{Start: "2020-01-01T00:00:00Z", End: "2020-01-02T00:00:00Z"},
+		DataFrames: []*mortarpb.DataFrame{{
+			Name:        "df",
+			Aggregation: mortarpb.AggFunc_AGG_FUNC_RAW,
+			Uuids:       uuids,
+		}},
+	})
+	upstream.queue <- req
+	return consumeFetch(req)
+}
+
+func TestInfluxDB2Fetch(t *testing.T) {
+	influx := &fakeInfluxDB2{}
+	server := httptest.NewServer(influx)
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, upstream := newTestInfluxDB2Stage(t, ctx, server.URL, "")
+
+	// multiple tables
+	responses, err := influxFetch(upstream, influxTablesUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		times  []int64
+		values []float64
+	)
+	for _, resp := range responses {
+		if resp.Summary != nil {
+			if missing := resp.Summary.DataFrames[0].UuidsMissing; missing != 0 {
+				t.Errorf("%d UUIDs missing", missing)
+			}
+			continue
+		}
+		if resp.Identifier != influxTablesUUID || resp.DataFrame != "df" {
+			t.Errorf("response for %s of %s", resp.Identifier, resp.DataFrame)
+		}
+		times = append(times, resp.Times...)
+		values = append(values, resp.Values...)
+	}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	wantTimes := []int64{start.UnixNano(), start.Add(time.Minute).UnixNano(), start.Add(2 * time.Minute).UnixNano()}
+	wantValues := []float64{1.5, 2.5, 3.5}
+	if len(times) != len(wantTimes) || len(values) != len(wantValues) {
+		t.Fatalf("got times %v and values %v", times, values)
+	}
+	for i := range wantTimes {
+		if times[i] != wantTimes[i] || values[i] != wantValues[i] {
+			t.Fatalf("got times %v and values %v", times, values)
+		}
+	}
+
+	// an empty result: the UUID is reported missing
+	responses, err = influxFetch(upstream, influxEmptyUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responses) != 1 || responses[0].Summary == nil {
+		t.Fatalf("empty result sent %v", responses)
+	}
+	if missing := responses[0].Summary.DataFrames[0].UuidsMissing; missing != 1 {
+		t.Errorf("%d UUIDs missing, want 1", missing)
+	}
+
+	// an error response
+	_, err = influxFetch(upstream, influxErrorUUID)
+	if status.Code(err) != codes.Unknown || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("error response: got %v", err)
+	}
+
+	// an error table in the result
+	_, err = influxFetch(upstream, "3f1e2d3c-4b5a-4697-8877-665544332211")
+	if err == nil || !strings.Contains(err.Error(), "unexpected query") {
+		t.Errorf("error table: got %v", err)
+	}
+}
+
+func TestInfluxDB2Query(t *testing.T) {
+	influx := &fakeInfluxDB2{}
+	server := httptest.NewServer(influx)
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, upstream := newTestInfluxDB2Stage(t, ctx, server.URL, `temp "zone" ${x} \ 1`)
+
+	if _, err := influxFetch(upstream, influxEmptyUUID); err != nil {
+		t.Fatal(err)
+	}
+	influx.Lock()
+	defer influx.Unlock()
+	if len(influx.queries) != 1 {
+		t.Fatalf("got queries %q", influx.queries)
+	}
+	want := strings.Join([]string{
+		`from(bucket: "bucket")`,
+		`  |> range(start: 2020-01-01T00:00:00Z, stop: 2020-01-02T00:00:00Z)`,
+		`  |> filter(fn: (r) => r["uuid"] == "` + influxEmptyUUID + `" and r._field == "value" and r._measurement == "temp \"zone\" \${x} \\ 1")`,
+		`  |> keep(columns: ["_time", "_value"])`,
+	}, "\n")
+	if influx.queries[0] != want {
+		t.Errorf("got query\n%s\nwant\n%s", influx.queries[0], want)
+	}
+}
+
+func TestFluxString(t *testing.T) {
+	for s, want := range map[string]string{
+		"uuid":         `"uuid"`,
+		`a "quoted" b`: `"a \"quoted\" b"`,
+		`back\slash`:   `"back\\slash"`,
+		"${injected}":  `"\${injected}"`,
+		`\${both}`:     `"\\\${both}"`,
+		"$ alone {}":   `"$ alone {}"`,
+	} {
+		if got := fluxString(s); got != want {
+			t.Errorf("fluxString(%q) = %s, want %s", s, got, want)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package stages
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeInfluxDB fails every query, and counts them
+type fakeInfluxDB struct {
+	sync.Mutex
+	queries int
+}
+
+func (influx *fakeInfluxDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	influx.Lock()
+	influx.queries++
+	influx.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"results":[{"statement_id":0,"error":"measurement is broken"}]}` + "\n"))
+}
+
+func TestInfluxDBQueryError(t *testing.T) {
+	influx := &fakeInfluxDB{}
+	server := httptest.NewServer(influx)
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	upstream := newTestStage()
+	if _, err := NewInfluxDBTimeseriesQueryStage(&InfluxDBTimeseriesStageConfig{
+		Upstream:     upstream,
+		StageContext: ctx,
+		Address:      server.URL,
+		Measurement:  "timeseries",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the failure ends the request once, without responses of its own
+	responses, err := influxFetch(upstream, influxTablesUUID)
+	if err == nil || !strings.Contains(err.Error(), "measurement is broken") {
+		t.Fatalf("got %v", err)
+	}
+	if strings.Count(err.Error(), "measurement is broken") != 1 {
+		t.Errorf("error repeats: %v", err)
+	}
+	if len(responses) != 0 {
+		t.Errorf("got responses %v", responses)
+	}
+	influx.Lock()
+	defer influx.Unlock()
+	if influx.queries != 1 {
+		t.Errorf("made %d queries", influx.queries)
+	}
+}
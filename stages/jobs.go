@@ -0,0 +1,603 @@
+package stages
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mortarpb "github.com/SoftwareDefinedBuildings/mortar/proto"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultJobPageSize = 100
+	maxJobPageSize     = 1000
+	// the status file of a running job is rewritten after this many responses
+	jobSaveInterval = 100
+	// bytes of the page token MAC that are kept
+	pageTokenMACSize = 16
+)
+
+type FetchJobsConfig struct {
+	// where job status and results are stored
+	Directory string
+	// how long results are kept after the job finishes
+	TTL time.Duration
+	// number of jobs run at once; others wait in PENDING
+	MaxRunning int
+	// how long a job may run before it fails; 0 for no limit
+	Timeout time.Duration
+}
+
+// fetchJobs runs Fetches in the background and stores their results on disk, so that
+// clients can download them at their own pace and survive disconnects.
+//
+// Each job is kept in two files in the directory: <id>.json holds the FetchJob status,
+// and <id>.results holds the FetchResponses, each prefixed with its length as a uvarint.
+// A page token holds the offset in the results file to continue reading from and the
+// number of responses before it, signed with the key in page-token.key so that clients
+// can only continue from where a page ended
+type fetchJobs struct {
+	dir      string
+	ttl      time.Duration
+	timeout  time.Duration
+	tokenKey []byte
+	ctx      context.Context
+	output   chan *Request
+	sem      chan struct{}
+	// jobs that have not finished
+	running sync.WaitGroup
+
+	sync.Mutex
+	jobs map[string]*fetchJob
+}
+
+type fetchJob struct {
+	sync.Mutex
+	status   *mortarpb.FetchJob
+	progress *fetchProgress
+	// length of the complete records in the results file
+	written   int64
+	responses int64
+}
+
+func newFetchJobs(ctx context.Context, output chan *Request, cfg FetchJobsConfig) (*fetchJobs, error) {
+	jobs := &fetchJobs{
+		dir:     cfg.Directory,
+		ttl:     cfg.TTL,
+		timeout: cfg.Timeout,
+		ctx:     ctx,
+		output:  output,
+		jobs:    make(map[string]*fetchJob),
+	}
+	if jobs.dir == "" {
+		jobs.dir = filepath.Join(os.TempDir(), "mortar-jobs")
+	}
+	if jobs.ttl <= 0 {
+		jobs.ttl = 24 * time.Hour
+	}
+	maxRunning := cfg.MaxRunning
+	if maxRunning <= 0 {
+		maxRunning = 4
+	}
+	jobs.sem = make(chan struct{}, maxRunning)
+
+	if err := os.MkdirAll(jobs.dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "Could not create job directory %s", jobs.dir)
+	}
+	key, err := loadPageTokenKey(filepath.Join(jobs.dir, "page-token.key"))
+	if err != nil {
+		return nil, err
+	}
+	jobs.tokenKey = key
+	if err := jobs.load(); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		interval := time.Minute
+		if jobs.ttl < interval {
+			interval = jobs.ttl
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				jobs.expire()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return jobs, nil
+}
+
+// loadPageTokenKey reads the key that signs page tokens, creating it on the first run.
+// It is kept with the jobs so that tokens stay valid across restarts
+func loadPageTokenKey(path string) ([]byte, error) {
+	key, err := ioutil.ReadFile(path)
+	if err == nil && len(key) == sha256.Size {
+		return key, nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "Could not read page token key")
+	}
+	key = make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, errors.Wrap(err, "Could not generate page token key")
+	}
+	if err := ioutil.WriteFile(path, key, 0600); err != nil {
+		return nil, errors.Wrap(err, "Could not save page token key")
+	}
+	return key, nil
+}
+
+func (jobs *fetchJobs) statusPath(id string) string {
+	return filepath.Join(jobs.dir, id+".json")
+}
+
+func (jobs *fetchJobs) resultsPath(id string) string {
+	return filepath.Join(jobs.dir, id+".results")
+}
+
+// load picks up the jobs stored by a previous run. Jobs that had not finished cannot be
+// resumed and are marked as failed
+func (jobs *fetchJobs) load() error {
+	files, err := filepath.Glob(filepath.Join(jobs.dir, "*.json"))
+	if err != nil {
+		return errors.Wrap(err, "Could not list jobs")
+	}
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return errors.Wrapf(err, "Could not open job %s", file)
+		}
+		var status mortarpb.FetchJob
+		err = jsonpb.Unmarshal(f, &status)
+		f.Close()
+		if err != nil {
+			log.Warning(errors.Wrapf(err, "Skipping unreadable job %s", file))
+			continue
+		}
+		if status.Id != strings.TrimSuffix(filepath.Base(file), ".json") {
+			log.Warningf("Skipping job %s with mismatched id %s", file, status.Id)
+			continue
+		}
+
+		job := &fetchJob{status: &status, progress: &fetchProgress{
+			uuidsTotal:     status.UuidsTotal,
+			uuidsCompleted: status.UuidsCompleted,
+			points:         status.PointsReturned,
+		}}
+		if info, err := os.Stat(jobs.resultsPath(status.Id)); err == nil {
+			job.written = info.Size()
+		}
+		job.responses = status.Responses
+		if status.State == mortarpb.FetchJobState_FETCH_JOB_STATE_PENDING || status.State == mortarpb.FetchJobState_FETCH_JOB_STATE_RUNNING {
+			job.finish(errors.New("Interrupted by server restart"), jobs.ttl)
+			// results may end in a partial record
+			job.written = 0
+			job.responses = 0
+			os.Truncate(jobs.resultsPath(status.Id), 0)
+			if err := jobs.save(job); err != nil {
+				log.Error(err)
+			}
+		}
+		jobs.jobs[status.Id] = job
+	}
+	log.Infof("Loaded %d fetch jobs from %s", len(jobs.jobs), jobs.dir)
+	jobs.expire()
+	return nil
+}
+
+// expire deletes the jobs whose results have expired
+func (jobs *fetchJobs) expire() {
+	now := time.Now()
+	jobs.Lock()
+	defer jobs.Unlock()
+	for id, job := range jobs.jobs {
+		job.Lock()
+		expires, err := time.Parse(time.RFC3339, job.status.Expires)
+		job.Unlock()
+		if err != nil || now.Before(expires) {
+			continue
+		}
+		delete(jobs.jobs, id)
+		os.Remove(jobs.statusPath(id))
+		os.Remove(jobs.resultsPath(id))
+		log.Infof("Expired fetch job %s", id)
+	}
+}
+
+// save writes the job status to disk
+func (jobs *fetchJobs) save(job *fetchJob) error {
+	status := job.snapshot()
+	tmp, err := ioutil.TempFile(jobs.dir, status.Id+".json.")
+	if err != nil {
+		return errors.Wrapf(err, "Could not save job %s", status.Id)
+	}
+	if err := (&jsonpb.Marshaler{}).Marshal(tmp, status); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "Could not save job %s", status.Id)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "Could not save job %s", status.Id)
+	}
+	// rename so the status file is never seen half written
+	return errors.Wrapf(os.Rename(tmp.Name(), jobs.statusPath(status.Id)), "Could not save job %s", status.Id)
+}
+
+// snapshot returns a copy of the job status with the current progress
+func (job *fetchJob) snapshot() *mortarpb.FetchJob {
+	job.Lock()
+	defer job.Unlock()
+	status := proto.Clone(job.status).(*mortarpb.FetchJob)
+	status.UuidsTotal = atomic.LoadInt64(&job.progress.uuidsTotal)
+	status.UuidsCompleted = atomic.LoadInt64(&job.progress.uuidsCompleted)
+	status.PointsReturned = atomic.LoadInt64(&job.progress.points)
+	status.Responses = job.responses
+	return status
+}
+
+func (job *fetchJob) setState(state mortarpb.FetchJobState) {
+	job.Lock()
+	defer job.Unlock()
+	job.status.State = state
+}
+
+// finish marks the job completed, or failed if err is not nil, and starts its TTL
+func (job *fetchJob) finish(err error, ttl time.Duration) {
+	job.Lock()
+	defer job.Unlock()
+	now := time.Now()
+	if err != nil {
+		job.status.State = mortarpb.FetchJobState_FETCH_JOB_STATE_FAILED
+		job.status.Error = err.Error()
+	} else {
+		job.status.State = mortarpb.FetchJobState_FETCH_JOB_STATE_COMPLETED
+	}
+	job.status.Finished = now.Format(time.RFC3339)
+	job.status.Expires = now.Add(ttl).Format(time.RFC3339)
+}
+
+func (job *fetchJob) finished() bool {
+	job.Lock()
+	defer job.Unlock()
+	return job.status.State == mortarpb.FetchJobState_FETCH_JOB_STATE_COMPLETED || job.status.State == mortarpb.FetchJobState_FETCH_JOB_STATE_FAILED
+}
+
+// submit starts a job for the request, which must already be validated, on behalf of
+// owner. The audit record of the submission is finished when the job is
+func (jobs *fetchJobs) submit(request *mortarpb.FetchRequest, owner string, audit *auditEntry) (*mortarpb.FetchJob, error) {
+	job := &fetchJob{
+		status: &mortarpb.FetchJob{
+			Id:        uuid.New(),
+			State:     mortarpb.FetchJobState_FETCH_JOB_STATE_PENDING,
+			Submitted: time.Now().Format(time.RFC3339),
+			Owner:     owner,
+		},
+		progress: &fetchProgress{},
+	}
+	results, err := os.OpenFile(jobs.resultsPath(job.status.Id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not create job results")
+	}
+	if err := jobs.save(job); err != nil {
+		results.Close()
+		os.Remove(jobs.resultsPath(job.status.Id))
+		return nil, err
+	}
+
+	jobs.Lock()
+	jobs.jobs[job.status.Id] = job
+	jobs.Unlock()
+
+	jobs.running.Add(1)
+	go func() {
+		defer jobs.running.Done()
+		defer results.Close()
+		err := jobs.run(job, request, results, audit)
+		audit.finish(err)
+		if err != nil {
+			log.Error(errors.Wrapf(err, "Fetch job %s failed", job.status.Id))
+		}
+		job.finish(err, jobs.ttl)
+		if err := jobs.save(job); err != nil {
+			log.Error(err)
+		}
+	}()
+
+	return job.snapshot(), nil
+}
+
+// run sends the job's request down the pipeline and appends the responses to results
+func (jobs *fetchJobs) run(job *fetchJob, request *mortarpb.FetchRequest, results io.Writer, audit *auditEntry) error {
+	select {
+	case jobs.sem <- struct{}{}:
+		defer func() { <-jobs.sem }()
+	case <-jobs.ctx.Done():
+		return jobs.ctx.Err()
+	}
+	job.setState(mortarpb.FetchJobState_FETCH_JOB_STATE_RUNNING)
+	if err := jobs.save(job); err != nil {
+		log.Error(err)
+	}
+
+	// jobs are for Fetches too long to wait on, so they do not get the deadline of
+	// interactive requests
+	ctx, cancel := context.WithCancel(jobs.ctx)
+	if jobs.timeout > 0 {
+		ctx, cancel = context.WithTimeout(jobs.ctx, jobs.timeout)
+	}
+	req := newFetchRequest(ctx, cancel, request)
+	req.progress = job.progress
+	defer req.cancel()
+
+	if err := enqueue(req.ctx, "brick", jobs.output, req); err != nil {
+		return errors.Wrap(err, "Could not dispatch the fetch job")
+	}
+
+	var (
+		buf  []byte
+		size [binary.MaxVarintLen64]byte
+	)
+	for {
+		select {
+		case resp := <-req.fetch_responses:
+			if len(resp.Times) > 0 {
+				job.progress.addPoints(len(resp.Times))
+			}
+
+			audit.sent(resp)
+			if resp.Summary != nil {
+				// kept with the status of the job rather than in its results
+				job.Lock()
+				job.status.Summary = resp.Summary
+				job.Unlock()
+				continue
+			}
+			data, err := proto.Marshal(resp)
+			finishResponse(resp)
+			if err != nil {
+				return errors.Wrap(err, "Could not encode response")
+			}
+			n := binary.PutUvarint(size[:], uint64(len(data)))
+			buf = append(append(buf[:0], size[:n]...), data...)
+			if _, err := results.Write(buf); err != nil {
+				return errors.Wrap(err, "Could not store response")
+			}
+
+			job.Lock()
+			job.written += int64(len(buf))
+			job.responses++
+			save := job.responses%jobSaveInterval == 0
+			job.Unlock()
+			if save {
+				if err := jobs.save(job); err != nil {
+					log.Error(err)
+				}
+			}
+		case <-req.Ended():
+			return req.Err()
+		case <-req.Done():
+			return req.abandon(errors.Wrap(req.ctx.Err(), "fetch job timeout"))
+		}
+	}
+}
+
+// wait blocks until all submitted jobs have finished
+func (jobs *fetchJobs) wait() {
+	if jobs != nil {
+		jobs.running.Wait()
+	}
+}
+
+// get returns the job if owner submitted it. Other users get NotFound, so they cannot
+// tell which jobs exist
+func (jobs *fetchJobs) get(id, owner string) (*fetchJob, error) {
+	jobs.Lock()
+	job, found := jobs.jobs[id]
+	jobs.Unlock()
+	if found {
+		job.Lock()
+		found = job.status.Owner == owner
+		job.Unlock()
+	}
+	if !found {
+		return nil, status.Errorf(codes.NotFound, "No such job %s", id)
+	}
+	return job, nil
+}
+
+// status returns the status and progress of the job
+func (jobs *fetchJobs) status(id, owner string) (*mortarpb.FetchJob, error) {
+	job, err := jobs.get(id, owner)
+	if err != nil {
+		return nil, err
+	}
+	return job.snapshot(), nil
+}
+
+// results reads the page of results starting at the page token
+func (jobs *fetchJobs) results(request *mortarpb.FetchJobResultsRequest, owner string) (*mortarpb.FetchJobResultsResponse, error) {
+	job, err := jobs.get(request.Id, owner)
+	if err != nil {
+		return nil, err
+	}
+
+	var offset, index int64
+	if request.PageToken != "" {
+		offset, index, err = jobs.parsePageToken(request.Id, request.PageToken)
+		if err != nil {
+			return nil, invalidArgument(err)
+		}
+	}
+	pageSize := int(request.PageSize)
+	if pageSize <= 0 {
+		pageSize = defaultJobPageSize
+	} else if pageSize > maxJobPageSize {
+		pageSize = maxJobPageSize
+	}
+
+	// check whether the job is done before looking at how much it wrote, so a job
+	// finishing in between cannot end the pages early
+	finished := job.finished()
+	job.Lock()
+	written, responses := job.written, job.responses
+	job.Unlock()
+	// a token from before a restart that discarded the results
+	if offset > written || index > responses {
+		return nil, invalidArgument(errors.Errorf("Invalid page token %q", request.PageToken))
+	}
+
+	resp := &mortarpb.FetchJobResultsResponse{}
+	if offset < written {
+		f, err := os.Open(jobs.resultsPath(request.Id))
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not open job results")
+		}
+		defer f.Close()
+		r := bufio.NewReader(io.NewSectionReader(f, offset, written-offset))
+		for len(resp.Responses) < pageSize && offset < written {
+			size, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, errors.Wrap(err, "Could not read job results")
+			}
+			if size > uint64(written-offset) {
+				return nil, errors.Errorf("Corrupt job results at offset %d", offset)
+			}
+			data := make([]byte, size)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil, errors.Wrap(err, "Could not read job results")
+			}
+			var fetchResp mortarpb.FetchResponse
+			if err := proto.Unmarshal(data, &fetchResp); err != nil {
+				return nil, errors.Wrap(err, "Could not decode job results")
+			}
+			resp.Responses = append(resp.Responses, &fetchResp)
+			offset += int64(uvarintLen(size)) + int64(size)
+			index++
+		}
+	}
+
+	if !finished || offset < written {
+		resp.NextPageToken = jobs.pageToken(request.Id, offset, index)
+	}
+	resp.Job = job.snapshot()
+	return resp, nil
+}
+
+// pageToken returns the token to continue reading the results of the job at offset, after
+// index responses
+func (jobs *fetchJobs) pageToken(id string, offset, index int64) string {
+	var buf [16 + pageTokenMACSize]byte
+	binary.BigEndian.PutUint64(buf[0:8], uint64(offset))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(index))
+	copy(buf[16:], jobs.pageTokenMAC(id, buf[:16]))
+	return base64.RawURLEncoding.EncodeToString(buf[:])
+}
+
+// parsePageToken returns the offset and index in a token given out for the job
+func (jobs *fetchJobs) parsePageToken(id, token string) (offset, index int64, err error) {
+	buf, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(buf) != 16+pageTokenMACSize || !hmac.Equal(buf[16:], jobs.pageTokenMAC(id, buf[:16])) {
+		return 0, 0, errors.Errorf("Invalid page token %q", token)
+	}
+	offset = int64(binary.BigEndian.Uint64(buf[0:8]))
+	index = int64(binary.BigEndian.Uint64(buf[8:16]))
+	if offset < 0 || index < 0 {
+		return 0, 0, errors.Errorf("Invalid page token %q", token)
+	}
+	return offset, index, nil
+}
+
+// pageTokenMAC signs the position for the job, so a token cannot be used with another
+func (jobs *fetchJobs) pageTokenMAC(id string, position []byte) []byte {
+	mac := hmac.New(sha256.New, jobs.tokenKey)
+	mac.Write([]byte(id))
+	mac.Write(position)
+	return mac.Sum(nil)[:pageTokenMACSize]
+}
+
+func uvarintLen(x uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], x)
+}
+
+// SubmitFetchJob runs the Fetch in the background; poll GetFetchJob for its progress and
+// download the results with GetFetchJobResults
+func (stage *ApiFrontendBasicStage) SubmitFetchJob(ctx context.Context, request *mortarpb.FetchRequest) (_ *mortarpb.FetchJob, err error) {
+	audit := startAudit(ctx, "SubmitFetchJob")
+	audit.fetch(request)
+	defer func() {
+		if err != nil {
+			audit.finish(err)
+		}
+	}()
+
+	authRequests.Inc()
+	if err := stage.authenticate(ctx); err != nil {
+		return nil, err
+	}
+	authRequestsSuccessful.Inc()
+	owner := tokenIdentity(ctx)
+	audit.identify(owner)
+
+	if err := validateFetchRequest(request); err != nil {
+		return nil, invalidArgument(err)
+	}
+	fetchQueriesProcessed.Inc()
+	return stage.jobs.submit(request, owner, audit)
+}
+
+// GetFetchJob returns the status and progress of a job
+func (stage *ApiFrontendBasicStage) GetFetchJob(ctx context.Context, request *mortarpb.FetchJobRequest) (*mortarpb.FetchJob, error) {
+	if err := stage.authenticate(ctx); err != nil {
+		return nil, err
+	}
+	return stage.jobs.status(request.Id, tokenIdentity(ctx))
+}
+
+// GetFetchJobResults returns a page of the results of a job
+func (stage *ApiFrontendBasicStage) GetFetchJobResults(ctx context.Context, request *mortarpb.FetchJobResultsRequest) (*mortarpb.FetchJobResultsResponse, error) {
+	if err := stage.authenticate(ctx); err != nil {
+		return nil, err
+	}
+	return stage.jobs.results(request, tokenIdentity(ctx))
+}
+
+// SubmitFetchJob is not available on the WAVE frontend: its callers have no identity to
+// own the job
+func (stage *ApiFrontendWAVEAuthStage) SubmitFetchJob(ctx context.Context, request *mortarpb.FetchRequest) (*mortarpb.FetchJob, error) {
+	return nil, status.Error(codes.PermissionDenied, "SubmitFetchJob needs a token from GetAPIKey")
+}
+
+// GetFetchJob is not available on the WAVE frontend
+func (stage *ApiFrontendWAVEAuthStage) GetFetchJob(ctx context.Context, request *mortarpb.FetchJobRequest) (*mortarpb.FetchJob, error) {
+	return nil, status.Error(codes.PermissionDenied, "GetFetchJob needs a token from GetAPIKey")
+}
+
+// GetFetchJobResults is not available on the WAVE frontend
+func (stage *ApiFrontendWAVEAuthStage) GetFetchJobResults(ctx context.Context, request *mortarpb.FetchJobResultsRequest) (*mortarpb.FetchJobResultsResponse, error) {
+	return nil, status.Error(codes.PermissionDenied, "GetFetchJobResults needs a token from GetAPIKey")
+}
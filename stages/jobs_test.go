@@ -0,0 +1,211 @@
+package stages
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	mortarpb "github.com/SoftwareDefinedBuildings/mortar/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestFetchJobOwner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mortar-jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// stands in for the Brick stage: every Fetch completes without data
+	output := make(chan *Request)
+	go func() {
+		for req := range output {
+			if req.start() {
+				req.finish()
+			}
+		}
+	}()
+	defer close(output)
+
+	jobs, err := newFetchJobs(ctx, output, FetchJobsConfig{Directory: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := jobs.submit(&mortarpb.FetchRequest{}, "alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs.wait()
+
+	got, err := jobs.status(job.Id, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.State != mortarpb.FetchJobState_FETCH_JOB_STATE_COMPLETED || got.Owner != "alice" || got.Summary == nil {
+		t.Fatalf("job is %v", got)
+	}
+	// the summary is in the status, not the results
+	results, err := jobs.results(&mortarpb.FetchJobResultsRequest{Id: job.Id}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results.Responses) != 0 {
+		t.Fatalf("results are %v", results.Responses)
+	}
+
+	for _, owner := range []string{"bob", ""} {
+		if _, err := jobs.status(job.Id, owner); status.Code(err) != codes.NotFound {
+			t.Errorf("status for %q: got %v", owner, err)
+		}
+		if _, err := jobs.results(&mortarpb.FetchJobResultsRequest{Id: job.Id}, owner); status.Code(err) != codes.NotFound {
+			t.Errorf("results for %q: got %v", owner, err)
+		}
+	}
+
+	// the owner survives a restart
+	reloaded, err := newFetchJobs(ctx, output, FetchJobsConfig{Directory: dir, TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloaded.status(job.Id, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloaded.status(job.Id, "bob"); status.Code(err) != codes.NotFound {
+		t.Errorf("status for bob after restart: got %v", err)
+	}
+}
+
+func TestFetchJobResultsPageToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mortar-jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// stands in for the Brick stage: every Fetch returns 5 responses
+	output := make(chan *Request)
+	go func() {
+		for req := range output {
+			if !req.start() {
+				continue
+			}
+			for i := 0; i < 5; i++ {
+				req.send(&mortarpb.FetchResponse{Identifier: fmt.Sprintf("uuid-%d", i), Times: []int64{int64(i)}, Values: []float64{float64(i)}})
+			}
+			req.finish()
+		}
+	}()
+	defer close(output)
+
+	jobs, err := newFetchJobs(ctx, output, FetchJobsConfig{Directory: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := jobs.submit(&mortarpb.FetchRequest{}, "alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := jobs.submit(&mortarpb.FetchRequest{}, "alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs.wait()
+
+	var (
+		read  []string
+		token string
+		pages []string
+	)
+	for {
+		page, err := jobs.results(&mortarpb.FetchJobResultsRequest{Id: job.Id, PageToken: token, PageSize: 2}, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, resp := range page.Responses {
+			read = append(read, resp.Identifier)
+		}
+		if page.NextPageToken == "" {
+			break
+		}
+		token = page.NextPageToken
+		pages = append(pages, token)
+	}
+	if fmt.Sprint(read) != "[uuid-0 uuid-1 uuid-2 uuid-3 uuid-4]" {
+		t.Fatalf("read %v", read)
+	}
+
+	tampered := []byte(pages[0])
+	tampered[0] ^= 1
+	for _, test := range []struct {
+		name  string
+		id    string
+		token string
+	}{
+		// page tokens used to be plain offsets
+		{"offset", job.Id, "3"},
+		{"garbage", job.Id, "not a token"},
+		{"tampered", job.Id, string(tampered)},
+		{"other job", other.Id, pages[0]},
+		{"past the end", job.Id, jobs.pageToken(job.Id, 1<<40, 5)},
+		{"past the last response", job.Id, jobs.pageToken(job.Id, 0, 6)},
+	} {
+		_, err := jobs.results(&mortarpb.FetchJobResultsRequest{Id: test.id, PageToken: test.token}, "alice")
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: got %v", test.name, err)
+		}
+	}
+
+	// a length that runs past the results is not allocated
+	if err := ioutil.WriteFile(jobs.resultsPath(job.Id), []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jobs.results(&mortarpb.FetchJobResultsRequest{Id: job.Id}, "alice"); err == nil {
+		t.Error("read a corrupt record")
+	}
+
+	// tokens survive a restart
+	first, err := jobs.results(&mortarpb.FetchJobResultsRequest{Id: other.Id, PageSize: 2}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := newFetchJobs(ctx, output, FetchJobsConfig{Directory: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := reloaded.results(&mortarpb.FetchJobResultsRequest{Id: other.Id, PageToken: first.NextPageToken}, "alice")
+	if err != nil || len(page.Responses) != 3 || page.Responses[0].Identifier != "uuid-2" {
+		t.Errorf("other job after restart: got %v, %v", page, err)
+	}
+}
+
+func TestFetchJobWAVE(t *testing.T) {
+	// WAVE callers have no verified user name, so a token naming someone cannot reach
+	// their jobs
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("token", gatewayTestToken(t, key, "alice")))
+	stage := &ApiFrontendWAVEAuthStage{ctx: context.Background()}
+
+	if _, err := stage.SubmitFetchJob(ctx, &mortarpb.FetchRequest{}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("SubmitFetchJob: got %v", err)
+	}
+	if _, err := stage.GetFetchJob(ctx, &mortarpb.FetchJobRequest{Id: "job"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("GetFetchJob: got %v", err)
+	}
+	if _, err := stage.GetFetchJobResults(ctx, &mortarpb.FetchJobResultsRequest{Id: "job"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("GetFetchJobResults: got %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+package stages
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xitongsys/parquet-go/common"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
+)
+
+// parquetDataFile reads the uuid, time and value columns of a Parquet file for the Arrow
+// stage, one row group at a time
+type parquetDataFile struct {
+	file   parquetLocalFile
+	reader *reader.ParquetReader
+	// internal (parquet-go) paths of the columns
+	uuidPath  string
+	timePath  string
+	valuePath string
+	// multiplies the time column to nanoseconds
+	timeScale int64
+}
+
+// openParquetFile opens the Parquet file and checks the types of its columns
+func (stage *ArrowTimeseriesQueryStage) openParquetFile(path string) (*parquetDataFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	file := &parquetDataFile{file: parquetLocalFile{f}, timeScale: 1}
+	if file.reader, err = reader.NewParquetColumnReader(file.file, 1); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	var uuidCol, timeCol, valueCol *parquet.SchemaElement
+	file.uuidPath, uuidCol = file.column(stage.uuidColumn)
+	file.timePath, timeCol = file.column(stage.timeColumn)
+	file.valuePath, valueCol = file.column(stage.valueColumn)
+	if uuidCol == nil || timeCol == nil || valueCol == nil {
+		f.Close()
+		return nil, errors.Wrapf(errNoTimeseriesColumns, "Need columns %s, %s and %s", stage.uuidColumn, stage.timeColumn, stage.valueColumn)
+	}
+	if uuidCol.GetType() != parquet.Type_BYTE_ARRAY {
+		f.Close()
+		return nil, errors.Errorf("Column %s must be a string, not %s", stage.uuidColumn, uuidCol.GetType())
+	}
+	if valueCol.GetType() != parquet.Type_DOUBLE && valueCol.GetType() != parquet.Type_FLOAT {
+		f.Close()
+		return nil, errors.Errorf("Column %s must be a double or float, not %s", stage.valueColumn, valueCol.GetType())
+	}
+	if timeCol.GetType() != parquet.Type_INT64 {
+		f.Close()
+		return nil, errors.Errorf("Column %s must be a timestamp or int64, not %s", stage.timeColumn, timeCol.GetType())
+	}
+	if logical := timeCol.LogicalType; logical != nil && logical.IsSetTIMESTAMP() && logical.TIMESTAMP.IsSetUnit() {
+		switch {
+		case logical.TIMESTAMP.Unit.IsSetMILLIS():
+			file.timeScale = int64(time.Millisecond)
+		case logical.TIMESTAMP.Unit.IsSetMICROS():
+			file.timeScale = int64(time.Microsecond)
+		}
+	} else if timeCol.ConvertedType != nil {
+		switch timeCol.GetConvertedType() {
+		case parquet.ConvertedType_TIMESTAMP_MILLIS:
+			file.timeScale = int64(time.Millisecond)
+		case parquet.ConvertedType_TIMESTAMP_MICROS:
+			file.timeScale = int64(time.Microsecond)
+		}
+	}
+	return file, nil
+}
+
+// column returns the internal path and schema of the top level column, or nil if there is
+// no such column
+func (file *parquetDataFile) column(name string) (string, *parquet.SchemaElement) {
+	schema := file.reader.SchemaHandler
+	path, err := schema.ConvertToInPathStr(common.PathToStr([]string{schema.GetRootExName(), name}))
+	if err != nil {
+		return "", nil
+	}
+	idx, found := schema.MapIndex[path]
+	if !found {
+		return "", nil
+	}
+	return path, schema.SchemaElements[idx]
+}
+
+func (file *parquetDataFile) numBatches() int {
+	return len(file.reader.Footer.GetRowGroups())
+}
+
+func (file *parquetDataFile) scanBatch(batch int, fn func(uu string, t int64, v float64)) error {
+	uuids, err := file.readColumn(batch, file.uuidPath)
+	if err != nil {
+		return err
+	}
+	times, err := file.readColumn(batch, file.timePath)
+	if err != nil {
+		return err
+	}
+	values, err := file.readColumn(batch, file.valuePath)
+	if err != nil {
+		return err
+	}
+	for row := range uuids {
+		uu, ok := uuids[row].(string)
+		if !ok {
+			continue
+		}
+		t, ok := times[row].(int64)
+		if !ok {
+			continue
+		}
+		switch v := values[row].(type) {
+		case float64:
+			fn(uu, t*file.timeScale, v)
+		case float32:
+			fn(uu, t*file.timeScale, float64(v))
+		}
+	}
+	return nil
+}
+
+// readColumn returns the values of the column in the row group; nulls are nil. The
+// column is read straight from the row group rather than skipping the rows before it
+func (file *parquetDataFile) readColumn(batch int, path string) ([]interface{}, error) {
+	rowGroup := file.reader.Footer.GetRowGroups()[batch]
+	f, err := file.file.Open("")
+	if err != nil {
+		return nil, err
+	}
+	buffer := &reader.ColumnBufferType{
+		PFile:            f,
+		Footer:           file.reader.Footer,
+		SchemaHandler:    file.reader.SchemaHandler,
+		PathStr:          path,
+		RowGroupIndex:    int64(batch),
+		DataTableNumRows: -1,
+	}
+	defer func() {
+		if buffer.ThriftReader != nil {
+			buffer.ThriftReader.Close()
+		}
+		buffer.PFile.Close()
+	}()
+	if err := buffer.NextRowGroup(); err != nil {
+		return nil, err
+	}
+	table, n := buffer.ReadRows(rowGroup.GetNumRows())
+	if n != rowGroup.GetNumRows() {
+		return nil, errors.Errorf("Read %d of the %d rows of column %s", n, rowGroup.GetNumRows(), path)
+	}
+	return table.Values, nil
+}
+
+func (file *parquetDataFile) Close() error {
+	return file.file.Close()
+}
+
+// parquetLocalFile lets the Parquet reader open the file again for each column it reads
+type parquetLocalFile struct {
+	*os.File
+}
+
+func (f parquetLocalFile) Open(name string) (source.ParquetFile, error) {
+	if name == "" {
+		name = f.Name()
+	} else if !filepath.IsAbs(name) {
+		// column chunks in other files are relative to this one
+		name = filepath.Join(filepath.Dir(f.Name()), name)
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return parquetLocalFile{file}, nil
+}
+
+func (f parquetLocalFile) Create(name string) (source.ParquetFile, error) {
+	return nil, errors.New("Cannot create Parquet files when reading")
+}
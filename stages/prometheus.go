@@ -1,10 +1,15 @@
 package stages
 
 import (
+	"context"
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	dto "github.com/prometheus/client_model/go"
 	logrus "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"strings"
 	"time"
 )
 
@@ -41,8 +46,107 @@ var (
 		Name: "active_queries",
 		Help: "number of actively processed queries",
 	})
+
+	queueBlocked = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "stage_queue_blocked",
+		Help: "number of requests waiting for room in the full queue of each stage",
+	}, []string{"stage"})
+	admissionRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "admission_rejections",
+		Help: "number of requests turned away because the queue of the stage was full",
+	}, []string{"stage"})
+	stageWorkers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "stage_workers",
+		Help: "number of workers of each stage",
+	}, []string{"stage"})
+	activeSubscriptions = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "subscriptions_active",
+		Help: "number of Subscribe streams being served",
+	})
+	stageWorkersBusy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "stage_workers_busy",
+		Help: "number of workers of each stage handling a request",
+	}, []string{"stage"})
+	timeseriesReadTimes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "timeseries_read_duration_seconds",
+		Help:    "time to read the data of one UUID from each timeseries backend",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"backend", "aggregation"})
+	pointsReturned = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "points_returned",
+		Help: "number of points sent to clients",
+	}, []string{"site", "aggregation"})
+	brickQueryTimes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "brick_query_duration_seconds",
+		Help:    "time to run the query of a View against a site",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"site"})
+	authFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_failures",
+		Help: "number of failed authentications by reason",
+	}, []string{"reason"})
+	rpcErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rpc_errors",
+		Help: "number of RPCs that returned an error, by gRPC status code",
+	}, []string{"rpc", "code"})
+	rpcTimes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rpc_duration_seconds",
+		Help:    "time to handle each RPC, including streaming all responses",
+		Buckets: prometheus.ExponentialBuckets(0.005, 4, 10),
+	}, []string{"rpc"})
 )
 
+// InFlightRequests is the number of requests the frontends are handling
+func InFlightRequests() int {
+	var m dto.Metric
+	if err := activeQueries.Write(&m); err != nil {
+		return 0
+	}
+	return int(m.Gauge.GetValue())
+}
+
+// enqueue sends req to the queue of the stage, waiting for room until ctx is done
+func enqueue(ctx context.Context, stage string, queue chan *Request, req *Request) error {
+	select {
+	case queue <- req:
+		return nil
+	default:
+	}
+	blocked := queueBlocked.WithLabelValues(stage)
+	blocked.Inc()
+	defer blocked.Dec()
+	select {
+	case queue <- req:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// instrumentUnary counts the errors and times the handling of unary RPCs
+func instrumentUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	t := time.Now()
+	resp, err := handler(ctx, req)
+	observeRPC(info.FullMethod, t, err)
+	return resp, err
+}
+
+// instrumentStream counts the errors and times the handling of streaming RPCs
+func instrumentStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	t := time.Now()
+	err := handler(srv, ss)
+	observeRPC(info.FullMethod, t, err)
+	return err
+}
+
+func observeRPC(method string, start time.Time, err error) {
+	rpc := method[strings.LastIndex(method, "/")+1:]
+	rpcTimes.WithLabelValues(rpc).Observe(time.Since(start).Seconds())
+	if err != nil {
+		rpcErrors.WithLabelValues(rpc, status.Code(err).String()).Inc()
+	}
+}
+
 func init() {
 	// monitor the prometheus metrics and print them out periodically
 	go func() {
@@ -59,42 +163,42 @@ func init() {
 			var m dto.Metric
 
 			if err := qualifyQueriesProcessed.Write(&m); err != nil {
-				panic(err)
+				log.Warning(errors.Wrap(err, "Could not read metric"))
 			} else {
 				f["#qualify"] = *m.Counter.Value - qualifyQueriesProcessed_old
 				qualifyQueriesProcessed_old = *m.Counter.Value
 			}
 
 			if err := fetchQueriesProcessed.Write(&m); err != nil {
-				panic(err)
+				log.Warning(errors.Wrap(err, "Could not read metric"))
 			} else {
 				f["#fetch"] = *m.Counter.Value - fetchQueriesProcessed_old
 				fetchQueriesProcessed_old = *m.Counter.Value
 			}
 
 			if err := messagesSent.Write(&m); err != nil {
-				panic(err)
+				log.Warning(errors.Wrap(err, "Could not read metric"))
 			} else {
 				f["#msg"] = *m.Counter.Value - messagesSent_old
 				messagesSent_old = *m.Counter.Value
 			}
 
 			if err := authRequests.Write(&m); err != nil {
-				panic(err)
+				log.Warning(errors.Wrap(err, "Could not read metric"))
 			} else {
 				f["#auth raw"] = *m.Counter.Value - authRequests_old
 				authRequests_old = *m.Counter.Value
 			}
 
 			if err := authRequestsSuccessful.Write(&m); err != nil {
-				panic(err)
+				log.Warning(errors.Wrap(err, "Could not read metric"))
 			} else {
 				f["#auth good"] = *m.Counter.Value - authRequestsSuccessful_old
 				authRequestsSuccessful_old = *m.Counter.Value
 			}
 
 			if err := activeQueries.Write(&m); err != nil {
-				panic(err)
+				log.Warning(errors.Wrap(err, "Could not read metric"))
 			} else {
 				f["#active"] = *m.Gauge.Value
 			}
@@ -0,0 +1,174 @@
+package stages
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type QueueConfig struct {
+	// number of requests each queue between stages holds; defaults to 100
+	Capacity int
+	// number of Qualify requests the frontends queue apart from Fetches; defaults to 100
+	PriorityCapacity int
+	// how long a new request waits for room in a full queue before it is turned away
+	AdmissionWait time.Duration
+	// how long clients turned away are told to wait before retrying; defaults to 5s
+	RetryAfter time.Duration
+}
+
+// the settings of the queues created by newQueue; set by ConfigureQueues before the stages
+// are created
+var queueConfig = QueueConfig{
+	Capacity:         100,
+	PriorityCapacity: 100,
+	RetryAfter:       5 * time.Second,
+}
+
+// ConfigureQueues sets the size of the queues between stages and how requests are admitted
+// into a full pipeline. Must be called before creating the stages
+func ConfigureQueues(cfg QueueConfig) {
+	if cfg.Capacity > 0 {
+		queueConfig.Capacity = cfg.Capacity
+	}
+	if cfg.PriorityCapacity > 0 {
+		queueConfig.PriorityCapacity = cfg.PriorityCapacity
+	}
+	if cfg.AdmissionWait > 0 {
+		queueConfig.AdmissionWait = cfg.AdmissionWait
+	}
+	if cfg.RetryAfter > 0 {
+		queueConfig.RetryAfter = cfg.RetryAfter
+	}
+}
+
+// PriorityQueuer is implemented by stages that send small requests, like Qualify, on a
+// queue of their own. The next stage takes from it before the regular queue
+type PriorityQueuer interface {
+	GetPriorityQueue() chan *Request
+}
+
+// newQueue creates a bounded queue feeding the named stage, whose length and capacity are
+// exported as metrics
+func newQueue(stage string) chan *Request {
+	return observeQueue(stage, make(chan *Request, queueConfig.Capacity))
+}
+
+// newPriorityQueue creates the queue for small requests feeding the named stage
+func newPriorityQueue(stage string) chan *Request {
+	return observeQueue(stage+"/priority", make(chan *Request, queueConfig.PriorityCapacity))
+}
+
+// takeRequest waits for the next request, taking one from priority first if there is
+// any. Returns nil once ctx is done. priority may be nil
+func takeRequest(ctx context.Context, priority, input chan *Request) *Request {
+	select {
+	case req := <-priority:
+		return req
+	default:
+	}
+	select {
+	case req := <-priority:
+		return req
+	case req := <-input:
+		return req
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// admit puts a new request in the queue of the stage. If the queue stays full for
+// AdmissionWait, the request is turned away with UNAVAILABLE and a hint of when to retry
+func admit(ctx context.Context, stage string, queue chan *Request, req *Request) error {
+	select {
+	case queue <- req:
+		return nil
+	default:
+	}
+	if queueConfig.AdmissionWait > 0 {
+		wait := time.NewTimer(queueConfig.AdmissionWait)
+		defer wait.Stop()
+		blocked := queueBlocked.WithLabelValues(stage)
+		blocked.Inc()
+		defer blocked.Dec()
+		select {
+		case queue <- req:
+			return nil
+		case <-wait.C:
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "Timed out dispatching the request")
+		}
+	}
+	admissionRejections.WithLabelValues(stage).Inc()
+	return errPipelineFull()
+}
+
+// errPipelineFull is the UNAVAILABLE status returned when a request is turned away,
+// carrying the RetryAfter delay as RetryInfo
+func errPipelineFull() error {
+	st := status.Newf(codes.Unavailable, "Server is busy; retry in %s", queueConfig.RetryAfter)
+	if detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: ptypes.DurationProto(queueConfig.RetryAfter)}); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// retryDelay is the delay an UNAVAILABLE error asks the client to wait before retrying
+func retryDelay(err error) (time.Duration, bool) {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.Unavailable {
+		return 0, false
+	}
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			delay, err := ptypes.Duration(info.RetryDelay)
+			return delay, err == nil
+		}
+	}
+	return 0, false
+}
+
+// queueCollector exports the length and capacity of the queues between stages
+type queueCollector struct {
+	sync.Mutex
+	queues map[string]chan *Request
+}
+
+var queues = &queueCollector{queues: make(map[string]chan *Request)}
+
+var (
+	queueLengthDesc = prometheus.NewDesc("stage_queue_depth", "number of requests in the queue of each stage", []string{"stage"}, nil)
+	queueCapDesc    = prometheus.NewDesc("stage_queue_capacity", "number of requests the queue of each stage holds", []string{"stage"}, nil)
+)
+
+func init() {
+	prometheus.MustRegister(queues)
+}
+
+func observeQueue(stage string, queue chan *Request) chan *Request {
+	queues.Lock()
+	defer queues.Unlock()
+	queues.queues[stage] = queue
+	return queue
+}
+
+func (c *queueCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- queueLengthDesc
+	descs <- queueCapDesc
+}
+
+func (c *queueCollector) Collect(metrics chan<- prometheus.Metric) {
+	c.Lock()
+	defer c.Unlock()
+	for stage, queue := range c.queues {
+		metrics <- prometheus.MustNewConstMetric(queueLengthDesc, prometheus.GaugeValue, float64(len(queue)), stage)
+		metrics <- prometheus.MustNewConstMetric(queueCapDesc, prometheus.GaugeValue, float64(cap(queue)), stage)
+	}
+}
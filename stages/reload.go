@@ -0,0 +1,189 @@
+package stages
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	logrus "github.com/sirupsen/logrus"
+)
+
+// changes to the watched files are applied once they have been quiet this long, so a file
+// is not read half-written
+const reloadDelay = time.Second
+
+// the settings applied while running; changes to any other setting need a restart
+var liveSettings = map[string]bool{
+	"LogLevel":             true,
+	"TLSCrtFile":           true,
+	"TLSKeyFile":           true,
+	"Cognito":              true,
+	"BTrDBAddr":            true,
+	"BTrDB.Clusters":       true,
+	"InfluxDBAddr":         true,
+	"InfluxDBUser":         true,
+	"InfluxDBPass":         true,
+	"InfluxDB2.Address":    true,
+	"InfluxDB2.Token":      true,
+	"Timescale.ConnString": true,
+}
+
+// Reloader is implemented by stages that can apply changes to the configuration while running
+type Reloader interface {
+	// Reload applies the live settings of cfg, logging those it cannot
+	Reload(cfg *Config)
+}
+
+// SetLogLevel sets the level of the stages' log
+func SetLogLevel(level logrus.Level) {
+	log.SetLevel(level)
+}
+
+// WatchConfig calls reload with the new configuration whenever the configuration file or the
+// TLS certificate and key it names change, until ctx is done. Settings that changed but
+// cannot be applied while running are logged. An invalid file is logged and ignored
+func WatchConfig(ctx context.Context, file string, cfg *Config, reload func(*Config)) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "Could not watch configuration")
+	}
+	// files are replaced rather than written in place by editors and by Kubernetes, so the
+	// directories are watched and the contents compared
+	watched := make(map[string]bool)
+	sums := make(map[string][sha256.Size]byte)
+	watch := func(cfg *Config) {
+		for _, f := range []string{file, cfg.TLSCrtFile, cfg.TLSKeyFile} {
+			if f == "" {
+				continue
+			}
+			if _, found := sums[f]; !found {
+				sums[f] = fileSum(f)
+			}
+			dir := filepath.Dir(f)
+			if watched[dir] {
+				continue
+			}
+			if err := watcher.Add(dir); err != nil {
+				log.Warning(errors.Wrapf(err, "Could not watch %s for changes", dir))
+				continue
+			}
+			watched[dir] = true
+		}
+	}
+	watch(cfg)
+
+	go func() {
+		defer watcher.Close()
+		var settle <-chan time.Time
+		for {
+			select {
+			case <-watcher.Events:
+				settle = time.After(reloadDelay)
+			case err := <-watcher.Errors:
+				log.Warning(errors.Wrap(err, "Error watching configuration"))
+			case <-settle:
+				settle = nil
+				changed := false
+				for f, sum := range sums {
+					if newSum := fileSum(f); newSum != sum {
+						sums[f] = newSum
+						changed = true
+					}
+				}
+				if !changed {
+					continue
+				}
+				newcfg, err := ReadConfig(file)
+				if err != nil {
+					log.Error(errors.Wrapf(err, "Could not reload %s; keeping the current configuration", file))
+					continue
+				}
+				log.Infof("Reloading configuration from %s", file)
+				for _, setting := range changedSettings(reflect.ValueOf(*cfg), reflect.ValueOf(*newcfg), "") {
+					log.Warningf("%s changed; restart to apply it", setting)
+				}
+				reload(newcfg)
+				cfg = newcfg
+				watch(cfg)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// fileSum is the hash of the contents of the file, or zero if it cannot be read
+func fileSum(file string) [sha256.Size]byte {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return [sha256.Size]byte{}
+	}
+	return sha256.Sum256(contents)
+}
+
+// changedSettings lists the settings that differ between old and new and cannot be applied
+// while running
+func changedSettings(old, new reflect.Value, prefix string) []string {
+	var changed []string
+	for i := 0; i < old.NumField(); i++ {
+		name := prefix + old.Type().Field(i).Name
+		if liveSettings[name] {
+			continue
+		}
+		o, n := old.Field(i), new.Field(i)
+		if o.Kind() == reflect.Struct {
+			changed = append(changed, changedSettings(o, n, name+".")...)
+		} else if !reflect.DeepEqual(o.Interface(), n.Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// certificate is the TLS certificate served by the frontend, which can be replaced while
+// running
+type certificate struct {
+	sync.RWMutex
+	cert *tls.Certificate
+}
+
+func loadCertificate(crtFile, keyFile string) (*certificate, error) {
+	c := &certificate{}
+	if _, err := c.load(crtFile, keyFile); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load reads the certificate and key, reporting whether the certificate changed. On error
+// the current certificate is kept
+func (c *certificate) load(crtFile, keyFile string) (bool, error) {
+	cert, err := tls.LoadX509KeyPair(crtFile, keyFile)
+	if err != nil {
+		return false, errors.Wrapf(err, "Could not load TLS certificate %s and key %s", crtFile, keyFile)
+	}
+	c.Lock()
+	defer c.Unlock()
+	changed := c.cert == nil || !bytes.Equal(c.cert.Certificate[0], cert.Certificate[0])
+	c.cert = &cert
+	return changed, nil
+}
+
+func (c *certificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.cert, nil
+}
+
+func (c *certificate) tlsConfig() *tls.Config {
+	return &tls.Config{GetCertificate: c.get}
+}
@@ -2,22 +2,161 @@ package stages
 
 import (
 	"context"
-	mortarpb "github.com/SoftwareDefinedBuildings/mortar/proto"
+	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
+
+	mortarpb "github.com/SoftwareDefinedBuildings/mortar/proto"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// requestState is where a Request is in its lifecycle. A request is pending in the queue of
+// the first stage, running once a stage picks it up, and then ends exactly once: completed,
+// failed or cancelled. Ended() is closed when it ends, after the last response of a Fetch
+// was delivered, so its consumer waits on its responses, Ended() and Done() and then reads
+// Err()
+type requestState int32
+
+const (
+	requestPending requestState = iota
+	requestRunning
+	requestCompleted
+	requestFailed
+	requestCancelled
+)
+
+func (state requestState) String() string {
+	switch state {
+	case requestPending:
+		return "pending"
+	case requestRunning:
+		return "running"
+	case requestCompleted:
+		return "completed"
+	case requestFailed:
+		return "failed"
+	case requestCancelled:
+		return "cancelled"
+	}
+	return fmt.Sprintf("requestState(%d)", int32(state))
+}
+
+func (state requestState) ended() bool {
+	return state >= requestCompleted
+}
+
+// requestFailure is a part of a request, a site or a UUID, that failed without failing the
+// whole request
+type requestFailure struct {
+	site      string
+	view      string
+	dataFrame string
+	uuid      string
+	err       error
+}
+
+func (failure requestFailure) String() string {
+	switch {
+	case failure.uuid != "":
+		return fmt.Sprintf("%s: %v", failure.uuid, failure.err)
+	case failure.site != "":
+		return fmt.Sprintf("%s: %v", failure.site, failure.err)
+	}
+	return failure.err.Error()
+}
+
+// response is what the client of a Fetch is sent about the failure
+func (failure requestFailure) response() *mortarpb.FetchResponse {
+	return &mortarpb.FetchResponse{
+		Error:      failure.err.Error(),
+		Site:       failure.site,
+		View:       failure.view,
+		DataFrame:  failure.dataFrame,
+		Identifier: failure.uuid,
+	}
+}
+
+// failureOf is the failure reported by a response with an error
+func failureOf(resp *mortarpb.FetchResponse) requestFailure {
+	return requestFailure{
+		site:      resp.Site,
+		view:      resp.View,
+		dataFrame: resp.DataFrame,
+		uuid:      resp.Identifier,
+		err:       errors.New(resp.Error),
+	}
+}
+
 type Request struct {
 	sync.Mutex
 
 	ctx    context.Context
 	cancel func()
-	err    error
+	state  requestState
+	// why the request failed or was cancelled, as a gRPC status error
+	err error
+	// the sites and UUIDs that could not be read
+	failures []requestFailure
+
+	// closed once the request ended
+	ended chan struct{}
 
 	qualify_request *mortarpb.QualifyRequest
 	fetch_request   *mortarpb.FetchRequest
 
-	fetch_responses   chan *mortarpb.FetchResponse
-	qualify_responses chan *mortarpb.QualifyResponse
+	fetch_responses chan *mortarpb.FetchResponse
+	// the result of a Qualify that completed
+	qualify_response *mortarpb.QualifyResponse
+
+	// uuid -> site it was found in by the Brick stage
+	uuid_sites map[string]string
+	// uuid -> view it was found in by the Brick stage
+	uuid_views map[string]string
+
+	// if set, the timeseries stage counts the UUIDs it reads here
+	progress *fetchProgress
+	// what the summary at the end of a Fetch reports
+	stats *fetchStats
+
+	// for each DataFrame, the index of each UUID in the client's request; set on the
+	// parts of a request that was split up
+	uuid_indexes [][]int
+	// set on the request for a single UUID of a resumable fetch: the position of the
+	// UUID, with the time up to which its points were already delivered
+	resume *resumePosition
+
+	// set for Subscribe: the timeseries stage keeps sending new data until the request
+	// is done, instead of reading fetch_request.Time
+	subscribe bool
+}
+
+// fetchProgress counts how far along a Fetch is. It is safe to use from several
+// goroutines, and a nil *fetchProgress ignores all updates
+type fetchProgress struct {
+	uuidsTotal     int64
+	uuidsCompleted int64
+	points         int64
+}
+
+func (p *fetchProgress) addUUIDs(n int) {
+	if p != nil {
+		atomic.AddInt64(&p.uuidsTotal, int64(n))
+	}
+}
+
+func (p *fetchProgress) uuidDone() {
+	if p != nil {
+		atomic.AddInt64(&p.uuidsCompleted, 1)
+	}
+}
+
+func (p *fetchProgress) addPoints(n int) {
+	if p != nil {
+		atomic.AddInt64(&p.points, int64(n))
+	}
 }
 
 func NewQualifyRequest(ctx context.Context, qualify *mortarpb.QualifyRequest) *Request {
@@ -25,10 +164,10 @@ func NewQualifyRequest(ctx context.Context, qualify *mortarpb.QualifyRequest) *R
 	//defer cancel()
 
 	req := &Request{
-		ctx:               ctx,
-		cancel:            cancel,
-		qualify_request:   qualify,
-		qualify_responses: make(chan *mortarpb.QualifyResponse),
+		ctx:             ctx,
+		cancel:          cancel,
+		ended:           make(chan struct{}),
+		qualify_request: qualify,
 	}
 
 	return req
@@ -37,43 +176,216 @@ func NewQualifyRequest(ctx context.Context, qualify *mortarpb.QualifyRequest) *R
 func NewFetchRequest(ctx context.Context, fetch *mortarpb.FetchRequest) *Request {
 	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
 	//defer cancel()
+	return newFetchRequest(ctx, cancel, fetch)
+}
 
+// newFetchRequest makes a Fetch request that ends with ctx; cancel must release ctx
+func newFetchRequest(ctx context.Context, cancel context.CancelFunc, fetch *mortarpb.FetchRequest) *Request {
 	req := &Request{
 		ctx:             ctx,
 		cancel:          cancel,
+		ended:           make(chan struct{}),
 		fetch_request:   fetch,
 		fetch_responses: make(chan *mortarpb.FetchResponse),
+		stats:           newFetchStats(),
 	}
 
 	return req
 }
 
+// start marks the request running when a stage picks it up. Returns false if the request
+// is over, e.g. because the client gave up or its deadline passed while it was queued; a
+// request refused that way is cancelled
+func (request *Request) start() bool {
+	request.Lock()
+	switch request.state {
+	case requestPending:
+		if err := request.ctx.Err(); err != nil {
+			request.state = requestCancelled
+			request.err = statusError(errors.Wrap(err, "Request expired while queued"))
+			request.Unlock()
+			request.terminate()
+			return false
+		}
+		request.state = requestRunning
+		request.Unlock()
+		return true
+	case requestRunning:
+		request.Unlock()
+		return true
+	}
+	request.Unlock()
+	return false
+}
+
+// addError fails the request with err. Only the first error ends the request; later ones
+// are ignored
 func (request *Request) addError(err error) {
+	request.end(requestFailed, err, nil)
+}
+
+// finish completes the request
+func (request *Request) finish() {
+	request.end(requestCompleted, nil, nil)
+}
+
+// respond completes the Qualify request with resp
+func (request *Request) respond(resp *mortarpb.QualifyResponse) {
+	request.end(requestCompleted, nil, resp)
+}
+
+// end moves the request to its final state, unless it already ended. A completed Fetch
+// sends its summary before Ended() is closed. A request that ends after its context is
+// done is cancelled
+func (request *Request) end(state requestState, err error, qualify *mortarpb.QualifyResponse) bool {
+	request.Lock()
+	if request.state.ended() {
+		request.Unlock()
+		return false
+	}
+	if ctxErr := request.ctx.Err(); ctxErr != nil {
+		state, err = requestCancelled, ctxErr
+	}
+	request.state = state
+	request.err = statusError(err)
+	request.qualify_response = qualify
+	var summary *mortarpb.FetchResponse
+	if state == requestCompleted && request.fetch_responses != nil && !request.subscribe {
+		summary = request.summary()
+	}
+	request.Unlock()
+
+	// sent without holding the lock, so the consumer can still inspect the request
+	if summary != nil {
+		request.send(summary)
+	}
+	request.terminate()
+	return true
+}
+
+// terminate closes Ended() and releases the context of the request, so anything still
+// working on it stops. Called once, by whoever moved the request to its final state
+func (request *Request) terminate() {
+	if request.ended != nil {
+		close(request.ended)
+	}
+	if request.cancel != nil {
+		request.cancel()
+	}
+}
+
+// abandon is called by the consumer of the request when it stops waiting for it, e.g.
+// because its client went away or its deadline passed. The request is cancelled with err
+// unless it already ended. Returns the error the request ended with, as a gRPC status
+// error
+func (request *Request) abandon(err error) error {
+	request.Lock()
+	abandoned := !request.state.ended()
+	if abandoned {
+		request.state = requestCancelled
+		request.err = statusError(err)
+	}
+	err = request.err
+	request.Unlock()
+	if abandoned {
+		request.terminate()
+	}
+	return err
+}
+
+// Ended is closed once the request has ended. By then all responses of a Fetch were
+// delivered
+func (request *Request) Ended() <-chan struct{} {
+	return request.ended
+}
+
+// awaitQualify waits for the Qualify request to end, returning its response or the error
+// it failed with
+func awaitQualify(req *Request) (*mortarpb.QualifyResponse, error) {
+	select {
+	case <-req.Ended():
+	case <-req.Done():
+		req.abandon(errors.Wrap(req.ctx.Err(), "qualify timeout on getting query response"))
+	}
+	req.Lock()
+	defer req.Unlock()
+	if req.err != nil {
+		return nil, req.err
+	}
+	return req.qualify_response, nil
+}
+
+// Err is the gRPC status error the request failed or was cancelled with; nil while it
+// runs and once it completed
+func (request *Request) Err() error {
 	request.Lock()
 	defer request.Unlock()
-	if request.err != nil {
-		return
+	return request.err
+}
+
+// send delivers a response of a Fetch to the consumer. Returns false if the request is done
+func (request *Request) send(resp *mortarpb.FetchResponse) bool {
+	select {
+	case request.fetch_responses <- resp:
+		return true
+	case <-request.Done():
+		return false
 	}
-	request.err = err
-	if request.fetch_responses != nil {
-		request.fetch_responses <- &mortarpb.FetchResponse{
-			Error: err.Error(),
-		}
-	} else if request.qualify_responses != nil {
-		request.qualify_responses <- &mortarpb.QualifyResponse{
-			Error: err.Error(),
-		}
+}
+
+// partialError records that a site or UUID could not be read, without failing the request.
+// The client of a Fetch is sent a response with the error, so it can tell which data is
+// missing
+func (request *Request) partialError(failure requestFailure) {
+	if request.recordFailure(failure) && request.fetch_responses != nil {
+		request.send(failure.response())
 	}
 }
 
-func (request *Request) finish() {
+// recordFailure adds the failure to those of the request without telling the client.
+// Returns false if the request already ended
+func (request *Request) recordFailure(failure requestFailure) bool {
+	request.Lock()
+	if request.state.ended() {
+		request.Unlock()
+		return false
+	}
+	request.failures = append(request.failures, failure)
+	request.Unlock()
+
+	log.Warning("Could not read ", failure)
+	return true
+}
+
+// uuidFailure is the failure to read the UUID of the DataFrame, with the site and view the
+// Brick stage found it in
+func (request *Request) uuidFailure(dataFrame, uuStr string, err error) requestFailure {
+	return requestFailure{
+		site:      request.uuid_sites[uuStr],
+		view:      request.uuid_views[uuStr],
+		dataFrame: dataFrame,
+		uuid:      uuStr,
+		err:       err,
+	}
+}
+
+// isBestEffort is true if the Fetch keeps going when UUIDs cannot be read
+func isBestEffort(req *Request) bool {
+	return req.fetch_request != nil && req.fetch_request.FailurePolicy == mortarpb.FailurePolicy_FAILURE_POLICY_BEST_EFFORT
+}
+
+// failureSummary describes the parts of the request that failed, or is empty if none did
+func (request *Request) failureSummary() string {
 	request.Lock()
 	defer request.Unlock()
-	if request.fetch_responses != nil {
-		request.fetch_responses <- nil
-	} else if request.qualify_responses != nil {
-		request.qualify_responses <- nil
+	if len(request.failures) == 0 {
+		return ""
 	}
+	parts := make([]string, len(request.failures))
+	for idx, failure := range request.failures {
+		parts[idx] = failure.String()
+	}
+	return fmt.Sprintf("%d failed: %s", len(parts), strings.Join(parts, "; "))
 }
 
 func (request *Request) Done() <-chan struct{} {
@@ -82,6 +394,41 @@ func (request *Request) Done() <-chan struct{} {
 	return request.ctx.Done()
 }
 
+// statusError converts err to a gRPC status error, so that clients can tell why their
+// request failed. Errors that already carry a status keep it
+func statusError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	cause := errors.Cause(err)
+	if st, ok := status.FromError(cause); ok {
+		// keep the code and details of the status, with the context of the wrapping errors
+		proto := st.Proto()
+		proto.Message = strings.TrimSuffix(err.Error(), cause.Error()) + st.Message()
+		return status.ErrorProto(proto)
+	}
+	code := codes.Unknown
+	switch cause {
+	case context.DeadlineExceeded:
+		code = codes.DeadlineExceeded
+	case context.Canceled:
+		code = codes.Canceled
+	case errStreamNotExist:
+		code = codes.NotFound
+	case errSubscribeNotSupported:
+		code = codes.Unimplemented
+	}
+	return status.Error(code, err.Error())
+}
+
+// invalidArgument marks err as caused by the client's request
+func invalidArgument(err error) error {
+	return status.Error(codes.InvalidArgument, err.Error())
+}
+
 //func (request *Request) handle() {
 //	go func() {
 //		if request.qualify_responses != nil {
@@ -0,0 +1,218 @@
+package stages
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	mortarpb "github.com/SoftwareDefinedBuildings/mortar/proto"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// consumeFetch reads the responses of req like the frontends do, until it ends or is done
+func consumeFetch(req *Request) (responses []*mortarpb.FetchResponse, err error) {
+	for {
+		select {
+		case resp := <-req.fetch_responses:
+			responses = append(responses, resp)
+		case <-req.Ended():
+			return responses, req.Err()
+		case <-req.Done():
+			return responses, req.abandon(errors.Wrap(req.ctx.Err(), "fetch timeout on response"))
+		}
+	}
+}
+
+func waitEnded(t *testing.T, req *Request) {
+	t.Helper()
+	select {
+	case <-req.Ended():
+	case <-time.After(5 * time.Second):
+		t.Fatal("request did not end")
+	}
+}
+
+func TestRequestEndingRaces(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		req := NewFetchRequest(context.Background(), &mortarpb.FetchRequest{})
+		if !req.start() {
+			t.Fatal("start refused a new request")
+		}
+
+		var wg sync.WaitGroup
+		for j := 0; j < 9; j++ {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				switch j % 3 {
+				case 0:
+					req.addError(errors.New("backend failed"))
+				case 1:
+					req.finish()
+				case 2:
+					req.abandon(errors.Wrap(context.Canceled, "client went away"))
+				}
+			}(j)
+		}
+		responses, err := consumeFetch(req)
+		wg.Wait()
+		waitEnded(t, req)
+
+		req.Lock()
+		state := req.state
+		req.Unlock()
+		switch state {
+		case requestCompleted:
+			if err != nil {
+				t.Fatalf("completed with error %v", err)
+			}
+			if len(responses) != 1 || responses[0].Summary == nil {
+				t.Fatalf("completed Fetch sent %v instead of one summary", responses)
+			}
+		case requestFailed:
+			if status.Code(err) != codes.Unknown {
+				t.Fatalf("failed with %v", err)
+			}
+		case requestCancelled:
+			if status.Code(err) != codes.Canceled {
+				t.Fatalf("cancelled with %v", err)
+			}
+		default:
+			t.Fatalf("request is %s after ending", state)
+		}
+		// later endings change nothing
+		req.addError(errors.New("late"))
+		req.finish()
+		if req.Err() != err {
+			t.Fatalf("error changed from %v to %v", err, req.Err())
+		}
+	}
+}
+
+func TestRequestClientCancelledWhilePending(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	req := NewFetchRequest(ctx, &mortarpb.FetchRequest{})
+
+	done := make(chan error)
+	go func() {
+		_, err := consumeFetch(req)
+		done <- err
+	}()
+	cancel()
+	if err := <-done; status.Code(err) != codes.Canceled {
+		t.Fatalf("consumer got %v", err)
+	}
+	waitEnded(t, req)
+	if req.start() {
+		t.Fatal("started a request whose client went away")
+	}
+	req.finish()
+	if status.Code(req.Err()) != codes.Canceled {
+		t.Fatalf("request error %v", req.Err())
+	}
+}
+
+func TestRequestClientCancelledWhileRunning(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	req := NewFetchRequest(ctx, &mortarpb.FetchRequest{})
+	if !req.start() {
+		t.Fatal("start refused a new request")
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := consumeFetch(req)
+		done <- err
+	}()
+	if !req.send(&mortarpb.FetchResponse{Identifier: "a"}) {
+		t.Fatal("response not delivered")
+	}
+	cancel()
+	if err := <-done; status.Code(err) != codes.Canceled {
+		t.Fatalf("consumer got %v", err)
+	}
+	// the stage notices once it tries to send more
+	if req.send(&mortarpb.FetchResponse{Identifier: "b"}) {
+		t.Fatal("response delivered to a client that went away")
+	}
+	req.addError(errors.New("backend failed"))
+	waitEnded(t, req)
+	if status.Code(req.Err()) != codes.Canceled {
+		t.Fatalf("request error %v", req.Err())
+	}
+}
+
+func TestRequestDeadlineWhileQueued(t *testing.T) {
+	defer func(timeout time.Duration) { requestTimeout = timeout }(requestTimeout)
+	requestTimeout = 10 * time.Millisecond
+
+	// nobody waits on the request: the stage must end it when it refuses it
+	req := NewFetchRequest(context.Background(), &mortarpb.FetchRequest{})
+	<-req.Done()
+	if req.start() {
+		t.Fatal("started an expired request")
+	}
+	waitEnded(t, req)
+	if status.Code(req.Err()) != codes.DeadlineExceeded {
+		t.Fatalf("request error %v", req.Err())
+	}
+
+	// a consumer waiting on a queued request gives up when it expires
+	req = NewQualifyRequest(context.Background(), &mortarpb.QualifyRequest{})
+	if _, err := awaitQualify(req); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("qualify got %v", err)
+	}
+	waitEnded(t, req)
+}
+
+func TestQualifyEndsOnce(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		req := NewQualifyRequest(context.Background(), &mortarpb.QualifyRequest{})
+		req.start()
+
+		var wg sync.WaitGroup
+		for j := 0; j < 6; j++ {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				if j%2 == 0 {
+					req.respond(&mortarpb.QualifyResponse{Sites: []string{"site"}})
+				} else {
+					req.addError(errors.New("hod failed"))
+				}
+			}(j)
+		}
+		resp, err := awaitQualify(req)
+		wg.Wait()
+		if (resp == nil) == (err == nil) {
+			t.Fatalf("got response %v and error %v", resp, err)
+		}
+		if resp != nil && len(resp.Sites) != 1 {
+			t.Fatalf("got response %v", resp)
+		}
+	}
+}
+
+func TestStatusErrors(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		code codes.Code
+	}{
+		{errors.Wrap(context.DeadlineExceeded, "fetch timeout"), codes.DeadlineExceeded},
+		{errors.Wrap(errStreamNotExist, "No stream"), codes.NotFound},
+		{errSubscribeNotSupported, codes.Unimplemented},
+		{invalidArgument(errors.New("bad time")), codes.InvalidArgument},
+		{errors.Wrap(errPipelineFull(), "brick"), codes.Unavailable},
+		{errors.New("hod failed"), codes.Unknown},
+	} {
+		if code := status.Code(statusError(test.err)); code != test.code {
+			t.Errorf("%v: got %s, want %s", test.err, code, test.code)
+		}
+	}
+	if _, found := retryDelay(statusError(errors.Wrap(errPipelineFull(), "brick"))); !found {
+		t.Error("wrapping lost the retry delay")
+	}
+}
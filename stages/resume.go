@@ -0,0 +1,112 @@
+package stages
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+
+	mortarpb "github.com/SoftwareDefinedBuildings/mortar/proto"
+	"github.com/pkg/errors"
+)
+
+// resumePosition is a point in the stream of a resumable Fetch: the time of a point of
+// the UUID at index uuid of the DataFrame at index dataFrame, both indexes into the
+// client's request after the Brick stage has filled in the UUIDs. Resumable Fetches
+// deliver their data in increasing position
+type resumePosition struct {
+	dataFrame int
+	uuid      int
+	time      int64
+}
+
+// uuidBefore is true if p is in a UUID that comes before the UUID of q
+func (p resumePosition) uuidBefore(q resumePosition) bool {
+	if p.dataFrame != q.dataFrame {
+		return p.dataFrame < q.dataFrame
+	}
+	return p.uuid < q.uuid
+}
+
+func (p resumePosition) sameUUID(q resumePosition) bool {
+	return p.dataFrame == q.dataFrame && p.uuid == q.uuid
+}
+
+func (p resumePosition) before(q resumePosition) bool {
+	if p.sameUUID(q) {
+		return p.time < q.time
+	}
+	return p.uuidBefore(q)
+}
+
+// token encodes the position as a FetchResponse.ResumeToken
+func (p resumePosition) token() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d.%d.%d", p.dataFrame, p.uuid, p.time)))
+}
+
+func parseResumeToken(token string) (resumePosition, error) {
+	var p resumePosition
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return p, errors.Errorf("Invalid resumeToken %q", token)
+	}
+	var rest string
+	if n, _ := fmt.Sscanf(string(data), "%d.%d.%d%s", &p.dataFrame, &p.uuid, &p.time, &rest); n != 3 || p.dataFrame < 0 || p.uuid < 0 {
+		return p, errors.Errorf("Invalid resumeToken %q", token)
+	}
+	return p, nil
+}
+
+// resumeFrom returns where the request continues from, or nil if it is not being resumed.
+// The token has been checked by validateFetchRequest
+func resumeFrom(req *Request) *resumePosition {
+	if req.fetch_request.ResumeToken == "" {
+		return nil
+	}
+	pos, err := parseResumeToken(req.fetch_request.ResumeToken)
+	if err != nil {
+		return nil
+	}
+	return &pos
+}
+
+// isResumable is true if the responses of the request must be delivered in order and
+// carry resume tokens
+func isResumable(req *Request) bool {
+	return req.fetch_request.Resumable || req.fetch_request.ResumeToken != ""
+}
+
+// uuidIndex is the index in the client's request of the UUID at index idx of the
+// DataFrame at index dataFrame of this request, which differ if the request was split
+func (request *Request) uuidIndex(dataFrame, idx int) int {
+	if request.uuid_indexes != nil {
+		return request.uuid_indexes[dataFrame][idx]
+	}
+	return idx
+}
+
+// uuidPosition is the position of the start of the data of the UUID. If the request
+// resumes in the middle of that UUID, points up to the resume time are skipped
+func uuidPosition(req *Request, dataFrame, idx int, resume *resumePosition) resumePosition {
+	pos := resumePosition{dataFrame: dataFrame, uuid: req.uuidIndex(dataFrame, idx), time: math.MinInt64}
+	if resume != nil && pos.sameUUID(*resume) {
+		pos.time = resume.time
+	}
+	return pos
+}
+
+// readStart is where reading a UUID from start continues if the request resumes in the
+// middle of it: just after the resume time, or at the next window for an aggregate with
+// windows of the given size. Fill policies that carry values into gaps need the points
+// before the resume time, so those DataFrames are still read from start
+func readStart(req *Request, dataFrame *mortarpb.DataFrame, start, window int64) int64 {
+	if req.resume == nil || req.resume.time < start {
+		return start
+	}
+	if fill := dataFrame.Fill; fill != nil && (fill.Method == mortarpb.FillMethod_FILL_METHOD_PREVIOUS || fill.Method == mortarpb.FillMethod_FILL_METHOD_LINEAR) {
+		return start
+	}
+	if window <= 0 {
+		return req.resume.time + 1
+	}
+	return start + ((req.resume.time-start)/window+1)*window
+}
@@ -0,0 +1,39 @@
+package stages
+
+import (
+	"math"
+	"testing"
+
+	mortarpb "github.com/SoftwareDefinedBuildings/mortar/proto"
+)
+
+func TestReadStart(t *testing.T) {
+	const (
+		start  = int64(1000)
+		window = int64(100)
+	)
+	previous := &mortarpb.FillPolicy{Method: mortarpb.FillMethod_FILL_METHOD_PREVIOUS}
+	constant := &mortarpb.FillPolicy{Method: mortarpb.FillMethod_FILL_METHOD_CONSTANT}
+	for _, test := range []struct {
+		name   string
+		resume *resumePosition
+		window int64
+		fill   *mortarpb.FillPolicy
+		want   int64
+	}{
+		{"not resumable", nil, 0, nil, start},
+		{"other UUID", &resumePosition{time: math.MinInt64}, 0, nil, start},
+		{"raw", &resumePosition{time: 1234}, 0, nil, 1235},
+		{"window", &resumePosition{time: 1200}, window, nil, 1300},
+		{"unaligned window", &resumePosition{time: 1250}, window, nil, 1300},
+		{"constant fill", &resumePosition{time: 1234}, 0, constant, 1235},
+		// the filler needs the points before the resume time
+		{"previous fill", &resumePosition{time: 1234}, 0, previous, start},
+	} {
+		req := &Request{resume: test.resume}
+		dataFrame := &mortarpb.DataFrame{Name: "df", Fill: test.fill}
+		if got := readStart(req, dataFrame, start, test.window); got != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, got, test.want)
+		}
+	}
+}
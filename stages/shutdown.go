@@ -0,0 +1,82 @@
+package stages
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+)
+
+// drainer stops the servers of a frontend, letting the calls in flight finish
+type drainer struct {
+	once     sync.Once
+	draining chan struct{}
+}
+
+func newDrainer() *drainer {
+	return &drainer{draining: make(chan struct{})}
+}
+
+// isDraining is true once the frontend has started shutting down
+func (d *drainer) isDraining() bool {
+	select {
+	case <-d.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// untilDraining returns a context that is cancelled when ctx is, or when the frontend starts
+// shutting down. Used for calls that never finish on their own, like Subscribe
+func (d *drainer) untilDraining(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-d.draining:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// drain stops the servers from accepting new calls and waits for the calls in flight and
+// the running fetch jobs to finish. Once ctx is done, the calls still running are cut off.
+// httpServer and jobs may be nil
+func (d *drainer) drain(ctx context.Context, server *grpc.Server, httpServer *http.Server, jobs *fetchJobs) error {
+	d.once.Do(func() { close(d.draining) })
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.GracefulStop()
+		}()
+		if httpServer != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				httpServer.Shutdown(ctx)
+			}()
+		}
+		jobs.wait()
+		wg.Wait()
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		server.Stop()
+		if httpServer != nil {
+			httpServer.Close()
+		}
+		return errors.Wrapf(ctx.Err(), "Cut off requests in flight (%d) and running fetch jobs", InFlightRequests())
+	}
+}
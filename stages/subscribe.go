@@ -0,0 +1,331 @@
+package stages
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+
+	mortarpb "github.com/SoftwareDefinedBuildings/mortar/proto"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/btrdb.v4"
+)
+
+var errSubscribeNotSupported = errors.New("Subscribe is only supported by the btrdb timeseries backend")
+
+var errTooManySubscriptions = status.Error(codes.ResourceExhausted, "Too many subscriptions; try again later")
+
+// end of the range of times BTrDB can store
+const btrdbMaximumTime int64 = 48 << 56
+
+// newSubscribeRequest creates the Request for a subscription. Unlike a Fetch it has no
+// timeout: it runs until ctx is done
+func newSubscribeRequest(ctx context.Context, subscribe *mortarpb.SubscribeRequest) *Request {
+	ctx, cancel := context.WithCancel(ctx)
+	return &Request{
+		ctx:    ctx,
+		cancel: cancel,
+		ended:  make(chan struct{}),
+		fetch_request: &mortarpb.FetchRequest{
+			Sites:      subscribe.Sites,
+			Views:      subscribe.Views,
+			DataFrames: subscribe.DataFrames,
+			Time:       &mortarpb.TimeParams{Start: subscribe.Start},
+		},
+		fetch_responses: make(chan *mortarpb.FetchResponse),
+		subscribe:       true,
+	}
+}
+
+// subscribe dispatches the subscription to output and streams the responses to the client
+// until the client goes away or the subscription fails
+func subscribe(ctx context.Context, output chan *Request, request *mortarpb.SubscribeRequest, client mortarpb.Mortar_SubscribeServer, audit *auditEntry) error {
+	req := newSubscribeRequest(ctx, request)
+	defer req.cancel()
+
+	if err := admit(ctx, "brick", output, req); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case resp := <-req.fetch_responses:
+			err := client.Send(resp)
+			if err == nil {
+				audit.sent(resp)
+			}
+			finishResponse(resp)
+			if err != nil {
+				log.Error(errors.Wrap(err, "Error on sending"))
+				req.abandon(err)
+				return err
+			}
+			messagesSent.Inc()
+		case <-req.Ended():
+			return req.Err()
+		case <-req.Done():
+			// the client went away, which ends the subscription without an error
+			return req.abandon(nil)
+		}
+	}
+}
+
+// Subscribe resolves the views, then streams new data for the UUIDs they matched
+func (stage *ApiFrontendBasicStage) Subscribe(request *mortarpb.SubscribeRequest, client mortarpb.Mortar_SubscribeServer) (err error) {
+	audit := startAudit(client.Context(), "Subscribe")
+	audit.subscribe(request)
+	defer func() { audit.finish(err) }()
+
+	authRequests.Inc()
+	activeQueries.Inc()
+	defer activeQueries.Dec()
+
+	// subscriptions only end when the client goes away, so they are ended on shutdown
+	ctx, cancel := stage.untilDraining(client.Context())
+	defer cancel()
+	if err := stage.authenticate(ctx); err != nil {
+		return err
+	}
+	authRequestsSuccessful.Inc()
+	audit.identify(tokenIdentity(ctx))
+
+	if err := validateSubscribeRequest(request); err != nil {
+		return invalidArgument(err)
+	}
+	fetchQueriesProcessed.Inc()
+
+	return subscribe(ctx, stage.output, request, client, audit)
+}
+
+// Subscribe resolves the views, then streams new data for the UUIDs they matched
+func (stage *ApiFrontendWAVEAuthStage) Subscribe(request *mortarpb.SubscribeRequest, client mortarpb.Mortar_SubscribeServer) (err error) {
+	audit := startAudit(client.Context(), "Subscribe")
+	audit.subscribe(request)
+	defer func() { audit.finish(err) }()
+
+	activeQueries.Inc()
+	defer activeQueries.Dec()
+
+	if err := validateSubscribeRequest(request); err != nil {
+		return invalidArgument(err)
+	}
+	fetchQueriesProcessed.Inc()
+
+	// subscriptions only end when the client goes away, so they are ended on shutdown
+	ctx, cancel := stage.untilDraining(client.Context())
+	defer cancel()
+	return subscribe(ctx, stage.output, request, client, audit)
+}
+
+// subscribedStream is a UUID of a subscription and how far it has been read
+type subscribedStream struct {
+	dataFrame *mortarpb.DataFrame
+	uuid      string
+	stream    *btrdb.Stream
+	// start of the subscription
+	start int64
+	// RAW: version last read; 0 until the stream has been read
+	version uint64
+	// windowed: the window width, and the start of the next window to read
+	width int64
+	next  int64
+}
+
+// subscribe reads the UUIDs the Brick stage resolved for the request every poll interval,
+// sending new points or closed windows, until the request is done
+func (stage *TimeseriesQueryStage) subscribe(req *Request) {
+	if err := stage.runSubscription(req); err != nil && req.ctx.Err() == nil {
+		req.addError(err)
+		log.Error(errors.Wrap(err, "Subscription failed"))
+	}
+}
+
+func (stage *TimeseriesQueryStage) runSubscription(req *Request) error {
+	start := time.Now().UnixNano()
+	if req.fetch_request.Time != nil && req.fetch_request.Time.Start != "" {
+		t, err := time.Parse(time.RFC3339, req.fetch_request.Time.Start)
+		if err != nil {
+			return invalidArgument(errors.Wrapf(err, "Could not parse Start time (%s)", req.fetch_request.Time.Start))
+		}
+		start = t.UnixNano()
+	}
+
+	var streams []*subscribedStream
+	for _, dataFrame := range req.fetch_request.DataFrames {
+		for _, uuStr := range dataFrame.Uuids {
+			uu := uuid.Parse(uuStr)
+			if uu == nil {
+				log.Warningf("Could not parse uuid %s", uuStr)
+				continue
+			}
+			stream, err := stage.getStream(req.ctx, uu)
+			if err != nil {
+				return err
+			}
+			s := &subscribedStream{dataFrame: dataFrame, uuid: uuStr, stream: stream, start: start}
+			if dataFrame.Aggregation != mortarpb.AggFunc_AGG_FUNC_RAW {
+				width, err := ParseDuration(dataFrame.Window)
+				if err != nil {
+					return err
+				}
+				s.width = width.Nanoseconds()
+				s.next = floorTime(start, s.width)
+			}
+			streams = append(streams, s)
+		}
+	}
+	log.Infof("Subscribed to %d streams", len(streams))
+
+	ticker := time.NewTicker(stage.pollInterval)
+	defer ticker.Stop()
+	for {
+		for _, s := range streams {
+			var err error
+			if s.width == 0 {
+				err = s.pollRaw(req)
+			} else {
+				err = s.pollWindows(req, time.Now().UnixNano()-stage.subscribeDelay.Nanoseconds())
+			}
+			if err != nil {
+				return errors.Wrapf(err, "Could not read %s", s.uuid)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-req.Done():
+			return nil
+		case <-stage.ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (s *subscribedStream) batcher(req *Request) *fetchBatcher {
+	return &fetchBatcher{
+		req:         req,
+		dataFrame:   s.dataFrame.Name,
+		identifier:  s.uuid,
+		aggregation: s.dataFrame.Aggregation,
+		resp:        &mortarpb.FetchResponse{},
+		live:        true,
+	}
+}
+
+// pollRaw sends the points written since the last poll, wherever they are in time: after
+// the first read, only the ranges BTrDB reports as changed between the versions are read,
+// and the points that were already there are left out. Streams are only read when their
+// version has changed
+func (s *subscribedStream) pollRaw(req *Request) error {
+	version, err := s.stream.Version(req.ctx)
+	if err != nil {
+		return err
+	}
+	if version == s.version {
+		return nil
+	}
+
+	batcher := s.batcher(req)
+	if s.version == 0 {
+		err = s.sendRaw(req, batcher, s.start, btrdbMaximumTime, version, nil)
+	} else {
+		err = s.sendChanges(req, batcher, version)
+	}
+	batcher.flush()
+	if err != nil {
+		return err
+	}
+	s.version = version
+	return nil
+}
+
+// sendChanges sends the points added in the ranges that changed after s.version
+func (s *subscribedStream) sendChanges(req *Request, batcher *fetchBatcher, version uint64) error {
+	var changed []btrdb.ChangedRange
+	ranges, generations, errchan := s.stream.Changes(req.ctx, s.version, version, 0)
+	for r := range ranges {
+		changed = append(changed, r)
+	}
+	<-generations
+	if err := <-errchan; err != nil {
+		return err
+	}
+	sort.Slice(changed, func(i, j int) bool { return changed[i].Start < changed[j].Start })
+
+	for _, r := range changed {
+		start := r.Start
+		if start < s.start {
+			start = s.start
+		}
+		if start >= r.End {
+			continue
+		}
+		// changed ranges can be wider than the points written, so the points
+		// already there are read to skip them
+		previous := make(map[btrdb.RawPoint]int)
+		points, generations, errchan := s.stream.RawValues(req.ctx, start, r.End, s.version)
+		for p := range points {
+			previous[p]++
+		}
+		<-generations
+		if err := <-errchan; err != nil {
+			return err
+		}
+		if err := s.sendRaw(req, batcher, start, r.End, version, previous); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendRaw sends the points in [start, end) at version, except for those in skip
+func (s *subscribedStream) sendRaw(req *Request, batcher *fetchBatcher, start, end int64, version uint64, skip map[btrdb.RawPoint]int) error {
+	points, generations, errchan := s.stream.RawValues(req.ctx, start, end, version)
+	for p := range points {
+		if skip[p] > 0 {
+			skip[p]--
+			continue
+		}
+		batcher.add(p.Time, p.Value)
+	}
+	<-generations
+	return <-errchan
+}
+
+// pollWindows sends the windows that closed before until
+func (s *subscribedStream) pollWindows(req *Request, until int64) error {
+	closed := floorTime(until, s.width)
+	if closed <= s.next {
+		return nil
+	}
+
+	batcher := s.batcher(req)
+	statpoints, generations, errchan := s.stream.Windows(req.ctx, s.next, closed, uint64(s.width), windowAccuracy(time.Duration(s.width)), 0)
+	for p := range statpoints {
+		batcher.add(p.Time, valueFromAggFunc(p, s.dataFrame.Aggregation))
+	}
+	batcher.flush()
+	<-generations
+	if err := <-errchan; err != nil {
+		return err
+	}
+	s.next = closed
+	return nil
+}
+
+// floorTime rounds t down to a multiple of width
+func floorTime(t, width int64) int64 {
+	rem := t % width
+	if rem < 0 {
+		rem += width
+	}
+	return t - rem
+}
+
+// windowAccuracy is the depth BTrDB computes windows of the size to
+func windowAccuracy(windowSize time.Duration) uint8 {
+	windowDepth := math.Log2(float64(windowSize))
+	return uint8(math.Max(windowDepth-5, 30))
+}
@@ -0,0 +1,116 @@
+package stages
+
+import (
+	"sync"
+	"time"
+
+	mortarpb "github.com/SoftwareDefinedBuildings/mortar/proto"
+)
+
+// fetchStats collects what the summary at the end of a Fetch reports. It is safe to use
+// from several goroutines, and a nil *fetchStats ignores all updates
+type fetchStats struct {
+	sync.Mutex
+	created time.Time
+
+	sitesQueried int64
+	viewRows     []*mortarpb.ViewRows
+	brickVersion int64
+	brickTime    time.Duration
+	// when the Brick stage handed the request on; zero if it ran no queries
+	brickDone time.Time
+
+	// DataFrame name -> count
+	uuidsMissing map[string]int64
+	points       map[string]int64
+}
+
+func newFetchStats() *fetchStats {
+	return &fetchStats{
+		created:      time.Now(),
+		uuidsMissing: make(map[string]int64),
+		points:       make(map[string]int64),
+	}
+}
+
+// brickQueried records that the views were queried on the sites, with the Brick models as
+// they were at version
+func (s *fetchStats) brickQueried(sites int, version int64) {
+	if s != nil {
+		s.Lock()
+		defer s.Unlock()
+		s.sitesQueried = int64(sites)
+		s.brickVersion = version
+	}
+}
+
+func (s *fetchStats) addViewRows(site, view string, rows int) {
+	if s != nil {
+		s.Lock()
+		defer s.Unlock()
+		s.viewRows = append(s.viewRows, &mortarpb.ViewRows{Site: site, View: view, Rows: int64(rows)})
+	}
+}
+
+func (s *fetchStats) brickFinished(took time.Duration) {
+	if s != nil {
+		s.Lock()
+		defer s.Unlock()
+		s.brickTime = took
+		s.brickDone = time.Now()
+	}
+}
+
+func (s *fetchStats) uuidMissing(dataFrame string) {
+	if s != nil {
+		s.Lock()
+		defer s.Unlock()
+		s.uuidsMissing[dataFrame]++
+	}
+}
+
+func (s *fetchStats) addPoints(dataFrame string, n int) {
+	if s != nil {
+		s.Lock()
+		defer s.Unlock()
+		s.points[dataFrame] += int64(n)
+	}
+}
+
+// summary is the last response of a completed Fetch. Must be called with the lock held
+func (request *Request) summary() *mortarpb.FetchResponse {
+	summary := &mortarpb.FetchSummary{}
+	for _, failure := range request.failures {
+		summary.Failures = append(summary.Failures, &mortarpb.FetchFailure{
+			Site:       failure.site,
+			View:       failure.view,
+			DataFrame:  failure.dataFrame,
+			Identifier: failure.uuid,
+			Error:      failure.err.Error(),
+		})
+	}
+
+	if stats := request.stats; stats != nil {
+		stats.Lock()
+		defer stats.Unlock()
+		summary.SitesQueried = stats.sitesQueried
+		summary.ViewRows = stats.viewRows
+		summary.BrickVersion = stats.brickVersion
+		summary.BrickSeconds = stats.brickTime.Seconds()
+		timeseriesStart := stats.brickDone
+		if timeseriesStart.IsZero() {
+			timeseriesStart = stats.created
+		}
+		summary.TimeseriesSeconds = time.Since(timeseriesStart).Seconds()
+		// the Brick stage has filled in the UUIDs of the DataFrames by now
+		for _, dataFrame := range request.fetch_request.DataFrames {
+			summary.DataFrames = append(summary.DataFrames, &mortarpb.DataFrameSummary{
+				Name:          dataFrame.Name,
+				UuidsResolved: int64(len(dataFrame.Uuids)),
+				UuidsMissing:  stats.uuidsMissing[dataFrame.Name],
+				Points:        stats.points[dataFrame.Name],
+			})
+		}
+	}
+	return &mortarpb.FetchResponse{Summary: summary}
+}
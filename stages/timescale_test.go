@@ -0,0 +1,74 @@
+package stages
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	mortarpb "github.com/SoftwareDefinedBuildings/mortar/proto"
+	"github.com/lib/pq"
+)
+
+func TestTimescaleQuery(t *testing.T) {
+	// identifiers are quoted the way NewTimescaleTimeseriesQueryStage does
+	stage := &TimescaleTimeseriesQueryStage{
+		table:       quotePostgresTable(`metrics.readings"; DROP TABLE x; --`),
+		uuidColumn:  pq.QuoteIdentifier("uuid"),
+		timeColumn:  pq.QuoteIdentifier("Time"),
+		valueColumn: pq.QuoteIdentifier("value"),
+		fetchSize:   500,
+	}
+	start := time.Date(2020, 1, 1, 0, 7, 0, 0, time.UTC)
+	end := start.Add(24 * time.Hour)
+	const (
+		table = `"metrics"."readings""; DROP TABLE x; --"`
+		where = `"uuid" = $1 AND "Time" >= $2 AND "Time" < $3`
+	)
+
+	for _, test := range []struct {
+		name      string
+		dataFrame *mortarpb.DataFrame
+		query     string
+		interval  string
+	}{
+		{"raw", &mortarpb.DataFrame{Aggregation: mortarpb.AggFunc_AGG_FUNC_RAW},
+			`SELECT "Time", "value" FROM ` + table + ` WHERE ` + where + ` ORDER BY "Time"`, ""},
+		// the buckets start at the start of the query, not at the epoch
+		{"mean", &mortarpb.DataFrame{Aggregation: mortarpb.AggFunc_AGG_FUNC_MEAN, Window: "15m"},
+			`SELECT time_bucket($4::interval, "Time", $2::timestamptz) AS bucket, avg("value")::double precision FROM ` + table + ` WHERE ` + where + ` GROUP BY bucket ORDER BY bucket`, "900000000 microseconds"},
+		{"count", &mortarpb.DataFrame{Aggregation: mortarpb.AggFunc_AGG_FUNC_COUNT, Window: "1h"},
+			`SELECT time_bucket($4::interval, "Time", $2::timestamptz) AS bucket, count("value")::double precision FROM ` + table + ` WHERE ` + where + ` GROUP BY bucket ORDER BY bucket`, "3600000000 microseconds"},
+		{"sub-millisecond window", &mortarpb.DataFrame{Aggregation: mortarpb.AggFunc_AGG_FUNC_MAX, Window: "250us"},
+			`SELECT time_bucket($4::interval, "Time", $2::timestamptz) AS bucket, max("value")::double precision FROM ` + table + ` WHERE ` + where + ` GROUP BY bucket ORDER BY bucket`, "250 microseconds"},
+	} {
+		query, args, err := stage.buildQuery(test.dataFrame, arrowTestUUID1, start, end)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if query != test.query {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, query, test.query)
+		}
+		// the UUID and times are bound as arguments
+		want := []interface{}{arrowTestUUID1, start, end}
+		if test.interval != "" {
+			want = append(want, test.interval)
+		}
+		if fmt.Sprint(args) != fmt.Sprint(want) {
+			t.Errorf("%s: got arguments %v, want %v", test.name, args, want)
+		}
+	}
+
+	for _, dataFrame := range []*mortarpb.DataFrame{
+		{Aggregation: mortarpb.AggFunc_AGG_FUNC_MEAN, Window: "soon"},
+		{Aggregation: mortarpb.AggFunc(42), Window: "1h"},
+	} {
+		if query, _, err := stage.buildQuery(dataFrame, arrowTestUUID1, start, end); err == nil {
+			t.Errorf("built %s for %v", query, dataFrame)
+		}
+	}
+
+	if fetch := stage.fetchStatement(); fetch != "FETCH FORWARD 500 FROM mortar_cursor" {
+		t.Errorf("fetch is %s", fetch)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	mortarpb "github.com/SoftwareDefinedBuildings/mortar/proto"
+	"github.com/heptiolabs/healthcheck"
 	"github.com/pborman/uuid"
 	"github.com/pkg/errors"
 	"gopkg.in/btrdb.v4"
@@ -20,16 +21,49 @@ type TimeseriesQueryStage struct {
 	output   chan *Request
 
 	// timeseries database stuff
-	conn        *btrdb.BTrDB
+	clusters []*btrdbCluster
+	// uuid -> cluster holding the stream
 	streamCache sync.Map
-
+	// number of UUIDs read concurrently for each request
+	concurrency int
+	// deliver the UUIDs of a request one after the other instead of interleaved
+	ordered bool
+	// how often subscriptions poll their streams, and how long they wait for late points
+	// before reading a window that has closed
+	pollInterval   time.Duration
+	subscribeDelay time.Duration
+	subscriptions  *subscriptionPool
+
+	// workers and subscriptions using the connections
+	workers sync.WaitGroup
 	sync.Mutex
 }
 
 type TimeseriesStageConfig struct {
 	Upstream     Stage
 	StageContext context.Context
+	// address of a single BTrDB endpoint; used if Clusters is empty
 	BTrDBAddress string
+	// BTrDB clusters to read from. Each stream is read from the first cluster that has it
+	Clusters []BTrDBClusterConfig
+	// number of connections opened through each endpoint; defaults to 1
+	ConnectionsPerEndpoint int
+	// how often endpoints are checked; defaults to 30s
+	HealthCheckInterval time.Duration
+	// number of requests handled at once; defaults to 20
+	Workers int
+	// number of UUIDs read concurrently for each request; defaults to 4
+	Concurrency int
+	// if true, all responses for a UUID are sent before those of the next UUID in the
+	// request. Otherwise responses of the UUIDs being read are interleaved
+	OrderedDelivery bool
+	// how often Subscribe checks streams for new data; defaults to 5s
+	SubscribePollInterval time.Duration
+	// how long after a window closes Subscribe waits for late points before reading it;
+	// defaults to 10s
+	SubscribeDelay time.Duration
+	// number of subscriptions served at once; defaults to 100
+	MaxSubscriptions int
 }
 
 func NewTimeseriesQueryStage(cfg *TimeseriesStageConfig) (*TimeseriesQueryStage, error) {
@@ -37,35 +71,84 @@ func NewTimeseriesQueryStage(cfg *TimeseriesStageConfig) (*TimeseriesQueryStage,
 		return nil, errors.New("Need to specify Upstream in Timeseries config")
 	}
 	stage := &TimeseriesQueryStage{
-		upstream: cfg.Upstream,
-		output:   make(chan *Request),
-		ctx:      cfg.StageContext,
+		upstream:    cfg.Upstream,
+		output:      make(chan *Request),
+		ctx:         cfg.StageContext,
+		concurrency: cfg.Concurrency,
+		ordered:     cfg.OrderedDelivery,
+
+		pollInterval:   cfg.SubscribePollInterval,
+		subscribeDelay: cfg.SubscribeDelay,
+	}
+	if stage.concurrency <= 0 {
+		stage.concurrency = 4
+	}
+	if stage.pollInterval <= 0 {
+		stage.pollInterval = 5 * time.Second
+	}
+	if stage.subscribeDelay <= 0 {
+		stage.subscribeDelay = 10 * time.Second
+	}
+	healthCheckInterval := cfg.HealthCheckInterval
+	if healthCheckInterval <= 0 {
+		healthCheckInterval = 30 * time.Second
 	}
 
-	conn, err := btrdb.Connect(stage.ctx, cfg.BTrDBAddress)
-	if err != nil {
-		return nil, errors.Wrapf(err, "Could not connect to BTrDB at address %s", cfg.BTrDBAddress)
+	for _, clustercfg := range btrdbClusters(cfg.Clusters, cfg.BTrDBAddress) {
+		cluster, err := connectCluster(stage.ctx, clustercfg, cfg.ConnectionsPerEndpoint)
+		if err != nil {
+			return nil, err
+		}
+		stage.clusters = append(stage.clusters, cluster)
+		go cluster.healthCheck(stage.ctx, healthCheckInterval)
 	}
-	stage.conn = conn
 
-	// TODO: configure concurrent connections
-	num_workers := 20
+	num_workers := cfg.Workers
+	if num_workers <= 0 {
+		num_workers = 20
+	}
+	busy := workerGauges(stage, "btrdb", num_workers)
+	maxSubscriptions := cfg.MaxSubscriptions
+	if maxSubscriptions <= 0 {
+		maxSubscriptions = 100
+	}
+	stage.subscriptions = subscriptionGauges(stage, maxSubscriptions)
 	// consume function
 	for i := 0; i < num_workers; i++ {
+		stage.workers.Add(1)
 		go func() {
+			defer stage.workers.Done()
 			input := stage.upstream.GetQueue()
 			for {
 				select {
 				case req := <-input:
-					if len(req.fetch_request.Sites) > 0 && len(req.fetch_request.DataFrames) > 0 {
+					busy.Inc()
+					if !req.start() {
+						// the client gave up while the request was queued
+					} else if req.subscribe {
+						if !stage.subscriptions.acquire() {
+							req.addError(errTooManySubscriptions)
+						} else {
+							// runs until the client goes away
+							stage.workers.Add(1)
+							go func() {
+								defer stage.workers.Done()
+								defer stage.subscriptions.release()
+								stage.subscribe(req)
+							}()
+						}
+					} else if len(req.fetch_request.Sites) > 0 && len(req.fetch_request.DataFrames) > 0 {
 						if err := stage.processQuery(req); err != nil {
 							req.addError(err)
 							log.Println(err)
+						} else {
+							req.finish()
 						}
 					} else {
 						req.finish()
 					}
 
+					busy.Dec()
 					//stage.output <- req
 				case <-stage.ctx.Done():
 					// case that breaks the stage and releases resources
@@ -79,6 +162,49 @@ func NewTimeseriesQueryStage(cfg *TimeseriesStageConfig) (*TimeseriesQueryStage,
 	return stage, nil
 }
 
+// Close disconnects from BTrDB once the workers and subscriptions have stopped. The
+// StageContext must be done
+func (stage *TimeseriesQueryStage) Close() error {
+	stage.workers.Wait()
+	for _, cluster := range stage.clusters {
+		cluster.close()
+	}
+	return nil
+}
+
+// btrdbClusters is the configured clusters, or a single one reached through address
+func btrdbClusters(clusters []BTrDBClusterConfig, address string) []BTrDBClusterConfig {
+	if len(clusters) == 0 {
+		return []BTrDBClusterConfig{{Name: "default", Endpoints: []string{address}}}
+	}
+	return clusters
+}
+
+// Reload applies changes to the endpoints of the clusters. Adding or removing clusters needs
+// a restart
+func (stage *TimeseriesQueryStage) Reload(cfg *Config) {
+	configured := make(map[string][]string)
+	for _, clustercfg := range btrdbClusters(cfg.BTrDB.Clusters, cfg.BTrDBAddr) {
+		configured[clustercfg.Name] = clustercfg.Endpoints
+	}
+	for _, cluster := range stage.clusters {
+		endpoints, found := configured[cluster.name]
+		if !found {
+			log.Warningf("BTrDB cluster %s removed; restart to apply it", cluster.name)
+			continue
+		}
+		delete(configured, cluster.name)
+		if len(endpoints) == 0 {
+			log.Warningf("BTrDB cluster %s has no endpoints; keeping the current ones", cluster.name)
+			continue
+		}
+		cluster.setEndpoints(stage.ctx, endpoints)
+	}
+	for name := range configured {
+		log.Warningf("BTrDB cluster %s added; restart to apply it", name)
+	}
+}
+
 func (stage *TimeseriesQueryStage) GetUpstream() Stage {
 	stage.Lock()
 	defer stage.Unlock()
@@ -102,54 +228,55 @@ func (stage *TimeseriesQueryStage) String() string {
 	return "<|ts stage|>"
 }
 
-func (stage *TimeseriesQueryStage) getStream(ctx context.Context, streamuuid uuid.UUID) (stream *btrdb.Stream, err error) {
-	_stream, found := stage.streamCache.Load(streamuuid.Array())
-	if found {
-		//var ok bool
-		stream = _stream.(*btrdb.Stream)
-		//_units, _ := b.unitCache.Load(streamuuid.Array())
-		//units, ok = _units.(Unit)
-		//if !ok {
-		//	units = NO_UNITS
-		//}
-		return
+// each cluster needs at least one healthy connection
+func (stage *TimeseriesQueryStage) ReadinessChecks() map[string]healthcheck.Check {
+	checks := workerChecks(stage, nil, false)
+	for _, cluster := range stage.clusters {
+		cluster := cluster
+		checks["btrdb-"+cluster.name] = func() error {
+			_, err := cluster.get()
+			return err
+		}
 	}
-	stream = stage.conn.StreamFromUUID(streamuuid)
-	if exists, existsErr := stream.Exists(ctx); existsErr != nil {
-		if existsErr != nil {
-			e := btrdb.ToCodedError(existsErr)
-			if e.Code != 501 {
-				err = errors.Wrap(existsErr, "Could not fetch stream")
-				//defer cancel()
-				return
-			}
+	return checks
+}
+
+func (stage *TimeseriesQueryStage) LivenessChecks() map[string]healthcheck.Check {
+	return workerChecks(stage, nil, true)
+}
+
+// getStream returns the stream from a healthy connection to the cluster that holds it.
+// The cluster is looked up once and cached
+func (stage *TimeseriesQueryStage) getStream(ctx context.Context, streamuuid uuid.UUID) (*btrdb.Stream, error) {
+	if _cluster, found := stage.streamCache.Load(streamuuid.Array()); found {
+		conn, err := _cluster.(*btrdbCluster).get()
+		if err != nil {
+			return nil, err
 		}
-	} else if exists {
-
-		//// get the units
-		//annotations, _, annotationErr := stream.CachedAnnotations(context.Background())
-		//if annotationErr != nil {
-		//	err = errors.Wrap(annotationErr, "Could not fetch stream annotations")
-		//	return
-		//}
-		//if _units, found := annotations["unit"]; found {
-		//	units = ParseUnit(_units)
-		//	b.unitCache.Store(streamuuid.Array(), units)
-		//} else {
-		//	b.unitCache.Store(streamuuid.Array(), NO_UNITS)
-		//	units = NO_UNITS
-		//}
-
-		stage.streamCache.Store(streamuuid.Array(), stream)
-		return
+		return conn.StreamFromUUID(streamuuid), nil
 	}
 
-	// else where we return a nil stream and the errStreamNotExist
-	if stream == nil {
-		err = errStreamNotExist
-		//defer cancel()
+	var lastErr error
+	for _, cluster := range stage.clusters {
+		exists, err := cluster.exists(ctx, streamuuid)
+		if err != nil {
+			// the stream may still be in another cluster
+			lastErr = err
+			continue
+		}
+		if exists {
+			stage.streamCache.Store(streamuuid.Array(), cluster)
+			conn, err := cluster.get()
+			if err != nil {
+				return nil, err
+			}
+			return conn.StreamFromUUID(streamuuid), nil
+		}
 	}
-	return
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, errors.Wrapf(errStreamNotExist, "No stream %s", streamuuid)
 }
 
 func (stage *TimeseriesQueryStage) processQuery(req *Request) error {
@@ -157,132 +284,78 @@ func (stage *TimeseriesQueryStage) processQuery(req *Request) error {
 	// parse timestamps for the query
 	start_time, err := time.Parse(time.RFC3339, req.fetch_request.Time.Start)
 	if err != nil {
-		err = errors.Wrapf(err, "Could not parse Start time (%s)", req.fetch_request.Time.Start)
-		req.addError(err)
-		return err
+		return invalidArgument(errors.Wrapf(err, "Could not parse Start time (%s)", req.fetch_request.Time.Start))
 	}
 	end_time, err := time.Parse(time.RFC3339, req.fetch_request.Time.End)
 	if err != nil {
-		err = errors.Wrapf(err, "Could not parse End time (%s)", req.fetch_request.Time.End)
-		req.addError(err)
-		return err
+		return invalidArgument(errors.Wrapf(err, "Could not parse End time (%s)", req.fetch_request.Time.End))
 	}
 
 	log.Debug("Fetch data in [", start_time, " - ", end_time, "]")
 
-	//ctx.request.TimeParams.window
-	//qctx, cancel := context.WithTimeout(ctx.ctx, MAX_TIMEOUT)
-
-	// loop over all streams, and then over all UUIDs
-	for _, dataFrame := range req.fetch_request.DataFrames {
-		for _, uuStr := range dataFrame.Uuids {
-			uu := uuid.Parse(uuStr)
-			if uu == nil {
-				log.Warningf("Could not parse uuid %s", uuStr)
-				continue
-			}
-			stream, err := stage.getStream(req.ctx, uu)
-			if err != nil {
-				req.addError(err)
-				return err
-			}
+	err = fetchConcurrently(req, "btrdb", stage.concurrency, stage.ordered, func(ctx context.Context, out *Request, dataFrame *mortarpb.DataFrame, uuStr string) error {
+		return stage.readUUID(ctx, out, dataFrame, uuStr, start_time.UnixNano(), end_time.UnixNano())
+	})
+	return err
+}
 
-			// handle RAW streams
-			if dataFrame.Aggregation == mortarpb.AggFunc_AGG_FUNC_RAW {
-				// if raw data...
-				rawpoints, generations, errchan := stream.RawValues(req.ctx, start_time.UnixNano(), end_time.UnixNano(), 0)
-				resp := &mortarpb.FetchResponse{}
-				var pcount = 0
-				for p := range rawpoints {
-					if p.Time > end_time.UnixNano() {
-						//TODO: fix this
-						continue
-						//log.Warning("TIME start ", start_time.UnixNano(), " until ", end_time.UnixNano(), " but got ", p.Time)
-					}
-					pcount += 1
-					resp.Times = append(resp.Times, p.Time)
-					resp.Values = append(resp.Values, p.Value)
-					if pcount == TS_BATCH_SIZE {
-						resp.DataFrame = dataFrame.Name
-						resp.Identifier = uuStr
-						select {
-						case req.fetch_responses <- resp:
-						case <-req.Done():
-							continue
-						}
-						resp = &mortarpb.FetchResponse{}
-						pcount = 0
-					}
-				}
-				if len(resp.Times) > 0 {
-					resp.DataFrame = dataFrame.Name
-					resp.Identifier = uuStr
-					select {
-					case req.fetch_responses <- resp:
-					case <-req.Done():
-					}
-				}
+// readUUID sends the points (or windows) for one UUID of the DataFrame to the client
+func (stage *TimeseriesQueryStage) readUUID(ctx context.Context, req *Request, dataFrame *mortarpb.DataFrame, uuStr string, start, end int64) error {
+	stream, err := stage.getStream(ctx, uuid.Parse(uuStr))
+	if err != nil {
+		return err
+	}
 
-				<-generations
-				if err := <-errchan; err != nil {
-					req.addError(err)
-					log.Error(errors.Wrap(err, "got error in stream rawvalues"))
-					return err
-				}
-			} else {
-				windowSize, err := ParseDuration(dataFrame.Window)
-				if err != nil {
-					req.addError(err)
-					return err
-				}
-				windowDepth := math.Log2(float64(windowSize))
-				suggestedAccuracy := uint8(math.Max(windowDepth-5, 30))
-
-				statpoints, generations, errchan := stream.Windows(req.ctx, start_time.UnixNano(), end_time.UnixNano(), uint64(windowSize.Nanoseconds()), suggestedAccuracy, 0)
-
-				resp := &mortarpb.FetchResponse{}
-				var pcount = 0
-				for p := range statpoints {
-					pcount += 1
-					resp.Times = append(resp.Times, p.Time)
-					resp.Values = append(resp.Values, valueFromAggFunc(p, dataFrame.Aggregation))
-
-					if pcount == TS_BATCH_SIZE {
-						resp.DataFrame = dataFrame.Name
-						resp.Identifier = uuStr
-						//if !ctx.isDone() {
-						select {
-						case req.fetch_responses <- resp:
-						case <-req.Done():
-							continue
-						}
-						//stage.output <- ctx
-						//}
-						resp = &mortarpb.FetchResponse{}
-						pcount = 0
-					}
-				}
-				if len(resp.Times) > 0 {
-					resp.DataFrame = dataFrame.Name
-					resp.Identifier = uuStr
-					select {
-					case req.fetch_responses <- resp:
-					case <-req.Done():
-						continue
-					}
-				}
+	batcher, err := newFetchBatcher(req, dataFrame, uuStr, start, end)
+	if err != nil {
+		return err
+	}
 
-				<-generations
-				if err := <-errchan; err != nil {
-					req.addError(err)
-					return err
-				}
+	var windowSize time.Duration
+	if dataFrame.Aggregation != mortarpb.AggFunc_AGG_FUNC_RAW {
+		if windowSize, err = ParseDuration(dataFrame.Window); err != nil {
+			return err
+		}
+	}
+	// a resumed UUID continues after the last point it delivered
+	from := readStart(req, dataFrame, start, windowSize.Nanoseconds())
+	if from >= end {
+		batcher.flush()
+		return nil
+	}
 
+	// handle RAW streams
+	if dataFrame.Aggregation == mortarpb.AggFunc_AGG_FUNC_RAW {
+		// if raw data...
+		rawpoints, generations, errchan := stream.RawValues(ctx, from, end, 0)
+		for p := range rawpoints {
+			if p.Time > end {
+				//TODO: fix this
+				continue
+				//log.Warning("TIME start ", start_time.UnixNano(), " until ", end_time.UnixNano(), " but got ", p.Time)
 			}
+			batcher.add(p.Time, p.Value)
+		}
+		batcher.flush()
+
+		<-generations
+		if err := <-errchan; err != nil {
+			log.Error(errors.Wrap(err, "got error in stream rawvalues"))
+			return err
+		}
+	} else {
+		statpoints, generations, errchan := stream.Windows(ctx, from, end, uint64(windowSize.Nanoseconds()), windowAccuracy(windowSize), 0)
+
+		for p := range statpoints {
+			batcher.add(p.Time, valueFromAggFunc(p, dataFrame.Aggregation))
+		}
+		batcher.flush()
 
+		<-generations
+		if err := <-errchan; err != nil {
+			return err
 		}
 	}
-	req.fetch_responses <- nil
 
 	return nil
 }
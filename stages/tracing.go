@@ -0,0 +1,114 @@
+package stages
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// spans are sent to the collector in batches of up to this many, at least every
+	// tracingFlushInterval
+	tracingBatchSize     = 512
+	tracingFlushInterval = 5 * time.Second
+	// spans ended while this many are waiting to be sent are dropped
+	tracingQueueSize = 4096
+
+	// name of the tracer that creates the spans of the stages
+	tracerName = "github.com/SoftwareDefinedBuildings/mortar/stages"
+)
+
+type TracingConfig struct {
+	// OTLP/HTTP traces endpoint of the collector, e.g. http://localhost:4318/v1/traces.
+	// Tracing is off if empty
+	Endpoint string
+	// service.name of the exported spans
+	ServiceName string
+	// fraction of requests traced, unless the caller's trace context says otherwise
+	SampleRatio float64
+}
+
+// the tracer provider of the process; nil if tracing is off, in which case the global
+// provider creates spans that are never recorded
+var activeTracerProvider *sdktrace.TracerProvider
+
+// StartTracing sends the spans of all requests to the collector, until FlushTracing. The
+// server spans of the gRPC API and the HTTP gateway continue the trace of the caller if it
+// sent a W3C trace context
+func StartTracing(ctx context.Context, cfg TracingConfig) error {
+	if cfg.Endpoint == "" {
+		return nil
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid tracing endpoint %s", cfg.Endpoint)
+	}
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(endpoint.Host),
+		otlptracehttp.WithURLPath(endpoint.Path),
+		otlptracehttp.WithTimeout(10 * time.Second),
+	}
+	if endpoint.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return errors.Wrap(err, "Could not create the trace exporter")
+	}
+
+	service := cfg.ServiceName
+	if service == "" {
+		service = "mortar"
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter,
+			sdktrace.WithMaxExportBatchSize(tracingBatchSize),
+			sdktrace.WithBatchTimeout(tracingFlushInterval),
+			sdktrace.WithMaxQueueSize(tracingQueueSize),
+		),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(service))),
+		// sample on the trace ID, so the decision is the same wherever it is made
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	activeTracerProvider = provider
+	log.Infof("Exporting traces to %s", cfg.Endpoint)
+	return nil
+}
+
+// FlushTracing sends the spans that are left and stops tracing, giving up when ctx is done
+func FlushTracing(ctx context.Context) {
+	provider := activeTracerProvider
+	if provider == nil {
+		return
+	}
+	if err := provider.Shutdown(ctx); err != nil {
+		log.Warning(errors.Wrap(err, "Could not export the last spans"))
+	}
+}
+
+// startSpan starts a span as a child of the one in ctx, returning a context holding it.
+// Without a sampled span in ctx nothing is recorded
+func startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name)
+}
+
+// endSpan finishes the span, marking it failed if err is not nil
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
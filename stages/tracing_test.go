@@ -0,0 +1,97 @@
+package stages
+
+import (
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+// fakeCollector records the spans exported to it over OTLP/HTTP
+type fakeCollector struct {
+	sync.Mutex
+	spans []*tracepb.Span
+}
+
+func (collector *fakeCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/traces" {
+		http.NotFound(w, r)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var request collectorpb.ExportTraceServiceRequest
+	if err := proto.Unmarshal(body, &request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	collector.Lock()
+	for _, resource := range request.ResourceSpans {
+		for _, library := range resource.InstrumentationLibrarySpans {
+			collector.spans = append(collector.spans, library.Spans...)
+		}
+	}
+	collector.Unlock()
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	body, _ = proto.Marshal(&collectorpb.ExportTraceServiceResponse{})
+	w.Write(body)
+}
+
+func TestGatewayContinuesTrace(t *testing.T) {
+	collector := &fakeCollector{}
+	server := httptest.NewServer(collector)
+	defer server.Close()
+	if err := StartTracing(context.Background(), TracingConfig{Endpoint: server.URL + "/v1/traces", SampleRatio: 0}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		activeTracerProvider = nil
+		otel.SetTracerProvider(trace.NewNoopTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	}()
+
+	stage := &ApiFrontendBasicStage{ctx: context.Background()}
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	parentID := "00f067aa0ba902b7"
+	for _, flags := range []string{"01", "00"} {
+		r := httptest.NewRequest(http.MethodPost, "/v1/qualify", strings.NewReader(`{}`))
+		r.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-"+flags)
+		w := httptest.NewRecorder()
+		stage.httpHandler(nil).ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("got %d %s", w.Code, w.Body)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	FlushTracing(ctx)
+
+	collector.Lock()
+	defer collector.Unlock()
+	// the caller's sampling decision holds, whatever the sample ratio
+	if len(collector.spans) != 1 {
+		t.Fatalf("exported %d spans, want the sampled one", len(collector.spans))
+	}
+	span := collector.spans[0]
+	if hex.EncodeToString(span.TraceId) != traceID || hex.EncodeToString(span.ParentSpanId) != parentID {
+		t.Errorf("span %x has parent %x, want %s and %s", span.TraceId, span.ParentSpanId, traceID, parentID)
+	}
+	if span.Name != "/v1/qualify" || span.Kind != tracepb.Span_SPAN_KIND_SERVER {
+		t.Errorf("span is %s of kind %s", span.Name, span.Kind)
+	}
+}
@@ -13,6 +13,16 @@ func validateFetchRequest(req *mortarpb.FetchRequest) error {
 		return errors.New("Need to include non-empty request.Sites")
 	}
 
+	if req.ResumeToken != "" {
+		if _, err := parseResumeToken(req.ResumeToken); err != nil {
+			return err
+		}
+	}
+
+	if _, found := mortarpb.FailurePolicy_name[int32(req.FailurePolicy)]; !found {
+		return fmt.Errorf("Unknown failure policy %d", req.FailurePolicy)
+	}
+
 	//TODO: add collection + selection tests
 	//// check that there are non-zero number of streams
 	//if len(req.Streams) == 0 {
@@ -44,6 +54,21 @@ func validateFetchRequest(req *mortarpb.FetchRequest) error {
 		// TODO: check units?
 	}
 
+	for idx, dataFrame := range req.DataFrames {
+		if dataFrame.Fill == nil || dataFrame.Fill.Method == mortarpb.FillMethod_FILL_METHOD_NONE {
+			continue
+		}
+		// RAW data needs the window to know what a gap is
+		if dataFrame.Window == "" {
+			return fmt.Errorf("DataFrame %d has a fill policy, so it needs a Window", idx)
+		}
+		if dataFrame.Fill.MaxStaleness != "" {
+			if _, err := ParseDuration(dataFrame.Fill.MaxStaleness); err != nil {
+				return errors.Wrapf(err, "DataFrame %d has invalid Fill.MaxStaleness (%s)", idx, dataFrame.Fill.MaxStaleness)
+			}
+		}
+	}
+
 	// check time params
 	if len(req.DataFrames) > 0 && req.Time == nil {
 		return errors.New("Need to include non-empty request.Time")
@@ -65,6 +90,46 @@ func validateFetchRequest(req *mortarpb.FetchRequest) error {
 
 	return nil
 }
+func validateExportRequest(req *mortarpb.ExportRequest) error {
+	if req.Fetch == nil {
+		return errors.New("Need to include request.Fetch")
+	}
+	if _, found := mortarpb.ExportFormat_name[int32(req.Format)]; !found {
+		return fmt.Errorf("Unknown export format %d", req.Format)
+	}
+	return validateFetchRequest(req.Fetch)
+}
+
+func validateSubscribeRequest(req *mortarpb.SubscribeRequest) error {
+	if len(req.Sites) == 0 {
+		return errors.New("Need to include non-empty request.Sites")
+	}
+	if len(req.DataFrames) == 0 {
+		return errors.New("Need to include non-empty request.DataFrames")
+	}
+	for idx, dataFrame := range req.DataFrames {
+		if dataFrame.Fill != nil && dataFrame.Fill.Method != mortarpb.FillMethod_FILL_METHOD_NONE {
+			return fmt.Errorf("DataFrame %d has a fill policy, which Subscribe does not support", idx)
+		}
+		if dataFrame.Aggregation == mortarpb.AggFunc_AGG_FUNC_INVALID {
+			return fmt.Errorf("DataFrame %d has no aggregation function (can be RAW)", idx)
+		}
+		if dataFrame.Aggregation != mortarpb.AggFunc_AGG_FUNC_RAW {
+			if window, err := ParseDuration(dataFrame.Window); err != nil {
+				return errors.Wrapf(err, "DataFrame %d has invalid Window (%s)", idx, dataFrame.Window)
+			} else if window <= 0 {
+				return fmt.Errorf("DataFrame %d needs a positive Window", idx)
+			}
+		}
+	}
+	if req.Start != "" {
+		if _, err := time.Parse(time.RFC3339, req.Start); err != nil {
+			return errors.Wrapf(err, "request.Start is not RFC3339-formatted timestamp (%s)", req.Start)
+		}
+	}
+	return nil
+}
+
 func validateQualifyRequest(req *mortarpb.QualifyRequest) error {
 	return nil
 }
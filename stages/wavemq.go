@@ -7,11 +7,15 @@ import (
 	"time"
 
 	mortarpb "github.com/SoftwareDefinedBuildings/mortar/proto"
+	// wavemq and wave both register eapi.proto
+	_ "github.com/SoftwareDefinedBuildings/mortar/proto/conflict"
 	"github.com/gtfierro/xboswave/grpcserver"
 	xbospb "github.com/gtfierro/xboswave/proto"
+	"github.com/heptiolabs/healthcheck"
 	"github.com/immesys/wavemq/mqpb"
 	"github.com/pkg/errors"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
 )
 
 type WAVEMQFrontendStageConfig struct {
@@ -24,8 +28,10 @@ type WAVEMQFrontendStageConfig struct {
 }
 
 type WAVEMQFrontendStage struct {
+	conn           *grpc.ClientConn
 	client         mqpb.WAVEMQClient
 	output         chan *Request
+	priority       chan *Request
 	perspective    *mqpb.Perspective
 	namespaceBytes []byte
 	sem            chan struct{}
@@ -59,7 +65,9 @@ func NewWAVEMQFrontendStage(cfg *WAVEMQFrontendStageConfig) (*WAVEMQFrontendStag
 	}
 
 	stage := &WAVEMQFrontendStage{
-		output:         make(chan *Request),
+		output:         newQueue("brick"),
+		priority:       newPriorityQueue("brick"),
+		conn:           conn,
 		client:         mqpb.NewWAVEMQClient(conn),
 		perspective:    perspective,
 		namespaceBytes: namespaceBytes,
@@ -120,10 +128,32 @@ func (stage *WAVEMQFrontendStage) SetUpstream(upstream Stage) {
 func (stage *WAVEMQFrontendStage) GetQueue() chan *Request {
 	return stage.output
 }
+
+// Qualify requests, taken by the next stage before those in GetQueue
+func (stage *WAVEMQFrontendStage) GetPriorityQueue() chan *Request {
+	return stage.priority
+}
 func (stage *WAVEMQFrontendStage) String() string {
 	return "<| wavemq frontend stage |>"
 }
 
+// the site router carrying the queries must be reachable
+func (stage *WAVEMQFrontendStage) ReadinessChecks() map[string]healthcheck.Check {
+	return map[string]healthcheck.Check{
+		"wavemq-site-router": func() error {
+			switch state := stage.conn.GetState(); state {
+			case connectivity.TransientFailure, connectivity.Shutdown:
+				return errors.Errorf("Connection to site router is %s", state)
+			}
+			return nil
+		},
+	}
+}
+
+func (stage *WAVEMQFrontendStage) LivenessChecks() map[string]healthcheck.Check {
+	return nil
+}
+
 func (stage *WAVEMQFrontendStage) Qualify(ctx context.Context, request *mortarpb.QualifyRequest) (*mortarpb.QualifyResponse, error) {
 	t := time.Now()
 	defer func() {
@@ -147,25 +177,18 @@ func (stage *WAVEMQFrontendStage) Qualify(ctx context.Context, request *mortarpb
 	// prepare context for the execution
 	req := NewQualifyRequest(ctx, request)
 
-	select {
-	case stage.output <- req:
-	case <-ctx.Done():
-		return nil, errors.Wrap(ctx.Err(), "qualify timeout on dispatching query")
+	if err := admit(ctx, "brick", stage.priority, req); err != nil {
+		return nil, err
 	}
 
-	select {
-	case resp := <-req.qualify_responses:
-		//close(responseChan)
-		if resp.Error != "" {
-			log.Warning(resp.Error)
-		}
-		return resp, nil
-	case <-ctx.Done():
-		return nil, errors.Wrap(ctx.Err(), "qualify timeout on getting query response")
+	resp, err := awaitQualify(req)
+	if err != nil {
+		return nil, err
 	}
-
-	return nil, errors.New("impossible error")
-
+	if resp.Error != "" {
+		log.Warning(resp.Error)
+	}
+	return resp, nil
 }
 
 // pull data from Mortar
@@ -199,7 +222,7 @@ func (stage *WAVEMQFrontendStage) Fetch(request *mortarpb.FetchRequest, client m
 	}
 
 	req := NewFetchRequest(ctx, request)
-	ret := make(chan error)
+	ret := make(chan error, 1)
 	go func() {
 		var err error
 
@@ -207,33 +230,32 @@ func (stage *WAVEMQFrontendStage) Fetch(request *mortarpb.FetchRequest, client m
 		for {
 			select {
 			case resp := <-req.fetch_responses:
-				if resp == nil {
-					// if this is nil then we are done, but there's no error (yet)
-					break sendloop
-				} else if err = client.Send(resp); err != nil {
+				if err = client.Send(resp); err != nil {
 					// we have an error on sending, so we tear it all down
 					log.Error(errors.Wrap(err, "Error on sending"))
-					// have to remember to call cancel() here
 					finishResponse(resp)
-					cancel()
+					req.abandon(err)
 					break sendloop
 				} else {
 					// happy path
 					finishResponse(resp)
 					messagesSent.Inc()
 				}
-			case <-ctx.Done():
-				err = errors.Wrap(ctx.Err(), "fetch timeout on response")
+			case <-req.Ended():
+				// the request ended; err is why, if it failed
+				err = req.Err()
+				break sendloop
+			case <-req.Done():
+				// the client went away or the request ran out of time
+				err = req.abandon(errors.Wrap(req.ctx.Err(), "fetch timeout on response"))
 				break sendloop
 			}
 		}
 		ret <- err
 	}()
 
-	select {
-	case stage.output <- req:
-	case <-ctx.Done():
-		return errors.New("timeout")
+	if err := admit(ctx, "brick", stage.output, req); err != nil {
+		return err
 	}
 
 	select {